@@ -3,8 +3,7 @@ package checks
 import (
 	"context"
 	"fmt"
-	"net/http"
-	"os"
+	"path"
 	"strings"
 	"time"
 
@@ -14,7 +13,9 @@ import (
 	apipb "github.com/jahagaley/phantomapi/phantom/api/v1"
 	api "github.com/jahagaley/phantomapi/phantom/api/v1/v1connect"
 
+	"github.com/jahagaley/phantom/services"
 	"github.com/jahagaley/phantom/utils"
+	"github.com/jahagaley/phantom/utils/tracing"
 	"github.com/jahagaley/phantomcli/config"
 	"github.com/rs/zerolog/log"
 )
@@ -23,17 +24,19 @@ const (
 	BUILD_ID_PATTERN = "build-%d-%s"
 )
 
-func BuildDockerImage(githubClient *github.Client, checkParams *CheckParams) ([]*CheckParams, error) {
-	// Creating Github Check
-	err := CreateCheckRun(githubClient, checkParams)
-	if err != nil {
-		return nil, err
+func BuildDockerImage(ctx context.Context, githubClient *github.Client, checkParams *CheckParams) ([]*CheckParams, error) {
+	// Resumed checks already have a check run
+	if checkParams.CheckRunID == 0 {
+		err := CreateCheckRun(githubClient, checkParams)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return BuildDockerImageWithCheck(githubClient, checkParams)
+	return BuildDockerImageWithCheck(ctx, githubClient, checkParams)
 }
 
-func BuildDockerImageWithCheck(githubClient *github.Client, checkParams *CheckParams) ([]*CheckParams, error) {
+func BuildDockerImageWithCheck(ctx context.Context, githubClient *github.Client, checkParams *CheckParams) ([]*CheckParams, error) {
 	owner, repo, headSHA := checkParams.Owner, checkParams.Repo, checkParams.HeadSHA
 	// update Check to in progress
 	UpdateCheckRunStatus(
@@ -44,109 +47,101 @@ func BuildDockerImageWithCheck(githubClient *github.Client, checkParams *CheckPa
 	)
 
 	// Download repo contents
-	tempDir, err := utils.HandleGithubRepoDownload(githubClient, owner, repo, headSHA)
+	tempDir, release, err := utils.HandleGithubRepoDownload(githubClient, owner, repo, headSHA)
 	if err != nil {
-		UpdateCheckRunCompletion(
-			githubClient,
-			checkParams,
-			CONCLUSION_FAILURE,
-			"Unable to download the the contents of commit to run build.",
-			nil,
-		)
-		os.RemoveAll(tempDir)
-		return nil, err
+		return nil, failCheck(fmt.Sprintf("Unable to download the contents of the commit to run the build: %v", err), err)
 	}
-	defer os.RemoveAll(tempDir)
+	defer release()
 
-	// Get the config file from the repo
-	cfg, err := config.GetConfigFromPath(tempDir)
+	// Get the config file defining the check from the repo
+	configDir := path.Join(tempDir, checkParams.ConfigPath())
+	cfg, err := config.GetConfigFromPath(configDir)
 	if err != nil {
-		// Updating Check Run on completion
-		UpdateCheckRunCompletion(
-			githubClient,
-			checkParams,
-			CONCLUSION_FAILURE,
-			"Unable to get 'phantom.yaml' file for building image.",
-			nil,
-		)
-		return nil, err
+		return nil, failCheck("Unable to get 'phantom.yaml' file for building image.", err)
 	}
 
 	buildName := checkParams.Options["name"]
 	build := cfg.GetBuild(buildName)
 	if build == nil {
-		UpdateCheckRunCompletion(
-			githubClient,
-			checkParams,
-			CONCLUSION_FAILURE,
-			"Unable to get the build from the config file.",
-			nil,
-		)
-		return nil, fmt.Errorf("Unable to find build with name '%s'", buildName)
+		return nil, failCheck("Unable to get the build from the config file.", fmt.Errorf("Unable to find build with name '%s'", buildName))
 	}
 
-	status, err := executeBuild(githubClient, checkParams, build)
+	timeout, err := GetCheckTimeout(configDir, PHANTOM_BUILD_IMAGE, buildName)
 	if err != nil {
-		UpdateCheckRunCompletion(
-			githubClient,
-			checkParams,
-			CONCLUSION_FAILURE,
-			"Unable to complete build execution.",
-			nil,
-		)
-		return nil, err
+		return nil, failCheck(err.Error(), err)
+	}
+
+	status, logs, err := executeBuild(ctx, githubClient, checkParams, build, timeout)
+	if err != nil {
+		// Checks interrupted by a shutdown are run again by another worker
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		return nil, failCheck("Unable to complete build execution.", err)
 	}
 
-	// Updating Check Run on completion
-	UpdateCheckRunCompletion(
+	// Check runs cancelled by a newer push while the build ran are left as is.
+	ConcludeCheckRun(
 		githubClient,
 		checkParams,
 		status,
 		fmt.Sprintf("Docker build completed with status '%s'.", status),
+		logs.Output(MAX_CHECK_OUTPUT_LENGTH),
 		nil,
 	)
 
-	var output []*CheckParams
-	// Check if any checks are needed for Phantom.
-	if len(cfg.Tests) > 0 {
-		for _, test := range cfg.Tests {
-			newCheck := &CheckParams{
-				Type:           PHANTOM_TEST_IMAGE,
-				Name:           fmt.Sprintf(PHANTOM_TEST_IMAGE_PATTERN, test.Name),
-				Owner:          checkParams.Owner,
-				Repo:           checkParams.Repo,
-				HeadSHA:        checkParams.HeadSHA,
-				Branch:         checkParams.Branch,
-				DefaultBranch:  checkParams.DefaultBranch,
-				InstallationID: checkParams.InstallationID,
-				RepoID:         checkParams.RepoID,
-				Options: map[string]string{
-					"name": test.Name,
-				},
-			}
+	// Schedule the tests using this build
+	return ScheduleChildren(githubClient, checkParams, &cfg, status)
+}
+
+func executeBuild(ctx context.Context, githubClient *github.Client, checkParams *CheckParams, build *config.PhantomBuild, timeout time.Duration) (string, *ExecutionLogs, error) {
+	// Resumed checks keep waiting on the execution they already started
+	if len(checkParams.ExecutionName) == 0 {
+		err := createBuildExecution(ctx, githubClient, checkParams, build)
+		if err != nil {
+			return "", nil, err
+		}
+		checkParams.ExecutionDeadline = time.Now().Add(timeout)
 
-			output = append(output, newCheck)
+		// Link the check run to the execution so it can be cancelled
+		err = UpdateCheckRunExecution(githubClient, checkParams)
+		if err != nil {
+			log.Warn().Err(err).Msg("Unable to link check run to execution")
 		}
 	}
 
-	return output, nil
+	// Show the logs on the check run while waiting on the execution, holding
+	// the check run so the reapers of other instances leave it alone
+	stopHolding := HoldCheckRun(githubClient, checkParams)
+	logs := NewExecutionLogs(checkParams.ExecutionName)
+	stopStreaming := logs.Stream(githubClient, checkParams, "Running Docker build for image.")
+	status, err := WatchExecution(ctx, checkParams)
+	stopStreaming()
+	stopHolding()
+	if err != nil {
+		return "", nil, err
+	}
+
+	if _, err := logs.Fetch(ctx); err != nil {
+		log.Warn().Err(err).Msg("Unable to fetch execution logs")
+	}
+	return status, logs, nil
 }
 
-func executeBuild(githubClient *github.Client, checkParams *CheckParams, build *config.PhantomBuild) (string, error) {
-	ctx := context.Background()
+func createBuildExecution(ctx context.Context, githubClient *github.Client, checkParams *CheckParams, build *config.PhantomBuild) error {
 	log.Info().Msg("Starting Docker Build Execution")
 
 	// Create ConnectRPC Client
-	gitClient := api.NewGitServiceClient(http.DefaultClient, utils.API_URL)
+	gitClient := api.NewGitServiceClient(tracing.HTTPClient, utils.API_URL)
 
 	// Get the installation from the GitService
 	getInstallationRequest := &apipb.GetInstallationRequest{
-		Name: fmt.Sprintf("projects/-/installations/%d", checkParams.InstallationID),
+		Name: services.InstallationName("-", checkParams.Host, checkParams.InstallationID),
 	}
 	installationRes, err := gitClient.GetInstallation(ctx, connect.NewRequest(getInstallationRequest))
 	if err != nil {
 		log.Err(err).Msg("Error getting installation, missing installation cannot be created")
-		return "", err
+		return err
 	}
 
 	// TODO - clean up this code
@@ -154,7 +149,7 @@ func executeBuild(githubClient *github.Client, checkParams *CheckParams, build *
 	project := strings.Split(installationRes.Msg.GetName(), "/")[1]
 
 	// Build Id
-	buildId := fmt.Sprintf(BUILD_ID_PATTERN, checkParams.RepoID, build.Name)
+	buildId := fmt.Sprintf(BUILD_ID_PATTERN, checkParams.RepoID, configResourceID(checkParams.ConfigPath(), build.Name))
 
 	// Get the build from the GitService
 	getBuildRequest := &apipb.GetBuildRequest{
@@ -169,7 +164,7 @@ func executeBuild(githubClient *github.Client, checkParams *CheckParams, build *
 			Build: &apipb.Build{
 				DisplayName: build.Name,
 				Repository:  fmt.Sprintf("projects/%s/repositories/%d", project, checkParams.RepoID),
-				Path:        build.Path,
+				Path:        configRelativePath(checkParams.ConfigPath(), build.Path),
 				File:        build.File,
 			},
 		}
@@ -177,11 +172,11 @@ func executeBuild(githubClient *github.Client, checkParams *CheckParams, build *
 		buildRes, err = gitClient.CreateBuild(ctx, connect.NewRequest(createBuildRequest))
 		if err != nil {
 			log.Err(err).Msg("Error creating build")
-			return "", err
+			return err
 		}
 	} else if err != nil {
 		log.Err(err).Msg("Error getting build")
-		return "", err
+		return err
 	}
 
 	// Get the download url
@@ -197,7 +192,7 @@ func executeBuild(githubClient *github.Client, checkParams *CheckParams, build *
 	)
 	if err != nil {
 		log.Err(err).Msg("Error getting download url")
-		return "", err
+		return err
 	}
 
 	// Create the execution
@@ -218,39 +213,9 @@ func executeBuild(githubClient *github.Client, checkParams *CheckParams, build *
 	executionRes, err := gitClient.CreateExecution(ctx, connect.NewRequest(createExecutionRequest))
 	if err != nil {
 		log.Err(err).Msg("Error creating execution")
-		return "", err
-	}
-
-	// In a loop, check the state of the build and sleep if it is not finished
-	// Only loop for 15 minutes
-	// TODO - Try long running operations
-	for i := 0; i < 60; i++ {
-		// Get the execution
-		getExecutionRequest := &apipb.GetExecutionRequest{
-			Name: executionRes.Msg.GetName(),
-		}
-		executionRes, err = gitClient.GetExecution(ctx, connect.NewRequest(getExecutionRequest))
-		if err != nil {
-			log.Err(err).Msg("Error getting execution")
-			return "", err
-		}
-
-		// Check the state of the execution
-		if executionRes.Msg.GetState() == apipb.Execution_STATE_SUCCESS {
-			// Return the status of the execution
-			return CONCLUSION_SUCCESS, nil
-		} else if executionRes.Msg.GetState() == apipb.Execution_STATE_FAILURE {
-			// Return the status of the execution
-			return CONCLUSION_FAILURE, nil
-		} else if executionRes.Msg.GetState() == apipb.Execution_STATE_CANCELLED {
-			// Returns the status of the execution
-			return CONCLUSION_CANCELLED, nil
-		} else if executionRes.Msg.GetState() == apipb.Execution_STATE_UNSPECIFIED {
-			return CONCLUSION_FAILURE, nil
-		}
-
-		time.Sleep(15 * time.Second)
+		return err
 	}
 
-	return CONCLUSION_TIMED_OUT, nil
+	checkParams.ExecutionName = executionRes.Msg.GetName()
+	return nil
 }
@@ -0,0 +1,172 @@
+package checks
+
+import (
+	"context"
+	"fmt"
+
+	"connectrpc.com/connect"
+	"github.com/google/go-github/v50/github"
+	apipb "github.com/jahagaley/phantomapi/phantom/api/v1"
+	api "github.com/jahagaley/phantomapi/phantom/api/v1/v1connect"
+	"github.com/rs/zerolog/log"
+
+	"github.com/jahagaley/phantom/services"
+	"github.com/jahagaley/phantom/utils"
+	"github.com/jahagaley/phantom/utils/settings"
+	"github.com/jahagaley/phantom/utils/tracing"
+)
+
+const (
+	// Summary of the check runs cancelled by a newer commit, followed by
+	// its SHA and URL.
+	SUPERSEDED_SUMMARY_PATTERN = "Cancelled because a newer commit [%.7s](%s) was pushed to this branch."
+
+	// Check cancelling the checks of the commit replaced by its head commit,
+	// queued along with the first check of the head commit. It has no check
+	// run of its own.
+	CANCEL_SUPERSEDED = "Cancel Superseded Checks"
+
+	// Options of CANCEL_SUPERSEDED checks.
+	SUPERSEDED_SHA_OPTION  = "superseded_sha"
+	SUPERSEDING_URL_OPTION = "superseding_url"
+)
+
+// NewCancelSupersededCheck returns the check cancelling the checks of the
+// superseded commit, check being the first check of the superseding commit.
+func NewCancelSupersededCheck(check *CheckParams, supersededSHA, supersedingURL string) *CheckParams {
+	cancelCheck := *check
+	cancelCheck.Type = CANCEL_SUPERSEDED
+	cancelCheck.Name = CANCEL_SUPERSEDED
+	cancelCheck.Options = map[string]string{
+		SUPERSEDED_SHA_OPTION:  supersededSHA,
+		SUPERSEDING_URL_OPTION: supersedingURL,
+	}
+	return &cancelCheck
+}
+
+// CancelSupersededChecks cancels the queued and running checks of a commit
+// that is no longer the head of its branch, as requested by a
+// CANCEL_SUPERSEDED check. Their Phantom executions are cancelled and their
+// check runs concluded as cancelled, linking to the superseding commit.
+// Checks still waiting in the queue are cancelled once they are run, see
+// CancelIfSuperseded.
+func CancelSupersededChecks(ctx context.Context, githubClient *github.Client, check *CheckParams) error {
+	gitClient := api.NewGitServiceClient(tracing.HTTPClient, utils.API_URL)
+	return cancelSupersededChecks(ctx, gitClient, githubClient, check)
+}
+
+func cancelSupersededChecks(ctx context.Context, gitClient api.GitServiceClient, githubClient *github.Client, check *CheckParams) error {
+	supersededSHA, supersedingURL := check.Options[SUPERSEDED_SHA_OPTION], check.Options[SUPERSEDING_URL_OPTION]
+	if len(supersededSHA) == 0 {
+		return fmt.Errorf("Missing the superseded commit of check '%s'.", check.Name)
+	}
+	owner, repo, supersedingSHA := check.Owner, check.Repo, check.HeadSHA
+
+	githubHost, err := services.GetGithubHost(check.Host)
+	if err != nil {
+		return err
+	}
+
+	// Collect the check runs of this app first, concluding them changes the
+	// listed pages.
+	var checkRuns []*github.CheckRun
+	for _, status := range []string{STATUS_QUEUED, STATUS_IN_PROGRESS} {
+		opts := &github.ListCheckRunsOptions{
+			Status:      github.String(status),
+			AppID:       github.Int64(githubHost.AppID),
+			ListOptions: github.ListOptions{PerPage: 100},
+		}
+		for {
+			result, res, err := githubClient.Checks.ListCheckRunsForRef(ctx, owner, repo, supersededSHA, opts)
+			if err != nil {
+				return fmt.Errorf("Error listing check runs: %w", err)
+			}
+			checkRuns = append(checkRuns, result.CheckRuns...)
+
+			if res.NextPage == 0 {
+				break
+			}
+			opts.Page = res.NextPage
+		}
+	}
+
+	summary := fmt.Sprintf(SUPERSEDED_SUMMARY_PATTERN, supersedingSHA, supersedingURL)
+	for _, checkRun := range checkRuns {
+		executionName, _ := ParseExternalID(checkRun.GetExternalID())
+		checkParams := &CheckParams{
+			Name:          checkRun.GetName(),
+			Owner:         owner,
+			Repo:          repo,
+			HeadSHA:       supersededSHA,
+			CheckRunID:    checkRun.GetID(),
+			ExecutionName: executionName,
+		}
+
+		if len(checkParams.ExecutionName) > 0 {
+			cancelExecutionRequest := &apipb.CancelExecutionRequest{
+				Name: checkParams.ExecutionName,
+			}
+			_, err := gitClient.CancelExecution(ctx, connect.NewRequest(cancelExecutionRequest))
+			if err != nil {
+				log.Warn().Err(err).Msg(fmt.Sprintf("Unable to cancel execution '%s'", checkParams.ExecutionName))
+				continue
+			}
+		}
+
+		err := UpdateCheckRunCompletion(githubClient, checkParams, CONCLUSION_CANCELLED, summary, nil)
+		if err != nil {
+			log.Warn().Err(err).Msg(fmt.Sprintf("Unable to cancel check run '%s'", checkParams.Name))
+			continue
+		}
+		log.Info().Msg(fmt.Sprintf("Cancelled check '%s' on superseded commit %s", checkParams.Name, supersededSHA))
+	}
+
+	return nil
+}
+
+// CancelIfSuperseded cancels a check queued on a commit that has since been
+// replaced as the head of its branch, before it starts. It reports whether
+// the check was cancelled. Checks that already have a check run were
+// cancelled by CancelSupersededChecks, and re-runs requested on older
+// commits are always run.
+func CancelIfSuperseded(githubClient *github.Client, checkParams *CheckParams) bool {
+	if checkParams.CheckRunID != 0 || checkParams.Rerun || checkParams.IsFork || len(checkParams.Branch) == 0 {
+		return false
+	}
+	if checkParams.Branch == checkParams.DefaultBranch && !settings.Get().Github.CancelDefaultBranch {
+		return false
+	}
+
+	branch, _, err := githubClient.Repositories.GetBranch(
+		context.Background(),
+		checkParams.Owner,
+		checkParams.Repo,
+		checkParams.Branch,
+		true,
+	)
+	if err != nil {
+		log.Warn().Err(err).Msg(fmt.Sprintf("Unable to get the head of branch '%s'", checkParams.Branch))
+		return false
+	}
+	head := branch.GetCommit()
+	if len(head.GetSHA()) == 0 || head.GetSHA() == checkParams.HeadSHA {
+		return false
+	}
+
+	err = CreateCheckRun(githubClient, checkParams)
+	if err == nil {
+		err = UpdateCheckRunCompletion(
+			githubClient,
+			checkParams,
+			CONCLUSION_CANCELLED,
+			fmt.Sprintf(SUPERSEDED_SUMMARY_PATTERN, head.GetSHA(), head.GetHTMLURL()),
+			nil,
+		)
+	}
+	if err != nil {
+		log.Warn().Err(err).Msg(fmt.Sprintf("Unable to cancel check '%s'", checkParams.Name))
+	} else {
+		log.Info().Msg(fmt.Sprintf("Cancelled queued check '%s' on superseded commit %s", checkParams.Name, checkParams.HeadSHA))
+	}
+	return true
+}
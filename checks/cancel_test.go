@@ -0,0 +1,109 @@
+package checks
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/google/go-github/v50/github"
+	apipb "github.com/jahagaley/phantomapi/phantom/api/v1"
+	api "github.com/jahagaley/phantomapi/phantom/api/v1/v1connect"
+)
+
+func TestCancelIfSuperseded(t *testing.T) {
+	tests := []struct {
+		name          string
+		check         CheckParams
+		wantCancelled bool
+	}{
+		{"branch head", CheckParams{Branch: "feature", HeadSHA: "head"}, false},
+		{"superseded", CheckParams{Branch: "feature", HeadSHA: "old"}, true},
+		{"superseded with a check run", CheckParams{Branch: "feature", HeadSHA: "old", CheckRunID: 1}, false},
+		{"superseded re-run", CheckParams{Branch: "feature", HeadSHA: "old", Rerun: true}, false},
+		{"superseded fork", CheckParams{Branch: "feature", HeadSHA: "old", IsFork: true}, false},
+		{"superseded default branch", CheckParams{Branch: "main", DefaultBranch: "main", HeadSHA: "old"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake, client := newFakeCheckRuns(t)
+			fake.branchHeads["feature"] = "head"
+			fake.branchHeads["main"] = "head"
+
+			check := test.check
+			check.Name, check.Owner, check.Repo = "Build Image - main", "owner", "repo"
+			if got := CancelIfSuperseded(client, &check); got != test.wantCancelled {
+				t.Fatalf("CancelIfSuperseded() = %v, want %v", got, test.wantCancelled)
+			}
+			if cancelled := fake.conclusions[100] == CONCLUSION_CANCELLED; cancelled != test.wantCancelled {
+				t.Errorf("check run cancelled = %v (%v), want %v", cancelled, fake.conclusions, test.wantCancelled)
+			}
+		})
+	}
+}
+
+// fakeCancelClient records the executions cancelled.
+type fakeCancelClient struct {
+	api.GitServiceClient
+
+	cancelled []string
+}
+
+func (c *fakeCancelClient) CancelExecution(ctx context.Context, req *connect.Request[apipb.CancelExecutionRequest]) (*connect.Response[apipb.Execution], error) {
+	c.cancelled = append(c.cancelled, req.Msg.Name)
+	return connect.NewResponse(&apipb.Execution{Name: req.Msg.Name}), nil
+}
+
+func TestCancelSupersededChecks(t *testing.T) {
+	lease := CheckRunLease{Owner: "other", Until: time.Now().Add(time.Hour)}
+	fake, client := newFakeCheckRuns(t,
+		&github.CheckRun{ID: github.Int64(1), Name: github.String("Build Image - api"), Status: github.String(STATUS_IN_PROGRESS), ExternalID: github.String(FormatExternalID("projects/p/executions/1", lease))},
+		&github.CheckRun{ID: github.Int64(2), Name: github.String("Run Test - unit"), Status: github.String(STATUS_QUEUED)},
+	)
+	gitClient := &fakeCancelClient{}
+
+	head := &CheckParams{Type: SETUP, Name: SETUP, Owner: "owner", Repo: "repo", HeadSHA: "head", Branch: "feature"}
+	check := NewCancelSupersededCheck(head, "sha", "https://github.com/owner/repo/commit/head")
+	if check.Type != CANCEL_SUPERSEDED || check.HeadSHA != "head" {
+		t.Fatalf("NewCancelSupersededCheck() = %s on %s, want %s on head", check.Type, check.HeadSHA, CANCEL_SUPERSEDED)
+	}
+
+	if err := cancelSupersededChecks(context.Background(), gitClient, client, check); err != nil {
+		t.Fatalf("cancelSupersededChecks() error = %v", err)
+	}
+	if len(gitClient.cancelled) != 1 || gitClient.cancelled[0] != "projects/p/executions/1" {
+		t.Errorf("cancelled executions = %v, want the execution of the build", gitClient.cancelled)
+	}
+	if fake.conclusions[1] != CONCLUSION_CANCELLED || fake.conclusions[2] != CONCLUSION_CANCELLED {
+		t.Errorf("conclusions = %v, want both check runs cancelled", fake.conclusions)
+	}
+
+	// Cancellations without the superseded commit fail
+	check.Options = nil
+	if err := cancelSupersededChecks(context.Background(), gitClient, client, check); err == nil {
+		t.Error("cancelSupersededChecks() without a superseded commit succeeded, want an error")
+	}
+}
+
+func TestConcludeCheckRun(t *testing.T) {
+	fake, client := newFakeCheckRuns(t)
+	fake.conclusions[1] = CONCLUSION_CANCELLED
+
+	// Check runs cancelled while their check ran stay cancelled
+	check := &CheckParams{Name: "Build Image - api", Owner: "owner", Repo: "repo", HeadSHA: "sha", CheckRunID: 1}
+	if err := ConcludeCheckRun(client, check, CONCLUSION_SUCCESS, "Done.", "", nil); err != nil {
+		t.Fatalf("ConcludeCheckRun() error = %v", err)
+	}
+	if fake.conclusions[1] != CONCLUSION_CANCELLED {
+		t.Errorf("conclusion = %s, want it left cancelled", fake.conclusions[1])
+	}
+
+	check.CheckRunID = 2
+	if err := ConcludeCheckRun(client, check, CONCLUSION_SUCCESS, "Done.", "logs", nil); err != nil {
+		t.Fatalf("ConcludeCheckRun() error = %v", err)
+	}
+	if fake.conclusions[2] != CONCLUSION_SUCCESS {
+		t.Errorf("conclusion = %s, want success", fake.conclusions[2])
+	}
+}
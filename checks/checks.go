@@ -2,10 +2,16 @@ package checks
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"reflect"
 	"strings"
+	"time"
 
 	"github.com/google/go-github/v50/github"
+	"github.com/rs/zerolog/log"
+
+	"github.com/jahagaley/phantom/utils/metrics"
 )
 
 const (
@@ -20,59 +26,217 @@ const (
 	PHANTOM_RESOURCE_VALIDATION         = "Resource Validation"
 	PHANTOM_RESOURCE_VALIDATION_PATTERN = "Resource Validation - %s"
 
+	// Checks of a 'phantom.yaml' file outside the repository root end with
+	// the directory of the file, ex: "Build Image - main (services/a)".
+	CONFIG_PATH_PATTERN = "%s (%s)"
+
 	// Conclusions for checks
 	CONCLUSION_SUCCESS   = "success"
 	CONCLUSION_FAILURE   = "failure"
 	CONCLUSION_CANCELLED = "cancelled"
 	CONCLUSION_TIMED_OUT = "timed_out"
+	CONCLUSION_NEUTRAL   = "neutral"
+	CONCLUSION_SKIPPED   = "skipped"
+
+	// Github accepts at most this many annotations per check run update
+	MAX_ANNOTATIONS_PER_REQUEST = 50
 
 	// Statuses for checks
+	STATUS_QUEUED      = "queued"
 	STATUS_IN_PROGRESS = "in_progress"
 	STATUS_COMPLETED   = "completed"
 )
 
 type CheckParams struct {
 	// Fields to run checks
-	Type          string
-	Name          string
-	Owner         string
-	Repo          string
-	HeadSHA       string
-	Branch        string
-	DefaultBranch string
+	Type          string `json:"type"`
+	Name          string `json:"name"`
+	Owner         string `json:"owner"`
+	Repo          string `json:"repo"`
+	HeadSHA       string `json:"head_sha"`
+	Branch        string `json:"branch"`
+	DefaultBranch string `json:"default_branch"`
+
+	// Commit the head commit is compared with to find the files it changes.
+	// When empty, the checks of every 'phantom.yaml' file are run.
+	BaseSHA string `json:"base_sha"`
+
+	Options map[string]string `json:"options"`
+
+	// Github fields, Host is empty for github.com
+	Host           string `json:"host"`
+	CheckRunID     int64  `json:"check_run_id"`
+	InstallationID int64  `json:"installation_id"`
+	RepoID         int64  `json:"repo_id"`
+
+	// Pull request fields, only set for checks started by a pull request.
+	PullRequestNumber int    `json:"pull_request_number"`
+	BaseBranch        string `json:"base_branch"`
+	IsFork            bool   `json:"is_fork"`
+	// Gated checks come from untrusted forks and need a maintainer to
+	// re-run the Setup check before any builds are started.
+	Gated bool `json:"gated"`
+
+	// Checks re-requested on Github, and the checks they start, run even on
+	// commits that are no longer the head of their branch.
+	Rerun bool `json:"rerun"`
+
+	// Phantom execution running the check, and when it times out.
+	ExecutionName     string    `json:"execution_name"`
+	ExecutionDeadline time.Time `json:"execution_deadline"`
+
+	// Shared by every check started by the same Github event.
+	TraceID string `json:"trace_id"`
+	// W3C trace context of the span that published the check.
+	TraceContext map[string]string `json:"trace_context"`
+
+	// Conclusions of the checks this check depends on, keyed by check name.
+	// Parents that hadn't concluded when it was scheduled are empty, and
+	// are waited on before it runs.
+	ParentConclusions  map[string]string `json:"parent_conclusions"`
+	ParentsScheduledAt time.Time         `json:"parents_scheduled_at"`
+
+	// Retry fields, Attempt counts the previous failed runs of this check.
+	Attempt   int       `json:"attempt"`
+	NotBefore time.Time `json:"not_before"`
+	LastError string    `json:"last_error"`
+}
+
+// legacyFieldNames maps the Go names of the CheckParams fields, used in the
+// JSON written before the fields had their own names, to their JSON names.
+var legacyFieldNames = func() map[string]string {
+	output := make(map[string]string)
+	t := reflect.TypeOf(CheckParams{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		// Names only differing by case are matched by encoding/json
+		if !strings.EqualFold(field.Name, name) {
+			output[field.Name] = name
+		}
+	}
+	return output
+}()
+
+// UnmarshalJSON decodes checks, including the checks queued or saved by older
+// versions under the Go names of the fields.
+func (c *CheckParams) UnmarshalJSON(data []byte) error {
+	type checkParams CheckParams
+	if err := json.Unmarshal(data, (*checkParams)(c)); err != nil {
+		return err
+	}
 
-	Options map[string]string
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	legacy := make(map[string]json.RawMessage)
+	for goName, name := range legacyFieldNames {
+		if value, ok := fields[goName]; ok {
+			if _, ok := fields[name]; !ok {
+				legacy[name] = value
+			}
+		}
+	}
+	if len(legacy) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(legacy)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, (*checkParams)(c))
+}
+
+// CheckFailure is returned by checks that couldn't run to completion, with
+// the summary reporting the failure on their check run. Check runs are only
+// concluded with it once the check won't be retried.
+type CheckFailure struct {
+	Summary string
+	Err     error
+}
+
+func failCheck(summary string, err error) error {
+	return &CheckFailure{Summary: summary, Err: err}
+}
+
+func (f *CheckFailure) Error() string {
+	return f.Err.Error()
+}
 
-	// Github fields
-	CheckRunID     int64
-	InstallationID int64
-	RepoID         int64
+func (f *CheckFailure) Unwrap() error {
+	return f.Err
+}
+
+// NewChildCheck creates the params for a check that follows this one on the
+// same commit.
+func (c *CheckParams) NewChildCheck(checkType, name string, options map[string]string) *CheckParams {
+	return &CheckParams{
+		Type:              checkType,
+		Name:              name,
+		Owner:             c.Owner,
+		Repo:              c.Repo,
+		HeadSHA:           c.HeadSHA,
+		Branch:            c.Branch,
+		DefaultBranch:     c.DefaultBranch,
+		Options:           options,
+		Host:              c.Host,
+		InstallationID:    c.InstallationID,
+		RepoID:            c.RepoID,
+		PullRequestNumber: c.PullRequestNumber,
+		BaseBranch:        c.BaseBranch,
+		IsFork:            c.IsFork,
+		Rerun:             c.Rerun,
+		TraceID:           c.TraceID,
+		TraceContext:      c.TraceContext,
+	}
+}
+
+// ConfigPath returns the directory of the 'phantom.yaml' file defining the
+// check, relative to the repository root. It is empty for the root config.
+func (c *CheckParams) ConfigPath() string {
+	return c.Options["config"]
+}
+
+// CheckName returns the name of a check defined in the 'phantom.yaml' file
+// of configPath. Checks of the root config keep their plain name.
+func CheckName(pattern, name, configPath string) string {
+	checkName := fmt.Sprintf(pattern, name)
+	if len(configPath) > 0 {
+		checkName = fmt.Sprintf(CONFIG_PATH_PATTERN, checkName, configPath)
+	}
+	return checkName
 }
 
 func GetCheckTypeAndOptions(checkName string) (string, map[string]string, error) {
-	name := ""
 	outputMap := make(map[string]string)
-	if strings.HasPrefix(checkName, PHANTOM_BUILD_IMAGE) {
-		if _, err := fmt.Sscanf(checkName, PHANTOM_BUILD_IMAGE_PATTERN, &name); err != nil {
-			return "", nil, err
-		}
+	if checkName == SETUP {
+		return SETUP, outputMap, nil
+	}
 
-		outputMap["name"] = name
-		return PHANTOM_BUILD_IMAGE, outputMap, nil
-	} else if strings.HasPrefix(checkName, PHANTOM_TEST_IMAGE) {
-		if _, err := fmt.Sscanf(checkName, PHANTOM_TEST_IMAGE_PATTERN, &name); err != nil {
-			return "", nil, err
+	patterns := map[string]string{
+		PHANTOM_BUILD_IMAGE:         PHANTOM_BUILD_IMAGE_PATTERN,
+		PHANTOM_TEST_IMAGE:          PHANTOM_TEST_IMAGE_PATTERN,
+		PHANTOM_RESOURCE_VALIDATION: PHANTOM_RESOURCE_VALIDATION_PATTERN,
+	}
+	for checkType, pattern := range patterns {
+		name, ok := strings.CutPrefix(checkName, strings.TrimSuffix(pattern, "%s"))
+		if !ok {
+			continue
 		}
 
-		outputMap["name"] = name
-		return PHANTOM_TEST_IMAGE, outputMap, nil
-	} else if strings.HasPrefix(checkName, PHANTOM_RESOURCE_VALIDATION) {
-		if _, err := fmt.Sscanf(checkName, PHANTOM_RESOURCE_VALIDATION_PATTERN, &name); err != nil {
-			return "", nil, err
+		// Split the directory of the config off the name
+		if i := strings.LastIndex(name, " ("); i > 0 && strings.HasSuffix(name, ")") {
+			outputMap["config"] = name[i+2 : len(name)-1]
+			name = name[:i]
+		}
+		if len(name) == 0 {
+			break
 		}
 
 		outputMap["name"] = name
-		return PHANTOM_RESOURCE_VALIDATION, outputMap, nil
+		return checkType, outputMap, nil
 	}
 
 	return "", outputMap, fmt.Errorf("Unable to parse the check run requested.")
@@ -90,13 +254,70 @@ func CreateCheckRun(client *github.Client, checkParams *CheckParams) error {
 		},
 	)
 	if err != nil {
-		return fmt.Errorf("Error creating check run: %v", err)
+		return fmt.Errorf("Error creating check run: %w", err)
 	}
 
 	checkParams.CheckRunID = checkRun.GetID()
 	return nil
 }
 
+// ListLatestCheckRuns returns the most recent check run of every check on the
+// head commit, keyed by check run name.
+func ListLatestCheckRuns(client *github.Client, checkParams *CheckParams) (map[string]*github.CheckRun, error) {
+	checkRuns := make(map[string]*github.CheckRun)
+	opts := &github.ListCheckRunsOptions{
+		Filter:      github.String("latest"),
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+	for {
+		result, res, err := client.Checks.ListCheckRunsForRef(
+			context.Background(),
+			checkParams.Owner,
+			checkParams.Repo,
+			checkParams.HeadSHA,
+			opts,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("Error listing check runs: %w", err)
+		}
+
+		for _, checkRun := range result.CheckRuns {
+			latest, ok := checkRuns[checkRun.GetName()]
+			if !ok || checkRun.GetStartedAt().After(latest.GetStartedAt().Time) {
+				checkRuns[checkRun.GetName()] = checkRun
+			}
+		}
+
+		if res.NextPage == 0 {
+			return checkRuns, nil
+		}
+		opts.Page = res.NextPage
+	}
+}
+
+// UpdateCheckRunExecution links the check run to the Phantom execution running
+// it through the check run's external ID, along with the lease of this
+// instance on the check run.
+func UpdateCheckRunExecution(client *github.Client, checkParams *CheckParams) error {
+	return LeaseCheckRun(client, checkParams, time.Now().Add(CHECK_RUN_LEASE))
+}
+
+// IsCheckRunCompleted reports whether the check run has already concluded.
+func IsCheckRunCompleted(client *github.Client, checkParams *CheckParams) bool {
+	checkRun, _, err := client.Checks.GetCheckRun(
+		context.Background(),
+		checkParams.Owner,
+		checkParams.Repo,
+		checkParams.CheckRunID,
+	)
+	if err != nil {
+		log.Warn().Err(err).Msg("Unable to get check run.")
+		return false
+	}
+
+	return checkRun.GetStatus() == STATUS_COMPLETED
+}
+
 func UpdateCheckRunStatus(
 	client *github.Client,
 	checkParams *CheckParams,
@@ -120,12 +341,92 @@ func UpdateCheckRunStatus(
 	)
 
 	if err != nil {
-		return fmt.Errorf("Error updating check run: %v", err)
+		return fmt.Errorf("Error updating check run: %w", err)
+	}
+
+	return nil
+}
+
+// UpdateCheckRunQueued marks the check run as queued again, held by this
+// instance until the given time.
+func UpdateCheckRunQueued(client *github.Client, checkParams *CheckParams, summary string, until time.Time) error {
+	status := STATUS_QUEUED
+	externalID := FormatExternalID(checkParams.ExecutionName, CheckRunLease{Owner: INSTANCE_ID, Until: until})
+	_, _, err := client.Checks.UpdateCheckRun(
+		context.Background(),
+		checkParams.Owner,
+		checkParams.Repo,
+		checkParams.CheckRunID,
+		github.UpdateCheckRunOptions{
+			Name:       checkParams.Name,
+			Status:     &status,
+			ExternalID: &externalID,
+			Output: &github.CheckRunOutput{
+				Title:   &checkParams.Name,
+				Summary: &summary,
+			},
+		},
+	)
+
+	if err != nil {
+		return fmt.Errorf("Error updating check run: %w", err)
+	}
+
+	return nil
+}
+
+func UpdateCheckRunStatusWithOutput(
+	client *github.Client,
+	checkParams *CheckParams,
+	status,
+	summary,
+	outputText string,
+) error {
+	// Update the check run status
+	_, _, err := client.Checks.UpdateCheckRun(
+		context.Background(),
+		checkParams.Owner,
+		checkParams.Repo,
+		checkParams.CheckRunID,
+		github.UpdateCheckRunOptions{
+			Name:   checkParams.Name,
+			Status: &status,
+			Output: &github.CheckRunOutput{
+				Title:   &checkParams.Name,
+				Summary: &summary,
+				Text:    &outputText,
+			},
+		},
+	)
+
+	if err != nil {
+		return fmt.Errorf("Error updating check run: %w", err)
 	}
 
 	return nil
 }
 
+// ConcludeCheckRun concludes the check run unless it has already concluded,
+// ex: cancelled by a newer push while the check was running.
+func ConcludeCheckRun(
+	client *github.Client,
+	checkParams *CheckParams,
+	conclusion,
+	summary,
+	outputText string,
+	annotations []*github.CheckRunAnnotation,
+) error {
+	if IsCheckRunCompleted(client, checkParams) {
+		log.Info().Msg(fmt.Sprintf("Check run '%s' has already concluded, leaving it as is.", checkParams.Name))
+		return nil
+	}
+
+	if len(outputText) == 0 {
+		return UpdateCheckRunCompletion(client, checkParams, conclusion, summary, annotations)
+	}
+	return UpdateCheckRunCompletionWithOutput(client, checkParams, conclusion, summary, outputText, annotations)
+}
+
 func UpdateCheckRunCompletion(
 	client *github.Client,
 	checkParams *CheckParams,
@@ -145,16 +446,17 @@ func UpdateCheckRunCompletion(
 			Output: &github.CheckRunOutput{
 				Title:       &checkParams.Name,
 				Summary:     &summary,
-				Annotations: annotations,
+				Annotations: firstAnnotations(annotations),
 			},
 		},
 	)
 
 	if err != nil {
-		return fmt.Errorf("Error updating check run: %v", err)
+		return fmt.Errorf("Error updating check run: %w", err)
 	}
+	metrics.ChecksCompleted.WithLabelValues(checkParams.Type, conclusion).Inc()
 
-	return nil
+	return addCheckRunAnnotations(client, checkParams, summary, annotations)
 }
 
 func UpdateCheckRunCompletionWithOutput(
@@ -178,13 +480,53 @@ func UpdateCheckRunCompletionWithOutput(
 				Title:       &checkParams.Name,
 				Summary:     &summary,
 				Text:        &outputText,
-				Annotations: annotations,
+				Annotations: firstAnnotations(annotations),
 			},
 		},
 	)
 
 	if err != nil {
-		return fmt.Errorf("Error updating check run: %v", err)
+		return fmt.Errorf("Error updating check run: %w", err)
+	}
+	metrics.ChecksCompleted.WithLabelValues(checkParams.Type, conclusion).Inc()
+
+	return addCheckRunAnnotations(client, checkParams, summary, annotations)
+}
+
+func firstAnnotations(annotations []*github.CheckRunAnnotation) []*github.CheckRunAnnotation {
+	if len(annotations) > MAX_ANNOTATIONS_PER_REQUEST {
+		return annotations[:MAX_ANNOTATIONS_PER_REQUEST]
+	}
+	return annotations
+}
+
+// addCheckRunAnnotations sends the annotations that didn't fit in the first
+// update of the check run, in batches of MAX_ANNOTATIONS_PER_REQUEST.
+func addCheckRunAnnotations(
+	client *github.Client,
+	checkParams *CheckParams,
+	summary string,
+	annotations []*github.CheckRunAnnotation,
+) error {
+	for i := MAX_ANNOTATIONS_PER_REQUEST; i < len(annotations); i += MAX_ANNOTATIONS_PER_REQUEST {
+		batch := annotations[i:min(i+MAX_ANNOTATIONS_PER_REQUEST, len(annotations))]
+		_, _, err := client.Checks.UpdateCheckRun(
+			context.Background(),
+			checkParams.Owner,
+			checkParams.Repo,
+			checkParams.CheckRunID,
+			github.UpdateCheckRunOptions{
+				Name: checkParams.Name,
+				Output: &github.CheckRunOutput{
+					Title:       &checkParams.Name,
+					Summary:     &summary,
+					Annotations: batch,
+				},
+			},
+		)
+		if err != nil {
+			return fmt.Errorf("Error adding check run annotations: %w", err)
+		}
 	}
 
 	return nil
@@ -0,0 +1,120 @@
+package checks
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"github.com/google/go-github/v50/github"
+	"github.com/rs/zerolog/log"
+
+	"github.com/jahagaley/phantom/utils"
+)
+
+const (
+	// Github lists at most this many files when comparing two commits.
+	MAX_COMPARED_FILES = 300
+)
+
+// FindConfigPaths returns the directory of every 'phantom.yaml' file of the
+// repository checked out in dir, relative to the repository root. The root
+// config has an empty path.
+func FindConfigPaths(dir string) ([]string, error) {
+	files, err := utils.GetInputFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var configPaths []string
+	for _, file := range files {
+		if !isConfigFile(file) {
+			continue
+		}
+		configPath := path.Dir(file)
+		if configPath == "." {
+			configPath = ""
+		}
+		configPaths = append(configPaths, configPath)
+	}
+
+	sort.Strings(configPaths)
+	return configPaths, nil
+}
+
+// GetChangedFiles returns the files changed between the base and head commits
+// of the check. It returns false when the changed files aren't known, in which
+// case every config should be considered affected.
+func GetChangedFiles(githubClient *github.Client, checkParams *CheckParams) ([]string, bool, error) {
+	if len(checkParams.BaseSHA) == 0 {
+		return nil, false, nil
+	}
+
+	comparison, _, err := githubClient.Repositories.CompareCommits(
+		context.Background(),
+		checkParams.Owner,
+		checkParams.Repo,
+		checkParams.BaseSHA,
+		checkParams.HeadSHA,
+		nil,
+	)
+	if err != nil {
+		return nil, false, fmt.Errorf("Error comparing commits: %w", err)
+	}
+
+	// Larger diffs are truncated by Github
+	if len(comparison.Files) >= MAX_COMPARED_FILES {
+		return nil, false, nil
+	}
+
+	var files []string
+	for _, file := range comparison.Files {
+		files = append(files, file.GetFilename())
+		if len(file.GetPreviousFilename()) > 0 {
+			files = append(files, file.GetPreviousFilename())
+		}
+	}
+	return files, true, nil
+}
+
+// IsConfigAffected reports whether any of the changed files is in the
+// directory of the config, or matches one of its 'paths' patterns.
+func IsConfigAffected(configPath string, triggerPaths, changedFiles []string) bool {
+	for _, file := range changedFiles {
+		if len(configPath) == 0 || strings.HasPrefix(file, configPath+"/") {
+			return true
+		}
+
+		for _, pattern := range triggerPaths {
+			matched, err := doublestar.Match(strings.TrimPrefix(pattern, "/"), file)
+			if err != nil {
+				log.Warn().Err(err).Msg(fmt.Sprintf("Invalid path pattern '%s' in '%s'", pattern, path.Join(configPath, CONFIG_FILE)))
+				continue
+			}
+			if matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// configResourceID returns the name used in the IDs of the Phantom builds and
+// tests of a config, keeping the IDs of the root config unchanged.
+func configResourceID(configPath, name string) string {
+	if len(configPath) == 0 {
+		return name
+	}
+	return strings.ReplaceAll(configPath, "/", "-") + "-" + name
+}
+
+// configRelativePath returns the path, relative to the repository root, of a
+// path of a config relative to its directory.
+func configRelativePath(configPath, p string) string {
+	if len(configPath) == 0 {
+		return p
+	}
+	return path.Join(configPath, p)
+}
@@ -0,0 +1,205 @@
+package checks
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/google/go-github/v50/github"
+)
+
+func TestFindConfigPaths(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		want  []string
+	}{
+		{"none", []string{"README.md", "main.go"}, nil},
+		{"root", []string{CONFIG_FILE, "main.go"}, []string{""}},
+		{"nested", []string{"services/a/" + CONFIG_FILE, "services/b/" + CONFIG_FILE, "services/c/main.go"}, []string{"services/a", "services/b"}},
+		{"root and nested", []string{"web/" + CONFIG_FILE, CONFIG_FILE, "api/" + CONFIG_FILE}, []string{"", "api", "web"}},
+		{"similar names", []string{"phantom.yml", "other-" + CONFIG_FILE, "docs/" + CONFIG_FILE + ".bak"}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, file := range test.files {
+				if err := os.MkdirAll(path.Join(dir, path.Dir(file)), 0o700); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path.Join(dir, file), nil, 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := FindConfigPaths(dir)
+			if err != nil {
+				t.Fatalf("FindConfigPaths() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("FindConfigPaths() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCheckNameConfigSuffix(t *testing.T) {
+	tests := []struct {
+		name        string
+		checkName   string
+		wantType    string
+		wantName    string
+		wantConfig  string
+		wantInvalid bool
+	}{
+		{"root build", "Build Image - api", PHANTOM_BUILD_IMAGE, "api", "", false},
+		{"nested test", "Run Test - unit (services/a)", PHANTOM_TEST_IMAGE, "unit", "services/a", false},
+		{"nested validation", "Resource Validation - production (infra)", PHANTOM_RESOURCE_VALIDATION, "production", "infra", false},
+		{"parentheses in name", "Run Test - unit (fast) (services/a)", PHANTOM_TEST_IMAGE, "unit (fast)", "services/a", false},
+		{"setup", SETUP, SETUP, "", "", false},
+		{"unknown", "Lint - api", "", "", "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			checkType, options, err := GetCheckTypeAndOptions(test.checkName)
+			if (err != nil) != test.wantInvalid {
+				t.Fatalf("GetCheckTypeAndOptions(%q) error = %v, want invalid %v", test.checkName, err, test.wantInvalid)
+			}
+			if test.wantInvalid {
+				return
+			}
+			if checkType != test.wantType || options["name"] != test.wantName || options["config"] != test.wantConfig {
+				t.Errorf("GetCheckTypeAndOptions(%q) = %s %v, want %s name %q config %q", test.checkName, checkType, options, test.wantType, test.wantName, test.wantConfig)
+			}
+
+			// Check names of nested configs parse back to their config
+			if checkType == SETUP {
+				return
+			}
+			pattern := map[string]string{
+				PHANTOM_BUILD_IMAGE:         PHANTOM_BUILD_IMAGE_PATTERN,
+				PHANTOM_TEST_IMAGE:          PHANTOM_TEST_IMAGE_PATTERN,
+				PHANTOM_RESOURCE_VALIDATION: PHANTOM_RESOURCE_VALIDATION_PATTERN,
+			}[checkType]
+			if got := CheckName(pattern, test.wantName, test.wantConfig); got != test.checkName {
+				t.Errorf("CheckName() = %q, want %q", got, test.checkName)
+			}
+		})
+	}
+}
+
+func TestGetChangedFiles(t *testing.T) {
+	tests := []struct {
+		name      string
+		baseSHA   string
+		files     []*github.CommitFile
+		want      []string
+		wantKnown bool
+	}{
+		{
+			name:    "new branch",
+			baseSHA: "",
+		},
+		{
+			name:      "modified",
+			baseSHA:   "base",
+			files:     []*github.CommitFile{{Filename: github.String("services/a/main.go"), Status: github.String("modified")}},
+			want:      []string{"services/a/main.go"},
+			wantKnown: true,
+		},
+		{
+			name:    "renamed",
+			baseSHA: "base",
+			files: []*github.CommitFile{{
+				Filename:         github.String("services/b/main.go"),
+				PreviousFilename: github.String("services/a/main.go"),
+				Status:           github.String("renamed"),
+			}},
+			want:      []string{"services/b/main.go", "services/a/main.go"},
+			wantKnown: true,
+		},
+		{
+			name:      "deleted",
+			baseSHA:   "base",
+			files:     []*github.CommitFile{{Filename: github.String("services/a/" + CONFIG_FILE), Status: github.String("removed")}},
+			want:      []string{"services/a/" + CONFIG_FILE},
+			wantKnown: true,
+		},
+		{
+			name:    "truncated",
+			baseSHA: "base",
+			files: func() []*github.CommitFile {
+				var files []*github.CommitFile
+				for i := 0; i < MAX_COMPARED_FILES; i++ {
+					files = append(files, &github.CommitFile{Filename: github.String(fmt.Sprintf("file-%d", i))})
+				}
+				return files
+			}(),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			compared := false
+			mux := http.NewServeMux()
+			mux.HandleFunc("/repos/owner/repo/compare/base...head", func(w http.ResponseWriter, r *http.Request) {
+				compared = true
+				json.NewEncoder(w).Encode(&github.CommitsComparison{Files: test.files})
+			})
+			srv := httptest.NewServer(mux)
+			defer srv.Close()
+			client := github.NewClient(srv.Client())
+			client.BaseURL, _ = url.Parse(srv.URL + "/")
+
+			check := &CheckParams{Owner: "owner", Repo: "repo", HeadSHA: "head", BaseSHA: test.baseSHA}
+			got, known, err := GetChangedFiles(client, check)
+			if err != nil {
+				t.Fatalf("GetChangedFiles() error = %v", err)
+			}
+			if known != test.wantKnown || !reflect.DeepEqual(got, test.want) {
+				t.Errorf("GetChangedFiles() = %q, %v, want %q, %v", got, known, test.want, test.wantKnown)
+			}
+			if compared != (len(test.baseSHA) > 0) {
+				t.Errorf("compared commits = %v, want %v", compared, len(test.baseSHA) > 0)
+			}
+		})
+	}
+}
+
+func TestIsConfigAffected(t *testing.T) {
+	tests := []struct {
+		name         string
+		configPath   string
+		triggerPaths []string
+		changedFiles []string
+		want         bool
+	}{
+		{"root config", "", nil, []string{"docs/README.md"}, true},
+		{"no changes", "services/a", nil, nil, false},
+		{"file of the config", "services/a", nil, []string{"services/a/main.go"}, true},
+		{"config itself", "services/a", nil, []string{"services/a/" + CONFIG_FILE}, true},
+		{"other config", "services/a", nil, []string{"services/b/main.go"}, false},
+		{"directory prefix", "services/a", nil, []string{"services/ab/main.go"}, false},
+		{"renamed out of the config", "services/a", nil, []string{"services/b/main.go", "services/a/main.go"}, true},
+		{"trigger path", "services/a", []string{"libs/**"}, []string{"libs/auth/token.go"}, true},
+		{"rooted trigger path", "services/a", []string{"/go.mod"}, []string{"go.mod"}, true},
+		{"unmatched trigger path", "services/a", []string{"libs/**/*.go"}, []string{"libs/README.md"}, false},
+		{"invalid trigger path", "services/a", []string{"libs/[", "go.*"}, []string{"go.sum"}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := IsConfigAffected(test.configPath, test.triggerPaths, test.changedFiles); got != test.want {
+				t.Errorf("IsConfigAffected(%q, %q, %q) = %v, want %v", test.configPath, test.triggerPaths, test.changedFiles, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package checks
+
+import (
+	"fmt"
+
+	"github.com/jahagaley/phantomcli/config"
+)
+
+// CheckNode is a check in the dependency graph of a 'phantom.yaml' file.
+type CheckNode struct {
+	Type    string
+	Name    string
+	Options map[string]string
+
+	// Names of the checks that must succeed before this check runs.
+	Parents []string
+}
+
+// CheckGraph holds the checks of a 'phantom.yaml' file and the order they run in:
+// builds first, then the tests using each build, then the resource validation
+// of every environment once all tests have passed. Checks only depend on
+// checks of the same file, and only the resource validations, which nothing
+// depends on, have several parents.
+type CheckGraph struct {
+	nodes    map[string]*CheckNode
+	order    []string
+	children map[string][]string
+}
+
+// NewCheckGraph creates the graph of the 'phantom.yaml' file in the configPath
+// directory of the repository.
+func NewCheckGraph(cfg *config.PhantomConfig, configPath string) *CheckGraph {
+	g := &CheckGraph{
+		nodes:    make(map[string]*CheckNode),
+		children: make(map[string][]string),
+	}
+
+	for _, b := range cfg.Builds {
+		g.add(&CheckNode{
+			Type:    PHANTOM_BUILD_IMAGE,
+			Name:    CheckName(PHANTOM_BUILD_IMAGE_PATTERN, b.Name, configPath),
+			Options: nodeOptions(b.Name, configPath),
+		})
+	}
+
+	var tests []string
+	for _, t := range cfg.Tests {
+		node := &CheckNode{
+			Type:    PHANTOM_TEST_IMAGE,
+			Name:    CheckName(PHANTOM_TEST_IMAGE_PATTERN, t.Name, configPath),
+			Options: nodeOptions(t.Name, configPath),
+			Parents: []string{CheckName(PHANTOM_BUILD_IMAGE_PATTERN, t.Build, configPath)},
+		}
+		g.add(node)
+		tests = append(tests, node.Name)
+	}
+
+	for _, e := range cfg.Environments {
+		g.add(&CheckNode{
+			Type:    PHANTOM_RESOURCE_VALIDATION,
+			Name:    CheckName(PHANTOM_RESOURCE_VALIDATION_PATTERN, e.Environment, configPath),
+			Options: nodeOptions(e.Environment, configPath),
+			Parents: tests,
+		})
+	}
+
+	return g
+}
+
+func nodeOptions(name, configPath string) map[string]string {
+	options := map[string]string{"name": name}
+	if len(configPath) > 0 {
+		options["config"] = configPath
+	}
+	return options
+}
+
+func (g *CheckGraph) add(node *CheckNode) {
+	g.nodes[node.Name] = node
+	g.order = append(g.order, node.Name)
+	for _, parent := range node.Parents {
+		g.children[parent] = append(g.children[parent], node.Name)
+	}
+}
+
+// Node returns the check with the given name, or nil if it isn't in the graph.
+func (g *CheckGraph) Node(name string) *CheckNode {
+	return g.nodes[name]
+}
+
+// Roots returns the checks that don't depend on any other check.
+func (g *CheckGraph) Roots() []*CheckNode {
+	var roots []*CheckNode
+	for _, name := range g.order {
+		if len(g.nodes[name].Parents) == 0 {
+			roots = append(roots, g.nodes[name])
+		}
+	}
+	return roots
+}
+
+// Children returns the checks depending directly on the given check.
+func (g *CheckGraph) Children(name string) []*CheckNode {
+	var children []*CheckNode
+	for _, child := range g.children[name] {
+		children = append(children, g.nodes[child])
+	}
+	return children
+}
+
+// OwnedChildren returns the children of which the given check is the first
+// parent. A check is only scheduled, or skipped, by its first parent.
+func (g *CheckGraph) OwnedChildren(name string) []*CheckNode {
+	var children []*CheckNode
+	for _, child := range g.Children(name) {
+		if child.Parents[0] == name {
+			children = append(children, child)
+		}
+	}
+	return children
+}
+
+// ValidateConfig checks that every check of the config depends on checks it
+// defines.
+func ValidateConfig(cfg *config.PhantomConfig) error {
+	for _, t := range cfg.Tests {
+		if len(t.Build) == 0 {
+			return fmt.Errorf("Test '%s' doesn't name the build it runs.", t.Name)
+		}
+		if cfg.GetBuild(t.Build) == nil {
+			return fmt.Errorf("Test '%s' runs build '%s', which is not defined.", t.Name, t.Build)
+		}
+	}
+	return nil
+}
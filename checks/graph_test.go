@@ -0,0 +1,102 @@
+package checks
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/jahagaley/phantomcli/config"
+)
+
+func loadConfig(t *testing.T, content string) *config.PhantomConfig {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(path.Join(dir, CONFIG_FILE), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.GetConfigFromPath(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &cfg
+}
+
+func nodeNames(nodes []*CheckNode) []string {
+	var names []string
+	for _, node := range nodes {
+		names = append(names, node.Name)
+	}
+	return names
+}
+
+func TestNewCheckGraph(t *testing.T) {
+	cfg := loadConfig(t, `
+builds:
+- name: api
+- name: web
+tests:
+- name: unit
+  build: api
+- name: e2e
+  build: web
+`)
+
+	graph := NewCheckGraph(cfg, "services/a")
+	if got, want := nodeNames(graph.Roots()), []string{"Build Image - api (services/a)", "Build Image - web (services/a)"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Roots() = %v, want %v", got, want)
+	}
+	if got, want := nodeNames(graph.Children("Build Image - api (services/a)")), []string{"Run Test - unit (services/a)"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Children() = %v, want %v", got, want)
+	}
+
+	test := graph.Node("Run Test - e2e (services/a)")
+	if test == nil {
+		t.Fatal("Node() = nil, want the e2e test")
+	}
+	wantOptions := map[string]string{"name": "e2e", "config": "services/a"}
+	if test.Type != PHANTOM_TEST_IMAGE || !reflect.DeepEqual(test.Options, wantOptions) {
+		t.Errorf("Node() = %+v, want a test with options %v", test, wantOptions)
+	}
+}
+
+func TestOwnedChildren(t *testing.T) {
+	graph := &CheckGraph{nodes: make(map[string]*CheckNode), children: make(map[string][]string)}
+	graph.add(&CheckNode{Name: "a"})
+	graph.add(&CheckNode{Name: "b"})
+	graph.add(&CheckNode{Name: "only a", Parents: []string{"a"}})
+	graph.add(&CheckNode{Name: "a and b", Parents: []string{"a", "b"}})
+
+	if got, want := nodeNames(graph.OwnedChildren("a")), []string{"only a", "a and b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("OwnedChildren(a) = %v, want %v", got, want)
+	}
+	if got := graph.OwnedChildren("b"); len(got) != 0 {
+		t.Errorf("OwnedChildren(b) = %v, want none", nodeNames(got))
+	}
+	if got, want := nodeNames(graph.Children("b")), []string{"a and b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Children(b) = %v, want %v", got, want)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr bool
+	}{
+		{"valid", "builds:\n- name: main\ntests:\n- name: unit\n  build: main\n", false},
+		{"no tests", "builds:\n- name: main\n", false},
+		{"undefined build", "builds:\n- name: main\ntests:\n- name: unit\n  build: other\n", true},
+		{"empty build", "builds:\n- name: main\ntests:\n- name: unit\n", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := ValidateConfig(loadConfig(t, test.config))
+			if (err != nil) != test.wantErr {
+				t.Errorf("ValidateConfig() error = %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
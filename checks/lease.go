@@ -0,0 +1,167 @@
+package checks
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v50/github"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// How long a check run is held by the instance working on it without
+	// being renewed. Check runs with a lease are left alone by the reapers of
+	// every instance.
+	CHECK_RUN_LEASE = 15 * time.Minute
+
+	// How often the lease of a check run waiting on its execution is renewed.
+	CHECK_RUN_LEASE_RENEWAL = 5 * time.Minute
+
+	// The lease is kept after the execution name in the external ID of the
+	// check run, execution names never containing it.
+	leaseSeparator = "#lease:"
+)
+
+// INSTANCE_ID identifies this instance in the leases it holds.
+var INSTANCE_ID = newInstanceID()
+
+func newInstanceID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
+
+// CheckRunLease is the claim of an instance on a check run, seen by every
+// instance through the check run's external ID.
+type CheckRunLease struct {
+	Owner string
+	Until time.Time
+}
+
+// Held reports whether the lease is still valid.
+func (l CheckRunLease) Held() bool {
+	return len(l.Owner) > 0 && time.Now().Before(l.Until)
+}
+
+// ParseExternalID returns the execution name and the lease kept in the
+// external ID of a check run.
+func ParseExternalID(externalID string) (string, CheckRunLease) {
+	executionName, leaseText, ok := strings.Cut(externalID, leaseSeparator)
+	if !ok {
+		return executionName, CheckRunLease{}
+	}
+
+	owner, until, _ := strings.Cut(leaseText, ":")
+	seconds, err := strconv.ParseInt(until, 10, 64)
+	if err != nil {
+		return executionName, CheckRunLease{}
+	}
+	return executionName, CheckRunLease{Owner: owner, Until: time.Unix(seconds, 0)}
+}
+
+// FormatExternalID returns the external ID of a check run running the
+// execution under the lease.
+func FormatExternalID(executionName string, lease CheckRunLease) string {
+	if len(lease.Owner) == 0 {
+		return executionName
+	}
+	return fmt.Sprintf("%s%s%s:%d", executionName, leaseSeparator, lease.Owner, lease.Until.Unix())
+}
+
+// LeaseCheckRun holds the check run for this instance until the given time,
+// keeping the execution of the check linked to it.
+func LeaseCheckRun(client *github.Client, checkParams *CheckParams, until time.Time) error {
+	externalID := FormatExternalID(checkParams.ExecutionName, CheckRunLease{Owner: INSTANCE_ID, Until: until})
+	_, _, err := client.Checks.UpdateCheckRun(
+		context.Background(),
+		checkParams.Owner,
+		checkParams.Repo,
+		checkParams.CheckRunID,
+		github.UpdateCheckRunOptions{
+			Name:       checkParams.Name,
+			ExternalID: &externalID,
+		},
+	)
+
+	if err != nil {
+		return fmt.Errorf("Error updating check run: %w", err)
+	}
+
+	return nil
+}
+
+// ClaimCheckRun takes the lease of a check run nobody holds, and reports
+// whether this instance got it. The check run is read again after being
+// claimed, so of the instances claiming it at once only the last one keeps it.
+func ClaimCheckRun(client *github.Client, checkParams *CheckParams) (bool, error) {
+	lease, err := getCheckRunLease(client, checkParams)
+	if err != nil {
+		return false, err
+	}
+	if lease.Held() && lease.Owner != INSTANCE_ID {
+		return false, nil
+	}
+
+	if err := LeaseCheckRun(client, checkParams, time.Now().Add(CHECK_RUN_LEASE)); err != nil {
+		return false, err
+	}
+
+	lease, err = getCheckRunLease(client, checkParams)
+	if err != nil {
+		return false, err
+	}
+	return lease.Owner == INSTANCE_ID, nil
+}
+
+func getCheckRunLease(client *github.Client, checkParams *CheckParams) (CheckRunLease, error) {
+	checkRun, _, err := client.Checks.GetCheckRun(
+		context.Background(),
+		checkParams.Owner,
+		checkParams.Repo,
+		checkParams.CheckRunID,
+	)
+	if err != nil {
+		return CheckRunLease{}, fmt.Errorf("Error getting check run: %w", err)
+	}
+
+	_, lease := ParseExternalID(checkRun.GetExternalID())
+	return lease, nil
+}
+
+// HoldCheckRun keeps the lease of the check run while its execution is
+// watched, until the returned function is called.
+func HoldCheckRun(githubClient *github.Client, checkParams *CheckParams) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(CHECK_RUN_LEASE_RENEWAL)
+		defer ticker.Stop()
+
+		for {
+			err := LeaseCheckRun(githubClient, checkParams, time.Now().Add(CHECK_RUN_LEASE))
+			if err != nil {
+				log.Warn().Err(err).Msg(fmt.Sprintf("Unable to renew the lease of check run '%s'", checkParams.Name))
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
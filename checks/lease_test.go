@@ -0,0 +1,35 @@
+package checks
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseExternalID(t *testing.T) {
+	until := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name          string
+		externalID    string
+		wantExecution string
+		wantLease     CheckRunLease
+	}{
+		{"empty", "", "", CheckRunLease{}},
+		{"execution", "projects/p/executions/1", "projects/p/executions/1", CheckRunLease{}},
+		{"execution and lease", "projects/p/executions/1#lease:abc:1700000000", "projects/p/executions/1", CheckRunLease{Owner: "abc", Until: until}},
+		{"lease only", "#lease:abc:1700000000", "", CheckRunLease{Owner: "abc", Until: until}},
+		{"invalid lease", "projects/p/executions/1#lease:abc", "projects/p/executions/1", CheckRunLease{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			executionName, lease := ParseExternalID(test.externalID)
+			if executionName != test.wantExecution || lease.Owner != test.wantLease.Owner || !lease.Until.Equal(test.wantLease.Until) {
+				t.Errorf("ParseExternalID() = %s, %+v, want %s, %+v", executionName, lease, test.wantExecution, test.wantLease)
+			}
+			if len(lease.Owner) > 0 && FormatExternalID(executionName, lease) != test.externalID {
+				t.Errorf("FormatExternalID() = %s, want %s", FormatExternalID(executionName, lease), test.externalID)
+			}
+		})
+	}
+}
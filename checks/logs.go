@@ -0,0 +1,194 @@
+package checks
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"connectrpc.com/connect"
+	"github.com/google/go-github/v50/github"
+	apipb "github.com/jahagaley/phantomapi/phantom/api/v1"
+	api "github.com/jahagaley/phantomapi/phantom/api/v1/v1connect"
+	"github.com/rs/zerolog/log"
+
+	"github.com/jahagaley/phantom/utils"
+	"github.com/jahagaley/phantom/utils/tracing"
+)
+
+const (
+	// Github rejects check run outputs longer than this many characters.
+	MAX_CHECK_OUTPUT_LENGTH = 65535
+
+	// Size of the log tail shown while an execution is running.
+	RUNNING_LOG_TAIL_SIZE = 8 * 1024
+
+	// How often the check run output is refreshed while an execution is running.
+	LOG_UPDATE_INTERVAL = 30 * time.Second
+
+	// Link to the full logs of an execution on the Phantom site.
+	EXECUTION_LOGS_URL_PATTERN = "%s/%s/logs"
+
+	logPageSize = 1000
+)
+
+// ExecutionLogs keeps the tail of the logs of a Phantom execution.
+type ExecutionLogs struct {
+	gitClient     api.GitServiceClient
+	executionName string
+
+	// Page of the logs read last, and the number of its entries already
+	// read. Logs are only appended, so the page gets more entries until the
+	// next one starts.
+	pageToken   string
+	pageEntries int
+
+	tail      []byte
+	truncated bool
+}
+
+func NewExecutionLogs(executionName string) *ExecutionLogs {
+	return &ExecutionLogs{
+		gitClient:     api.NewGitServiceClient(tracing.HTTPClient, utils.API_URL),
+		executionName: executionName,
+	}
+}
+
+// Fetch reads the log lines written since the last fetch and reports whether
+// there were any.
+func (l *ExecutionLogs) Fetch(ctx context.Context) (bool, error) {
+	changed := false
+	for {
+		listExecutionLogsRequest := &apipb.ListExecutionLogsRequest{
+			Parent:    l.executionName,
+			PageSize:  logPageSize,
+			PageToken: l.pageToken,
+		}
+		res, err := l.gitClient.ListExecutionLogs(ctx, connect.NewRequest(listExecutionLogsRequest))
+		if err != nil {
+			return changed, err
+		}
+
+		entries := res.Msg.GetEntries()
+		for _, entry := range entries[min(l.pageEntries, len(entries)):] {
+			l.append(entry.GetText())
+			changed = true
+		}
+		l.pageEntries = max(l.pageEntries, len(entries))
+
+		// The last page is read again on the next fetch, skipping the entries
+		// already read, while the execution is still writing logs.
+		if len(entries) == 0 || len(res.Msg.GetNextPageToken()) == 0 {
+			return changed, nil
+		}
+		l.pageToken = res.Msg.GetNextPageToken()
+		l.pageEntries = 0
+	}
+}
+
+func (l *ExecutionLogs) append(line string) {
+	l.tail = append(l.tail, line...)
+	if !strings.HasSuffix(line, "\n") {
+		l.tail = append(l.tail, '\n')
+	}
+
+	if len(l.tail) > MAX_CHECK_OUTPUT_LENGTH {
+		l.tail = trimToLength(l.tail, MAX_CHECK_OUTPUT_LENGTH)
+		l.truncated = true
+	}
+}
+
+// Output formats the tail of the logs as markdown for a check run output,
+// keeping it under maxLength bytes.
+func (l *ExecutionLogs) Output(maxLength int) string {
+	link := fmt.Sprintf(EXECUTION_LOGS_URL_PATTERN, utils.SITE_URL, l.executionName)
+	if len(l.tail) == 0 {
+		return fmt.Sprintf("No logs yet, the full logs are available [here](%s).", link)
+	}
+
+	// The fence has to be longer than any run of backticks in the logs.
+	fence := strings.Repeat("`", max(3, longestRun(l.tail, '`')+1))
+	header := fmt.Sprintf("The full logs are available [here](%s).\n\n", link)
+	body := l.tail
+	if l.truncated || len(header)+2*len(fence)+1+len(body) > maxLength {
+		header = fmt.Sprintf("Showing the end of the logs, the full logs are available [here](%s).\n\n", link)
+		body = trimToLength(body, maxLength-len(header)-2*len(fence)-1)
+	}
+
+	return header + fence + "\n" + string(body) + fence
+}
+
+// trimToLength drops the start of the logs so they fit in length bytes,
+// cutting on a line boundary when possible.
+func trimToLength(logs []byte, length int) []byte {
+	if len(logs) <= length {
+		return logs
+	}
+	logs = logs[len(logs)-length:]
+	if i := strings.IndexByte(string(logs), '\n'); i >= 0 && i < len(logs)-1 {
+		return logs[i+1:]
+	}
+	for len(logs) > 0 && !utf8.RuneStart(logs[0]) {
+		logs = logs[1:]
+	}
+	return logs
+}
+
+func longestRun(data []byte, c byte) int {
+	longest, current := 0, 0
+	for _, b := range data {
+		if b == c {
+			current++
+			longest = max(longest, current)
+		} else {
+			current = 0
+		}
+	}
+	return longest
+}
+
+// Stream refreshes the check run output with the tail of the logs until the
+// returned stop function is called.
+func (l *ExecutionLogs) Stream(githubClient *github.Client, checkParams *CheckParams, summary string) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(LOG_UPDATE_INTERVAL)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+
+			changed, err := l.Fetch(ctx)
+			if err != nil {
+				log.Debug().Err(err).Msg(fmt.Sprintf("Unable to fetch logs of execution '%s'", l.executionName))
+			}
+			if !changed {
+				continue
+			}
+
+			err = UpdateCheckRunStatusWithOutput(
+				githubClient,
+				checkParams,
+				STATUS_IN_PROGRESS,
+				summary,
+				l.Output(RUNNING_LOG_TAIL_SIZE),
+			)
+			if err != nil {
+				log.Debug().Err(err).Msg("Unable to update check run with logs")
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
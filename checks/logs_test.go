@@ -0,0 +1,110 @@
+package checks
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+
+	"connectrpc.com/connect"
+	apipb "github.com/jahagaley/phantomapi/phantom/api/v1"
+	api "github.com/jahagaley/phantomapi/phantom/api/v1/v1connect"
+)
+
+// fakeLogsClient pages through lines, page tokens being offsets in lines.
+type fakeLogsClient struct {
+	api.GitServiceClient
+
+	lines    []string
+	pageSize int
+}
+
+func (c *fakeLogsClient) ListExecutionLogs(ctx context.Context, req *connect.Request[apipb.ListExecutionLogsRequest]) (*connect.Response[apipb.ListExecutionLogsResponse], error) {
+	offset, _ := strconv.Atoi(req.Msg.PageToken)
+	end := min(offset+c.pageSize, len(c.lines))
+
+	res := &apipb.ListExecutionLogsResponse{}
+	for _, line := range c.lines[offset:end] {
+		res.Entries = append(res.Entries, &apipb.LogEntry{Text: line})
+	}
+	if end < len(c.lines) {
+		res.NextPageToken = strconv.Itoa(end)
+	}
+	return connect.NewResponse(res), nil
+}
+
+func TestExecutionLogsFetch(t *testing.T) {
+	client := &fakeLogsClient{pageSize: 2}
+	logs := &ExecutionLogs{gitClient: client, executionName: "projects/p/executions/1"}
+
+	fetch := func(wantChanged bool, want string) {
+		t.Helper()
+		changed, err := logs.Fetch(context.Background())
+		if err != nil {
+			t.Fatalf("Fetch() error = %v", err)
+		}
+		if changed != wantChanged || string(logs.tail) != want {
+			t.Errorf("Fetch() = %v, %q, want %v, %q", changed, logs.tail, wantChanged, want)
+		}
+	}
+
+	fetch(false, "")
+
+	client.lines = append(client.lines, "one", "two", "three")
+	fetch(true, "one\ntwo\nthree\n")
+
+	// Nothing new on the last page
+	fetch(false, "one\ntwo\nthree\n")
+
+	// New lines on the last page, then on the next ones
+	client.lines = append(client.lines, "four")
+	fetch(true, "one\ntwo\nthree\nfour\n")
+	client.lines = append(client.lines, "five", "six", "seven\n")
+	fetch(true, "one\ntwo\nthree\nfour\nfive\nsix\nseven\n")
+	fetch(false, "one\ntwo\nthree\nfour\nfive\nsix\nseven\n")
+}
+
+func TestExecutionLogsOutput(t *testing.T) {
+	logs := &ExecutionLogs{executionName: "projects/p/executions/1"}
+	if got := logs.Output(MAX_CHECK_OUTPUT_LENGTH); !strings.HasPrefix(got, "No logs yet") {
+		t.Errorf("Output() = %q, want no logs", got)
+	}
+
+	logs.append("```go")
+	logs.append("fmt.Println()")
+	logs.append("```")
+	got := logs.Output(MAX_CHECK_OUTPUT_LENGTH)
+	if !strings.HasSuffix(got, "````\n```go\nfmt.Println()\n```\n````") {
+		t.Errorf("Output() = %q, want the logs in a longer fence", got)
+	}
+
+	for i := 0; i < 100; i++ {
+		logs.append(strings.Repeat("x", 99))
+	}
+	got = logs.Output(1000)
+	if len(got) > 1000 || !strings.HasPrefix(got, "Showing the end of the logs") {
+		t.Errorf("Output(1000) is %d bytes: %q", len(got), got)
+	}
+	if !strings.HasSuffix(got, strings.Repeat("x", 99)+"\n````") {
+		t.Errorf("Output(1000) doesn't end with the last line: %q", got)
+	}
+}
+
+func TestTrimToLength(t *testing.T) {
+	tests := []struct {
+		logs   string
+		length int
+		want   string
+	}{
+		{"short\n", 10, "short\n"},
+		{"first\nsecond\n", 10, "second\n"},
+		{"no line breaks", 5, "reaks"},
+		{"héllo", 4, "llo"},
+	}
+
+	for _, test := range tests {
+		if got := string(trimToLength([]byte(test.logs), test.length)); got != test.want {
+			t.Errorf("trimToLength(%q, %d) = %q, want %q", test.logs, test.length, got, test.want)
+		}
+	}
+}
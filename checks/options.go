@@ -0,0 +1,81 @@
+package checks
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	CONFIG_FILE = "phantom.yaml"
+
+	// Timeouts used when 'phantom.yaml' doesn't set one.
+	DEFAULT_BUILD_TIMEOUT = 15 * time.Minute
+	DEFAULT_TEST_TIMEOUT  = time.Hour
+)
+
+// checkOptions holds the settings of 'phantom.yaml' only used by checks, on
+// top of the ones read by the phantomcli config.
+type checkOptions struct {
+	Builds []namedCheckOptions `yaml:"builds"`
+	Tests  []namedCheckOptions `yaml:"tests"`
+
+	// Glob patterns, relative to the repository root, of files outside the
+	// directory of the config whose changes also trigger its checks.
+	Paths []string `yaml:"paths"`
+}
+
+type namedCheckOptions struct {
+	Name string `yaml:"name"`
+	// Duration string such as "30m", see time.ParseDuration.
+	Timeout string `yaml:"timeout"`
+}
+
+func getCheckOptions(dir string) (*checkOptions, error) {
+	data, err := os.ReadFile(path.Join(dir, CONFIG_FILE))
+	if err != nil {
+		return nil, err
+	}
+
+	options := &checkOptions{}
+	if err := yaml.Unmarshal(data, options); err != nil {
+		return nil, fmt.Errorf("Unable to parse '%s': %w", CONFIG_FILE, err)
+	}
+	return options, nil
+}
+
+// GetCheckTimeout returns how long the execution of a build or test may run.
+func GetCheckTimeout(dir, checkType, name string) (time.Duration, error) {
+	options, err := getCheckOptions(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	named, timeout := options.Builds, DEFAULT_BUILD_TIMEOUT
+	if checkType == PHANTOM_TEST_IMAGE {
+		named, timeout = options.Tests, DEFAULT_TEST_TIMEOUT
+	}
+
+	for _, n := range named {
+		if n.Name != name || len(n.Timeout) == 0 {
+			continue
+		}
+		timeout, err = time.ParseDuration(n.Timeout)
+		if err != nil || timeout <= 0 {
+			return 0, fmt.Errorf("Invalid timeout '%s' for '%s'.", n.Timeout, name)
+		}
+	}
+	return timeout, nil
+}
+
+// GetConfigTriggerPaths returns the 'paths' patterns of the 'phantom.yaml' file in dir.
+func GetConfigTriggerPaths(dir string) ([]string, error) {
+	options, err := getCheckOptions(dir)
+	if err != nil {
+		return nil, err
+	}
+	return options.Paths, nil
+}
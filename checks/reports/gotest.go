@@ -0,0 +1,66 @@
+package reports
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// Event written by 'go test -json', see 'go doc test2json'.
+type goTestEvent struct {
+	Action  string
+	Package string
+	Test    string
+	Output  string
+}
+
+// ParseGoTestJSON reads the output of 'go test -json'.
+func ParseGoTestJSON(data []byte) (*Report, error) {
+	report := &Report{}
+	outputs := make(map[string]*strings.Builder)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 || line[0] != '{' {
+			continue
+		}
+
+		var event goTestEvent
+		if err := json.Unmarshal(line, &event); err != nil {
+			return nil, err
+		}
+		// Package level events don't belong to a test.
+		if len(event.Test) == 0 {
+			continue
+		}
+
+		key := event.Package + "." + event.Test
+		switch event.Action {
+		case "output":
+			if outputs[key] == nil {
+				outputs[key] = &strings.Builder{}
+			}
+			outputs[key].WriteString(event.Output)
+		case "pass", "fail", "skip":
+			result := &TestResult{
+				Suite:  event.Package,
+				Name:   event.Test,
+				Status: map[string]string{"pass": STATUS_PASSED, "fail": STATUS_FAILED, "skip": STATUS_SKIPPED}[event.Action],
+			}
+			if result.Status == STATUS_FAILED && outputs[key] != nil {
+				result.Message = strings.TrimSpace(outputs[key].String())
+				result.File, result.Line = findLocation(result.Message)
+			}
+			delete(outputs, key)
+			report.Results = append(report.Results, result)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
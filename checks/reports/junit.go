@@ -0,0 +1,95 @@
+package reports
+
+import (
+	"encoding/xml"
+	"strings"
+)
+
+type junitTestSuite struct {
+	Name   string           `xml:"name,attr"`
+	File   string           `xml:"file,attr"`
+	Cases  []junitTestCase  `xml:"testcase"`
+	Suites []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	File      string        `xml:"file,attr"`
+	Line      int           `xml:"line,attr"`
+	Failure   *junitFailure `xml:"failure"`
+	Error     *junitFailure `xml:"error"`
+	Skipped   *struct{}     `xml:"skipped"`
+	SystemOut string        `xml:"system-out"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// ParseJUnit reads a JUnit XML report, with either a <testsuites> or a
+// single <testsuite> root element.
+func ParseJUnit(data []byte) (*Report, error) {
+	var root struct {
+		XMLName xml.Name
+		junitTestSuite
+	}
+	if err := xml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+
+	// The suites nested in a <testsuites> root are read as its Suites.
+	suites := root.Suites
+	if root.XMLName.Local == "testsuite" {
+		suites = []junitTestSuite{root.junitTestSuite}
+	}
+
+	report := &Report{}
+	for _, suite := range suites {
+		addJUnitSuite(report, suite)
+	}
+	return report, nil
+}
+
+func addJUnitSuite(report *Report, suite junitTestSuite) {
+	for _, c := range suite.Cases {
+		result := &TestResult{
+			Suite:  suite.Name,
+			Name:   c.Name,
+			Status: STATUS_PASSED,
+			File:   c.File,
+			Line:   c.Line,
+		}
+		if len(result.Suite) == 0 {
+			result.Suite = c.ClassName
+		}
+		if len(result.File) == 0 {
+			result.File = suite.File
+		}
+
+		failure := c.Failure
+		if failure == nil {
+			failure = c.Error
+		}
+		if failure != nil {
+			result.Status = STATUS_FAILED
+			result.Message = strings.TrimSpace(strings.Join([]string{failure.Message, failure.Text}, "\n"))
+			if result.Line == 0 {
+				file, line := findLocation(failure.Text + "\n" + failure.Message + "\n" + c.SystemOut)
+				if len(result.File) == 0 || strings.HasSuffix(file, result.File) || strings.HasSuffix(result.File, file) {
+					result.File, result.Line = file, line
+				}
+			}
+		} else if c.Skipped != nil {
+			result.Status = STATUS_SKIPPED
+		}
+
+		report.Results = append(report.Results, result)
+	}
+
+	for _, nested := range suite.Suites {
+		addJUnitSuite(report, nested)
+	}
+}
@@ -0,0 +1,126 @@
+package reports
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	STATUS_PASSED  = "passed"
+	STATUS_FAILED  = "failed"
+	STATUS_SKIPPED = "skipped"
+)
+
+// Matches locations such as "pkg/foo_test.go:42" in test output.
+var locationPattern = regexp.MustCompile(`([\w./\\-]+\.\w+):(\d+)`)
+
+// TestResult is the outcome of a single test case.
+type TestResult struct {
+	Suite  string
+	Name   string
+	Status string
+
+	// Location of the failure, when the report provides one.
+	File    string
+	Line    int
+	Message string
+}
+
+// Report holds the results of one or more test report files.
+type Report struct {
+	Results []*TestResult
+}
+
+// Counts returns the number of passed, failed and skipped tests.
+func (r *Report) Counts() (passed, failed, skipped int) {
+	for _, result := range r.Results {
+		switch result.Status {
+		case STATUS_PASSED:
+			passed++
+		case STATUS_FAILED:
+			failed++
+		case STATUS_SKIPPED:
+			skipped++
+		}
+	}
+	return passed, failed, skipped
+}
+
+// Failures returns the failed tests.
+func (r *Report) Failures() []*TestResult {
+	var failures []*TestResult
+	for _, result := range r.Results {
+		if result.Status == STATUS_FAILED {
+			failures = append(failures, result)
+		}
+	}
+	return failures
+}
+
+// Merge adds the results of another report.
+func (r *Report) Merge(other *Report) {
+	r.Results = append(r.Results, other.Results...)
+}
+
+var ErrNoResults = errors.New("Test report has no test results.")
+
+// IsReportFile reports whether the file name looks like a supported test
+// report: a TAP file, or an XML or JSON file named after tests, such as
+// 'junit.xml', 'TEST-Foo.xml' or 'test-results.json'. Other XML and JSON
+// artifacts, such as 'package.json' or 'coverage.xml', aren't reports.
+func IsReportFile(name string) bool {
+	base := strings.ToLower(path.Base(name))
+	switch path.Ext(base) {
+	case ".tap":
+		return true
+	case ".xml", ".json", ".jsonl":
+		return strings.Contains(base, "test") || strings.Contains(base, "junit")
+	}
+	return false
+}
+
+// Parse reads a JUnit XML, Go test2json or TAP report, picking the format
+// from the file name and its contents. It returns ErrNoResults if the file
+// has no test results.
+func Parse(name string, data []byte) (*Report, error) {
+	var report *Report
+	var err error
+
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case strings.EqualFold(path.Ext(name), ".tap"), bytes.HasPrefix(trimmed, []byte("TAP version")):
+		report, err = ParseTAP(data)
+	case bytes.HasPrefix(trimmed, []byte("<")):
+		report, err = ParseJUnit(data)
+	case bytes.HasPrefix(trimmed, []byte("{")):
+		report, err = ParseGoTestJSON(data)
+	default:
+		return nil, fmt.Errorf("Unknown test report format for '%s'.", name)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	if len(report.Results) == 0 {
+		return nil, ErrNoResults
+	}
+	return report, nil
+}
+
+// findLocation returns the first file and line mentioned in the text.
+func findLocation(text string) (string, int) {
+	match := locationPattern.FindStringSubmatch(text)
+	if match == nil {
+		return "", 0
+	}
+	line, err := strconv.Atoi(match[2])
+	if err != nil {
+		return "", 0
+	}
+	return match[1], line
+}
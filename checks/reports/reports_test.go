@@ -0,0 +1,179 @@
+package reports
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestIsReportFile(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"junit.xml", true},
+		{"reports/TEST-com.example.FooTest.xml", true},
+		{"out/test-results.json", true},
+		{"go-test.jsonl", true},
+		{"results.tap", true},
+		{"package.json", false},
+		{"pom.xml", false},
+		{"coverage/coverage.xml", false},
+		{"tests/coverage.json", false},
+		{"test.log", false},
+	}
+
+	for _, test := range tests {
+		if got := IsReportFile(test.name); got != test.want {
+			t.Errorf("IsReportFile(%q) = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		data    string
+		want    []*TestResult
+		wantErr error
+	}{
+		{
+			name: "junit testsuites",
+			file: "junit.xml",
+			data: `<?xml version="1.0"?>
+<testsuites>
+  <testsuite name="pkg.FooTest" file="src/foo_test.py">
+    <testcase name="test_ok" classname="pkg.FooTest"/>
+    <testcase name="test_fail" classname="pkg.FooTest">
+      <failure message="assert 1 == 2">src/foo_test.py:12: AssertionError</failure>
+    </testcase>
+    <testcase name="test_skip" classname="pkg.FooTest"><skipped/></testcase>
+  </testsuite>
+</testsuites>`,
+			want: []*TestResult{
+				{Suite: "pkg.FooTest", Name: "test_ok", Status: STATUS_PASSED, File: "src/foo_test.py"},
+				{
+					Suite:   "pkg.FooTest",
+					Name:    "test_fail",
+					Status:  STATUS_FAILED,
+					File:    "src/foo_test.py",
+					Line:    12,
+					Message: "assert 1 == 2\nsrc/foo_test.py:12: AssertionError",
+				},
+				{Suite: "pkg.FooTest", Name: "test_skip", Status: STATUS_SKIPPED, File: "src/foo_test.py"},
+			},
+		},
+		{
+			name: "junit single testsuite",
+			file: "TEST-Bar.xml",
+			data: `<testsuite name="Bar">
+  <testcase name="errors" classname="Bar" file="Bar.java" line="7"><error message="boom"/></testcase>
+</testsuite>`,
+			want: []*TestResult{
+				{Suite: "Bar", Name: "errors", Status: STATUS_FAILED, File: "Bar.java", Line: 7, Message: "boom"},
+			},
+		},
+		{
+			name: "go test2json",
+			file: "test.json",
+			data: `{"Action":"run","Package":"example.com/pkg","Test":"TestOK"}
+{"Action":"pass","Package":"example.com/pkg","Test":"TestOK"}
+{"Action":"output","Package":"example.com/pkg","Test":"TestFail","Output":"    foo_test.go:20: got 1\n"}
+{"Action":"fail","Package":"example.com/pkg","Test":"TestFail"}
+{"Action":"skip","Package":"example.com/pkg","Test":"TestSkip"}
+{"Action":"pass","Package":"example.com/pkg"}`,
+			want: []*TestResult{
+				{Suite: "example.com/pkg", Name: "TestOK", Status: STATUS_PASSED},
+				{
+					Suite:   "example.com/pkg",
+					Name:    "TestFail",
+					Status:  STATUS_FAILED,
+					File:    "foo_test.go",
+					Line:    20,
+					Message: "foo_test.go:20: got 1",
+				},
+				{Suite: "example.com/pkg", Name: "TestSkip", Status: STATUS_SKIPPED},
+			},
+		},
+		{
+			name: "tap",
+			file: "results.tap",
+			data: `TAP version 13
+1..4
+ok 1 - parses input
+not ok 2 - rejects empty input
+  ---
+  message: expected an error
+  at: test/parse.js:31:5
+  ...
+ok 3 - slow path # SKIP not supported
+not ok 4`,
+			want: []*TestResult{
+				{Name: "parses input", Status: STATUS_PASSED},
+				{Name: "rejects empty input", Status: STATUS_FAILED, File: "test/parse.js", Line: 31, Message: "message: expected an error"},
+				{Name: "slow path", Status: STATUS_SKIPPED},
+				{Name: "test 4", Status: STATUS_FAILED},
+			},
+		},
+		{
+			name:    "json without results",
+			file:    "test-config.json",
+			data:    `{"name": "config", "version": "1.0.0"}`,
+			wantErr: ErrNoResults,
+		},
+		{
+			name:    "xml without results",
+			file:    "junit.xml",
+			data:    `<testsuites></testsuites>`,
+			wantErr: ErrNoResults,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			report, err := Parse(test.file, []byte(test.data))
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Fatalf("Parse() error = %v, want %v", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if !reflect.DeepEqual(report.Results, test.want) {
+				for i, result := range report.Results {
+					t.Logf("result %d: %+v", i, *result)
+				}
+				t.Errorf("Parse() returned %d results, want %d", len(report.Results), len(test.want))
+			}
+		})
+	}
+}
+
+func TestParseUnknownFormat(t *testing.T) {
+	if _, err := Parse("test.json", []byte("not a report")); err == nil {
+		t.Error("Parse() succeeded, want an error")
+	}
+}
+
+func TestReportCounts(t *testing.T) {
+	report := &Report{}
+	report.Merge(&Report{Results: []*TestResult{
+		{Name: "a", Status: STATUS_PASSED},
+		{Name: "b", Status: STATUS_FAILED},
+	}})
+	report.Merge(&Report{Results: []*TestResult{
+		{Name: "c", Status: STATUS_SKIPPED},
+		{Name: "d", Status: STATUS_PASSED},
+	}})
+
+	passed, failed, skipped := report.Counts()
+	if passed != 2 || failed != 1 || skipped != 1 {
+		t.Errorf("Counts() = %d, %d, %d, want 2, 1, 1", passed, failed, skipped)
+	}
+	if failures := report.Failures(); len(failures) != 1 || failures[0].Name != "b" {
+		t.Errorf("Failures() = %v, want [b]", failures)
+	}
+}
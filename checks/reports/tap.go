@@ -0,0 +1,80 @@
+package reports
+
+import (
+	"bufio"
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// Matches test lines such as "not ok 3 - parses empty input # SKIP".
+	tapTestPattern = regexp.MustCompile(`^(not ok|ok)\b\s*(\d*)\s*(?:-\s*)?([^#]*)(?:#\s*(\w+))?`)
+	// Matches the location keys of a YAML diagnostic block.
+	tapFilePattern = regexp.MustCompile(`^\s*(?:file|at):\s*(.+)$`)
+	tapLinePattern = regexp.MustCompile(`^\s*line:\s*(\d+)`)
+)
+
+// ParseTAP reads a Test Anything Protocol report.
+func ParseTAP(data []byte) (*Report, error) {
+	report := &Report{}
+	var current *TestResult
+	inDiagnostics := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+
+		// YAML diagnostics following a failed test
+		if current != nil && trimmed == "---" {
+			inDiagnostics = true
+			continue
+		}
+		if inDiagnostics {
+			if trimmed == "..." {
+				inDiagnostics = false
+				continue
+			}
+			if match := tapFilePattern.FindStringSubmatch(line); match != nil {
+				value := strings.Trim(strings.TrimSpace(match[1]), `'"`)
+				if file, line := findLocation(value); len(file) > 0 {
+					current.File, current.Line = file, line
+				} else {
+					current.File = value
+				}
+			} else if match := tapLinePattern.FindStringSubmatch(line); match != nil {
+				current.Line, _ = strconv.Atoi(match[1])
+			} else {
+				current.Message = strings.TrimSpace(current.Message + "\n" + trimmed)
+			}
+			continue
+		}
+
+		match := tapTestPattern.FindStringSubmatch(trimmed)
+		if match == nil {
+			continue
+		}
+		current = &TestResult{
+			Name:   strings.TrimSpace(match[3]),
+			Status: STATUS_PASSED,
+		}
+		if len(current.Name) == 0 {
+			current.Name = "test " + match[2]
+		}
+		directive := strings.ToUpper(match[4])
+		switch {
+		case directive == "SKIP" || directive == "TODO":
+			current.Status = STATUS_SKIPPED
+		case match[1] == "not ok":
+			current.Status = STATUS_FAILED
+		}
+		report.Results = append(report.Results, current)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
@@ -2,10 +2,11 @@ package checks
 
 import (
 	"fmt"
-	"os"
+	"path"
 
 	"github.com/google/go-github/v50/github"
 	"github.com/jahagaley/phantom/utils"
+	"github.com/jahagaley/phantom/utils/settings"
 	"github.com/jahagaley/phantomcli/cloud/gcp"
 	"github.com/jahagaley/phantomcli/config"
 	"github.com/jedib0t/go-pretty/v6/table"
@@ -13,10 +14,12 @@ import (
 )
 
 func ValidateEnvironmentResources(githubClient *github.Client, checkParams *CheckParams) ([]*CheckParams, error) {
-	// Creating Github Check
-	err := CreateCheckRun(githubClient, checkParams)
-	if err != nil {
-		return nil, err
+	// Retried checks already have a check run
+	if checkParams.CheckRunID == 0 {
+		err := CreateCheckRun(githubClient, checkParams)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return ValidateEnvironmentResourcesWithCheck(githubClient, checkParams)
@@ -34,32 +37,17 @@ func ValidateEnvironmentResourcesWithCheck(githubClient *github.Client, checkPar
 	)
 
 	// Download repo contents
-	tempDir, err := utils.HandleGithubRepoDownload(githubClient, owner, repo, headSHA)
+	tempDir, release, err := utils.HandleGithubRepoDownload(githubClient, owner, repo, headSHA)
 	if err != nil {
-		UpdateCheckRunCompletion(
-			githubClient,
-			checkParams,
-			CONCLUSION_FAILURE,
-			"Unable to download the the contents of commit to check resources",
-			nil,
-		)
-		os.RemoveAll(tempDir)
-		return nil, err
+		return nil, failCheck(fmt.Sprintf("Unable to download the contents of the commit to check resources: %v", err), err)
 	}
-	defer os.RemoveAll(tempDir)
+	defer release()
 
-	// Get the config file from the repo
-	cfg, err := config.GetConfigFromPath(tempDir)
+	// Get the config file defining the check from the repo
+	configDir := path.Join(tempDir, checkParams.ConfigPath())
+	cfg, err := config.GetConfigFromPath(configDir)
 	if err != nil {
-		// Updating Check Run on completion
-		UpdateCheckRunCompletion(
-			githubClient,
-			checkParams,
-			CONCLUSION_FAILURE,
-			"Unable to get 'phantom.yaml' file for testing image.",
-			nil,
-		)
-		return nil, err
+		return nil, failCheck("Unable to get 'phantom.yaml' file for testing image.", err)
 	}
 
 	// Get the test
@@ -71,50 +59,28 @@ func ValidateEnvironmentResourcesWithCheck(githubClient *github.Client, checkPar
 	env := cfg.GetDeployEnvironment(environment)
 	if env == nil {
 		err = fmt.Errorf("Unable to get environment with name '%s", environment)
-
-		UpdateCheckRunCompletion(
-			githubClient,
-			checkParams,
-			CONCLUSION_FAILURE,
-			err.Error(),
-			nil,
-		)
-		return nil, err
+		return nil, failCheck(err.Error(), err)
 	}
 	log.Info().Msg(fmt.Sprintf("Running resource validation for '%s'", environment))
 
 	// Get IAM access token.
 	token, err := GetAuthAccessToken()
 	if err != nil {
-		UpdateCheckRunCompletion(
-			githubClient,
-			checkParams,
-			CONCLUSION_FAILURE,
-			"Failed to get access token to connect with your cloud.",
-			nil,
-		)
-		return nil, err
+		return nil, failCheck("Failed to get access token to connect with your cloud.", err)
 	}
 
 	// TODO - pull this from a DB
 	provider := gcp.Provider{
 		IAMToken:         token,
-		Project:          "jahagaley",
-		ArtifactRegistry: "us-docker.pkg.dev/jahagaley/phantom",
+		Project:          settings.Get().Project,
+		ArtifactRegistry: settings.Get().ArtifactRegistry,
 	}
 
 	// Get the status of the resources.
 	cloudManager := gcp.NewGoogleCloudManager(provider, &cfg)
 	statuses, err := cloudManager.GetStatus(env)
 	if err != nil {
-		UpdateCheckRunCompletion(
-			githubClient,
-			checkParams,
-			CONCLUSION_FAILURE,
-			"Failed to get status of cloud resources.",
-			nil,
-		)
-		return nil, err
+		return nil, failCheck("Failed to get status of cloud resources.", err)
 	}
 
 	// generate output for checks
@@ -131,7 +97,7 @@ func ValidateEnvironmentResourcesWithCheck(githubClient *github.Client, checkPar
 	outputMarkDown := t.RenderMarkdown()
 
 	// Updating Check Run on completion
-	UpdateCheckRunCompletionWithOutput(
+	ConcludeCheckRun(
 		githubClient,
 		checkParams,
 		CONCLUSION_SUCCESS,
@@ -0,0 +1,184 @@
+package checks
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/go-github/v50/github"
+	"github.com/jahagaley/phantomcli/config"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// Checks waiting on some of their parents look for their conclusions at
+	// this interval, and are skipped once they waited for longer than
+	// MAX_PARENTS_WAIT.
+	PARENTS_POLL_INTERVAL = 30 * time.Second
+	MAX_PARENTS_WAIT      = 6 * time.Hour
+)
+
+// ScheduleRoots returns the checks of the config in the configPath directory
+// that don't depend on any other check.
+func ScheduleRoots(checkParams *CheckParams, cfg *config.PhantomConfig, configPath string) []*CheckParams {
+	var output []*CheckParams
+	for _, node := range NewCheckGraph(cfg, configPath).Roots() {
+		output = append(output, checkParams.NewChildCheck(node.Type, node.Name, node.Options))
+	}
+	return output
+}
+
+// ScheduleChildren returns the checks to queue now that the given check has
+// concluded. Checks that can no longer run because it didn't succeed are
+// concluded as skipped.
+func ScheduleChildren(
+	githubClient *github.Client,
+	checkParams *CheckParams,
+	cfg *config.PhantomConfig,
+	conclusion string,
+) ([]*CheckParams, error) {
+	return scheduleChildren(githubClient, checkParams, NewCheckGraph(cfg, checkParams.ConfigPath()), conclusion), nil
+}
+
+// scheduleChildren queues the children of the check it owns, the ones of
+// which it is the first parent, so every check is queued exactly once. The
+// children record the conclusion of the check, and wait in the queue for the
+// conclusions of their other parents.
+func scheduleChildren(
+	githubClient *github.Client,
+	checkParams *CheckParams,
+	graph *CheckGraph,
+	conclusion string,
+) []*CheckParams {
+	var output []*CheckParams
+	skipped := make(map[string]bool)
+	for _, child := range graph.OwnedChildren(checkParams.Name) {
+		if conclusion != CONCLUSION_SUCCESS {
+			skipCheck(githubClient, checkParams, graph, child, fmt.Sprintf("'%s' concluded with '%s'", checkParams.Name, conclusion), skipped)
+			continue
+		}
+
+		childCheck := checkParams.NewChildCheck(child.Type, child.Name, child.Options)
+		if len(child.Parents) > 1 {
+			childCheck.ParentConclusions = make(map[string]string)
+			for _, parent := range child.Parents {
+				childCheck.ParentConclusions[parent] = ""
+			}
+			childCheck.ParentConclusions[checkParams.Name] = conclusion
+			childCheck.ParentsScheduledAt = time.Now()
+		}
+		output = append(output, childCheck)
+	}
+	return output
+}
+
+// PendingParents returns the parents of the check that haven't concluded yet,
+// as far as it knows.
+func PendingParents(checkParams *CheckParams) []string {
+	var pending []string
+	for parent, conclusion := range checkParams.ParentConclusions {
+		if len(conclusion) == 0 {
+			pending = append(pending, parent)
+		}
+	}
+	sort.Strings(pending)
+	return pending
+}
+
+// AwaitParents looks for the conclusions of the parents the check is waiting
+// on. The check is returned to be queued again, either to wait a little
+// longer, or to run once they all succeeded. Checks with a parent that didn't
+// succeed, or that waited for too long, are concluded as skipped instead.
+func AwaitParents(githubClient *github.Client, checkParams *CheckParams) ([]*CheckParams, error) {
+	checkRuns, err := ListLatestCheckRuns(githubClient, checkParams)
+	if err != nil {
+		return nil, err
+	}
+
+	waiting := *checkParams
+	waiting.ParentConclusions = make(map[string]string)
+	for parent, conclusion := range checkParams.ParentConclusions {
+		if run, ok := checkRuns[parent]; ok && len(conclusion) == 0 && run.GetStatus() == STATUS_COMPLETED {
+			conclusion = run.GetConclusion()
+		}
+		waiting.ParentConclusions[parent] = conclusion
+	}
+
+	reason := failedParent(&waiting)
+	pending := PendingParents(&waiting)
+	if len(reason) == 0 && len(pending) > 0 && time.Since(waiting.ParentsScheduledAt) > MAX_PARENTS_WAIT {
+		reason = fmt.Sprintf("'%s' didn't conclude within %s", pending[0], MAX_PARENTS_WAIT)
+	}
+	if len(reason) > 0 {
+		concludeSkipped(githubClient, checkParams, reason)
+		return nil, nil
+	}
+
+	if len(pending) > 0 {
+		log.Debug().Msg(fmt.Sprintf("Check '%s' is waiting on %v", checkParams.Name, pending))
+		waiting.NotBefore = time.Now().Add(PARENTS_POLL_INTERVAL)
+	} else {
+		waiting.NotBefore = time.Time{}
+	}
+	return []*CheckParams{&waiting}, nil
+}
+
+// failedParent returns the reason the check can't run if one of its parents
+// concluded without succeeding.
+func failedParent(checkParams *CheckParams) string {
+	parents := make([]string, 0, len(checkParams.ParentConclusions))
+	for parent := range checkParams.ParentConclusions {
+		parents = append(parents, parent)
+	}
+	sort.Strings(parents)
+
+	for _, parent := range parents {
+		conclusion := checkParams.ParentConclusions[parent]
+		if len(conclusion) > 0 && conclusion != CONCLUSION_SUCCESS {
+			return fmt.Sprintf("'%s' concluded with '%s'", parent, conclusion)
+		}
+	}
+	return ""
+}
+
+// skipCheck concludes the check and the checks it owns as skipped. The
+// checks it doesn't own see it was skipped while waiting on it.
+func skipCheck(
+	githubClient *github.Client,
+	checkParams *CheckParams,
+	graph *CheckGraph,
+	node *CheckNode,
+	reason string,
+	skipped map[string]bool,
+) {
+	if skipped[node.Name] {
+		return
+	}
+	skipped[node.Name] = true
+
+	concludeSkipped(githubClient, checkParams.NewChildCheck(node.Type, node.Name, node.Options), reason)
+	for _, child := range graph.OwnedChildren(node.Name) {
+		skipCheck(githubClient, checkParams, graph, child, fmt.Sprintf("'%s' was skipped", node.Name), skipped)
+	}
+}
+
+// concludeSkipped creates the check run of a check that won't run, concluded
+// as skipped.
+func concludeSkipped(githubClient *github.Client, checkParams *CheckParams, reason string) {
+	var err error
+	if checkParams.CheckRunID == 0 {
+		err = CreateCheckRun(githubClient, checkParams)
+	}
+	if err == nil {
+		err = UpdateCheckRunCompletion(
+			githubClient,
+			checkParams,
+			CONCLUSION_SKIPPED,
+			fmt.Sprintf("Skipped because %s.", reason),
+			nil,
+		)
+	}
+	if err != nil {
+		log.Warn().Err(err).Msg(fmt.Sprintf("Unable to mark check '%s' as skipped.", checkParams.Name))
+	}
+}
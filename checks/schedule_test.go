@@ -0,0 +1,161 @@
+package checks
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v50/github"
+)
+
+// fakeCheckRuns serves the check runs of a commit, and records the
+// conclusions of the check runs created by the checks.
+type fakeCheckRuns struct {
+	runs        []*github.CheckRun
+	conclusions map[int64]string
+	branchHeads map[string]string
+}
+
+func newFakeCheckRuns(t *testing.T, runs ...*github.CheckRun) (*fakeCheckRuns, *github.Client) {
+	t.Helper()
+
+	fake := &fakeCheckRuns{runs: runs, conclusions: make(map[int64]string), branchHeads: make(map[string]string)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/owner/repo/branches/", func(w http.ResponseWriter, r *http.Request) {
+		sha := fake.branchHeads[path.Base(r.URL.Path)]
+		json.NewEncoder(w).Encode(&github.Branch{Commit: &github.RepositoryCommit{SHA: github.String(sha)}})
+	})
+	mux.HandleFunc("/repos/owner/repo/commits/sha/check-runs", func(w http.ResponseWriter, r *http.Request) {
+		result := &github.ListCheckRunsResults{}
+		for _, run := range fake.runs {
+			if status := r.URL.Query().Get("status"); len(status) == 0 || run.GetStatus() == status {
+				result.CheckRuns = append(result.CheckRuns, run)
+			}
+		}
+		result.Total = github.Int(len(result.CheckRuns))
+		json.NewEncoder(w).Encode(result)
+	})
+	mux.HandleFunc("/repos/owner/repo/check-runs", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&github.CheckRun{ID: github.Int64(int64(len(fake.conclusions) + 100))})
+	})
+	mux.HandleFunc("/repos/owner/repo/check-runs/", func(w http.ResponseWriter, r *http.Request) {
+		id, _ := strconv.ParseInt(path.Base(r.URL.Path), 10, 64)
+		if r.Method == http.MethodPatch {
+			var opts github.UpdateCheckRunOptions
+			json.NewDecoder(r.Body).Decode(&opts)
+			fake.conclusions[id] = opts.GetConclusion()
+		}
+		run := &github.CheckRun{ID: github.Int64(id), Status: github.String(STATUS_IN_PROGRESS)}
+		if len(fake.conclusions[id]) > 0 {
+			run.Status, run.Conclusion = github.String(STATUS_COMPLETED), github.String(fake.conclusions[id])
+		}
+		json.NewEncoder(w).Encode(run)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	client := github.NewClient(srv.Client())
+	client.BaseURL, _ = url.Parse(srv.URL + "/")
+	return fake, client
+}
+
+func completedRun(name, conclusion string) *github.CheckRun {
+	return &github.CheckRun{
+		Name:       github.String(name),
+		Status:     github.String(STATUS_COMPLETED),
+		Conclusion: github.String(conclusion),
+		StartedAt:  &github.Timestamp{Time: time.Now()},
+	}
+}
+
+func TestScheduleChildren(t *testing.T) {
+	graph := &CheckGraph{nodes: make(map[string]*CheckNode), children: make(map[string][]string)}
+	graph.add(&CheckNode{Type: PHANTOM_TEST_IMAGE, Name: "unit"})
+	graph.add(&CheckNode{Type: PHANTOM_TEST_IMAGE, Name: "e2e"})
+	graph.add(&CheckNode{Type: PHANTOM_RESOURCE_VALIDATION, Name: "production", Parents: []string{"unit", "e2e"}})
+
+	unit := &CheckParams{Name: "unit", Owner: "owner", Repo: "repo", HeadSHA: "sha"}
+	children := scheduleChildren(nil, unit, graph, CONCLUSION_SUCCESS)
+	if len(children) != 1 || children[0].Name != "production" {
+		t.Fatalf("scheduleChildren(unit) = %v, want the production validation", children)
+	}
+	want := map[string]string{"unit": CONCLUSION_SUCCESS, "e2e": ""}
+	if !reflect.DeepEqual(children[0].ParentConclusions, want) {
+		t.Errorf("ParentConclusions = %v, want %v", children[0].ParentConclusions, want)
+	}
+	if got := PendingParents(children[0]); !reflect.DeepEqual(got, []string{"e2e"}) {
+		t.Errorf("PendingParents() = %v, want [e2e]", got)
+	}
+
+	// Only the first parent schedules the check
+	e2e := &CheckParams{Name: "e2e", Owner: "owner", Repo: "repo", HeadSHA: "sha"}
+	if children := scheduleChildren(nil, e2e, graph, CONCLUSION_SUCCESS); len(children) != 0 {
+		t.Errorf("scheduleChildren(e2e) = %v, want none", children)
+	}
+	if children := scheduleChildren(nil, e2e, graph, CONCLUSION_FAILURE); len(children) != 0 {
+		t.Errorf("scheduleChildren(e2e) = %v, want none", children)
+	}
+}
+
+func TestAwaitParents(t *testing.T) {
+	waiting := func(scheduledAt time.Time) *CheckParams {
+		return &CheckParams{
+			Type:               PHANTOM_RESOURCE_VALIDATION,
+			Name:               "production",
+			Owner:              "owner",
+			Repo:               "repo",
+			HeadSHA:            "sha",
+			ParentConclusions:  map[string]string{"unit": CONCLUSION_SUCCESS, "e2e": ""},
+			ParentsScheduledAt: scheduledAt,
+		}
+	}
+
+	tests := []struct {
+		name        string
+		runs        []*github.CheckRun
+		scheduledAt time.Time
+		wantQueued  bool
+		wantPending bool
+		wantSkipped bool
+	}{
+		{"parent running", []*github.CheckRun{{Name: github.String("e2e"), Status: github.String(STATUS_IN_PROGRESS)}}, time.Now(), true, true, false},
+		{"parent not started", nil, time.Now(), true, true, false},
+		{"parent succeeded", []*github.CheckRun{completedRun("e2e", CONCLUSION_SUCCESS)}, time.Now(), true, false, false},
+		{"parent failed", []*github.CheckRun{completedRun("e2e", CONCLUSION_FAILURE)}, time.Now(), false, false, true},
+		{"parent never concluded", nil, time.Now().Add(-MAX_PARENTS_WAIT - time.Minute), false, false, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake, client := newFakeCheckRuns(t, test.runs...)
+			output, err := AwaitParents(client, waiting(test.scheduledAt))
+			if err != nil {
+				t.Fatalf("AwaitParents() error = %v", err)
+			}
+
+			if !test.wantQueued {
+				if len(output) != 0 {
+					t.Errorf("AwaitParents() = %v, want nothing queued", output)
+				}
+			} else if len(output) != 1 {
+				t.Fatalf("AwaitParents() = %v, want the check queued again", output)
+			} else {
+				pending := len(PendingParents(output[0])) > 0
+				if pending != test.wantPending || pending != output[0].NotBefore.After(time.Now()) {
+					t.Errorf("AwaitParents() = pending %v until %s, want pending %v", pending, output[0].NotBefore, test.wantPending)
+				}
+			}
+
+			skipped := len(fake.conclusions) == 1 && fake.conclusions[100] == CONCLUSION_SKIPPED
+			if skipped != test.wantSkipped {
+				t.Errorf("check skipped = %v (%v), want %v", skipped, fake.conclusions, test.wantSkipped)
+			}
+		})
+	}
+}
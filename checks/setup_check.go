@@ -3,8 +3,9 @@ package checks
 import (
 	"errors"
 	"fmt"
-	"os"
+	"io/fs"
 	"path"
+	"strings"
 
 	"github.com/google/go-github/v50/github"
 	"github.com/jahagaley/phantom/utils"
@@ -19,11 +20,31 @@ func Setup(githubClient *github.Client, checkParams *CheckParams) ([]*CheckParam
 	repo := checkParams.Repo
 	headSHA := checkParams.HeadSHA
 
-	// Creating Github Check
-	err := CreateCheckRun(githubClient, checkParams)
-	if err != nil {
-		log.Error().Err(err).Send()
-		return nil, err
+	// Retried checks already have a check run
+	if checkParams.CheckRunID == 0 {
+		err := CreateCheckRun(githubClient, checkParams)
+		if err != nil {
+			log.Error().Err(err).Send()
+			return nil, err
+		}
+	}
+
+	// Pull requests from untrusted forks don't get any builds until a
+	// maintainer re-runs this check.
+	if checkParams.Gated {
+		ConcludeCheckRun(
+			githubClient,
+			checkParams,
+			CONCLUSION_NEUTRAL,
+			fmt.Sprintf(
+				"Pull request #%d comes from a fork, builds need to be approved. A maintainer can approve them by re-running this check.",
+				checkParams.PullRequestNumber,
+			),
+			"",
+			nil,
+		)
+		log.Info().Msg(fmt.Sprintf("Gated Setup check for fork pull request #%d.", checkParams.PullRequestNumber))
+		return nil, nil
 	}
 
 	// update Check to in progress
@@ -34,100 +55,100 @@ func Setup(githubClient *github.Client, checkParams *CheckParams) ([]*CheckParam
 		"Running setup check.",
 	)
 
-	// Check to see if any 'phantom.yaml' files exist
-	tempDir, err := utils.HandleGithubRepoDownload(githubClient, owner, repo, headSHA)
+	// Only the 'phantom.yaml' files are fetched, the whole repository is only
+	// downloaded when they can't be listed or refer to other files.
+	tempDir, release, sparse, err := utils.HandleGithubFilesOrRepoDownload(githubClient, owner, repo, headSHA, isConfigFile)
 	if err != nil {
-		UpdateCheckRunCompletion(
-			githubClient,
-			checkParams,
-			CONCLUSION_FAILURE,
-			fmt.Sprintf("Failed to download files from your repository: %v", err),
-			nil,
-		)
-		os.RemoveAll(tempDir)
-		return nil, err
+		return nil, failCheck(fmt.Sprintf("Failed to download files from your repository: %v", err), err)
 	}
-	defer os.RemoveAll(tempDir)
+	defer func() { release() }()
 
-	// TODO: support mono repos and multiple config files.
-	if _, err := os.Stat(path.Join(tempDir, "phantom.yaml")); errors.Is(err, os.ErrNotExist) {
+	// Check to see if any 'phantom.yaml' files exist
+	configPaths, err := FindConfigPaths(tempDir)
+	if err != nil {
+		return nil, failCheck("Unable to look for 'phantom.yaml' files in your repository.", err)
+	}
+	if len(configPaths) == 0 {
 		// Updating Check Run on completion
-		UpdateCheckRunCompletion(
+		ConcludeCheckRun(
 			githubClient,
 			checkParams,
 			CONCLUSION_SUCCESS,
 			"No 'phantom.yaml' file detected.",
+			"",
 			nil,
 		)
 		log.Info().Msg("No 'phantom.yaml' file detected.")
-		return nil, err
+		return nil, nil
 	}
 
-	cfg, err := config.GetConfigFromPath(tempDir)
+	// Only the configs affected by the changes of the commit are checked
+	changedFiles, known, err := GetChangedFiles(githubClient, checkParams)
 	if err != nil {
-		// Updating Check Run on completion
-		UpdateCheckRunCompletion(
-			githubClient,
-			checkParams,
-			CONCLUSION_FAILURE,
-			"Unable to load your 'phantom.yaml' file.",
-			nil,
-		)
-		log.Warn().Msg("Unable to load your 'phantom.yaml' file.")
-		return nil, err
+		log.Warn().Err(err).Msg("Unable to get the files changed by the commit, checking every 'phantom.yaml' file.")
 	}
 
-	// Get follow up checks
 	var output []*CheckParams
-
-	// Check if any builds need to be done.
-	for _, b := range cfg.Builds {
-		newCheck := &CheckParams{
-			Type:           PHANTOM_BUILD_IMAGE,
-			Name:           fmt.Sprintf(PHANTOM_BUILD_IMAGE_PATTERN, b.Name),
-			Owner:          checkParams.Owner,
-			Repo:           checkParams.Repo,
-			HeadSHA:        checkParams.HeadSHA,
-			Branch:         checkParams.Branch,
-			DefaultBranch:  checkParams.DefaultBranch,
-			InstallationID: checkParams.InstallationID,
-			RepoID:         checkParams.RepoID,
-			Options: map[string]string{
-				"name": b.Name,
-			},
+	var summary strings.Builder
+	summary.WriteString("Setup complete.\n")
+	for _, configPath := range configPaths {
+		configFile := path.Join(configPath, CONFIG_FILE)
+		configDir := path.Join(tempDir, configPath)
+
+		cfg, err := config.GetConfigFromPath(configDir)
+		if err != nil && sparse && errors.Is(err, fs.ErrNotExist) {
+			// The config refers to files that weren't fetched
+			log.Info().Msg(fmt.Sprintf("'%s' refers to other files, downloading the repository.", configFile))
+			release()
+			sparse = false
+			tempDir, release, err = utils.HandleGithubRepoDownload(githubClient, owner, repo, headSHA)
+			if err != nil {
+				release = func() {}
+				return nil, failCheck(fmt.Sprintf("Failed to download files from your repository: %v", err), err)
+			}
+			configDir = path.Join(tempDir, configPath)
+			cfg, err = config.GetConfigFromPath(configDir)
+		}
+		if err != nil {
+			log.Warn().Msg(fmt.Sprintf("Unable to load your '%s' file.", configFile))
+			return nil, failCheck(fmt.Sprintf("Unable to load your '%s' file.", configFile), err)
 		}
 
-		output = append(output, newCheck)
-	}
+		if err := ValidateConfig(&cfg); err != nil {
+			return nil, failCheck(fmt.Sprintf("Invalid '%s' file: %v", configFile, err), err)
+		}
 
-	// Validate resources for each environment
-	for _, e := range cfg.Environments {
-		newCheck := &CheckParams{
-			Type:           PHANTOM_RESOURCE_VALIDATION,
-			Name:           fmt.Sprintf(PHANTOM_RESOURCE_VALIDATION_PATTERN, e.Environment),
-			Owner:          checkParams.Owner,
-			Repo:           checkParams.Repo,
-			HeadSHA:        checkParams.HeadSHA,
-			Branch:         checkParams.Branch,
-			DefaultBranch:  checkParams.DefaultBranch,
-			InstallationID: checkParams.InstallationID,
-			RepoID:         checkParams.RepoID,
-			Options: map[string]string{
-				"name": e.Environment,
-			},
+		if known {
+			triggerPaths, err := GetConfigTriggerPaths(configDir)
+			if err != nil {
+				log.Warn().Err(err).Msg(fmt.Sprintf("Unable to read the paths of '%s'.", configFile))
+			}
+			if !IsConfigAffected(configPath, triggerPaths, changedFiles) {
+				summary.WriteString(fmt.Sprintf("\n- `%s`: not affected by this commit.", configFile))
+				continue
+			}
 		}
 
-		output = append(output, newCheck)
+		// Start the checks that don't depend on any other check, the rest are
+		// scheduled as their parents conclude.
+		output = append(output, ScheduleRoots(checkParams, &cfg, configPath)...)
+		summary.WriteString(fmt.Sprintf("\n- `%s`: checks scheduled.", configFile))
 	}
 
 	// Updating Check Run on completion
-	UpdateCheckRunCompletion(
+	ConcludeCheckRun(
 		githubClient,
 		checkParams,
 		CONCLUSION_SUCCESS,
-		"Setup complete.",
+		summary.String(),
+		"",
 		nil,
 	)
 
 	return output, nil
 }
+
+// isConfigFile reports whether the repository file is a 'phantom.yaml' file.
+func isConfigFile(filePath string) bool {
+	return path.Base(filePath) == CONFIG_FILE
+}
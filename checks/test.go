@@ -3,8 +3,7 @@ package checks
 import (
 	"context"
 	"fmt"
-	"net/http"
-	"os"
+	"path"
 	"strings"
 	"time"
 
@@ -13,8 +12,9 @@ import (
 	apipb "github.com/jahagaley/phantomapi/phantom/api/v1"
 	api "github.com/jahagaley/phantomapi/phantom/api/v1/v1connect"
 
-	. "github.com/jahagaley/phantom/checks/utils"
+	"github.com/jahagaley/phantom/services"
 	"github.com/jahagaley/phantom/utils"
+	"github.com/jahagaley/phantom/utils/tracing"
 	"github.com/jahagaley/phantomcli/config"
 	"github.com/rs/zerolog/log"
 )
@@ -23,17 +23,19 @@ const (
 	TEST_ID_PATTERN = "test-%d-%s"
 )
 
-func TestDockerImage(githubClient *github.Client, checkParams *CheckParams) ([]*CheckParams, error) {
-	// Creating Github Check
-	err := CreateCheckRun(githubClient, checkParams)
-	if err != nil {
-		return nil, err
+func TestDockerImage(ctx context.Context, githubClient *github.Client, checkParams *CheckParams) ([]*CheckParams, error) {
+	// Resumed checks already have a check run
+	if checkParams.CheckRunID == 0 {
+		err := CreateCheckRun(githubClient, checkParams)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return TestDockerImageWithCheck(githubClient, checkParams)
+	return TestDockerImageWithCheck(ctx, githubClient, checkParams)
 }
 
-func TestDockerImageWithCheck(githubClient *github.Client, checkParams *CheckParams) ([]*CheckParams, error) {
+func TestDockerImageWithCheck(ctx context.Context, githubClient *github.Client, checkParams *CheckParams) ([]*CheckParams, error) {
 
 	owner, repo, headSHA := checkParams.Owner, checkParams.Repo, checkParams.HeadSHA
 	// update Check to in progress
@@ -45,32 +47,17 @@ func TestDockerImageWithCheck(githubClient *github.Client, checkParams *CheckPar
 	)
 
 	// Download repo contents
-	tempDir, err := utils.HandleGithubRepoDownload(githubClient, owner, repo, headSHA)
+	tempDir, release, err := utils.HandleGithubRepoDownload(githubClient, owner, repo, headSHA)
 	if err != nil {
-		UpdateCheckRunCompletion(
-			githubClient,
-			checkParams,
-			CONCLUSION_FAILURE,
-			"Unable to download the the contents of commit to run tests.",
-			nil,
-		)
-		os.RemoveAll(tempDir)
-		return nil, err
+		return nil, failCheck(fmt.Sprintf("Unable to download the contents of the commit to run tests: %v", err), err)
 	}
-	defer os.RemoveAll(tempDir)
+	defer release()
 
-	// Get the config file from the repo
-	cfg, err := config.GetConfigFromPath(tempDir)
+	// Get the config file defining the check from the repo
+	configDir := path.Join(tempDir, checkParams.ConfigPath())
+	cfg, err := config.GetConfigFromPath(configDir)
 	if err != nil {
-		// Updating Check Run on completion
-		UpdateCheckRunCompletion(
-			githubClient,
-			checkParams,
-			CONCLUSION_FAILURE,
-			"Unable to get 'phantom.yaml' file for testing image.",
-			nil,
-		)
-		return nil, err
+		return nil, failCheck("Unable to get 'phantom.yaml' file for testing image.", err)
 	}
 
 	// Get the test
@@ -82,14 +69,7 @@ func TestDockerImageWithCheck(githubClient *github.Client, checkParams *CheckPar
 	test := cfg.GetTest(testName)
 	if test == nil {
 		err = fmt.Errorf("Unable to get test with name '%s", testName)
-		UpdateCheckRunCompletion(
-			githubClient,
-			checkParams,
-			CONCLUSION_FAILURE,
-			err.Error(),
-			nil,
-		)
-		return nil, err
+		return nil, failCheck(err.Error(), err)
 	}
 	log.Info().Msg(fmt.Sprintf("Running test for '%s'", testName))
 
@@ -97,56 +77,99 @@ func TestDockerImageWithCheck(githubClient *github.Client, checkParams *CheckPar
 	build := cfg.GetBuild(test.Build)
 	if build == nil {
 		err = fmt.Errorf("Unable to get build '%s' used by test '%s'", test.Build, test.Name)
-		UpdateCheckRunCompletion(
-			githubClient,
-			checkParams,
-			CONCLUSION_FAILURE,
-			err.Error(),
-			nil,
-		)
-		return nil, err
+		return nil, failCheck(err.Error(), err)
+	}
+
+	timeout, err := GetCheckTimeout(configDir, PHANTOM_TEST_IMAGE, testName)
+	if err != nil {
+		return nil, failCheck(err.Error(), err)
 	}
 
-	status, err := executeTest(githubClient, checkParams, test)
+	status, logs, err := executeTest(ctx, githubClient, checkParams, test, timeout)
 	if err != nil {
-		UpdateCheckRunCompletion(
+		// Checks interrupted by a shutdown are run again by another worker
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		return nil, failCheck("Unable to complete test execution.", err)
+	}
+
+	// Check runs cancelled by a newer push while the test ran are left as is.
+	if !IsCheckRunCompleted(githubClient, checkParams) {
+		summary := fmt.Sprintf("Test execution completed with status '%s'.", status)
+
+		// Add the results of the test reports saved by the execution
+		var annotations []*github.CheckRunAnnotation
+		report, err := FetchTestReport(ctx, checkParams.ExecutionName)
+		if err != nil {
+			log.Warn().Err(err).Msg("Unable to fetch test reports")
+		} else if report != nil {
+			summary = fmt.Sprintf("%s\n\n%s", summary, TestReportSummary(report))
+			annotations = TestReportAnnotations(report, tempDir)
+		}
+
+		UpdateCheckRunCompletionWithOutput(
 			githubClient,
 			checkParams,
-			CONCLUSION_FAILURE,
-			"Unable to complete test execution.",
-			nil,
+			status,
+			summary,
+			logs.Output(MAX_CHECK_OUTPUT_LENGTH),
+			annotations,
 		)
-		return nil, err
 	}
 
-	// Updating Check Run on completion
-	UpdateCheckRunCompletion(
-		githubClient,
-		checkParams,
-		status,
-		fmt.Sprintf("Test execution completed with status '%s'.", status),
-		nil,
-	)
+	// Schedule the checks waiting on this test
+	return ScheduleChildren(githubClient, checkParams, &cfg, status)
+}
+
+func executeTest(ctx context.Context, githubClient *github.Client, checkParams *CheckParams, test *config.PhantomTest, timeout time.Duration) (string, *ExecutionLogs, error) {
+	// Resumed checks keep waiting on the execution they already started
+	if len(checkParams.ExecutionName) == 0 {
+		err := createTestExecution(ctx, githubClient, checkParams, test)
+		if err != nil {
+			return "", nil, err
+		}
+		checkParams.ExecutionDeadline = time.Now().Add(timeout)
+
+		// Link the check run to the execution so it can be cancelled
+		err = UpdateCheckRunExecution(githubClient, checkParams)
+		if err != nil {
+			log.Warn().Err(err).Msg("Unable to link check run to execution")
+		}
+	}
 
-	return nil, err
+	// Show the logs on the check run while waiting on the execution, holding
+	// the check run so the reapers of other instances leave it alone
+	stopHolding := HoldCheckRun(githubClient, checkParams)
+	logs := NewExecutionLogs(checkParams.ExecutionName)
+	stopStreaming := logs.Stream(githubClient, checkParams, "Running Docker tests for images.")
+	status, err := WatchExecution(ctx, checkParams)
+	stopStreaming()
+	stopHolding()
+	if err != nil {
+		return "", nil, err
+	}
+
+	if _, err := logs.Fetch(ctx); err != nil {
+		log.Warn().Err(err).Msg("Unable to fetch execution logs")
+	}
+	return status, logs, nil
 }
 
-func executeTest(githubClient *github.Client, checkParams *CheckParams, test *config.PhantomTest) (string, error) {
-	// Create a client
-	ctx := context.Background()
+func createTestExecution(ctx context.Context, githubClient *github.Client, checkParams *CheckParams, test *config.PhantomTest) error {
 	log.Info().Msg("Starting Docker Test Execution")
 
 	// Create ConnectRPC Client
-	gitClient := api.NewGitServiceClient(http.DefaultClient, utils.API_URL)
+	gitClient := api.NewGitServiceClient(tracing.HTTPClient, utils.API_URL)
 
 	// Get the installation from the GitService
 	getInstallationRequest := &apipb.GetInstallationRequest{
-		Name: fmt.Sprintf("projects/-/installations/%d", checkParams.InstallationID),
+		Name: services.InstallationName("-", checkParams.Host, checkParams.InstallationID),
 	}
 	installationRes, err := gitClient.GetInstallation(ctx, connect.NewRequest(getInstallationRequest))
 	if err != nil {
 		log.Err(err).Msg("Error getting installation, missing installation cannot be created")
-		return "", err
+		return err
 	}
 
 	// TODO - clean up this code
@@ -154,8 +177,8 @@ func executeTest(githubClient *github.Client, checkParams *CheckParams, test *co
 	project := strings.Split(installationRes.Msg.GetName(), "/")[1]
 
 	// Build and Test Id
-	buildId := fmt.Sprintf(BUILD_ID_PATTERN, checkParams.RepoID, test.Build)
-	testId := fmt.Sprintf(TEST_ID_PATTERN, checkParams.RepoID, test.Name)
+	buildId := fmt.Sprintf(BUILD_ID_PATTERN, checkParams.RepoID, configResourceID(checkParams.ConfigPath(), test.Build))
+	testId := fmt.Sprintf(TEST_ID_PATTERN, checkParams.RepoID, configResourceID(checkParams.ConfigPath(), test.Name))
 
 	// Get the test from the GitService
 	getTestRequest := &apipb.GetTestRequest{
@@ -178,11 +201,11 @@ func executeTest(githubClient *github.Client, checkParams *CheckParams, test *co
 		testRes, err = gitClient.CreateTest(ctx, connect.NewRequest(createTestRequest))
 		if err != nil {
 			log.Err(err).Msg("Error creating test")
-			return "", err
+			return err
 		}
 	} else if err != nil {
 		log.Err(err).Msg("Error getting test")
-		return "", err
+		return err
 	}
 
 	// Create the execution
@@ -202,36 +225,9 @@ func executeTest(githubClient *github.Client, checkParams *CheckParams, test *co
 	executionRes, err := gitClient.CreateExecution(ctx, connect.NewRequest(createExecutionRequest))
 	if err != nil {
 		log.Err(err).Msg("Error creating execution")
-		return "", err
+		return err
 	}
 
-	// In a loop, check the state of the build and sleep if it is not finished
-	for {
-		// Get the execution
-		getExecutionRequest := &apipb.GetExecutionRequest{
-			Name: executionRes.Msg.GetName(),
-		}
-		executionRes, err = gitClient.GetExecution(ctx, connect.NewRequest(getExecutionRequest))
-		if err != nil {
-			log.Err(err).Msg("Error getting execution")
-			return "", err
-		}
-
-		// Check the state of the execution
-		if executionRes.Msg.GetState() == apipb.Execution_STATE_SUCCESS {
-			// Return the status of the execution
-			return CONCLUSION_SUCCESS, nil
-		} else if executionRes.Msg.GetState() == apipb.Execution_STATE_FAILURE {
-			// Return the status of the execution
-			return CONCLUSION_FAILURE, nil
-		} else if executionRes.Msg.GetState() == apipb.Execution_STATE_CANCELLED {
-			// Sleep for 5 seconds
-			return CONCLUSION_CANCELLED, nil
-		} else if executionRes.Msg.GetState() == apipb.Execution_STATE_UNSPECIFIED {
-			return CONCLUSION_FAILURE, nil
-		}
-
-		// Sleep
-		time.Sleep(15 * time.Second)
-	}
+	checkParams.ExecutionName = executionRes.Msg.GetName()
+	return nil
 }
@@ -0,0 +1,205 @@
+package checks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"connectrpc.com/connect"
+	"github.com/google/go-github/v50/github"
+	apipb "github.com/jahagaley/phantomapi/phantom/api/v1"
+	api "github.com/jahagaley/phantomapi/phantom/api/v1/v1connect"
+	"github.com/rs/zerolog/log"
+
+	"github.com/jahagaley/phantom/checks/reports"
+	"github.com/jahagaley/phantom/utils"
+	"github.com/jahagaley/phantom/utils/tracing"
+)
+
+const (
+	// Largest test report file that is downloaded.
+	MAX_TEST_REPORT_SIZE = 20 * 1024 * 1024
+
+	// Number of failed tests listed in the check run summary.
+	MAX_LISTED_FAILURES = 50
+
+	// Longest message shown in an annotation.
+	MAX_ANNOTATION_MESSAGE_LENGTH = 4096
+)
+
+// FetchTestReport downloads and parses the test reports (JUnit XML, Go
+// test2json or TAP) saved as artifacts of the execution. It returns nil if the
+// execution didn't save any.
+func FetchTestReport(ctx context.Context, executionName string) (*reports.Report, error) {
+	gitClient := api.NewGitServiceClient(tracing.HTTPClient, utils.API_URL)
+
+	var report *reports.Report
+	pageToken := ""
+	for {
+		listExecutionArtifactsRequest := &apipb.ListExecutionArtifactsRequest{
+			Parent:    executionName,
+			PageToken: pageToken,
+		}
+		res, err := gitClient.ListExecutionArtifacts(ctx, connect.NewRequest(listExecutionArtifactsRequest))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, artifact := range res.Msg.GetArtifacts() {
+			if !reports.IsReportFile(artifact.GetPath()) {
+				continue
+			}
+
+			artifactReport, err := fetchArtifactReport(ctx, artifact)
+			if errors.Is(err, reports.ErrNoResults) {
+				log.Debug().Msg(fmt.Sprintf("Artifact '%s' has no test results", artifact.GetPath()))
+				continue
+			} else if err != nil {
+				log.Warn().Err(err).Msg(fmt.Sprintf("Unable to read test report '%s'", artifact.GetPath()))
+				continue
+			}
+			if report == nil {
+				report = &reports.Report{}
+			}
+			report.Merge(artifactReport)
+		}
+
+		pageToken = res.Msg.GetNextPageToken()
+		if len(pageToken) == 0 {
+			return report, nil
+		}
+	}
+}
+
+func fetchArtifactReport(ctx context.Context, artifact *apipb.Artifact) (*reports.Report, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, artifact.GetUri(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status downloading artifact: %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, MAX_TEST_REPORT_SIZE+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MAX_TEST_REPORT_SIZE {
+		return nil, fmt.Errorf("Test report is larger than %d bytes.", MAX_TEST_REPORT_SIZE)
+	}
+
+	return reports.Parse(artifact.GetPath(), data)
+}
+
+// TestReportSummary returns the test counts and the failed tests as markdown.
+func TestReportSummary(report *reports.Report) string {
+	passed, failed, skipped := report.Counts()
+	summary := fmt.Sprintf("%d passed, %d failed, %d skipped.", passed, failed, skipped)
+
+	failures := report.Failures()
+	if len(failures) == 0 {
+		return summary
+	}
+
+	var sb strings.Builder
+	sb.WriteString(summary + "\n\nFailed tests:\n")
+	for i, failure := range failures {
+		if i == MAX_LISTED_FAILURES {
+			sb.WriteString(fmt.Sprintf("- and %d more\n", len(failures)-MAX_LISTED_FAILURES))
+			break
+		}
+		name := failure.Name
+		if len(failure.Suite) > 0 {
+			name = failure.Suite + " / " + name
+		}
+		sb.WriteString(fmt.Sprintf("- `%s`\n", name))
+	}
+	return sb.String()
+}
+
+// TestReportAnnotations points at the failed tests whose location is a file of
+// the repository checked out in repoDir.
+func TestReportAnnotations(report *reports.Report, repoDir string) []*github.CheckRunAnnotation {
+	files, err := utils.GetInputFiles(repoDir)
+	if err != nil {
+		log.Warn().Err(err).Msg("Unable to list repository files for annotations")
+		return nil
+	}
+
+	var annotations []*github.CheckRunAnnotation
+	for _, failure := range report.Failures() {
+		file := resolveRepoPath(files, failure.Suite, failure.File)
+		if len(file) == 0 {
+			continue
+		}
+
+		line := max(failure.Line, 1)
+		message := failure.Message
+		if len(message) == 0 {
+			message = "Test failed."
+		} else if len(message) > MAX_ANNOTATION_MESSAGE_LENGTH {
+			message = message[:MAX_ANNOTATION_MESSAGE_LENGTH]
+		}
+
+		annotations = append(annotations, &github.CheckRunAnnotation{
+			Path:            github.String(file),
+			StartLine:       github.Int(line),
+			EndLine:         github.Int(line),
+			AnnotationLevel: github.String("failure"),
+			Title:           github.String(failure.Name),
+			Message:         github.String(strings.ToValidUTF8(message, "")),
+		})
+	}
+	return annotations
+}
+
+// resolveRepoPath finds the repository file a test report refers to. Reports
+// often use paths relative to the package, or absolute paths inside the test
+// container, so leading directories are dropped until a file matches. When
+// several files match, the one whose directory best matches the suite name is
+// used.
+func resolveRepoPath(files []string, suite, file string) string {
+	suiteParts := make(map[string]bool)
+	for _, part := range strings.FieldsFunc(suite, func(r rune) bool { return r == '/' || r == '.' || r == ':' }) {
+		suiteParts[part] = true
+	}
+
+	candidate := strings.TrimPrefix(path.Clean(strings.ReplaceAll(file, "\\", "/")), "/")
+	for len(file) > 0 && len(candidate) > 0 {
+		best, bestScore := "", -1
+		for _, f := range files {
+			if f != candidate && !strings.HasSuffix(f, "/"+candidate) {
+				continue
+			}
+			score := 0
+			for _, part := range strings.Split(path.Dir(f), "/") {
+				if suiteParts[part] {
+					score++
+				}
+			}
+			if score > bestScore {
+				best, bestScore = f, score
+			}
+		}
+		if len(best) > 0 {
+			return best
+		}
+
+		i := strings.IndexByte(candidate, '/')
+		if i < 0 {
+			break
+		}
+		candidate = candidate[i+1:]
+	}
+	return ""
+}
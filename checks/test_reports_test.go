@@ -0,0 +1,101 @@
+package checks
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/google/go-github/v50/github"
+
+	"github.com/jahagaley/phantom/checks/reports"
+)
+
+func TestResolveRepoPath(t *testing.T) {
+	files := []string{
+		"go.mod",
+		"pkg/parser/parser_test.go",
+		"services/a/parser_test.go",
+		"services/b/src/test/java/com/example/FooTest.java",
+	}
+
+	tests := []struct {
+		name  string
+		suite string
+		file  string
+		want  string
+	}{
+		{"repository path", "", "pkg/parser/parser_test.go", "pkg/parser/parser_test.go"},
+		{"container path", "", "/workspace/src/pkg/parser/parser_test.go", "pkg/parser/parser_test.go"},
+		{"windows path", "", `C:\build\services\a\parser_test.go`, "services/a/parser_test.go"},
+		{"package relative path picked by suite", "example.com/repo/services/a", "parser_test.go", "services/a/parser_test.go"},
+		{"java class path", "com.example.FooTest", "com/example/FooTest.java", "services/b/src/test/java/com/example/FooTest.java"},
+		{"unknown file", "", "missing_test.go", ""},
+		{"no file", "pkg", "", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := resolveRepoPath(files, test.suite, test.file); got != test.want {
+				t.Errorf("resolveRepoPath(%q, %q) = %q, want %q", test.suite, test.file, got, test.want)
+			}
+		})
+	}
+}
+
+func TestTestReportSummary(t *testing.T) {
+	report := &reports.Report{Results: []*reports.TestResult{
+		{Suite: "pkg", Name: "TestOK", Status: reports.STATUS_PASSED},
+		{Suite: "pkg", Name: "TestFail", Status: reports.STATUS_FAILED},
+		{Name: "skipped", Status: reports.STATUS_SKIPPED},
+	}}
+
+	want := "1 passed, 1 failed, 1 skipped.\n\nFailed tests:\n- `pkg / TestFail`\n"
+	if got := TestReportSummary(report); got != want {
+		t.Errorf("TestReportSummary() = %q, want %q", got, want)
+	}
+
+	for i := 0; i < MAX_LISTED_FAILURES+5; i++ {
+		report.Results = append(report.Results, &reports.TestResult{Name: fmt.Sprint(i), Status: reports.STATUS_FAILED})
+	}
+	if got := TestReportSummary(report); !strings.HasSuffix(got, "- and 6 more\n") {
+		t.Errorf("TestReportSummary() = %q, want the failures past %d left out", got, MAX_LISTED_FAILURES)
+	}
+}
+
+func TestUpdateCheckRunCompletionAnnotationBatches(t *testing.T) {
+	var batches []int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPatch || r.URL.Path != "/repos/owner/repo/check-runs/1" {
+			http.NotFound(w, r)
+			return
+		}
+		var opts github.UpdateCheckRunOptions
+		if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+			t.Errorf("decoding check run update: %v", err)
+		}
+		batches = append(batches, len(opts.Output.Annotations))
+		w.Write([]byte(`{"id": 1}`))
+	}))
+	defer srv.Close()
+
+	client := github.NewClient(srv.Client())
+	client.BaseURL, _ = url.Parse(srv.URL + "/")
+
+	var annotations []*github.CheckRunAnnotation
+	for i := 0; i < 2*MAX_ANNOTATIONS_PER_REQUEST+1; i++ {
+		annotations = append(annotations, &github.CheckRunAnnotation{Path: github.String("main.go"), StartLine: github.Int(i + 1)})
+	}
+	checkParams := &CheckParams{Type: "test", Name: "Run Test - unit", Owner: "owner", Repo: "repo", CheckRunID: 1}
+
+	err := UpdateCheckRunCompletionWithOutput(client, checkParams, CONCLUSION_FAILURE, "1 failed.", "", annotations)
+	if err != nil {
+		t.Fatalf("UpdateCheckRunCompletionWithOutput() error = %v", err)
+	}
+	if fmt.Sprint(batches) != "[50 50 1]" {
+		t.Errorf("annotation batches = %v, want [50 50 1]", batches)
+	}
+}
@@ -0,0 +1,302 @@
+package checks
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"connectrpc.com/connect"
+	apipb "github.com/jahagaley/phantomapi/phantom/api/v1"
+	api "github.com/jahagaley/phantomapi/phantom/api/v1/v1connect"
+	"github.com/rs/zerolog/log"
+
+	"github.com/jahagaley/phantom/utils"
+	"github.com/jahagaley/phantom/utils/metrics"
+	"github.com/jahagaley/phantom/utils/settings"
+	"github.com/jahagaley/phantom/utils/tracing"
+)
+
+const (
+	// Polling starts fast and slows down while the execution state doesn't change.
+	minPollInterval = 5 * time.Second
+	maxPollInterval = time.Minute
+
+	// Longest single WaitExecution call.
+	maxWaitExecution = 5 * time.Minute
+
+	watchFileExtension = ".json"
+)
+
+// ExecutionWatcher tracks every outstanding Phantom execution until it
+// finishes. Watched executions are saved to disk so they can be resumed after
+// a restart.
+type ExecutionWatcher struct {
+	gitClient api.GitServiceClient
+	stateDir  string
+
+	// Bounds of the poll interval, tests shorten them.
+	minPollInterval time.Duration
+	maxPollInterval time.Duration
+
+	mu      sync.Mutex
+	watches map[string]*CheckParams
+
+	// Set once the API reports it doesn't support WaitExecution.
+	waitUnsupported atomic.Bool
+}
+
+// Watcher used by builds and tests to wait on their executions.
+var watcher *ExecutionWatcher
+
+// SetExecutionWatcher sets the watcher used by builds and tests.
+func SetExecutionWatcher(w *ExecutionWatcher) {
+	watcher = w
+}
+
+func NewExecutionWatcher(stateDir string) (*ExecutionWatcher, error) {
+	if err := os.MkdirAll(stateDir, 0o700); err != nil {
+		return nil, err
+	}
+
+	return &ExecutionWatcher{
+		gitClient:       api.NewGitServiceClient(tracing.HTTPClient, utils.API_URL),
+		stateDir:        stateDir,
+		minPollInterval: minPollInterval,
+		maxPollInterval: maxPollInterval,
+		watches:         make(map[string]*CheckParams),
+	}, nil
+}
+
+// NewExecutionWatcherFromSettings creates a watcher saving its state to the
+// state directory of the settings.
+func NewExecutionWatcherFromSettings() (*ExecutionWatcher, error) {
+	return NewExecutionWatcher(path.Join(settings.Get().StateDir, "executions"))
+}
+
+// Resume publishes the checks whose executions were being watched when the
+// process last stopped, so they continue waiting on their executions.
+func (w *ExecutionWatcher) Resume(publish func(*CheckParams) error) error {
+	entries, err := os.ReadDir(w.stateDir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), watchFileExtension) {
+			continue
+		}
+		file := path.Join(w.stateDir, entry.Name())
+		data, err := os.ReadFile(file)
+		if err != nil {
+			log.Warn().Err(err).Msg(fmt.Sprintf("Unable to read watched execution '%s'", file))
+			continue
+		}
+
+		checkParams := &CheckParams{}
+		if err := json.Unmarshal(data, checkParams); err != nil {
+			log.Warn().Err(err).Msg(fmt.Sprintf("Unable to decode watched execution '%s'", file))
+			os.Remove(file)
+			continue
+		}
+
+		if err := publish(checkParams); err != nil {
+			return err
+		}
+		log.Info().Msg(fmt.Sprintf("Resumed watching execution '%s'", checkParams.ExecutionName))
+		os.Remove(file)
+	}
+
+	return nil
+}
+
+// Outstanding returns the checks currently waiting on their executions.
+func (w *ExecutionWatcher) Outstanding() []*CheckParams {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var output []*CheckParams
+	for _, checkParams := range w.watches {
+		output = append(output, checkParams)
+	}
+	return output
+}
+
+func (w *ExecutionWatcher) watchFile(executionName string) string {
+	hash := sha256.Sum256([]byte(executionName))
+	return path.Join(w.stateDir, hex.EncodeToString(hash[:])+watchFileExtension)
+}
+
+func (w *ExecutionWatcher) add(checkParams *CheckParams) error {
+	data, err := json.Marshal(checkParams)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(w.watchFile(checkParams.ExecutionName), data, 0o600); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	w.watches[checkParams.ExecutionName] = checkParams
+	w.mu.Unlock()
+	return nil
+}
+
+func (w *ExecutionWatcher) remove(checkParams *CheckParams, keepFile bool) {
+	w.mu.Lock()
+	delete(w.watches, checkParams.ExecutionName)
+	w.mu.Unlock()
+
+	if !keepFile {
+		os.Remove(w.watchFile(checkParams.ExecutionName))
+	}
+}
+
+// Watch waits until the execution of the check finishes or its deadline
+// passes, and returns the check conclusion. Executions running past their
+// deadline are cancelled.
+func (w *ExecutionWatcher) Watch(ctx context.Context, checkParams *CheckParams) (string, error) {
+	if err := w.add(checkParams); err != nil {
+		log.Warn().Err(err).Msg("Unable to save watched execution, it won't be resumed after a restart")
+	}
+	defer func() {
+		// Executions interrupted by the process stopping are resumed on restart.
+		w.remove(checkParams, ctx.Err() != nil)
+	}()
+
+	start := time.Now()
+	interval := w.minPollInterval
+	lastState := apipb.Execution_STATE_UNSPECIFIED
+	for {
+		execution, err := w.next(ctx, checkParams, interval)
+		if err != nil {
+			return "", err
+		}
+
+		if conclusion, done := executionConclusion(execution.GetState()); done {
+			metrics.Since(metrics.ExecutionWait.WithLabelValues(checkParams.Type, conclusion), start)
+			return conclusion, nil
+		}
+
+		if time.Now().After(checkParams.ExecutionDeadline) {
+			cancelExecutionRequest := &apipb.CancelExecutionRequest{
+				Name: checkParams.ExecutionName,
+			}
+			_, err := w.gitClient.CancelExecution(ctx, connect.NewRequest(cancelExecutionRequest))
+			if err != nil {
+				log.Warn().Err(err).Msg(fmt.Sprintf("Unable to cancel timed out execution '%s'", checkParams.ExecutionName))
+			}
+			metrics.Since(metrics.ExecutionWait.WithLabelValues(checkParams.Type, CONCLUSION_TIMED_OUT), start)
+			return CONCLUSION_TIMED_OUT, nil
+		}
+
+		interval = w.nextPollInterval(interval, execution.GetState() != lastState)
+		lastState = execution.GetState()
+	}
+}
+
+// nextPollInterval polls less often while nothing is happening, and fast
+// again once the execution changed state.
+func (w *ExecutionWatcher) nextPollInterval(interval time.Duration, changed bool) time.Duration {
+	if changed {
+		return w.minPollInterval
+	}
+	return min(interval*3/2, w.maxPollInterval)
+}
+
+// next returns the execution once it changed state, or once the poll
+// interval has passed when the API doesn't support waiting on executions.
+func (w *ExecutionWatcher) next(ctx context.Context, checkParams *CheckParams, interval time.Duration) (*apipb.Execution, error) {
+	untilDeadline := time.Until(checkParams.ExecutionDeadline)
+
+	if !w.waitUnsupported.Load() && untilDeadline > 0 {
+		waitCtx, cancel := context.WithTimeout(ctx, min(maxWaitExecution, untilDeadline))
+		defer cancel()
+
+		waitExecutionRequest := &apipb.WaitExecutionRequest{
+			Name: checkParams.ExecutionName,
+		}
+		res, err := w.gitClient.WaitExecution(waitCtx, connect.NewRequest(waitExecutionRequest))
+		if err == nil {
+			return res.Msg, nil
+		}
+
+		if connect.CodeOf(err) == connect.CodeUnimplemented {
+			log.Info().Msg("WaitExecution isn't supported by the API, polling executions instead")
+			w.waitUnsupported.Store(true)
+		} else if ctx.Err() != nil {
+			return nil, ctx.Err()
+		} else if !errors.Is(err, context.DeadlineExceeded) && connect.CodeOf(err) != connect.CodeDeadlineExceeded {
+			return nil, err
+		}
+	} else {
+		timer := time.NewTimer(max(min(interval, untilDeadline), 0))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+
+	getExecutionRequest := &apipb.GetExecutionRequest{
+		Name: checkParams.ExecutionName,
+	}
+	res, err := w.gitClient.GetExecution(ctx, connect.NewRequest(getExecutionRequest))
+	if err != nil {
+		log.Err(err).Msg("Error getting execution")
+		return nil, err
+	}
+	return res.Msg, nil
+}
+
+// executionConclusion returns the check conclusion of a finished execution.
+// Executions in an unspecified state, ex: just created, are still running.
+func executionConclusion(state apipb.Execution_State) (string, bool) {
+	switch state {
+	case apipb.Execution_STATE_SUCCESS:
+		return CONCLUSION_SUCCESS, true
+	case apipb.Execution_STATE_FAILURE:
+		return CONCLUSION_FAILURE, true
+	case apipb.Execution_STATE_CANCELLED:
+		return CONCLUSION_CANCELLED, true
+	}
+	return "", false
+}
+
+// IsExecutionWatched reports whether a check of this instance is waiting on
+// the execution.
+func IsExecutionWatched(executionName string) bool {
+	if watcher == nil {
+		return false
+	}
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+
+	_, ok := watcher.watches[executionName]
+	return ok
+}
+
+// ForgetExecution stops resuming the execution of the check on restart, once
+// it is resumed by another worker.
+func ForgetExecution(checkParams *CheckParams) {
+	if watcher != nil && len(checkParams.ExecutionName) > 0 {
+		watcher.remove(checkParams, false)
+	}
+}
+
+// WatchExecution waits on the execution of the check with the configured watcher.
+func WatchExecution(ctx context.Context, checkParams *CheckParams) (string, error) {
+	if watcher == nil {
+		return "", fmt.Errorf("No execution watcher has been configured.")
+	}
+	return watcher.Watch(ctx, checkParams)
+}
@@ -0,0 +1,205 @@
+package checks
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"connectrpc.com/connect"
+	apipb "github.com/jahagaley/phantomapi/phantom/api/v1"
+	api "github.com/jahagaley/phantomapi/phantom/api/v1/v1connect"
+)
+
+// fakeWatchClient serves the states of an execution in turn, the last one
+// being kept.
+type fakeWatchClient struct {
+	api.GitServiceClient
+
+	mu                sync.Mutex
+	states            []apipb.Execution_State
+	waitUnimplemented bool
+	waitCalls         int
+	getCalls          int
+	cancelled         []string
+}
+
+func (c *fakeWatchClient) nextState(name string) *apipb.Execution {
+	state := c.states[0]
+	if len(c.states) > 1 {
+		c.states = c.states[1:]
+	}
+	return &apipb.Execution{Name: name, State: state}
+}
+
+func (c *fakeWatchClient) GetExecution(ctx context.Context, req *connect.Request[apipb.GetExecutionRequest]) (*connect.Response[apipb.Execution], error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.getCalls++
+	return connect.NewResponse(c.nextState(req.Msg.Name)), nil
+}
+
+func (c *fakeWatchClient) WaitExecution(ctx context.Context, req *connect.Request[apipb.WaitExecutionRequest]) (*connect.Response[apipb.Execution], error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.waitCalls++
+	if c.waitUnimplemented {
+		return nil, connect.NewError(connect.CodeUnimplemented, errors.New("unimplemented"))
+	}
+	return connect.NewResponse(c.nextState(req.Msg.Name)), nil
+}
+
+func (c *fakeWatchClient) CancelExecution(ctx context.Context, req *connect.Request[apipb.CancelExecutionRequest]) (*connect.Response[apipb.Execution], error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cancelled = append(c.cancelled, req.Msg.Name)
+	return connect.NewResponse(&apipb.Execution{Name: req.Msg.Name, State: apipb.Execution_STATE_CANCELLED}), nil
+}
+
+func newTestWatcher(t *testing.T, client api.GitServiceClient) *ExecutionWatcher {
+	t.Helper()
+	return &ExecutionWatcher{
+		gitClient:       client,
+		stateDir:        t.TempDir(),
+		minPollInterval: time.Millisecond,
+		maxPollInterval: 4 * time.Millisecond,
+		watches:         make(map[string]*CheckParams),
+	}
+}
+
+func watchedCheck(deadline time.Duration) *CheckParams {
+	return &CheckParams{
+		Type:              PHANTOM_BUILD_IMAGE,
+		Name:              "Build Image - api",
+		ExecutionName:     "projects/p/executions/1",
+		ExecutionDeadline: time.Now().Add(deadline),
+	}
+}
+
+func TestWatch(t *testing.T) {
+	tests := []struct {
+		name              string
+		states            []apipb.Execution_State
+		waitUnimplemented bool
+		deadline          time.Duration
+		want              string
+		wantCancelled     bool
+	}{
+		{
+			name:     "wait",
+			states:   []apipb.Execution_State{apipb.Execution_STATE_RUNNING, apipb.Execution_STATE_SUCCESS},
+			deadline: time.Minute,
+			want:     CONCLUSION_SUCCESS,
+		},
+		{
+			name:              "poll",
+			states:            []apipb.Execution_State{apipb.Execution_STATE_PENDING, apipb.Execution_STATE_RUNNING, apipb.Execution_STATE_FAILURE},
+			waitUnimplemented: true,
+			deadline:          time.Minute,
+			want:              CONCLUSION_FAILURE,
+		},
+		{
+			name:              "unspecified is running",
+			states:            []apipb.Execution_State{apipb.Execution_STATE_UNSPECIFIED, apipb.Execution_STATE_UNSPECIFIED, apipb.Execution_STATE_SUCCESS},
+			waitUnimplemented: true,
+			deadline:          time.Minute,
+			want:              CONCLUSION_SUCCESS,
+		},
+		{
+			name:              "deadline",
+			states:            []apipb.Execution_State{apipb.Execution_STATE_RUNNING},
+			waitUnimplemented: true,
+			deadline:          20 * time.Millisecond,
+			want:              CONCLUSION_TIMED_OUT,
+			wantCancelled:     true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &fakeWatchClient{states: test.states, waitUnimplemented: test.waitUnimplemented}
+			w := newTestWatcher(t, client)
+
+			got, err := w.Watch(context.Background(), watchedCheck(test.deadline))
+			if err != nil {
+				t.Fatalf("Watch() error = %v", err)
+			}
+			if got != test.want {
+				t.Errorf("Watch() = %s, want %s", got, test.want)
+			}
+			if (len(client.cancelled) > 0) != test.wantCancelled {
+				t.Errorf("cancelled %v, want cancelled %v", client.cancelled, test.wantCancelled)
+			}
+
+			// Executions no longer watched aren't resumed
+			if len(w.Outstanding()) != 0 {
+				t.Errorf("Outstanding() = %v after Watch(), want none", w.Outstanding())
+			}
+			if entries, _ := os.ReadDir(w.stateDir); len(entries) != 0 {
+				t.Errorf("state dir holds %d files after Watch(), want none", len(entries))
+			}
+
+			// WaitExecution is only tried once when the API doesn't support it
+			if test.waitUnimplemented && (client.waitCalls != 1 || !w.waitUnsupported.Load()) {
+				t.Errorf("WaitExecution called %d times, unsupported %v, want once and unsupported", client.waitCalls, w.waitUnsupported.Load())
+			}
+		})
+	}
+}
+
+func TestNextPollInterval(t *testing.T) {
+	w := &ExecutionWatcher{minPollInterval: 4 * time.Second, maxPollInterval: 10 * time.Second}
+
+	tests := []struct {
+		interval time.Duration
+		changed  bool
+		want     time.Duration
+	}{
+		{4 * time.Second, false, 6 * time.Second},
+		{6 * time.Second, false, 9 * time.Second},
+		{9 * time.Second, false, 10 * time.Second},
+		{10 * time.Second, false, 10 * time.Second},
+		{10 * time.Second, true, 4 * time.Second},
+	}
+
+	for _, test := range tests {
+		if got := w.nextPollInterval(test.interval, test.changed); got != test.want {
+			t.Errorf("nextPollInterval(%s, %v) = %s, want %s", test.interval, test.changed, got, test.want)
+		}
+	}
+}
+
+func TestWatchResume(t *testing.T) {
+	client := &fakeWatchClient{states: []apipb.Execution_State{apipb.Execution_STATE_RUNNING}, waitUnimplemented: true}
+	w := newTestWatcher(t, client)
+
+	// Executions interrupted by the process stopping are kept on disk
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := w.Watch(ctx, watchedCheck(time.Hour)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Watch() error = %v, want the context error", err)
+	}
+	if err := os.WriteFile(path.Join(w.stateDir, "invalid"+watchFileExtension), []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := newTestWatcher(t, client)
+	restarted.stateDir = w.stateDir
+	var resumed []*CheckParams
+	err := restarted.Resume(func(checkParams *CheckParams) error {
+		resumed = append(resumed, checkParams)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Resume() error = %v", err)
+	}
+	if len(resumed) != 1 || resumed[0].ExecutionName != "projects/p/executions/1" || resumed[0].ExecutionDeadline.IsZero() {
+		t.Errorf("Resume() published %v, want the interrupted check with its deadline", resumed)
+	}
+	if entries, _ := os.ReadDir(w.stateDir); len(entries) != 0 {
+		t.Errorf("state dir holds %d files after Resume(), want none", len(entries))
+	}
+}
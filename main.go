@@ -1,22 +1,46 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
+	"github.com/jahagaley/phantom/checks"
+	"github.com/jahagaley/phantom/services"
 	"github.com/jahagaley/phantom/services/github"
+	"github.com/jahagaley/phantom/services/health"
 	"github.com/jahagaley/phantom/services/pubsub"
+	"github.com/jahagaley/phantom/utils"
+	"github.com/jahagaley/phantom/utils/metrics"
+	"github.com/jahagaley/phantom/utils/settings"
+	"github.com/jahagaley/phantom/utils/tracing"
 )
 
 const (
-	health               = "/"
+	health_path          = "/"
+	liveness_path        = "/healthz"
+	readiness_path       = "/readyz"
 	github_web_hook_path = "/github/webhooks"
 	github_setup_path    = "/github/setup"
 	pubsub_path          = "/gcp/pubsub"
+	metrics_path         = "/metrics"
+
+	// Timeouts of the HTTP server, webhooks and pushes are answered quickly.
+	read_header_timeout = 10 * time.Second
+	read_timeout        = 30 * time.Second
+	write_timeout       = 30 * time.Second
+	idle_timeout        = 2 * time.Minute
+
+	// Longest time spent exporting the last spans when stopping.
+	trace_flush_timeout = 5 * time.Second
 )
 
 func init() {
@@ -27,23 +51,162 @@ func init() {
 	log.Logger = log.With().Caller().Logger()
 }
 
-func healthHandler(w http.ResponseWriter, r *http.Request) {
-	// Check the health of the server and return a status code accordingly
-	log.Info().Msg("Health check")
-	w.WriteHeader(http.StatusOK)
-}
-
 func RunServer() {
 	err := godotenv.Load()
 	if err != nil {
 		log.Fatal().Msg(fmt.Sprintf("Error loading .env file: %v", err))
 	}
 
-	http.HandleFunc(health, healthHandler)
-	http.HandleFunc(github_web_hook_path, github.WebhookHandler)
+	// Loading the settings, so invalid ones stop the server right away
+	config, err := settings.Load(os.Args[1:])
+	if err != nil {
+		log.Fatal().Msg(fmt.Sprintf("Error loading settings: %v", err))
+	}
+	settings.Set(config)
+	level, _ := zerolog.ParseLevel(config.LogLevel)
+	zerolog.SetGlobalLevel(level)
+	utils.API_URL = config.APIURL
+	utils.SITE_URL = config.SiteURL
+
+	if _, err := services.GetGithubHost(services.DEFAULT_GITHUB_HOST); err != nil {
+		log.Fatal().Msg(fmt.Sprintf("Error loading Github hosts: %v", err))
+	}
+
+	// Setting up the export of traces, before any span is started
+	ctx := context.Background()
+	stopTracing, err := tracing.Start(ctx, config.Tracing)
+	if err != nil {
+		log.Fatal().Msg(fmt.Sprintf("Error setting up tracing: %v", err))
+	}
+
+	// Setting up the queue used to run checks
+	queue, err := pubsub.NewQueueFromSettings(ctx, config.Queue)
+	if err != nil {
+		log.Fatal().Msg(fmt.Sprintf("Error creating check queue: %v", err))
+	}
+	defer queue.Close()
+	pubsub.SetQueue(queue)
+
+	deadLetterQueue, err := pubsub.NewDeadLetterQueueFromSettings(ctx, config.Queue)
+	if err != nil {
+		log.Fatal().Msg(fmt.Sprintf("Error creating dead-letter queue: %v", err))
+	}
+	defer deadLetterQueue.Close()
+	pubsub.SetDeadLetterQueue(deadLetterQueue)
+
+	// Setting up the watcher waiting on executions, and resuming the ones
+	// that were watched before the last restart
+	watcher, err := checks.NewExecutionWatcherFromSettings()
+	if err != nil {
+		log.Fatal().Msg(fmt.Sprintf("Error creating execution watcher: %v", err))
+	}
+	checks.SetExecutionWatcher(watcher)
+	if err := watcher.Resume(pubsub.PublishGithubCheck); err != nil {
+		log.Error().Err(err).Msg("Unable to resume watching executions")
+	}
+
+	// Checks keep running once the server stops receiving them, until they
+	// are interrupted by cancelling checksCtx
+	subscribeCtx, stopSubscribing := context.WithCancel(ctx)
+	checksCtx, cancelChecks := context.WithCancel(context.Background())
+	defer cancelChecks()
+	go func() {
+		err := pubsub.Subscribe(subscribeCtx, checksCtx)
+		if subscribeCtx.Err() == nil {
+			log.Fatal().Msg(fmt.Sprintf("Stopped receiving checks from queue: %v", err))
+		}
+	}()
+	go pubsub.RunReaper(subscribeCtx)
+
+	http.HandleFunc(health_path, health.LivenessHandler)
+	http.HandleFunc(liveness_path, health.LivenessHandler)
+	http.HandleFunc(readiness_path, health.ReadinessHandler)
+	http.Handle(github_web_hook_path, tracing.Handler(http.HandlerFunc(github.WebhookHandler), "github.webhook"))
 	http.HandleFunc(github_setup_path, github.SetupHandler)
 	http.HandleFunc(pubsub_path, pubsub.Handler)
-	http.ListenAndServe(":8080", nil)
+	server := &http.Server{
+		Addr:              config.Addr,
+		ReadHeaderTimeout: read_header_timeout,
+		ReadTimeout:       read_timeout,
+		WriteTimeout:      write_timeout,
+		IdleTimeout:       idle_timeout,
+	}
+
+	// Metrics are only served on the internal address
+	metricsMux := http.NewServeMux()
+	metricsMux.Handle(metrics_path, metrics.Handler())
+	metricsServer := &http.Server{
+		Addr:              config.MetricsAddr,
+		Handler:           metricsMux,
+		ReadHeaderTimeout: read_header_timeout,
+		ReadTimeout:       read_timeout,
+		WriteTimeout:      write_timeout,
+		IdleTimeout:       idle_timeout,
+	}
+
+	serverErr := make(chan error, 2)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+	go func() {
+		serverErr <- metricsServer.ListenAndServe()
+	}()
+
+	// Deploys and spot VM preemptions stop the server with SIGTERM
+	signals, stopSignals := signal.NotifyContext(ctx, syscall.SIGTERM, os.Interrupt)
+	defer stopSignals()
+	select {
+	case err := <-serverErr:
+		log.Fatal().Msg(fmt.Sprintf("Server stopped: %v", err))
+	case <-signals.Done():
+	}
+
+	shutdown(server, stopSubscribing, cancelChecks, config.ShutdownTimeout, config.DrainDelay)
+	metricsServer.Close()
+
+	// Spans of the re-queued checks are exported before exiting
+	flushCtx, cancelFlush := context.WithTimeout(ctx, trace_flush_timeout)
+	defer cancelFlush()
+	if err := stopTracing(flushCtx); err != nil {
+		log.Warn().Err(err).Msg("Unable to export the last spans")
+	}
+}
+
+// shutdown stops accepting requests and checks, then gives the running checks
+// until the timeout to finish. Checks still running are interrupted and
+// re-queued, so other instances resume them.
+func shutdown(server *http.Server, stopSubscribing, cancelChecks context.CancelFunc, timeout, drainDelay time.Duration) {
+	log.Info().Msg("Shutting down, draining running checks.")
+	deadline := time.Now().Add(timeout)
+
+	pubsub.StartDraining()
+	stopSubscribing()
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	// Keep answering until the load balancer's health checks see the server
+	// is draining, requests sent meanwhile would be refused otherwise
+	select {
+	case <-time.After(drainDelay):
+	case <-ctx.Done():
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		log.Warn().Err(err).Msg("Unable to close every connection before shutting down")
+	}
+
+	// Leave enough time to re-queue the checks that don't finish
+	waitCtx, cancelWait := context.WithDeadline(ctx, deadline.Add(-pubsub.REQUEUE_TIMEOUT))
+	defer cancelWait()
+	if !pubsub.WaitRunningChecks(waitCtx) {
+		log.Warn().Msg("Interrupting the running checks to re-queue them.")
+		cancelChecks()
+		if !pubsub.WaitRunningChecks(ctx) {
+			log.Warn().Msg("Some checks were not re-queued before shutting down.")
+		}
+	}
+
+	log.Info().Msg("Server stopped.")
 }
 
 func main() {
@@ -0,0 +1,220 @@
+package apitest
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"connectrpc.com/connect"
+
+	apipb "github.com/jahagaley/phantomapi/phantom/api/v1"
+)
+
+// Executions returns the executions created so far, oldest first.
+func (s *Server) Executions() []*apipb.Execution {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	executions := make([]*apipb.Execution, s.executionSeq)
+	for _, e := range s.executions {
+		id, _ := strconv.Atoi(e.Name[strings.LastIndex(e.Name, "/")+1:])
+		executions[id-1] = copyExecution(e.Execution)
+	}
+	return executions
+}
+
+// AddLogs appends log lines to the execution.
+func (s *Server) AddLogs(name string, lines ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, err := lookup(s.executions, name)
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		e.logs = append(e.logs, &apipb.LogEntry{Text: line})
+	}
+	return nil
+}
+
+// AddArtifacts adds artifacts to the execution, like the test reports it
+// uploaded.
+func (s *Server) AddArtifacts(name string, artifacts ...*apipb.Artifact) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, err := lookup(s.executions, name)
+	if err != nil {
+		return err
+	}
+	e.artifacts = append(e.artifacts, artifacts...)
+	return nil
+}
+
+func (s *Server) CreateExecution(ctx context.Context, req *connect.Request[apipb.CreateExecutionRequest]) (*connect.Response[apipb.Execution], error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if build := req.Msg.Execution.GetBuildRequest().GetBuild(); len(build) > 0 {
+		if _, ok := s.builds[build]; !ok {
+			return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("Build '%s' not found.", build))
+		}
+	} else if test := req.Msg.Execution.GetTestRequest().GetTest(); len(test) > 0 {
+		if _, ok := s.tests[test]; !ok {
+			return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("Test '%s' not found.", test))
+		}
+	} else {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("Execution has no build or test."))
+	}
+
+	s.executionSeq++
+	e := &execution{Execution: copyExecution(req.Msg.Execution)}
+	e.Name = fmt.Sprintf("%s/executions/%d", req.Msg.Parent, s.executionSeq)
+
+	if s.ExecutionStates != nil {
+		e.states = s.ExecutionStates(copyExecution(e.Execution))
+	} else {
+		e.states = []apipb.Execution_State{
+			apipb.Execution_STATE_RUNNING,
+			apipb.Execution_STATE_SUCCESS,
+		}
+	}
+	e.State = apipb.Execution_STATE_PENDING
+	s.executions[e.Name] = e
+
+	return connect.NewResponse(copyExecution(e.Execution)), nil
+}
+
+func (s *Server) GetExecution(ctx context.Context, req *connect.Request[apipb.GetExecutionRequest]) (*connect.Response[apipb.Execution], error) {
+	return s.advanceExecution(req.Msg.Name)
+}
+
+// WaitExecution returns right away, as every read moves the execution to its
+// next state.
+func (s *Server) WaitExecution(ctx context.Context, req *connect.Request[apipb.WaitExecutionRequest]) (*connect.Response[apipb.Execution], error) {
+	return s.advanceExecution(req.Msg.Name)
+}
+
+func (s *Server) CancelExecution(ctx context.Context, req *connect.Request[apipb.CancelExecutionRequest]) (*connect.Response[apipb.Execution], error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, err := lookup(s.executions, req.Msg.Name)
+	if err != nil {
+		return nil, err
+	}
+	if !isFinal(e.State) {
+		e.State = apipb.Execution_STATE_CANCELLED
+		e.states = nil
+	}
+	return connect.NewResponse(copyExecution(e.Execution)), nil
+}
+
+func (s *Server) ListExecutions(ctx context.Context, req *connect.Request[apipb.ListExecutionsRequest]) (*connect.Response[apipb.ListExecutionsResponse], error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	executions, next, err := list(s.executions, req.Msg.Parent, req.Msg.Filter, req.Msg.PageSize, req.Msg.PageToken, func(e *execution) map[string]string {
+		return map[string]string{
+			"state":  strings.TrimPrefix(e.State.String(), "STATE_"),
+			"branch": e.Branch,
+			"commit": e.Commit,
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := &apipb.ListExecutionsResponse{NextPageToken: next}
+	for _, e := range executions {
+		res.Executions = append(res.Executions, copyExecution(e.Execution))
+	}
+	return connect.NewResponse(res), nil
+}
+
+func (s *Server) ListExecutionLogs(ctx context.Context, req *connect.Request[apipb.ListExecutionLogsRequest]) (*connect.Response[apipb.ListExecutionLogsResponse], error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, err := lookup(s.executions, req.Msg.Parent)
+	if err != nil {
+		return nil, err
+	}
+	entries, next, err := page(e.logs, req.Msg.PageSize, req.Msg.PageToken)
+	if err != nil {
+		return nil, err
+	}
+	return connect.NewResponse(&apipb.ListExecutionLogsResponse{Entries: entries, NextPageToken: next}), nil
+}
+
+func (s *Server) ListExecutionArtifacts(ctx context.Context, req *connect.Request[apipb.ListExecutionArtifactsRequest]) (*connect.Response[apipb.ListExecutionArtifactsResponse], error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, err := lookup(s.executions, req.Msg.Parent)
+	if err != nil {
+		return nil, err
+	}
+	artifacts, next, err := page(e.artifacts, req.Msg.PageSize, req.Msg.PageToken)
+	if err != nil {
+		return nil, err
+	}
+	return connect.NewResponse(&apipb.ListExecutionArtifactsResponse{Artifacts: artifacts, NextPageToken: next}), nil
+}
+
+// advanceExecution moves the execution to its next scripted state.
+func (s *Server) advanceExecution(name string) (*connect.Response[apipb.Execution], error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, err := lookup(s.executions, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(e.states) > 0 {
+		e.State, e.states = e.states[0], e.states[1:]
+	}
+	return connect.NewResponse(copyExecution(e.Execution)), nil
+}
+
+// page returns the items of a page, page tokens being offsets in items.
+func page[T any](items []T, pageSize int32, pageToken string) ([]T, string, error) {
+	offset := 0
+	if len(pageToken) > 0 {
+		var err error
+		offset, err = strconv.Atoi(pageToken)
+		if err != nil || offset < 0 || offset > len(items) {
+			return nil, "", connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("Invalid page token '%s'.", pageToken))
+		}
+	}
+	if pageSize <= 0 {
+		pageSize = DEFAULT_PAGE_SIZE
+	}
+	end := min(offset+int(pageSize), len(items))
+
+	next := ""
+	if end < len(items) {
+		next = strconv.Itoa(end)
+	}
+	return items[offset:end], next, nil
+}
+
+func isFinal(state apipb.Execution_State) bool {
+	switch state {
+	case apipb.Execution_STATE_SUCCESS, apipb.Execution_STATE_FAILURE, apipb.Execution_STATE_CANCELLED:
+		return true
+	}
+	return false
+}
+
+func copyExecution(e *apipb.Execution) *apipb.Execution {
+	return &apipb.Execution{
+		Name:        e.Name,
+		Branch:      e.Branch,
+		Commit:      e.Commit,
+		BuildOrTest: e.BuildOrTest,
+		State:       e.State,
+	}
+}
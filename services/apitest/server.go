@@ -0,0 +1,391 @@
+// Package apitest implements an in-process stand-in of the Phantom API, so
+// checks can run end to end without production.
+package apitest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"connectrpc.com/connect"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/jahagaley/phantom/utils"
+	apipb "github.com/jahagaley/phantomapi/phantom/api/v1"
+	api "github.com/jahagaley/phantomapi/phantom/api/v1/v1connect"
+)
+
+const (
+	// Page size of the list calls that don't set one.
+	DEFAULT_PAGE_SIZE = 50
+)
+
+// Server is a fake GitService keeping its resources in memory. Executions go
+// through the states returned by ExecutionStates, moving to the next one every
+// time they are read.
+type Server struct {
+	api.UnimplementedGitServiceHandler
+
+	// ExecutionStates returns the states a new execution goes through, the
+	// last one being final. Executions succeed after running by default.
+	ExecutionStates func(execution *apipb.Execution) []apipb.Execution_State
+
+	mu            sync.Mutex
+	installations map[string]*apipb.Installation
+	repositories  map[string]*apipb.Repository
+	builds        map[string]*apipb.Build
+	tests         map[string]*apipb.Test
+	executions    map[string]*execution
+	executionSeq  int
+
+	// Set while the fake is started, with the API URL it replaced.
+	server      *httptest.Server
+	previousURL string
+}
+
+type execution struct {
+	*apipb.Execution
+
+	// States the execution hasn't been through yet.
+	states    []apipb.Execution_State
+	logs      []*apipb.LogEntry
+	artifacts []*apipb.Artifact
+}
+
+// NewServer returns an empty fake.
+func NewServer() *Server {
+	return &Server{
+		installations: make(map[string]*apipb.Installation),
+		repositories:  make(map[string]*apipb.Repository),
+		builds:        make(map[string]*apipb.Build),
+		tests:         make(map[string]*apipb.Test),
+		executions:    make(map[string]*execution),
+	}
+}
+
+// Handler returns the HTTP handler serving the GitService.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(api.NewGitServiceHandler(s))
+	return mux
+}
+
+// Start serves the fake on a local port and points utils.API_URL to it until
+// Close is called.
+func (s *Server) Start() {
+	s.server = httptest.NewServer(s.Handler())
+	s.previousURL = utils.API_URL
+	utils.API_URL = s.server.URL
+}
+
+// Close stops serving the fake and restores the previous utils.API_URL.
+func (s *Server) Close() {
+	if s.server == nil {
+		return
+	}
+	s.server.Close()
+	s.server = nil
+	utils.API_URL = s.previousURL
+}
+
+// AddInstallation adds the installation to the project, as done when the
+// Github app is installed through the setup page.
+func (s *Server) AddInstallation(project string, installationID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name := fmt.Sprintf("projects/%s/installations/%d", project, installationID)
+	s.installations[name] = &apipb.Installation{Name: name}
+}
+
+func (s *Server) CreateInstallation(ctx context.Context, req *connect.Request[apipb.CreateInstallationRequest]) (*connect.Response[apipb.Installation], error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name := fmt.Sprintf("%s/installations/%s", req.Msg.Parent, req.Msg.InstallationId)
+	if _, ok := s.installations[name]; ok {
+		return nil, alreadyExists(name)
+	}
+	s.installations[name] = &apipb.Installation{Name: name}
+	return connect.NewResponse(&apipb.Installation{Name: name}), nil
+}
+
+func (s *Server) GetInstallation(ctx context.Context, req *connect.Request[apipb.GetInstallationRequest]) (*connect.Response[apipb.Installation], error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	installation, err := lookup(s.installations, req.Msg.Name)
+	if err != nil {
+		return nil, err
+	}
+	return connect.NewResponse(&apipb.Installation{Name: installation.Name}), nil
+}
+
+func (s *Server) DeleteInstallation(ctx context.Context, req *connect.Request[apipb.DeleteInstallationRequest]) (*connect.Response[emptypb.Empty], error) {
+	return remove(&s.mu, s.installations, req.Msg.Name)
+}
+
+func (s *Server) CreateRepository(ctx context.Context, req *connect.Request[apipb.CreateRepositoryRequest]) (*connect.Response[apipb.Repository], error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name := fmt.Sprintf("%s/repositories/%s", req.Msg.Parent, req.Msg.RepositoryId)
+	if _, ok := s.repositories[name]; ok {
+		return nil, alreadyExists(name)
+	}
+	repository := copyRepository(req.Msg.Repository)
+	repository.Name = name
+	s.repositories[name] = repository
+	return connect.NewResponse(copyRepository(repository)), nil
+}
+
+func (s *Server) ListRepositories(ctx context.Context, req *connect.Request[apipb.ListRepositoriesRequest]) (*connect.Response[apipb.ListRepositoriesResponse], error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	repositories, next, err := list(s.repositories, req.Msg.Parent, req.Msg.Filter, req.Msg.PageSize, req.Msg.PageToken, func(r *apipb.Repository) map[string]string {
+		return map[string]string{"installation": r.Installation, "owner": r.Owner}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := &apipb.ListRepositoriesResponse{NextPageToken: next}
+	for _, repository := range repositories {
+		res.Repositories = append(res.Repositories, copyRepository(repository))
+	}
+	return connect.NewResponse(res), nil
+}
+
+func (s *Server) DeleteRepository(ctx context.Context, req *connect.Request[apipb.DeleteRepositoryRequest]) (*connect.Response[emptypb.Empty], error) {
+	return remove(&s.mu, s.repositories, req.Msg.Name)
+}
+
+func (s *Server) GetBuild(ctx context.Context, req *connect.Request[apipb.GetBuildRequest]) (*connect.Response[apipb.Build], error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	build, err := lookup(s.builds, req.Msg.Name)
+	if err != nil {
+		return nil, err
+	}
+	return connect.NewResponse(copyBuild(build)), nil
+}
+
+func (s *Server) CreateBuild(ctx context.Context, req *connect.Request[apipb.CreateBuildRequest]) (*connect.Response[apipb.Build], error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name := fmt.Sprintf("%s/builds/%s", req.Msg.Parent, req.Msg.BuildId)
+	if _, ok := s.builds[name]; ok {
+		return nil, alreadyExists(name)
+	}
+	if _, ok := s.repositories[req.Msg.Build.Repository]; !ok {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("Repository '%s' not found.", req.Msg.Build.Repository))
+	}
+	build := copyBuild(req.Msg.Build)
+	build.Name = name
+	s.builds[name] = build
+	return connect.NewResponse(copyBuild(build)), nil
+}
+
+func (s *Server) ListBuilds(ctx context.Context, req *connect.Request[apipb.ListBuildsRequest]) (*connect.Response[apipb.ListBuildsResponse], error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	builds, next, err := list(s.builds, req.Msg.Parent, req.Msg.Filter, req.Msg.PageSize, req.Msg.PageToken, func(b *apipb.Build) map[string]string {
+		return map[string]string{"repository": b.Repository}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := &apipb.ListBuildsResponse{NextPageToken: next}
+	for _, build := range builds {
+		res.Builds = append(res.Builds, copyBuild(build))
+	}
+	return connect.NewResponse(res), nil
+}
+
+func (s *Server) DeleteBuild(ctx context.Context, req *connect.Request[apipb.DeleteBuildRequest]) (*connect.Response[emptypb.Empty], error) {
+	return remove(&s.mu, s.builds, req.Msg.Name)
+}
+
+func (s *Server) GetTest(ctx context.Context, req *connect.Request[apipb.GetTestRequest]) (*connect.Response[apipb.Test], error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	test, err := lookup(s.tests, req.Msg.Name)
+	if err != nil {
+		return nil, err
+	}
+	return connect.NewResponse(copyTest(test)), nil
+}
+
+func (s *Server) CreateTest(ctx context.Context, req *connect.Request[apipb.CreateTestRequest]) (*connect.Response[apipb.Test], error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name := fmt.Sprintf("%s/tests/%s", req.Msg.Parent, req.Msg.TestId)
+	if _, ok := s.tests[name]; ok {
+		return nil, alreadyExists(name)
+	}
+	if _, ok := s.builds[req.Msg.Test.Build]; !ok {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("Build '%s' not found.", req.Msg.Test.Build))
+	}
+	test := copyTest(req.Msg.Test)
+	test.Name = name
+	s.tests[name] = test
+	return connect.NewResponse(copyTest(test)), nil
+}
+
+func (s *Server) ListTests(ctx context.Context, req *connect.Request[apipb.ListTestsRequest]) (*connect.Response[apipb.ListTestsResponse], error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tests, next, err := list(s.tests, req.Msg.Parent, req.Msg.Filter, req.Msg.PageSize, req.Msg.PageToken, func(t *apipb.Test) map[string]string {
+		return map[string]string{"repository": t.Repository, "build": t.Build}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := &apipb.ListTestsResponse{NextPageToken: next}
+	for _, test := range tests {
+		res.Tests = append(res.Tests, copyTest(test))
+	}
+	return connect.NewResponse(res), nil
+}
+
+func (s *Server) DeleteTest(ctx context.Context, req *connect.Request[apipb.DeleteTestRequest]) (*connect.Response[emptypb.Empty], error) {
+	return remove(&s.mu, s.tests, req.Msg.Name)
+}
+
+// lookup returns the resource with the name, where '-' matches any project.
+func lookup[T any](items map[string]T, name string) (T, error) {
+	if item, ok := items[name]; ok {
+		return item, nil
+	}
+
+	if parts := strings.Split(name, "/"); len(parts) > 2 && parts[1] == "-" {
+		suffix := "/" + strings.Join(parts[2:], "/")
+		for itemName, item := range items {
+			if strings.HasPrefix(itemName, "projects/") && strings.HasSuffix(itemName, suffix) &&
+				strings.Count(itemName, "/") == strings.Count(name, "/") {
+				return item, nil
+			}
+		}
+	}
+
+	var zero T
+	return zero, connect.NewError(connect.CodeNotFound, fmt.Errorf("Resource '%s' not found.", name))
+}
+
+func remove[T any](mu *sync.Mutex, items map[string]T, name string) (*connect.Response[emptypb.Empty], error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, ok := items[name]; !ok {
+		return nil, connect.NewError(connect.CodeNotFound, fmt.Errorf("Resource '%s' not found.", name))
+	}
+	delete(items, name)
+	return connect.NewResponse(&emptypb.Empty{}), nil
+}
+
+// list returns a page of the resources of the parent matching the filter,
+// sorted by name. Page tokens are offsets in the matching resources.
+func list[T any](
+	items map[string]T,
+	parent,
+	filter string,
+	pageSize int32,
+	pageToken string,
+	fields func(T) map[string]string,
+) ([]T, string, error) {
+	match, err := parseFilter(filter)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var names []string
+	for name, item := range items {
+		if strings.HasPrefix(name, parent+"/") && match(fields(item)) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var matching []T
+	for _, name := range names {
+		matching = append(matching, items[name])
+	}
+	return page(matching, pageSize, pageToken)
+}
+
+// parseFilter supports the filters used by Phantom: comparisons of a field
+// with a quoted value, joined by OR.
+func parseFilter(filter string) (func(fields map[string]string) bool, error) {
+	if len(strings.TrimSpace(filter)) == 0 {
+		return func(map[string]string) bool { return true }, nil
+	}
+
+	type comparison struct{ field, value string }
+	var comparisons []comparison
+	for _, clause := range strings.Split(filter, " OR ") {
+		field, value, ok := strings.Cut(clause, "=")
+		value, err := strconv.Unquote(strings.TrimSpace(value))
+		if !ok || err != nil {
+			return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("Invalid filter '%s'.", filter))
+		}
+		comparisons = append(comparisons, comparison{strings.TrimSpace(field), value})
+	}
+
+	return func(fields map[string]string) bool {
+		for _, c := range comparisons {
+			if fields[c.field] == c.value {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+func alreadyExists(name string) error {
+	return connect.NewError(connect.CodeAlreadyExists, fmt.Errorf("Resource '%s' already exists.", name))
+}
+
+func copyRepository(r *apipb.Repository) *apipb.Repository {
+	return &apipb.Repository{
+		Name:           r.Name,
+		DisplayName:    r.DisplayName,
+		Owner:          r.Owner,
+		DefaultBranch:  r.DefaultBranch,
+		Installation:   r.Installation,
+		RepositoryType: r.RepositoryType,
+	}
+}
+
+func copyBuild(b *apipb.Build) *apipb.Build {
+	return &apipb.Build{
+		Name:        b.Name,
+		DisplayName: b.DisplayName,
+		Repository:  b.Repository,
+		Path:        b.Path,
+		File:        b.File,
+	}
+}
+
+func copyTest(t *apipb.Test) *apipb.Test {
+	return &apipb.Test{
+		Name:        t.Name,
+		DisplayName: t.DisplayName,
+		Repository:  t.Repository,
+		Build:       t.Build,
+		Command:     append([]string(nil), t.Command...),
+	}
+}
@@ -0,0 +1,245 @@
+package apitest
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strconv"
+	"sync"
+	"testing"
+
+	"connectrpc.com/connect"
+	"github.com/google/go-github/v50/github"
+	apipb "github.com/jahagaley/phantomapi/phantom/api/v1"
+
+	"github.com/jahagaley/phantom/checks"
+	"github.com/jahagaley/phantom/utils"
+	"github.com/jahagaley/phantom/utils/settings"
+)
+
+const testConfig = `
+builds:
+- name: api
+  path: .
+  file: Dockerfile
+tests:
+- name: unit
+  build: api
+  command: ["go", "test", "./..."]
+`
+
+// fakeGithub serves the files of a single commit of owner/repo, and records
+// the check runs created on it.
+type fakeGithub struct {
+	files map[string]string
+
+	mu   sync.Mutex
+	runs map[int64]*github.CheckRun
+}
+
+func newFakeGithub(t *testing.T, files map[string]string) (*fakeGithub, *httptest.Server, *github.Client) {
+	t.Helper()
+
+	fake := &fakeGithub{files: files, runs: make(map[int64]*github.CheckRun)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/owner/repo/git/trees/sha", func(w http.ResponseWriter, r *http.Request) {
+		tree := &github.Tree{SHA: github.String("sha"), Truncated: github.Bool(false)}
+		for name := range fake.files {
+			tree.Entries = append(tree.Entries, &github.TreeEntry{Path: github.String(name), Type: github.String("blob"), SHA: github.String(name)})
+		}
+		json.NewEncoder(w).Encode(tree)
+	})
+	mux.HandleFunc("/repos/owner/repo/git/blobs/", func(w http.ResponseWriter, r *http.Request) {
+		content, ok := fake.files[path.Base(r.URL.Path)]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(content))
+	})
+	mux.HandleFunc("/repos/owner/repo/tarball/sha", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://"+r.Host+"/archive/sha.tar.gz", http.StatusFound)
+	})
+	mux.HandleFunc("/archive/sha.tar.gz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(fake.tarball(t))
+	})
+	mux.HandleFunc("/repos/owner/repo/check-runs", func(w http.ResponseWriter, r *http.Request) {
+		var opts github.CreateCheckRunOptions
+		json.NewDecoder(r.Body).Decode(&opts)
+
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		run := &github.CheckRun{ID: github.Int64(int64(len(fake.runs) + 1)), Name: github.String(opts.Name), Status: github.String(checks.STATUS_QUEUED)}
+		fake.runs[run.GetID()] = run
+		json.NewEncoder(w).Encode(run)
+	})
+	mux.HandleFunc("/repos/owner/repo/check-runs/", func(w http.ResponseWriter, r *http.Request) {
+		id, _ := strconv.ParseInt(path.Base(r.URL.Path), 10, 64)
+
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		run, ok := fake.runs[id]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == http.MethodPatch {
+			var opts github.UpdateCheckRunOptions
+			json.NewDecoder(r.Body).Decode(&opts)
+			if opts.Status != nil {
+				run.Status = opts.Status
+			}
+			if opts.Conclusion != nil {
+				run.Status, run.Conclusion = github.String(checks.STATUS_COMPLETED), opts.Conclusion
+			}
+		}
+		json.NewEncoder(w).Encode(run)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	client := github.NewClient(srv.Client())
+	client.BaseURL, _ = url.Parse(srv.URL + "/")
+	return fake, srv, client
+}
+
+// tarball returns the archive of the commit, its files being in a directory
+// as in the archives of Github.
+func (f *fakeGithub) tarball(t *testing.T) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range f.files {
+		hdr := &tar.Header{Name: "owner-repo-sha/" + name, Mode: 0o644, Size: int64(len(content)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func (f *fakeGithub) conclusions() map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	output := make(map[string]string)
+	for _, run := range f.runs {
+		output[run.GetName()] = run.GetConclusion()
+	}
+	return output
+}
+
+func TestChecksEndToEnd(t *testing.T) {
+	previousSettings := settings.Get()
+	s := *previousSettings
+	s.RepoCache.Dir = t.TempDir()
+	settings.Set(&s)
+	defer settings.Set(previousSettings)
+
+	previousURL := utils.API_URL
+	apiServer := NewServer()
+	apiServer.AddInstallation("project", 12)
+	_, err := apiServer.CreateRepository(context.Background(), connect.NewRequest(&apipb.CreateRepositoryRequest{
+		Parent:       "projects/project",
+		RepositoryId: "7",
+		Repository:   &apipb.Repository{DisplayName: "repo", Owner: "owner", DefaultBranch: "main"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiServer.Start()
+	defer apiServer.Close()
+
+	watcher, err := checks.NewExecutionWatcher(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checks.SetExecutionWatcher(watcher)
+	defer checks.SetExecutionWatcher(nil)
+
+	fake, githubServer, githubClient := newFakeGithub(t, map[string]string{
+		checks.CONFIG_FILE: testConfig,
+		"Dockerfile":       "FROM golang",
+	})
+
+	// Run the checks as the queue would, every check queuing the next ones
+	queue := []*checks.CheckParams{{
+		Type:           checks.SETUP,
+		Name:           checks.SETUP,
+		Owner:          "owner",
+		Repo:           "repo",
+		HeadSHA:        "sha",
+		Branch:         "main",
+		InstallationID: 12,
+		RepoID:         7,
+	}}
+	var ran []string
+	for len(queue) > 0 {
+		checkParams := queue[0]
+		queue = queue[1:]
+
+		var output []*checks.CheckParams
+		switch checkParams.Type {
+		case checks.SETUP:
+			output, err = checks.Setup(githubClient, checkParams)
+		case checks.PHANTOM_BUILD_IMAGE:
+			output, err = checks.BuildDockerImage(context.Background(), githubClient, checkParams)
+		case checks.PHANTOM_TEST_IMAGE:
+			output, err = checks.TestDockerImage(context.Background(), githubClient, checkParams)
+		default:
+			t.Fatalf("unexpected check %s '%s'", checkParams.Type, checkParams.Name)
+		}
+		if err != nil {
+			t.Fatalf("check '%s' failed: %v", checkParams.Name, err)
+		}
+		ran = append(ran, checkParams.Type)
+		queue = append(queue, output...)
+	}
+
+	if want := []string{checks.SETUP, checks.PHANTOM_BUILD_IMAGE, checks.PHANTOM_TEST_IMAGE}; len(ran) != len(want) || ran[0] != want[0] || ran[1] != want[1] || ran[2] != want[2] {
+		t.Errorf("ran %v, want %v", ran, want)
+	}
+	for name, conclusion := range fake.conclusions() {
+		if conclusion != checks.CONCLUSION_SUCCESS {
+			t.Errorf("check run '%s' concluded with '%s', want success", name, conclusion)
+		}
+	}
+
+	executions := apiServer.Executions()
+	if len(executions) != 2 {
+		t.Fatalf("Executions() = %v, want a build and a test", executions)
+	}
+	var build *apipb.Execution_BuildRequest
+	var test *apipb.Execution_TestRequest
+	for _, execution := range executions {
+		if execution.GetState() != apipb.Execution_STATE_SUCCESS {
+			t.Errorf("execution '%s' is %v, want success", execution.GetName(), execution.GetState())
+		}
+		if execution.GetBuildRequest() != nil {
+			build = execution.GetBuildRequest()
+		}
+		if execution.GetTestRequest() != nil {
+			test = execution.GetTestRequest()
+		}
+	}
+	if build == nil || build.Download != githubServer.URL+"/archive/sha.tar.gz" {
+		t.Errorf("build request = %v, want the archive of the commit", build)
+	}
+	if test == nil || len(test.GetTest()) == 0 {
+		t.Errorf("test request = %v, want the test of the config", test)
+	}
+
+	apiServer.Close()
+	if utils.API_URL != previousURL {
+		t.Errorf("API_URL = %s after stopping, want %s", utils.API_URL, previousURL)
+	}
+}
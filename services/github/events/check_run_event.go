@@ -1,15 +1,28 @@
 package events
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/google/go-github/v50/github"
 	checks "github.com/jahagaley/phantom/checks"
+	"github.com/jahagaley/phantom/services"
 	"github.com/jahagaley/phantom/services/pubsub"
 	"github.com/rs/zerolog/log"
 )
 
-func CheckRunEventHandler(event *github.CheckRunEvent) {
+// Permissions of the users whose re-runs approve the builds of fork pull
+// requests.
+var WRITE_PERMISSIONS = map[string]bool{
+	"admin": true,
+	"write": true,
+}
+
+// newGithubClient creates the Github client of an installation, tests replace
+// it with a client of a fake server.
+var newGithubClient = services.NewGithubClientWithInstallationId
+
+func CheckRunEventHandler(ctx context.Context, host string, event *github.CheckRunEvent) {
 
 	if event == nil {
 		log.Warn().Msg("CheckRunEvent is empty.")
@@ -36,12 +49,80 @@ func CheckRunEventHandler(event *github.CheckRunEvent) {
 		Branch:         *event.CheckRun.CheckSuite.HeadBranch,
 		DefaultBranch:  *event.Repo.DefaultBranch,
 		Options:        options,
+		Host:           host,
 		InstallationID: *event.Installation.ID,
 		RepoID:         *event.Repo.ID,
+		Rerun:          true,
 	}
 
-	err = pubsub.PublishGithubCheck(check)
+	// Re-runs requested on pull request checks stay scoped to the pull
+	// request. Re-running a gated check approves the builds of the fork,
+	// unless the user re-running it doesn't have write access.
+	pullRequest, githubClient, err := findPullRequest(ctx, check)
+	if err != nil {
+		log.Warn().Err(err).Msg(fmt.Sprintf("Unable to find the pull request of %s", check.HeadSHA))
+	} else if pullRequest != nil {
+		check.PullRequestNumber = pullRequest.GetNumber()
+		check.BaseBranch = pullRequest.GetBase().GetRef()
+		check.BaseSHA = pullRequest.GetBase().GetSHA()
+		check.IsFork = pullRequest.GetHead().GetRepo().GetID() != event.GetRepo().GetID()
+	}
+	if check.IsFork {
+		canWrite, err := hasWriteAccess(ctx, githubClient, check, event.GetSender().GetLogin())
+		if err != nil {
+			log.Warn().Err(err).Msg(fmt.Sprintf("Unable to get the permission of '%s', keeping the check gated.", event.GetSender().GetLogin()))
+		}
+		check.Gated = !canWrite
+	}
+
+	err = pubsub.PublishGithubCheckWithContext(ctx, check)
 	if err != nil {
 		log.Err(err).Msg("Unable to Publish CheckParams to PubSub")
 	}
 }
+
+// findPullRequest returns the open pull request whose head is the commit of
+// the check, or nil if there is none, with the client used to find it. Check
+// runs don't list the pull requests of forks, so they are looked up by their
+// head commit.
+func findPullRequest(ctx context.Context, check *checks.CheckParams) (*github.PullRequest, *github.Client, error) {
+	githubClient, err := newGithubClient(check.Host, check.InstallationID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	opts := &github.PullRequestListOptions{
+		State:       "open",
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+	for {
+		pullRequests, res, err := githubClient.PullRequests.List(ctx, check.Owner, check.Repo, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, pullRequest := range pullRequests {
+			if pullRequest.GetHead().GetSHA() == check.HeadSHA {
+				return pullRequest, githubClient, nil
+			}
+		}
+
+		if res.NextPage == 0 {
+			return nil, githubClient, nil
+		}
+		opts.Page = res.NextPage
+	}
+}
+
+// hasWriteAccess reports whether the user can push to the repository of the
+// check, and so approve the builds of fork pull requests.
+func hasWriteAccess(ctx context.Context, githubClient *github.Client, check *checks.CheckParams, user string) (bool, error) {
+	if len(user) == 0 {
+		return false, fmt.Errorf("The check run was re-run by an unknown user.")
+	}
+
+	permission, _, err := githubClient.Repositories.GetPermissionLevel(ctx, check.Owner, check.Repo, user)
+	if err != nil {
+		return false, err
+	}
+	return WRITE_PERMISSIONS[permission.GetPermission()], nil
+}
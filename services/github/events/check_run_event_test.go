@@ -0,0 +1,172 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"testing"
+
+	"github.com/google/go-github/v50/github"
+	checks "github.com/jahagaley/phantom/checks"
+)
+
+// fakeGithub serves the open pull requests of owner/repo over several pages,
+// and the permissions of its users.
+type fakeGithub struct {
+	pages       [][]*github.PullRequest
+	permissions map[string]string
+}
+
+func newFakeGithub(t *testing.T, fake *fakeGithub) {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/owner/repo/pulls", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("state") != "open" {
+			t.Errorf("pull requests listed with state %q, want open", r.URL.Query().Get("state"))
+		}
+		page := 1
+		fmt.Sscan(r.URL.Query().Get("page"), &page)
+		if page < len(fake.pages) {
+			w.Header().Set("Link", fmt.Sprintf(`<%s?state=open&page=%d>; rel="next"`, r.URL.Path, page+1))
+		}
+		var pullRequests []*github.PullRequest
+		if page <= len(fake.pages) {
+			pullRequests = fake.pages[page-1]
+		}
+		json.NewEncoder(w).Encode(pullRequests)
+	})
+	mux.HandleFunc("/repos/owner/repo/collaborators/", func(w http.ResponseWriter, r *http.Request) {
+		user := path.Base(path.Dir(r.URL.Path))
+		permission, ok := fake.permissions[user]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(&github.RepositoryPermissionLevel{Permission: github.String(permission)})
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	original := newGithubClient
+	newGithubClient = func(host string, installationID int64) (*github.Client, error) {
+		client := github.NewClient(srv.Client())
+		client.BaseURL, _ = url.Parse(srv.URL + "/")
+		return client, nil
+	}
+	t.Cleanup(func() { newGithubClient = original })
+}
+
+func pullRequest(number int, headSHA string, headRepoID int64) *github.PullRequest {
+	return &github.PullRequest{
+		Number: github.Int(number),
+		Head:   &github.PullRequestBranch{SHA: github.String(headSHA), Repo: &github.Repository{ID: github.Int64(headRepoID)}},
+		Base:   &github.PullRequestBranch{Ref: github.String("main"), SHA: github.String("base")},
+	}
+}
+
+func checkRunEvent(action, name, sender string) *github.CheckRunEvent {
+	return &github.CheckRunEvent{
+		Action: github.String(action),
+		CheckRun: &github.CheckRun{
+			ID:         github.Int64(100),
+			Name:       github.String(name),
+			HeadSHA:    github.String("head"),
+			CheckSuite: &github.CheckSuite{HeadBranch: github.String("feature")},
+		},
+		Repo: &github.Repository{
+			ID:            github.Int64(1),
+			Name:          github.String("repo"),
+			Owner:         &github.User{Login: github.String("owner")},
+			DefaultBranch: github.String("main"),
+		},
+		Installation: &github.Installation{ID: github.Int64(42)},
+		Sender:       &github.User{Login: github.String(sender)},
+	}
+}
+
+func TestCheckRunEventHandler(t *testing.T) {
+	forkPages := [][]*github.PullRequest{{pullRequest(3, "other", 2)}, {pullRequest(7, "head", 2)}}
+	branchPages := [][]*github.PullRequest{{pullRequest(8, "head", 1)}}
+	permissions := map[string]string{"maintainer": "admin", "developer": "write", "author": "read", "stranger": "none"}
+
+	tests := []struct {
+		name        string
+		event       *github.CheckRunEvent
+		pages       [][]*github.PullRequest
+		wantChecked bool
+		wantPR      int
+		wantFork    bool
+		wantGated   bool
+	}{
+		{"fork approved by an admin", checkRunEvent("rerequested", checks.SETUP, "maintainer"), forkPages, true, 7, true, false},
+		{"fork approved by a writer", checkRunEvent("rerequested", checks.SETUP, "developer"), forkPages, true, 7, true, false},
+		{"fork re-run by a reader", checkRunEvent("rerequested", checks.SETUP, "author"), forkPages, true, 7, true, true},
+		{"fork re-run without access", checkRunEvent("rerequested", checks.SETUP, "stranger"), forkPages, true, 7, true, true},
+		{"fork re-run by an unknown user", checkRunEvent("rerequested", checks.SETUP, "ghost"), forkPages, true, 7, true, true},
+		{"fork build re-run", checkRunEvent("rerequested", "Build Image - api (services/a)", "developer"), forkPages, true, 7, true, false},
+		{"branch pull request", checkRunEvent("rerequested", checks.SETUP, "author"), branchPages, true, 8, false, false},
+		{"no pull request", checkRunEvent("rerequested", checks.SETUP, "author"), nil, true, 0, false, false},
+		{"not a re-run", checkRunEvent("completed", checks.SETUP, "maintainer"), forkPages, false, 0, false, false},
+		{"unknown check", checkRunEvent("rerequested", "Lint - api", "maintainer"), forkPages, false, 0, false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			newFakeGithub(t, &fakeGithub{pages: test.pages, permissions: permissions})
+			q := usePublishedQueue(t)
+			CheckRunEventHandler(context.Background(), "", test.event)
+
+			if !test.wantChecked {
+				if len(q.checks) != 0 {
+					t.Errorf("CheckRunEventHandler() published %v, want nothing", q.checks)
+				}
+				return
+			}
+			if len(q.checks) != 1 {
+				t.Fatalf("CheckRunEventHandler() published %d checks, want the re-run check", len(q.checks))
+			}
+
+			check := q.checks[0]
+			if check.Name != test.event.CheckRun.GetName() || check.HeadSHA != "head" || !check.Rerun {
+				t.Errorf("CheckRunEventHandler() published %+v, want a re-run of %s", check, test.event.CheckRun.GetName())
+			}
+			if check.PullRequestNumber != test.wantPR || check.IsFork != test.wantFork || check.Gated != test.wantGated {
+				t.Errorf("pull request #%d, fork %v, gated %v, want #%d, fork %v, gated %v",
+					check.PullRequestNumber, check.IsFork, check.Gated, test.wantPR, test.wantFork, test.wantGated)
+			}
+		})
+	}
+}
+
+func TestFindPullRequest(t *testing.T) {
+	newFakeGithub(t, &fakeGithub{pages: [][]*github.PullRequest{
+		{pullRequest(1, "one", 2), pullRequest(2, "two", 1)},
+		{pullRequest(3, "three", 2)},
+	}})
+
+	tests := []struct {
+		headSHA string
+		want    int
+	}{
+		{"one", 1},
+		{"two", 2},
+		{"three", 3},
+		{"other", 0},
+	}
+
+	for _, test := range tests {
+		check := &checks.CheckParams{Owner: "owner", Repo: "repo", HeadSHA: test.headSHA}
+		pullRequest, client, err := findPullRequest(context.Background(), check)
+		if err != nil || client == nil {
+			t.Fatalf("findPullRequest(%s) error = %v", test.headSHA, err)
+		}
+		if pullRequest.GetNumber() != test.want {
+			t.Errorf("findPullRequest(%s) = #%d, want #%d", test.headSHA, pullRequest.GetNumber(), test.want)
+		}
+	}
+}
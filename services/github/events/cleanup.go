@@ -0,0 +1,211 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"connectrpc.com/connect"
+	apipb "github.com/jahagaley/phantomapi/phantom/api/v1"
+	api "github.com/jahagaley/phantomapi/phantom/api/v1/v1connect"
+
+	"github.com/jahagaley/phantom/services"
+)
+
+const (
+	// Filter matching the executions that haven't finished yet.
+	ACTIVE_EXECUTIONS_FILTER = `state = "PENDING" OR state = "RUNNING"`
+
+	// Longest time spent cancelling the executions and deleting the records
+	// of removed repositories.
+	CLEANUP_TIMEOUT = 10 * time.Minute
+)
+
+// runCleanup runs the cleanup in the background, on a context that isn't
+// cancelled once the webhook has been answered.
+func runCleanup(ctx context.Context, cleanup func(ctx context.Context)) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), CLEANUP_TIMEOUT)
+		defer cancel()
+		cleanup(ctx)
+	}()
+}
+
+// getInstallationProject returns the Phantom project the installation belongs to.
+func getInstallationProject(ctx context.Context, gitClient api.GitServiceClient, host string, installationID int64) (string, error) {
+	getInstallationRequest := &apipb.GetInstallationRequest{
+		Name: services.InstallationName("-", host, installationID),
+	}
+	res, err := gitClient.GetInstallation(ctx, connect.NewRequest(getInstallationRequest))
+	if err != nil {
+		return "", err
+	}
+
+	// Split the name field of the installation response to get the project name
+	parts := strings.Split(res.Msg.GetName(), "/")
+	if len(parts) < 2 {
+		return "", fmt.Errorf("Invalid installation name '%s'.", res.Msg.GetName())
+	}
+	return parts[1], nil
+}
+
+// listInstallationRepositories returns the names of the Phantom repositories
+// of the installation.
+func listInstallationRepositories(ctx context.Context, gitClient api.GitServiceClient, project, host string, installationID int64) ([]string, error) {
+	var repositories []string
+	pageToken := ""
+	for {
+		listRepositoriesRequest := &apipb.ListRepositoriesRequest{
+			Parent:    fmt.Sprintf("projects/%s", project),
+			Filter:    fmt.Sprintf(`installation = "%s"`, services.InstallationName(project, host, installationID)),
+			PageToken: pageToken,
+		}
+		res, err := gitClient.ListRepositories(ctx, connect.NewRequest(listRepositoriesRequest))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, repository := range res.Msg.GetRepositories() {
+			repositories = append(repositories, repository.GetName())
+		}
+
+		pageToken = res.Msg.GetNextPageToken()
+		if len(pageToken) == 0 {
+			return repositories, nil
+		}
+	}
+}
+
+// listRepositoryBuildsAndTests returns the names of the builds and tests of
+// the Phantom repository.
+func listRepositoryBuildsAndTests(ctx context.Context, gitClient api.GitServiceClient, project, repository string) ([]string, []string, error) {
+	filter := fmt.Sprintf(`repository = "%s"`, repository)
+
+	var builds []string
+	pageToken := ""
+	for {
+		listBuildsRequest := &apipb.ListBuildsRequest{
+			Parent:    fmt.Sprintf("projects/%s", project),
+			Filter:    filter,
+			PageToken: pageToken,
+		}
+		res, err := gitClient.ListBuilds(ctx, connect.NewRequest(listBuildsRequest))
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, build := range res.Msg.GetBuilds() {
+			builds = append(builds, build.GetName())
+		}
+
+		pageToken = res.Msg.GetNextPageToken()
+		if len(pageToken) == 0 {
+			break
+		}
+	}
+
+	var tests []string
+	for {
+		listTestsRequest := &apipb.ListTestsRequest{
+			Parent:    fmt.Sprintf("projects/%s", project),
+			Filter:    filter,
+			PageToken: pageToken,
+		}
+		res, err := gitClient.ListTests(ctx, connect.NewRequest(listTestsRequest))
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, test := range res.Msg.GetTests() {
+			tests = append(tests, test.GetName())
+		}
+
+		pageToken = res.Msg.GetNextPageToken()
+		if len(pageToken) == 0 {
+			return builds, tests, nil
+		}
+	}
+}
+
+// cancelRepositoryExecutions cancels the executions still running the builds
+// and tests of the Phantom repositories.
+func cancelRepositoryExecutions(ctx context.Context, gitClient api.GitServiceClient, project string, repositories []string) error {
+	buildsAndTests := make(map[string]bool)
+	for _, repository := range repositories {
+		builds, tests, err := listRepositoryBuildsAndTests(ctx, gitClient, project, repository)
+		if err != nil {
+			return err
+		}
+		for _, name := range append(builds, tests...) {
+			buildsAndTests[name] = true
+		}
+	}
+	if len(buildsAndTests) == 0 {
+		return nil
+	}
+
+	pageToken := ""
+	for {
+		listExecutionsRequest := &apipb.ListExecutionsRequest{
+			Parent:    fmt.Sprintf("projects/%s", project),
+			Filter:    ACTIVE_EXECUTIONS_FILTER,
+			PageToken: pageToken,
+		}
+		res, err := gitClient.ListExecutions(ctx, connect.NewRequest(listExecutionsRequest))
+		if err != nil {
+			return err
+		}
+
+		for _, execution := range res.Msg.GetExecutions() {
+			if !buildsAndTests[execution.GetBuildRequest().GetBuild()] && !buildsAndTests[execution.GetTestRequest().GetTest()] {
+				continue
+			}
+
+			cancelExecutionRequest := &apipb.CancelExecutionRequest{
+				Name: execution.GetName(),
+			}
+			_, err := gitClient.CancelExecution(ctx, connect.NewRequest(cancelExecutionRequest))
+			if err != nil {
+				log.Warn().Err(err).Msgf("Unable to cancel execution '%s'", execution.GetName())
+				continue
+			}
+			log.Info().Msgf("Cancelled execution '%s'", execution.GetName())
+		}
+
+		pageToken = res.Msg.GetNextPageToken()
+		if len(pageToken) == 0 {
+			return nil
+		}
+	}
+}
+
+// deleteRepository deletes the Phantom repository along with its builds and tests.
+func deleteRepository(ctx context.Context, gitClient api.GitServiceClient, project, repository string) error {
+	builds, tests, err := listRepositoryBuildsAndTests(ctx, gitClient, project, repository)
+	if err != nil {
+		return err
+	}
+
+	// Tests refer to builds, so they are deleted first
+	for _, test := range tests {
+		_, err := gitClient.DeleteTest(ctx, connect.NewRequest(&apipb.DeleteTestRequest{Name: test}))
+		if err != nil && connect.CodeOf(err) != connect.CodeNotFound {
+			return err
+		}
+	}
+	for _, build := range builds {
+		_, err := gitClient.DeleteBuild(ctx, connect.NewRequest(&apipb.DeleteBuildRequest{Name: build}))
+		if err != nil && connect.CodeOf(err) != connect.CodeNotFound {
+			return err
+		}
+	}
+
+	_, err = gitClient.DeleteRepository(ctx, connect.NewRequest(&apipb.DeleteRepositoryRequest{Name: repository}))
+	if err != nil && connect.CodeOf(err) != connect.CodeNotFound {
+		return err
+	}
+
+	log.Info().Msgf("Deleted repository '%s'", repository)
+	return nil
+}
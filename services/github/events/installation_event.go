@@ -0,0 +1,95 @@
+package events
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/go-github/v50/github"
+	"github.com/rs/zerolog/log"
+
+	"connectrpc.com/connect"
+	apipb "github.com/jahagaley/phantomapi/phantom/api/v1"
+	api "github.com/jahagaley/phantomapi/phantom/api/v1/v1connect"
+
+	"github.com/jahagaley/phantom/services"
+	"github.com/jahagaley/phantom/utils"
+	"github.com/jahagaley/phantom/utils/tracing"
+)
+
+func InstallationEventHandler(ctx context.Context, host string, event *github.InstallationEvent) {
+
+	if event == nil {
+		log.Warn().Msg("InstallationEvent is empty.")
+		return
+	}
+
+	installationID := event.GetInstallation().GetID()
+
+	switch event.GetAction() {
+	case "deleted":
+		// Events still queued for the installation can't get a token anymore
+		services.DeactivateInstallation(host, installationID)
+		runCleanup(ctx, func(ctx context.Context) { removeInstallation(ctx, host, installationID, true) })
+	case "suspend":
+		// The records are kept so checks run again once unsuspended
+		services.DeactivateInstallation(host, installationID)
+		runCleanup(ctx, func(ctx context.Context) { removeInstallation(ctx, host, installationID, false) })
+	case "unsuspend":
+		services.ActivateInstallation(host, installationID)
+		log.Info().Msg(fmt.Sprintf("Installation %d was unsuspended.", installationID))
+	default:
+		log.Info().Msg(fmt.Sprintf("InstallationEvent action '%s' is ignored: %d", event.GetAction(), installationID))
+	}
+}
+
+// removeInstallation cancels the executions of every repository of the
+// installation, and deletes the installation and its repositories if asked to.
+func removeInstallation(ctx context.Context, host string, installationID int64, deleteRecords bool) {
+	// Create a Phantom Git API client
+	gitClient := api.NewGitServiceClient(tracing.HTTPClient, utils.API_URL)
+
+	project, err := getInstallationProject(ctx, gitClient, host, installationID)
+	if connect.CodeOf(err) == connect.CodeNotFound {
+		log.Warn().Err(err).Msg("Installation not found")
+		return
+	} else if err != nil {
+		log.Err(err).Msg("Error getting installation")
+		return
+	}
+
+	repositories, err := listInstallationRepositories(ctx, gitClient, project, host, installationID)
+	if err != nil {
+		log.Err(err).Msg("Error listing repositories of installation")
+		return
+	}
+
+	err = cancelRepositoryExecutions(ctx, gitClient, project, repositories)
+	if err != nil {
+		log.Err(err).Msg("Error cancelling executions of installation")
+	}
+
+	if !deleteRecords {
+		log.Info().Msg(fmt.Sprintf("Installation %d was suspended.", installationID))
+		return
+	}
+
+	for _, repository := range repositories {
+		err = deleteRepository(ctx, gitClient, project, repository)
+		if err != nil {
+			// The installation is kept so the deletion can be retried
+			log.Err(err).Msgf("Error deleting repository: %s", repository)
+			return
+		}
+	}
+
+	deleteInstallationRequest := &apipb.DeleteInstallationRequest{
+		Name: services.InstallationName(project, host, installationID),
+	}
+	_, err = gitClient.DeleteInstallation(ctx, connect.NewRequest(deleteInstallationRequest))
+	if err != nil && connect.CodeOf(err) != connect.CodeNotFound {
+		log.Err(err).Msg("Error deleting installation")
+		return
+	}
+
+	log.Info().Msg(fmt.Sprintf("Installation %d was deleted.", installationID))
+}
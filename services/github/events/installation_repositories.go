@@ -3,7 +3,6 @@ package events
 import (
 	"context"
 	"fmt"
-	"net/http"
 	"strings"
 
 	"github.com/rs/zerolog/log"
@@ -16,10 +15,12 @@ import (
 	apipb "github.com/jahagaley/phantomapi/phantom/api/v1"
 	api "github.com/jahagaley/phantomapi/phantom/api/v1/v1connect"
 
+	"github.com/jahagaley/phantom/services"
 	"github.com/jahagaley/phantom/utils"
+	"github.com/jahagaley/phantom/utils/tracing"
 )
 
-func InstallationRepositoriesEventHandler(ctx context.Context, event *github.InstallationRepositoriesEvent) {
+func InstallationRepositoriesEventHandler(ctx context.Context, host string, event *github.InstallationRepositoriesEvent) {
 
 	if event == nil {
 		log.Warn().Msg("InstallationEvent is empty.")
@@ -31,11 +32,11 @@ func InstallationRepositoriesEventHandler(ctx context.Context, event *github.Ins
 
 	if event.GetAction() == "added" {
 		// Create a Phantom Git API client
-		gitClient := api.NewGitServiceClient(http.DefaultClient, utils.API_URL)
+		gitClient := api.NewGitServiceClient(tracing.HTTPClient, utils.API_URL)
 
 		// Get the installation from the GitService
 		getInstallationRequest := &apipb.GetInstallationRequest{
-			Name: fmt.Sprintf("projects/-/installations/%d", installationID),
+			Name: services.InstallationName("-", host, installationID),
 		}
 		res, err := gitClient.GetInstallation(ctx, connect.NewRequest(getInstallationRequest))
 		installation := res.Msg
@@ -58,7 +59,7 @@ func InstallationRepositoriesEventHandler(ctx context.Context, event *github.Ins
 				DisplayName:    repo.GetName(),
 				Owner:          repo.GetOwner().GetLogin(),
 				DefaultBranch:  repo.GetDefaultBranch(),
-				Installation:   fmt.Sprintf("projects/%s/installations/%d", project, installationID),
+				Installation:   services.InstallationName(project, host, installationID),
 				RepositoryType: apipb.Repository_REPOSITORY_TYPE_GITHUB,
 			}
 
@@ -75,6 +76,41 @@ func InstallationRepositoriesEventHandler(ctx context.Context, event *github.Ins
 		}
 
 	} else if event.GetAction() == "removed" {
-		// TODO - support removing repositories
+		removed := event.RepositoriesRemoved
+		runCleanup(ctx, func(ctx context.Context) { removeRepositories(ctx, host, installationID, removed) })
+	}
+}
+
+// removeRepositories cancels the executions of the repositories removed from
+// the installation, and deletes them.
+func removeRepositories(ctx context.Context, host string, installationID int64, removed []*github.Repository) {
+	// Create a Phantom Git API client
+	gitClient := api.NewGitServiceClient(tracing.HTTPClient, utils.API_URL)
+
+	project, err := getInstallationProject(ctx, gitClient, host, installationID)
+	if connect.CodeOf(err) == connect.CodeNotFound {
+		log.Warn().Err(err).Msg("Installation not found")
+		return
+	} else if err != nil {
+		log.Err(err).Msg("Error getting installation")
+		return
+	}
+
+	var repositories []string
+	for _, repo := range removed {
+		repositories = append(repositories, fmt.Sprintf("projects/%s/repositories/%d", project, repo.GetID()))
+	}
+
+	// Stop the builds and tests of the removed repositories before deleting them
+	err = cancelRepositoryExecutions(ctx, gitClient, project, repositories)
+	if err != nil {
+		log.Err(err).Msg("Error cancelling executions of removed repositories")
+	}
+
+	for _, repository := range repositories {
+		err = deleteRepository(ctx, gitClient, project, repository)
+		if err != nil {
+			log.Err(err).Msgf("Error deleting repository: %s", repository)
+		}
 	}
 }
@@ -0,0 +1,66 @@
+package events
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/go-github/v50/github"
+	checks "github.com/jahagaley/phantom/checks"
+	"github.com/jahagaley/phantom/services/pubsub"
+	"github.com/rs/zerolog/log"
+)
+
+// Authors of fork pull requests whose builds run without approval.
+var TRUSTED_AUTHOR_ASSOCIATIONS = map[string]bool{
+	"OWNER":        true,
+	"MEMBER":       true,
+	"COLLABORATOR": true,
+}
+
+func PullRequestEventHandler(ctx context.Context, host string, event *github.PullRequestEvent) {
+
+	if event == nil {
+		log.Warn().Msg("PullRequestEvent is empty.")
+		return
+	}
+
+	action := event.GetAction()
+	if action != "opened" && action != "synchronize" && action != "reopened" {
+		log.Info().Msg(fmt.Sprintf("PullRequestEvent action '%s' is ignored: %d", action, event.GetNumber()))
+		return
+	}
+
+	pullRequest := event.GetPullRequest()
+	head, base := pullRequest.GetHead(), pullRequest.GetBase()
+	isFork := head.GetRepo().GetFullName() != base.GetRepo().GetFullName()
+
+	// Commits on branches of this repository already get a Setup check from
+	// their push event.
+	if !isFork {
+		log.Info().Msg(fmt.Sprintf("PullRequestEvent for branch '%s' is handled by push events.", head.GetRef()))
+		return
+	}
+
+	check := &checks.CheckParams{
+		Type:              checks.SETUP,
+		Name:              checks.SETUP,
+		Owner:             event.GetRepo().GetOwner().GetLogin(),
+		Repo:              event.GetRepo().GetName(),
+		HeadSHA:           head.GetSHA(),
+		Branch:            head.GetRef(),
+		DefaultBranch:     event.GetRepo().GetDefaultBranch(),
+		Host:              host,
+		InstallationID:    event.GetInstallation().GetID(),
+		RepoID:            event.GetRepo().GetID(),
+		PullRequestNumber: event.GetNumber(),
+		BaseBranch:        base.GetRef(),
+		BaseSHA:           base.GetSHA(),
+		IsFork:            true,
+		Gated:             !TRUSTED_AUTHOR_ASSOCIATIONS[pullRequest.GetAuthorAssociation()],
+	}
+
+	err := pubsub.PublishGithubCheckWithContext(ctx, check)
+	if err != nil {
+		log.Err(err).Msg("Unable to Publish CheckParams to PubSub")
+	}
+}
@@ -0,0 +1,107 @@
+package events
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-github/v50/github"
+	checks "github.com/jahagaley/phantom/checks"
+	"github.com/jahagaley/phantom/services/pubsub"
+)
+
+// publishedQueue records the checks published by the event handlers.
+type publishedQueue struct {
+	*pubsub.MemoryQueue
+	checks []*checks.CheckParams
+}
+
+func (q *publishedQueue) Publish(ctx context.Context, data []byte) (string, error) {
+	check, err := pubsub.DecodeCheckParams(data)
+	if err != nil {
+		return "", err
+	}
+	q.checks = append(q.checks, check)
+	return check.Name, nil
+}
+
+func usePublishedQueue(t *testing.T) *publishedQueue {
+	t.Helper()
+	q := &publishedQueue{MemoryQueue: pubsub.NewMemoryQueue(1, 1)}
+	pubsub.SetQueue(q)
+	t.Cleanup(func() {
+		pubsub.SetQueue(nil)
+		q.Close()
+	})
+	return q
+}
+
+func pullRequestEvent(action, headRepo, association string) *github.PullRequestEvent {
+	return &github.PullRequestEvent{
+		Action: github.String(action),
+		Number: github.Int(7),
+		Repo: &github.Repository{
+			ID:            github.Int64(1),
+			Name:          github.String("repo"),
+			Owner:         &github.User{Login: github.String("owner")},
+			DefaultBranch: github.String("main"),
+		},
+		Installation: &github.Installation{ID: github.Int64(42)},
+		PullRequest: &github.PullRequest{
+			AuthorAssociation: github.String(association),
+			Head: &github.PullRequestBranch{
+				Ref:  github.String("feature"),
+				SHA:  github.String("head"),
+				Repo: &github.Repository{FullName: github.String(headRepo)},
+			},
+			Base: &github.PullRequestBranch{
+				Ref:  github.String("main"),
+				SHA:  github.String("base"),
+				Repo: &github.Repository{FullName: github.String("owner/repo")},
+			},
+		},
+	}
+}
+
+func TestPullRequestEventHandler(t *testing.T) {
+	tests := []struct {
+		name        string
+		event       *github.PullRequestEvent
+		wantChecked bool
+		wantGated   bool
+	}{
+		{"fork by an owner", pullRequestEvent("opened", "fork/repo", "OWNER"), true, false},
+		{"fork by a member", pullRequestEvent("synchronize", "fork/repo", "MEMBER"), true, false},
+		{"fork by a collaborator", pullRequestEvent("reopened", "fork/repo", "COLLABORATOR"), true, false},
+		{"fork by a contributor", pullRequestEvent("opened", "fork/repo", "CONTRIBUTOR"), true, true},
+		{"fork by a first time contributor", pullRequestEvent("opened", "fork/repo", "FIRST_TIME_CONTRIBUTOR"), true, true},
+		{"fork by anyone", pullRequestEvent("synchronize", "fork/repo", "NONE"), true, true},
+		{"branch of the repository", pullRequestEvent("opened", "owner/repo", "CONTRIBUTOR"), false, false},
+		{"closed fork", pullRequestEvent("closed", "fork/repo", "NONE"), false, false},
+		{"no event", nil, false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q := usePublishedQueue(t)
+			PullRequestEventHandler(context.Background(), "", test.event)
+
+			if !test.wantChecked {
+				if len(q.checks) != 0 {
+					t.Errorf("PullRequestEventHandler() published %v, want nothing", q.checks)
+				}
+				return
+			}
+			if len(q.checks) != 1 {
+				t.Fatalf("PullRequestEventHandler() published %d checks, want a Setup check", len(q.checks))
+			}
+
+			check := q.checks[0]
+			if check.Type != checks.SETUP || check.HeadSHA != "head" || check.PullRequestNumber != 7 || check.BaseSHA != "base" || !check.IsFork {
+				t.Errorf("PullRequestEventHandler() published %+v, want the Setup check of the fork pull request", check)
+			}
+			if check.Gated != test.wantGated {
+				t.Errorf("Gated = %v, want %v", check.Gated, test.wantGated)
+			}
+		})
+	}
+}
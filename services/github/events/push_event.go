@@ -1,15 +1,22 @@
 package events
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/google/go-github/v50/github"
-	"github.com/jahagaley/phantom/async"
-	checks "github.com/jahagaley/phantom/checks/utils"
+	checks "github.com/jahagaley/phantom/checks"
+	"github.com/jahagaley/phantom/services/pubsub"
+	"github.com/jahagaley/phantom/utils/settings"
 	"github.com/rs/zerolog/log"
 )
 
-func PushEventHandler(event *github.PushEvent) {
+const (
+	// Before SHA of pushes creating a new branch.
+	EMPTY_SHA = "0000000000000000000000000000000000000000"
+)
+
+func PushEventHandler(ctx context.Context, host string, event *github.PushEvent) {
 
 	if event == nil {
 		log.Warn().Msg("PushEvent is empty.")
@@ -34,13 +41,33 @@ func PushEventHandler(event *github.PushEvent) {
 		HeadSHA:        *event.HeadCommit.ID,
 		Branch:         event.GetRef()[len("refs/heads/"):],
 		DefaultBranch:  *event.Repo.DefaultBranch,
+		Host:           host,
 		InstallationID: *event.Installation.ID,
 		RepoID:         *event.Repo.ID,
 	}
 
-	err := async.PublishGithubCheck(check)
+	// Only the configs affected by the pushed commits are checked. Pushes
+	// creating a branch have nothing to compare with.
+	before := event.GetBefore()
+	if before != EMPTY_SHA {
+		check.BaseSHA = before
+	}
+
+	err := pubsub.PublishGithubCheckWithContext(ctx, check)
 	if err != nil {
 		log.Err(err).Msg("Unable to Publish CheckParams to PubSub")
 	}
 
+	// Checks of the previous head of the branch are no longer needed.
+	if len(before) == 0 || before == EMPTY_SHA || before == check.HeadSHA {
+		return
+	}
+	if check.Branch == check.DefaultBranch && !settings.Get().Github.CancelDefaultBranch {
+		return
+	}
+	// The cancellation is queued, so it is retried and drained like any check.
+	cancelCheck := checks.NewCancelSupersededCheck(check, before, event.GetHeadCommit().GetURL())
+	if err := pubsub.PublishGithubCheckWithContext(ctx, cancelCheck); err != nil {
+		log.Err(err).Msg(fmt.Sprintf("Unable to queue the cancellation of the checks superseded by %s", check.HeadSHA))
+	}
 }
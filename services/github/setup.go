@@ -15,9 +15,11 @@ import (
 
 	"github.com/jahagaley/phantom/services"
 	"github.com/jahagaley/phantom/utils"
+	"github.com/jahagaley/phantom/utils/tracing"
 )
 
-// TODO - Support Github app removals
+// SetupHandler creates the installation and its repositories once the Github
+// app is installed. Removals are handled by the installation webhook events.
 func SetupHandler(w http.ResponseWriter, r *http.Request) {
 	// Get the installation_id and state query parameters from the request
 	installationID := r.URL.Query().Get("installation_id")
@@ -43,8 +45,11 @@ func SetupHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Apps on Github Enterprise Server name their host in their setup URL
+	host := r.URL.Query().Get("host")
+
 	// Create a GitHub client using the installation ID
-	client, err := services.NewGithubClientWithInstallationId(installationIDInt)
+	client, err := services.NewGithubClientWithInstallationId(host, installationIDInt)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to create GitHub client")
 		http.Error(w, "Failed to create GitHub client", http.StatusInternalServerError)
@@ -60,12 +65,12 @@ func SetupHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Create a Phantom Git API client
-	gitClient := api.NewGitServiceClient(http.DefaultClient, utils.API_URL)
+	gitClient := api.NewGitServiceClient(tracing.HTTPClient, utils.API_URL)
 
 	// Creates a new installation for the project
 	createInstallationRequest := &apipb.CreateInstallationRequest{
 		Parent:         fmt.Sprintf("projects/%s", state),
-		InstallationId: installationID,
+		InstallationId: services.InstallationID(host, installationIDInt),
 		Installation:   &apipb.Installation{},
 	}
 	_, err = gitClient.CreateInstallation(r.Context(), connect.NewRequest(createInstallationRequest))
@@ -88,7 +93,7 @@ func SetupHandler(w http.ResponseWriter, r *http.Request) {
 				DisplayName:    repo.GetName(),
 				Owner:          repo.GetOwner().GetLogin(),
 				DefaultBranch:  repo.GetDefaultBranch(),
-				Installation:   fmt.Sprintf("projects/%s/installations/%s", state, installationID),
+				Installation:   services.InstallationName(state, host, installationIDInt),
 				RepositoryType: apipb.Repository_REPOSITORY_TYPE_GITHUB,
 			},
 		}
@@ -0,0 +1,183 @@
+package github
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v50/github"
+
+	"github.com/jahagaley/phantom/services"
+	"github.com/jahagaley/phantom/utils"
+	"github.com/jahagaley/phantom/utils/settings"
+)
+
+const (
+	// Header naming the Github Enterprise Server instance sending a webhook.
+	ENTERPRISE_HOST_HEADER = "X-GitHub-Enterprise-Host"
+
+	// How long loaded secrets are cached before being read again, and how
+	// long to wait before trying again after failing to load them.
+	webhookSecretRefreshInterval = 5 * time.Minute
+	webhookSecretRetryInterval   = 30 * time.Second
+)
+
+var (
+	ErrMissingSignature   = errors.New("missing " + github.SHA256SignatureHeader + " header")
+	ErrInvalidSignature   = errors.New("payload signature does not match any webhook secret")
+	ErrInvalidContentType = errors.New("webhook payload is neither JSON nor form encoded")
+)
+
+type webhookSecrets struct {
+	host string
+
+	mu         sync.Mutex
+	current    []byte
+	previous   []byte
+	graceUntil time.Time
+	loadedAt   time.Time
+
+	// Last error loading the secrets, returned until the retry interval passed.
+	loadErr    error
+	loadFailed time.Time
+}
+
+// Webhook secrets of every Github host.
+var (
+	secretsMu sync.Mutex
+	secrets   = make(map[string]*webhookSecrets)
+)
+
+// getWebhookSecrets returns the webhook secrets of a configured Github host.
+func getWebhookSecrets(host string) (*webhookSecrets, error) {
+	githubHost, err := services.GetGithubHost(host)
+	if err != nil {
+		return nil, err
+	}
+
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+
+	s, ok := secrets[githubHost.Host]
+	if !ok {
+		s = &webhookSecrets{host: githubHost.Host}
+		secrets[githubHost.Host] = s
+	}
+	return s, nil
+}
+
+// keys returns the secrets a webhook signature may currently be validated against.
+func (s *webhookSecrets) keys() ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	stale := s.current == nil || now.Sub(s.loadedAt) > webhookSecretRefreshInterval
+	if stale && now.Sub(s.loadFailed) > webhookSecretRetryInterval {
+		if err := s.load(); err != nil {
+			s.loadErr, s.loadFailed = err, now
+		} else {
+			s.loadErr, s.loadedAt = nil, now
+		}
+	}
+
+	// Keep serving the secrets we already have if a refresh fails.
+	if s.current == nil {
+		return nil, s.loadErr
+	}
+
+	keys := [][]byte{s.current}
+	if len(s.previous) > 0 && now.Before(s.graceUntil) {
+		keys = append(keys, s.previous)
+	}
+	return keys, nil
+}
+
+func (s *webhookSecrets) load() error {
+	githubHost, err := services.GetGithubHost(s.host)
+	if err != nil {
+		return err
+	}
+	name := githubHost.WebhookSecretName
+	if len(name) == 0 {
+		return fmt.Errorf("No webhook secret configured for host '%s'.", s.host)
+	}
+
+	// The webhook secret of github.com can be rotated through the settings.
+	var previousName string
+	var graceUntil time.Time
+	if githubHost.Host == services.DEFAULT_GITHUB_HOST {
+		previousName = settings.Get().Github.PreviousWebhookSecret
+		graceUntil = settings.Get().Github.WebhookSecretGraceUntil
+	}
+
+	current, err := utils.AccessSecretVersion(name)
+	if err != nil {
+		return fmt.Errorf("Unable to load webhook secret: %w", err)
+	}
+	if len(current) == 0 {
+		return fmt.Errorf("Webhook secret '%s' is empty.", name)
+	}
+
+	var previous []byte
+	if len(previousName) > 0 {
+		// There is no need to read the previous secret once the grace window is over.
+		if time.Now().Before(graceUntil) {
+			previous, err = utils.AccessSecretVersion(previousName)
+			if err != nil {
+				return fmt.Errorf("Unable to load previous webhook secret: %w", err)
+			}
+		}
+	}
+
+	s.current, s.previous, s.graceUntil = current, previous, graceUntil
+	return nil
+}
+
+// WebhookHost returns the Github host that sent the webhook request.
+func WebhookHost(r *http.Request) string {
+	return services.HostName(r.Header.Get(ENTERPRISE_HOST_HEADER))
+}
+
+// ValidateWebhookPayload verifies the HMAC-SHA256 signature of a Github webhook
+// request against the webhook secrets of its host and returns the JSON payload.
+func ValidateWebhookPayload(r *http.Request, host string) ([]byte, error) {
+	signature := r.Header.Get(github.SHA256SignatureHeader)
+	if len(signature) == 0 {
+		return nil, ErrMissingSignature
+	}
+
+	contentType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || (contentType != "application/json" && contentType != "application/x-www-form-urlencoded") {
+		return nil, fmt.Errorf("%w: '%s'", ErrInvalidContentType, r.Header.Get("Content-Type"))
+	}
+
+	hostSecrets, err := getWebhookSecrets(host)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := hostSecrets.keys()
+	if err != nil {
+		return nil, err
+	}
+
+	// The body can only be read once, so keep it around to try every key.
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		payload, err := github.ValidatePayloadFromBody(contentType, bytes.NewReader(body), signature, key)
+		if err == nil {
+			return payload, nil
+		}
+	}
+
+	return nil, ErrInvalidSignature
+}
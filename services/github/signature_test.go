@@ -0,0 +1,130 @@
+package github
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v50/github"
+
+	"github.com/jahagaley/phantom/services"
+)
+
+func sign(key, payload string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(payload))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestValidateWebhookPayload(t *testing.T) {
+	const host = "github.com"
+	const payload = `{"action": "opened"}`
+
+	secretsMu.Lock()
+	secrets[host] = &webhookSecrets{
+		host:       host,
+		current:    []byte("current"),
+		previous:   []byte("previous"),
+		graceUntil: time.Now().Add(time.Hour),
+		loadedAt:   time.Now(),
+	}
+	secretsMu.Unlock()
+	t.Cleanup(func() {
+		secretsMu.Lock()
+		delete(secrets, host)
+		secretsMu.Unlock()
+	})
+
+	tests := []struct {
+		name        string
+		contentType string
+		signature   string
+		wantErr     error
+	}{
+		{"current secret", "application/json", sign("current", payload), nil},
+		{"previous secret", "application/json; charset=utf-8", sign("previous", payload), nil},
+		{"other secret", "application/json", sign("other", payload), ErrInvalidSignature},
+		{"missing signature", "application/json", "", ErrMissingSignature},
+		{"missing content type", "", sign("current", payload), ErrInvalidContentType},
+		{"unsupported content type", "text/plain", sign("current", payload), ErrInvalidContentType},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/github/webhooks", strings.NewReader(payload))
+			if len(test.contentType) > 0 {
+				r.Header.Set("Content-Type", test.contentType)
+			}
+			if len(test.signature) > 0 {
+				r.Header.Set(github.SHA256SignatureHeader, test.signature)
+			}
+
+			got, err := ValidateWebhookPayload(r, host)
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Errorf("ValidateWebhookPayload() error = %v, want %v", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil || string(got) != payload {
+				t.Errorf("ValidateWebhookPayload() = %q, %v, want %q", got, err, payload)
+			}
+		})
+	}
+}
+
+func TestWebhookSecretsOfUnknownHost(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/github/webhooks", strings.NewReader("payload"))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set(github.SHA256SignatureHeader, sign("current", "payload"))
+
+	_, err := ValidateWebhookPayload(r, "unknown.example.com")
+	if !errors.Is(err, services.ErrUnknownHost) {
+		t.Errorf("ValidateWebhookPayload() error = %v, want %v", err, services.ErrUnknownHost)
+	}
+
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	if _, ok := secrets["unknown.example.com"]; ok {
+		t.Error("secrets are kept for an unknown host")
+	}
+}
+
+func TestWebhookSecretsRetryInterval(t *testing.T) {
+	loadErr := errors.New("secret manager unavailable")
+	s := &webhookSecrets{host: "github.example.com", loadErr: loadErr, loadFailed: time.Now()}
+
+	// Loading again right away would fail on the unknown host instead
+	if _, err := s.keys(); err != loadErr {
+		t.Errorf("keys() error = %v, want the last load error", err)
+	}
+
+	s.loadFailed = time.Now().Add(-webhookSecretRetryInterval - time.Second)
+	if _, err := s.keys(); err == loadErr || err == nil {
+		t.Errorf("keys() error = %v, want a new load error", err)
+	}
+
+	// Secrets already loaded are kept while loading them fails
+	s.current, s.loadedAt, s.loadFailed = []byte("current"), time.Now().Add(-time.Hour), time.Now()
+	if keys, err := s.keys(); err != nil || len(keys) != 1 {
+		t.Errorf("keys() = %q, %v, want the loaded secret", keys, err)
+	}
+}
+
+func TestWebhookHandlerRejectsInvalidContentType(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/github/webhooks", strings.NewReader("payload"))
+	r.Header.Set("Content-Type", "text/plain")
+	r.Header.Set(github.SHA256SignatureHeader, sign("current", "payload"))
+	w := httptest.NewRecorder()
+
+	WebhookHandler(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("WebhookHandler() status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
@@ -1,34 +1,75 @@
 package github
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/google/go-github/v50/github"
+	"github.com/jahagaley/phantom/services"
 	"github.com/jahagaley/phantom/services/github/events"
+	"github.com/jahagaley/phantom/utils/metrics"
 )
 
 // Github Webhook Handler
 func WebhookHandler(w http.ResponseWriter, r *http.Request) {
 	log.Info().Msg("Received a Github Webhook event.")
-	payload, err := github.ValidatePayload(r, nil)
-	if err != nil {
-		log.Error().Msg(fmt.Sprintf("Unable to read payload: %v", err))
+	recorder := metrics.NewStatusRecorder(w)
+	defer func() {
+		metrics.WebhooksReceived.WithLabelValues(github.WebHookType(r), strconv.Itoa(recorder.Status)).Inc()
+	}()
+	w = recorder
+
+	host := WebhookHost(r)
+	payload, err := ValidateWebhookPayload(r, host)
+	if errors.Is(err, ErrMissingSignature) || errors.Is(err, ErrInvalidSignature) || errors.Is(err, services.ErrUnknownHost) {
+		log.Warn().
+			Err(err).
+			Str("delivery_id", github.DeliveryID(r)).
+			Str("event_type", github.WebHookType(r)).
+			Str("host", host).
+			Str("remote_addr", r.RemoteAddr).
+			Str("user_agent", r.UserAgent()).
+			Msg("Rejected Github Webhook event with an invalid signature.")
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	} else if errors.Is(err, ErrInvalidContentType) {
+		log.Warn().Err(err).Str("delivery_id", github.DeliveryID(r)).Msg("Rejected Github Webhook event with an invalid content type.")
+		http.Error(w, "Unsupported content type", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Error().Err(err).Str("delivery_id", github.DeliveryID(r)).Msg("Unable to read payload")
+		http.Error(w, "Unable to read payload", http.StatusInternalServerError)
+		return
 	}
 
 	event, err := github.ParseWebHook(github.WebHookType(r), payload)
 	if err != nil {
 		log.Error().Msg(fmt.Sprintf("Unable to parse event: %v", err))
+		http.Error(w, "Unable to parse event", http.StatusBadRequest)
+		return
 	}
 
+	trace.SpanFromContext(r.Context()).SetAttributes(
+		attribute.String("github.event", github.WebHookType(r)),
+		attribute.String("github.delivery_id", github.DeliveryID(r)),
+	)
+
 	switch event := event.(type) {
 	case *github.PushEvent:
-		events.PushEventHandler(event)
+		events.PushEventHandler(r.Context(), host, event)
+	case *github.PullRequestEvent:
+		events.PullRequestEventHandler(r.Context(), host, event)
 	case *github.CheckRunEvent:
-		events.CheckRunEventHandler(event)
+		events.CheckRunEventHandler(r.Context(), host, event)
 	case *github.InstallationRepositoriesEvent:
-		events.InstallationRepositoriesEventHandler(r.Context(), event)
+		events.InstallationRepositoriesEventHandler(r.Context(), host, event)
+	case *github.InstallationEvent:
+		events.InstallationEventHandler(r.Context(), host, event)
 	}
 }
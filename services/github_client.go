@@ -1,90 +1,81 @@
 package services
 
 import (
-	"context"
-	"time"
+	"fmt"
+	"net/http"
 
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/go-github/v50/github"
-	"github.com/jahagaley/phantom/utils"
 	"github.com/rs/zerolog/log"
 	"golang.org/x/oauth2"
-)
 
-const (
-	GITHUB_APP_ID = "PHANTOM_APP_ID"
+	"github.com/jahagaley/phantom/utils/metrics"
+	"github.com/jahagaley/phantom/utils/tracing"
 )
 
-func createInstallationToken(currentClient *github.Client, installationID int64) (string, error) {
-	// Create an installation token for the repository
-	token, _, err := currentClient.Apps.CreateInstallationToken(context.Background(), installationID, nil)
-	if err != nil {
-		log.Warn().Err(err).Msg("Error creating installation token")
-		return "", err
+// NewGithubClientWithInstallationId creates a client authenticated as the
+// installation of the app on the Github host, an empty host being github.com.
+func NewGithubClientWithInstallationId(host string, installationID int64) (*github.Client, error) {
+	// Deleted and suspended installations can't get a token
+	if !IsInstallationActive(host, installationID) {
+		return nil, ErrInstallationInactive
 	}
 
-	return token.GetToken(), nil
-}
-
-func NewGithubClientWithInstallationId(installationID int64) (*github.Client, error) {
-	client, err := NewGithubClient()
+	githubHost, err := GetGithubHost(host)
 	if err != nil {
-		log.Err(err).Msg("Error creating Github client")
 		return nil, err
 	}
 
-	// Create a new OAuth2 token source with the installation access token
-	token, err := createInstallationToken(client, installationID)
-	if err != nil {
+	// Installation tokens are cached until they are about to expire, get one
+	// now so a failure is reported when creating the client.
+	ts := getInstallationTokenSource(githubHost, installationID)
+	if _, err := ts.Token(); err != nil {
 		log.Err(err).Msg("Unable to create token for Github installation")
 		return nil, err
 	}
-	ts := oauth2.StaticTokenSource(
-		&oauth2.Token{AccessToken: token},
-	)
 
 	// Create a new OAuth2 HTTP client with the token source
-	tc := oauth2.NewClient(context.Background(), ts)
+	tc := newRateLimitedClient(ts, githubHost.Host, installationID)
 
 	// Create a new GitHub client with the HTTP client
-	client = github.NewClient(tc)
-
-	return client, nil
+	return githubHost.NewClient(tc)
 }
 
-func NewGithubClient() (*github.Client, error) {
-	// Getting secret from Secret Manager
-	privateKey, err := utils.AccessSecretVersion("projects/jahagaley/secrets/github_pem/versions/latest")
+// NewGithubClient creates a client authenticated as the app on the Github host.
+func NewGithubClient(host string) (*github.Client, error) {
+	githubHost, err := GetGithubHost(host)
 	if err != nil {
-		log.Err(err).Msg("Error reading private key - from named secret")
 		return nil, err
 	}
 
-	// Parse the private key into an rsa.PrivateKey object
-	key, err := jwt.ParseRSAPrivateKeyFromPEM(privateKey)
-	if err != nil {
-		log.Warn().Err(err).Msg("Error parsing private key")
+	// App JWTs are cached until they are about to expire
+	ts := getAppTokenSource(githubHost)
+	if _, err := ts.Token(); err != nil {
+		log.Err(err).Msg("Error creating Github app token")
 		return nil, err
 	}
 
-	// Create a new JWT for the GitHub App
-	now := time.Now()
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.RegisteredClaims{
-		IssuedAt:  jwt.NewNumericDate(now),
-		ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute * 10)),
-		Issuer:    GITHUB_APP_ID,
-	})
-	tokenString, err := token.SignedString(key)
-	if err != nil {
-		return nil, err
-	}
-
-	// Set up the OAuth2 token for authentication using the JWT
-	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: tokenString})
-	tc := oauth2.NewClient(context.Background(), ts)
+	tc := newRateLimitedClient(ts, githubHost.Host, 0)
 
 	// Create a new GitHub client with the HTTP client
-	client := github.NewClient(tc)
+	return githubHost.NewClient(tc)
+}
+
+// newRateLimitedClient creates an HTTP client authenticated with the token
+// source, which handles the Github rate limits of the installation.
+func newRateLimitedClient(ts oauth2.TokenSource, host string, installationID int64) *http.Client {
+	return &http.Client{
+		Transport: tracing.NewTransport(&RateLimitTransport{
+			Base: &oauth2.Transport{
+				Source: ts,
+				Base:   &metrics.Transport{Base: http.DefaultTransport},
+			},
+			Host:           host,
+			InstallationID: installationID,
+		}, githubSpanName),
+	}
+}
 
-	return client, nil
+// githubSpanName names the spans of Github API requests after their endpoint.
+func githubSpanName(r *http.Request) string {
+	return fmt.Sprintf("github %s %s", r.Method, metrics.GithubEndpoint(r.URL.Path))
 }
@@ -0,0 +1,186 @@
+// Package health serves the liveness and readiness probes of the server.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"connectrpc.com/connect"
+	apipb "github.com/jahagaley/phantomapi/phantom/api/v1"
+	api "github.com/jahagaley/phantomapi/phantom/api/v1/v1connect"
+	"github.com/rs/zerolog/log"
+
+	"github.com/jahagaley/phantom/services"
+	"github.com/jahagaley/phantom/services/pubsub"
+	"github.com/jahagaley/phantom/utils/settings"
+)
+
+const (
+	// How long dependency checks are reused, load balancers probe every few
+	// seconds.
+	CHECK_INTERVAL = 30 * time.Second
+
+	// Longest time a single dependency check takes.
+	CHECK_TIMEOUT = 3 * time.Second
+
+	STATUS_OK        = "ok"
+	STATUS_ERROR     = "error"
+	STATUS_READY     = "ready"
+	STATUS_NOT_READY = "not_ready"
+	STATUS_DRAINING  = "draining"
+)
+
+// Dependency is a service the server needs to run checks.
+type Dependency struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// Dependencies checked by the readiness probe.
+var Dependencies = []Dependency{
+	{"github", func(ctx context.Context) error { return services.CheckPrivateKeys() }},
+	{"queue", pubsub.PingQueue},
+	{"phantom_api", pingAPI},
+}
+
+// DependencyStatus is the result of the last check of a dependency.
+type DependencyStatus struct {
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// Report is the body of the probe responses.
+type Report struct {
+	Status       string                      `json:"status"`
+	Dependencies map[string]DependencyStatus `json:"dependencies,omitempty"`
+}
+
+var (
+	statusesMu sync.Mutex
+	statuses   = make(map[string]DependencyStatus)
+)
+
+// LivenessHandler reports that the server is running. It doesn't check the
+// dependencies, so their outages don't restart the server.
+func LivenessHandler(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, http.StatusOK, &Report{Status: STATUS_OK})
+}
+
+// ReadinessHandler reports whether the server can take checks: every
+// dependency answers and the server isn't shutting down.
+func ReadinessHandler(w http.ResponseWriter, r *http.Request) {
+	report := &Report{
+		Status:       STATUS_READY,
+		Dependencies: checkDependencies(r.Context()),
+	}
+	for _, status := range report.Dependencies {
+		if status.Status != STATUS_OK {
+			report.Status = STATUS_NOT_READY
+		}
+	}
+	// Load balancers stop sending requests before the server stops
+	if pubsub.IsDraining() {
+		report.Status = STATUS_DRAINING
+	}
+
+	code := http.StatusOK
+	if report.Status != STATUS_READY {
+		code = http.StatusServiceUnavailable
+	}
+	writeReport(w, code, report)
+}
+
+// checkDependencies returns the status of every dependency, checking again
+// the ones last checked more than CHECK_INTERVAL ago. Concurrent probes wait
+// for the same checks.
+func checkDependencies(ctx context.Context) map[string]DependencyStatus {
+	statusesMu.Lock()
+	defer statusesMu.Unlock()
+
+	var wg sync.WaitGroup
+	results := make([]DependencyStatus, len(Dependencies))
+	for i, dependency := range Dependencies {
+		if status, ok := statuses[dependency.Name]; ok && time.Since(status.CheckedAt) < CHECK_INTERVAL {
+			results[i] = status
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, dependency Dependency) {
+			defer wg.Done()
+			results[i] = checkDependency(ctx, dependency)
+		}(i, dependency)
+	}
+	wg.Wait()
+
+	output := make(map[string]DependencyStatus)
+	for i, dependency := range Dependencies {
+		previous, checked := statuses[dependency.Name]
+		status := results[i]
+
+		// Only changes are logged, probes would flood the logs otherwise
+		if status.Status == STATUS_ERROR && (!checked || previous.Status != STATUS_ERROR) {
+			log.Warn().Str("dependency", dependency.Name).Msg(fmt.Sprintf("Dependency is unavailable: %s", status.Error))
+		} else if status.Status == STATUS_OK && checked && previous.Status != STATUS_OK {
+			log.Info().Str("dependency", dependency.Name).Msg("Dependency is available again")
+		}
+
+		statuses[dependency.Name] = status
+		output[dependency.Name] = status
+	}
+	return output
+}
+
+func checkDependency(ctx context.Context, dependency Dependency) DependencyStatus {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), CHECK_TIMEOUT)
+	defer cancel()
+
+	// Checks ignoring the context don't hold the probe past the timeout
+	done := make(chan error, 1)
+	go func() {
+		done <- dependency.Check(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("No answer after %s.", CHECK_TIMEOUT)
+	}
+
+	status := DependencyStatus{Status: STATUS_OK, CheckedAt: time.Now()}
+	if err != nil {
+		status.Status = STATUS_ERROR
+		status.Error = err.Error()
+	}
+	return status
+}
+
+// pingAPI checks that the GitService of the Phantom API answers, on its own
+// address so the probe doesn't go through the load balancer of this server.
+// There is no installation 0, so any answer of the service but an outage will
+// do.
+func pingAPI(ctx context.Context) error {
+	gitClient := api.NewGitServiceClient(http.DefaultClient, settings.Get().APIHealthURL)
+	_, err := gitClient.GetInstallation(ctx, connect.NewRequest(&apipb.GetInstallationRequest{
+		Name: services.InstallationName("-", services.DEFAULT_GITHUB_HOST, 0),
+	}))
+
+	switch connect.CodeOf(err) {
+	case connect.CodeNotFound, connect.CodePermissionDenied, connect.CodeUnauthenticated:
+		return nil
+	}
+	return err
+}
+
+func writeReport(w http.ResponseWriter, code int, report *Report) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(report)
+}
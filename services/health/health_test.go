@@ -0,0 +1,58 @@
+package health
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jahagaley/phantom/services/apitest"
+	"github.com/jahagaley/phantom/utils/settings"
+)
+
+func TestPingAPI(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.Handler
+		wantErr bool
+	}{
+		{
+			name:    "git service",
+			handler: apitest.NewServer().Handler(),
+		},
+		{
+			name: "server error",
+			handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			}),
+			wantErr: true,
+		},
+		{
+			// A load balancer or site answering on the address isn't the API
+			name: "not the git service",
+			handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("<html></html>"))
+			}),
+			wantErr: true,
+		},
+	}
+
+	previous := settings.Get()
+	defer settings.Set(previous)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(tt.handler)
+			defer server.Close()
+
+			s := *previous
+			s.APIHealthURL = server.URL
+			settings.Set(&s)
+
+			err := pingAPI(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("pingAPI() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
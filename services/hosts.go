@@ -0,0 +1,119 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/google/go-github/v50/github"
+	"gopkg.in/yaml.v3"
+
+	"github.com/jahagaley/phantom/utils/settings"
+)
+
+const (
+	// Host of the events and checks that don't name one.
+	DEFAULT_GITHUB_HOST = "github.com"
+)
+
+var ErrUnknownHost = errors.New("Unknown Github host.")
+
+// GithubHost is a Github instance the app is installed on, with the app
+// registered on it.
+type GithubHost struct {
+	Host string `yaml:"host"`
+
+	// API URLs of Github Enterprise Server, ex: "https://github.example.com/api/v3/".
+	// Empty for github.com.
+	BaseURL   string `yaml:"base_url"`
+	UploadURL string `yaml:"upload_url"`
+
+	AppID int64 `yaml:"app_id"`
+
+	// Secret Manager versions holding the private key of the app and the
+	// secret of its webhooks.
+	PrivateKeyName    string `yaml:"private_key"`
+	WebhookSecretName string `yaml:"webhook_secret"`
+}
+
+var (
+	hostsOnce sync.Once
+	hosts     map[string]*GithubHost
+	hostsErr  error
+)
+
+// GetGithubHost returns the configuration of the Github host, an empty host
+// being github.com.
+func GetGithubHost(host string) (*GithubHost, error) {
+	hostsOnce.Do(func() {
+		hosts, hostsErr = loadGithubHosts()
+	})
+	if hostsErr != nil {
+		return nil, hostsErr
+	}
+
+	githubHost, ok := hosts[HostName(host)]
+	if !ok {
+		return nil, fmt.Errorf("%w: '%s'", ErrUnknownHost, host)
+	}
+	return githubHost, nil
+}
+
+// HostName returns the name of the host, defaulting to github.com.
+func HostName(host string) string {
+	if len(host) == 0 {
+		return DEFAULT_GITHUB_HOST
+	}
+	return host
+}
+
+func loadGithubHosts() (map[string]*GithubHost, error) {
+	output := make(map[string]*GithubHost)
+
+	// The app on github.com is configured by the settings, Github Enterprise
+	// Server apps are listed in the hosts file.
+	s := settings.Get().Github
+	output[DEFAULT_GITHUB_HOST] = &GithubHost{
+		Host:              DEFAULT_GITHUB_HOST,
+		AppID:             s.AppID,
+		PrivateKeyName:    s.PrivateKey,
+		WebhookSecretName: s.WebhookSecret,
+	}
+
+	file := s.HostsFile
+	if len(file) == 0 {
+		return output, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read Github hosts: %w", err)
+	}
+	var githubHosts []*GithubHost
+	if err := yaml.Unmarshal(data, &githubHosts); err != nil {
+		return nil, fmt.Errorf("Unable to parse Github hosts: %w", err)
+	}
+
+	for _, githubHost := range githubHosts {
+		if len(githubHost.Host) == 0 || len(githubHost.PrivateKeyName) == 0 {
+			return nil, fmt.Errorf("Github hosts need a 'host' and a 'private_key'.")
+		}
+		output[githubHost.Host] = githubHost
+	}
+	return output, nil
+}
+
+// NewClient creates a Github client for the API of the host.
+func (h *GithubHost) NewClient(httpClient *http.Client) (*github.Client, error) {
+	if len(h.BaseURL) == 0 {
+		return github.NewClient(httpClient), nil
+	}
+
+	uploadURL := h.UploadURL
+	if len(uploadURL) == 0 {
+		uploadURL = h.BaseURL
+	}
+	return github.NewEnterpriseClient(h.BaseURL, uploadURL, httpClient)
+}
@@ -0,0 +1,85 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v50/github"
+)
+
+const (
+	// Installations are known to be inactive for this long, then Github is
+	// asked again when creating their next token. Installations deactivated
+	// by a webhook delivered to another instance are found the same way.
+	INACTIVE_INSTALLATION_TTL = 10 * time.Minute
+)
+
+// ErrInstallationInactive is returned for installations that were deleted
+// or suspended, Github refuses to create tokens for them.
+var ErrInstallationInactive = errors.New("Github installation is deleted or suspended.")
+
+// Installations known to be deleted or suspended, with the time they were
+// found to be.
+var inactiveInstallations sync.Map
+
+// DeactivateInstallation stops creating clients for the installation.
+func DeactivateInstallation(host string, installationID int64) {
+	inactiveInstallations.Store(installationKey{HostName(host), installationID}, time.Now())
+	forgetInstallationTokenSource(host, installationID)
+}
+
+// ActivateInstallation creates clients for the installation again, after it
+// was unsuspended.
+func ActivateInstallation(host string, installationID int64) {
+	inactiveInstallations.Delete(installationKey{HostName(host), installationID})
+}
+
+// IsInstallationActive reports whether clients can be created for the installation.
+func IsInstallationActive(host string, installationID int64) bool {
+	key := installationKey{HostName(host), installationID}
+	since, inactive := inactiveInstallations.Load(key)
+	if inactive && time.Since(since.(time.Time)) > INACTIVE_INSTALLATION_TTL {
+		inactiveInstallations.CompareAndDelete(key, since)
+		return true
+	}
+	return !inactive
+}
+
+// isInstallationGone reports whether Github refused to create a token because
+// the installation was deleted or suspended.
+func isInstallationGone(err error) bool {
+	var errorResponse *github.ErrorResponse
+	if !errors.As(err, &errorResponse) || errorResponse.Response == nil {
+		return false
+	}
+
+	switch errorResponse.Response.StatusCode {
+	case http.StatusNotFound:
+		return true
+	case http.StatusForbidden:
+		return strings.Contains(strings.ToLower(errorResponse.Message), "suspended")
+	}
+	return false
+}
+
+// InstallationID returns the ID of the Phantom installation of a Github
+// installation. Installation IDs are only unique on a host, so the IDs of
+// installations on Github Enterprise Server start with their host.
+func InstallationID(host string, installationID int64) string {
+	host = HostName(host)
+	if host == DEFAULT_GITHUB_HOST {
+		return strconv.FormatInt(installationID, 10)
+	}
+	return fmt.Sprintf("%s-%d", strings.ReplaceAll(strings.ToLower(host), ".", "-"), installationID)
+}
+
+// InstallationName returns the name of the Phantom installation of a Github
+// installation in the project, "-" matching any project.
+func InstallationName(project, host string, installationID int64) string {
+	return fmt.Sprintf("projects/%s/installations/%s", project, InstallationID(host, installationID))
+}
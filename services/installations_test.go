@@ -0,0 +1,81 @@
+package services
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v50/github"
+)
+
+func TestIsInstallationActive(t *testing.T) {
+	const installationID = 42
+	t.Cleanup(func() { ActivateInstallation("", installationID) })
+
+	if !IsInstallationActive("", installationID) {
+		t.Fatal("unknown installation is inactive")
+	}
+
+	DeactivateInstallation("", installationID)
+	if IsInstallationActive(DEFAULT_GITHUB_HOST, installationID) {
+		t.Error("deactivated installation is active")
+	}
+	if !IsInstallationActive("github.example.com", installationID) {
+		t.Error("installation with the same ID on another host is inactive")
+	}
+
+	// Github is asked again once the deactivation is old enough
+	inactiveInstallations.Store(installationKey{DEFAULT_GITHUB_HOST, installationID}, time.Now().Add(-INACTIVE_INSTALLATION_TTL-time.Second))
+	if !IsInstallationActive("", installationID) {
+		t.Error("installation deactivated long ago is inactive")
+	}
+
+	DeactivateInstallation("", installationID)
+	ActivateInstallation("", installationID)
+	if !IsInstallationActive("", installationID) {
+		t.Error("activated installation is inactive")
+	}
+}
+
+func TestIsInstallationGone(t *testing.T) {
+	errorResponse := func(status int, message string) error {
+		return &github.ErrorResponse{Response: &http.Response{StatusCode: status}, Message: message}
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"deleted", errorResponse(http.StatusNotFound, "Not Found"), true},
+		{"suspended", errorResponse(http.StatusForbidden, "This installation has been suspended"), true},
+		{"forbidden", errorResponse(http.StatusForbidden, "Resource not accessible by integration"), false},
+		{"server error", errorResponse(http.StatusBadGateway, ""), false},
+		{"other", errors.New("connection refused"), false},
+		{"none", nil, false},
+	}
+
+	for _, test := range tests {
+		if got := isInstallationGone(test.err); got != test.want {
+			t.Errorf("isInstallationGone(%s) = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestInstallationName(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"", "projects/p/installations/12"},
+		{DEFAULT_GITHUB_HOST, "projects/p/installations/12"},
+		{"GitHub.Example.com", "projects/p/installations/github-example-com-12"},
+	}
+
+	for _, test := range tests {
+		if got := InstallationName("p", test.host, 12); got != test.want {
+			t.Errorf("InstallationName(%q) = %q, want %q", test.host, got, test.want)
+		}
+	}
+}
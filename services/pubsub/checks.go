@@ -1,30 +1,77 @@
 package pubsub
 
 import (
+	"context"
+	"fmt"
+	"time"
+
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/trace"
 
 	. "github.com/jahagaley/phantom/checks"
 	"github.com/jahagaley/phantom/services"
+	"github.com/jahagaley/phantom/utils/metrics"
+	"github.com/jahagaley/phantom/utils/tracing"
 )
 
-func RunIntendedCheck(checkParams *CheckParams) error {
+// newGithubClient creates the Github client of an installation, tests replace
+// it with a client of a fake server.
+var newGithubClient = services.NewGithubClientWithInstallationId
+
+// RunIntendedCheck runs the check, builds and tests stop waiting on their
+// execution once the context is done.
+func RunIntendedCheck(ctx context.Context, checkParams *CheckParams) (err error) {
+	// The check continues the trace of the Github event that started it
+	ctx, span := tracing.Tracer().Start(tracing.Extract(ctx, checkParams.TraceContext), "check "+checkParams.Name,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(checkAttributes(checkParams)...),
+	)
+	defer func() { tracing.EndSpan(span, err) }()
+
+	metrics.ChecksStarted.WithLabelValues(checkParams.Type).Inc()
+	defer func(start time.Time) {
+		result := metrics.Result(err)
+		if err != nil && ctx.Err() != nil {
+			result = "interrupted"
+		}
+		metrics.Since(metrics.CheckDuration.WithLabelValues(checkParams.Type, result), start)
+	}(time.Now())
+
 	// Get the Client from Github
-	githubClient, err := services.NewGithubClientWithInstallationId(checkParams.InstallationID)
+	githubClient, err := newGithubClient(checkParams.Host, checkParams.InstallationID)
 	if err != nil {
 		log.Err(err).Msg("Failed to create Github client.")
 		return err
 	}
 
+	if checkParams.Type == CANCEL_SUPERSEDED {
+		return CancelSupersededChecks(ctx, githubClient, checkParams)
+	}
+
+	// Checks queued on a commit replaced by a newer push don't run, nor do
+	// retries of checks whose check run was concluded since, ex: cancelled.
+	if CancelIfSuperseded(githubClient, checkParams) {
+		return nil
+	}
+	if checkParams.CheckRunID != 0 && IsCheckRunCompleted(githubClient, checkParams) {
+		log.Info().Msg(fmt.Sprintf("Check run '%s' has already concluded, skipping the check.", checkParams.Name))
+		return nil
+	}
+
 	// outputs of checks
 	var checks []*CheckParams
-	switch checkParams.Type {
-	case SETUP:
+	switch {
+	// Checks depending on several checks are queued again until all of
+	// them have concluded.
+	case len(PendingParents(checkParams)) > 0:
+		checks, err = AwaitParents(githubClient, checkParams)
+	case checkParams.Type == SETUP:
 		checks, err = Setup(githubClient, checkParams)
-	case PHANTOM_BUILD_IMAGE:
-		checks, err = BuildDockerImage(githubClient, checkParams)
-	case PHANTOM_TEST_IMAGE:
-		checks, err = TestDockerImage(githubClient, checkParams)
-	case PHANTOM_RESOURCE_VALIDATION:
+	case checkParams.Type == PHANTOM_BUILD_IMAGE:
+		checks, err = BuildDockerImage(ctx, githubClient, checkParams)
+	case checkParams.Type == PHANTOM_TEST_IMAGE:
+		checks, err = TestDockerImage(ctx, githubClient, checkParams)
+	case checkParams.Type == PHANTOM_RESOURCE_VALIDATION:
 		checks, err = ValidateEnvironmentResources(githubClient, checkParams)
 	}
 
@@ -35,7 +82,7 @@ func RunIntendedCheck(checkParams *CheckParams) error {
 
 	// publish new checks back to pubsub
 	for _, c := range checks {
-		err = PublishGithubCheck(c)
+		err = PublishGithubCheckWithContext(ctx, c)
 		if err != nil {
 			log.Err(err).Msg("Failed to publish check.")
 			return err
@@ -0,0 +1,120 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/jahagaley/phantom/checks"
+)
+
+const (
+	// Longest time spent re-publishing, acking or delaying a message once its
+	// check was interrupted by a shutdown.
+	REQUEUE_TIMEOUT = 5 * time.Second
+)
+
+// Set once the server is shutting down, new checks are no longer accepted.
+var draining atomic.Bool
+
+// Checks currently being handled, idle is closed once there are none.
+var (
+	runningMu sync.Mutex
+	running   int
+	idle      chan struct{}
+)
+
+// StartDraining stops accepting Pub/Sub pushes and new checks, so they are
+// delivered to other instances.
+func StartDraining() {
+	runningMu.Lock()
+	defer runningMu.Unlock()
+
+	draining.Store(true)
+}
+
+// IsDraining reports whether the server is shutting down.
+func IsDraining() bool {
+	return draining.Load()
+}
+
+// WaitRunningChecks waits until no check is running, and returns false if the
+// context is done first.
+func WaitRunningChecks(ctx context.Context) bool {
+	runningMu.Lock()
+	if running == 0 {
+		runningMu.Unlock()
+		return true
+	}
+	done := idle
+	runningMu.Unlock()
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// startCheck counts a check as running, and returns false without counting
+// it once the server is draining. Both happen under runningMu, so no check
+// starts after WaitRunningChecks has seen none running.
+func startCheck() bool {
+	runningMu.Lock()
+	defer runningMu.Unlock()
+
+	if IsDraining() {
+		return false
+	}
+	if running == 0 {
+		idle = make(chan struct{})
+	}
+	running++
+	return true
+}
+
+func endCheck() {
+	runningMu.Lock()
+	defer runningMu.Unlock()
+
+	running--
+	if running == 0 {
+		close(idle)
+	}
+}
+
+// requeueInterruptedCheck publishes a check interrupted by a shutdown again,
+// so another worker resumes waiting on its execution, and marks its check run
+// as queued. Checks that can't be published, or would be lost with the
+// in-memory queue, are resumed by this instance on restart.
+func requeueInterruptedCheck(checkParams *checks.CheckParams) {
+	if _, ok := queue.(*MemoryQueue); ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), REQUEUE_TIMEOUT)
+	defer cancel()
+
+	interruptedCheck := *checkParams
+	interruptedCheck.NotBefore = time.Time{}
+
+	data, err := EncodeCheckParams(&interruptedCheck)
+	if err == nil {
+		_, err = queue.Publish(ctx, data)
+	}
+	if err != nil {
+		log.Error().Err(err).Msg(fmt.Sprintf("Unable to re-queue interrupted check '%s', it resumes on restart", checkParams.Name))
+		return
+	}
+	checks.ForgetExecution(checkParams)
+	log.Info().Msg(fmt.Sprintf("Re-queued check '%s' interrupted by shutdown", checkParams.Name))
+
+	if checkParams.CheckRunID != 0 {
+		requeueCheckRun(&interruptedCheck, "Phantom is restarting, the check will resume shortly.")
+	}
+}
@@ -0,0 +1,74 @@
+package pubsub
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// Version of the envelope format, bumped on incompatible changes.
+	ENVELOPE_VERSION = 1
+
+	// Types of the messages sent through the queues.
+	MESSAGE_TYPE_CHECK = "github.check"
+)
+
+var errNotAnEnvelope = errors.New("message is not a JSON envelope")
+
+// Envelope wraps every message sent through the queues, so messages can be
+// read by other tools and by other versions of Phantom.
+type Envelope struct {
+	Version int    `json:"version"`
+	Type    string `json:"type"`
+
+	// Shared by every message caused by the same Github event.
+	TraceID   string    `json:"trace_id"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// W3C trace context of the span publishing the message.
+	TraceContext map[string]string `json:"trace_context,omitempty"`
+
+	Payload json.RawMessage `json:"payload"`
+}
+
+func encodeEnvelope(messageType, traceID string, traceContext map[string]string, payload any) ([]byte, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(traceID) == 0 {
+		traceID = NewTraceID()
+	}
+
+	return json.Marshal(&Envelope{
+		Version:      ENVELOPE_VERSION,
+		Type:         messageType,
+		TraceID:      traceID,
+		CreatedAt:    time.Now().UTC(),
+		TraceContext: traceContext,
+		Payload:      data,
+	})
+}
+
+// decodeEnvelope returns errNotAnEnvelope for data in another format.
+func decodeEnvelope(data []byte) (*Envelope, error) {
+	envelope := &Envelope{}
+	if err := json.Unmarshal(data, envelope); err != nil || envelope.Version == 0 {
+		return nil, errNotAnEnvelope
+	}
+	if envelope.Version > ENVELOPE_VERSION {
+		return nil, fmt.Errorf("Unsupported envelope version %d, expected at most %d.", envelope.Version, ENVELOPE_VERSION)
+	}
+	return envelope, nil
+}
+
+// NewTraceID returns a random ID in the W3C trace context format.
+func NewTraceID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,235 @@
+package pubsub
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jahagaley/phantom/checks"
+	"github.com/jahagaley/phantom/utils/settings"
+)
+
+func testCheckParams() *checks.CheckParams {
+	return &checks.CheckParams{
+		Type:           checks.PHANTOM_TEST_IMAGE,
+		Name:           "unit",
+		Owner:          "owner",
+		Repo:           "repo",
+		HeadSHA:        "sha",
+		Options:        map[string]string{"name": "unit"},
+		InstallationID: 12,
+		Attempt:        2,
+		NotBefore:      time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+	}
+}
+
+func TestDecodeEnvelope(t *testing.T) {
+	gobData, err := encodeGobCheckParams(testCheckParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		data          []byte
+		wantType      string
+		wantErr       bool
+		notAnEnvelope bool
+	}{
+		{"envelope", []byte(`{"version":1,"type":"github.check","trace_id":"abc","payload":{}}`), MESSAGE_TYPE_CHECK, false, false},
+		{"gob", gobData, "", true, true},
+		{"not JSON", []byte("check"), "", true, true},
+		{"JSON without version", []byte(`{"type":"github.check"}`), "", true, true},
+		{"newer version", []byte(`{"version":2,"type":"github.check","payload":{}}`), "", true, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			envelope, err := decodeEnvelope(test.data)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("decodeEnvelope() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if errors.Is(err, errNotAnEnvelope) != test.notAnEnvelope {
+				t.Errorf("decodeEnvelope() error = %v, want errNotAnEnvelope %v", err, test.notAnEnvelope)
+			}
+			if err == nil && envelope.Type != test.wantType {
+				t.Errorf("Type = %s, want %s", envelope.Type, test.wantType)
+			}
+		})
+	}
+}
+
+func TestDecodeCheckParams(t *testing.T) {
+	previous := settings.Get()
+	defer settings.Set(previous)
+
+	for _, encoding := range []string{settings.QUEUE_ENCODING_JSON, settings.QUEUE_ENCODING_GOB} {
+		t.Run(encoding, func(t *testing.T) {
+			s := *previous
+			s.Queue.Encoding = encoding
+			settings.Set(&s)
+
+			want := testCheckParams()
+			want.TraceID = "trace"
+			data, err := EncodeCheckParams(want)
+			if err != nil {
+				t.Fatalf("EncodeCheckParams() error = %v", err)
+			}
+			got, err := DecodeCheckParams(data)
+			if err != nil {
+				t.Fatalf("DecodeCheckParams() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("DecodeCheckParams() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestDecodeCheckParamsEnvelope(t *testing.T) {
+	payload, err := json.Marshal(testCheckParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope := func(messageType string, payload []byte) []byte {
+		data, err := json.Marshal(&Envelope{
+			Version:      ENVELOPE_VERSION,
+			Type:         messageType,
+			TraceID:      "envelope-trace",
+			TraceContext: map[string]string{"traceparent": "00-envelope-trace-01"},
+			Payload:      payload,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	// Checks without a trace continue the trace of their envelope
+	checkParams, err := DecodeCheckParams(envelope(MESSAGE_TYPE_CHECK, payload))
+	if err != nil {
+		t.Fatalf("DecodeCheckParams() error = %v", err)
+	}
+	if checkParams.TraceID != "envelope-trace" || checkParams.TraceContext["traceparent"] != "00-envelope-trace-01" {
+		t.Errorf("DecodeCheckParams() trace = %s %v, want the trace of the envelope", checkParams.TraceID, checkParams.TraceContext)
+	}
+
+	if _, err := DecodeCheckParams(envelope("github.other", payload)); err == nil {
+		t.Error("DecodeCheckParams() of another message type succeeded, want an error")
+	}
+	if _, err := DecodeCheckParams(envelope(MESSAGE_TYPE_CHECK, []byte(`"check"`))); err == nil {
+		t.Error("DecodeCheckParams() of an invalid payload succeeded, want an error")
+	}
+}
+
+// goldenCheckPayload is the payload of a check in the envelope, pinning the
+// names of its fields read by other tools and versions.
+const goldenCheckPayload = `{
+	"type": "Run Test",
+	"name": "Run Test - unit",
+	"owner": "owner",
+	"repo": "repo",
+	"head_sha": "sha",
+	"branch": "feature",
+	"default_branch": "main",
+	"base_sha": "base",
+	"options": {"name": "unit"},
+	"host": "github.example.com",
+	"check_run_id": 42,
+	"installation_id": 12,
+	"repo_id": 7,
+	"pull_request_number": 3,
+	"base_branch": "main",
+	"is_fork": true,
+	"gated": true,
+	"rerun": true,
+	"execution_name": "projects/p/executions/1",
+	"execution_deadline": "2024-05-01T12:00:00Z",
+	"trace_id": "trace",
+	"trace_context": {"traceparent": "00-trace-01"},
+	"parent_conclusions": {"Build Image - api": "success"},
+	"parents_scheduled_at": "2024-05-01T12:00:00Z",
+	"attempt": 2,
+	"not_before": "2024-05-01T12:00:00Z",
+	"last_error": "down"
+}`
+
+func goldenCheckParams() *checks.CheckParams {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	return &checks.CheckParams{
+		Type:               checks.PHANTOM_TEST_IMAGE,
+		Name:               "Run Test - unit",
+		Owner:              "owner",
+		Repo:               "repo",
+		HeadSHA:            "sha",
+		Branch:             "feature",
+		DefaultBranch:      "main",
+		BaseSHA:            "base",
+		Options:            map[string]string{"name": "unit"},
+		Host:               "github.example.com",
+		CheckRunID:         42,
+		InstallationID:     12,
+		RepoID:             7,
+		PullRequestNumber:  3,
+		BaseBranch:         "main",
+		IsFork:             true,
+		Gated:              true,
+		Rerun:              true,
+		ExecutionName:      "projects/p/executions/1",
+		ExecutionDeadline:  at,
+		TraceID:            "trace",
+		TraceContext:       map[string]string{"traceparent": "00-trace-01"},
+		ParentConclusions:  map[string]string{"Build Image - api": "success"},
+		ParentsScheduledAt: at,
+		Attempt:            2,
+		NotBefore:          at,
+		LastError:          "down",
+	}
+}
+
+func TestCheckPayloadGolden(t *testing.T) {
+	var want bytes.Buffer
+	if err := json.Compact(&want, []byte(goldenCheckPayload)); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := json.Marshal(goldenCheckParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want.String() {
+		t.Errorf("payload = %s\nwant %s", got, want.String())
+	}
+
+	decoded := &checks.CheckParams{}
+	if err := json.Unmarshal([]byte(goldenCheckPayload), decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, goldenCheckParams()) {
+		t.Errorf("decoded payload = %+v, want %+v", decoded, goldenCheckParams())
+	}
+}
+
+func TestDecodeLegacyCheckPayload(t *testing.T) {
+	// Older versions wrote the Go names of the fields
+	legacy := map[string]any{}
+	value := reflect.ValueOf(goldenCheckParams()).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		legacy[value.Type().Field(i).Name] = value.Field(i).Interface()
+	}
+	payload, err := json.Marshal(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := &checks.CheckParams{}
+	if err := json.Unmarshal(payload, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, goldenCheckParams()) {
+		t.Errorf("decoded legacy payload = %+v, want %+v", decoded, goldenCheckParams())
+	}
+}
@@ -0,0 +1,184 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// Directories used by the file queue for waiting and delivered messages.
+	fileQueuePendingDir  = "pending"
+	fileQueueInflightDir = "inflight"
+	fileQueueExtension   = ".msg"
+
+	// How often the file queue looks for new messages.
+	fileQueuePollInterval = time.Second
+)
+
+// FileQueue is a durable queue storing each message as a file in a directory.
+// Messages that were delivered but never acked are delivered again when the
+// queue is subscribed to after a restart.
+type FileQueue struct {
+	dir string
+}
+
+func NewFileQueue(dir string) (*FileQueue, error) {
+	for _, d := range []string{fileQueuePendingDir, fileQueueInflightDir} {
+		if err := os.MkdirAll(path.Join(dir, d), 0o700); err != nil {
+			return nil, err
+		}
+	}
+	return &FileQueue{dir: dir}, nil
+}
+
+func (q *FileQueue) pendingPath(id string) string {
+	return path.Join(q.dir, fileQueuePendingDir, id+fileQueueExtension)
+}
+
+func (q *FileQueue) inflightPath(id string) string {
+	return path.Join(q.dir, fileQueueInflightDir, id+fileQueueExtension)
+}
+
+// newFileQueueID returns the ID of a message delivered from notBefore on.
+// IDs sort in delivery order.
+func newFileQueueID(notBefore time.Time) (string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%020d-%s", notBefore.UnixNano(), hex.EncodeToString(suffix)), nil
+}
+
+// isDue reports whether the message can be delivered.
+func isDue(id string, now time.Time) bool {
+	notBefore, _, _ := strings.Cut(id, "-")
+	nanos, err := strconv.ParseInt(notBefore, 10, 64)
+	return err != nil || nanos <= now.UnixNano()
+}
+
+func (q *FileQueue) Publish(ctx context.Context, data []byte) (string, error) {
+	id, err := newFileQueueID(time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	// Write to a temporary file first so subscribers never see partial messages.
+	tempFile := path.Join(q.dir, id+".tmp")
+	if err := os.WriteFile(tempFile, data, 0o600); err != nil {
+		os.Remove(tempFile)
+		return "", err
+	}
+	if err := os.Rename(tempFile, q.pendingPath(id)); err != nil {
+		os.Remove(tempFile)
+		return "", err
+	}
+	return id, nil
+}
+
+func (q *FileQueue) Subscribe(ctx context.Context, handler MessageHandler) error {
+	// Deliver messages that were in flight when the process last stopped.
+	inflight, err := q.list(fileQueueInflightDir)
+	if err != nil {
+		return err
+	}
+	for _, id := range inflight {
+		if err := os.Rename(q.inflightPath(id), q.pendingPath(id)); err != nil {
+			log.Warn().Err(err).Msg(fmt.Sprintf("Unable to recover in flight message '%s'", id))
+		}
+	}
+
+	ticker := time.NewTicker(fileQueuePollInterval)
+	defer ticker.Stop()
+	for {
+		pending, err := q.list(fileQueuePendingDir)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		for _, id := range pending {
+			// Pending messages sort by delivery time
+			if !isDue(id, now) {
+				break
+			}
+			// Renaming claims the message, skip it if another subscriber got it first.
+			if err := os.Rename(q.pendingPath(id), q.inflightPath(id)); err != nil {
+				continue
+			}
+			data, err := os.ReadFile(q.inflightPath(id))
+			if err != nil {
+				log.Warn().Err(err).Msg(fmt.Sprintf("Unable to read message '%s'", id))
+				continue
+			}
+			go handler(ctx, &Message{ID: id, Data: data})
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (q *FileQueue) list(dir string) ([]string, error) {
+	entries, err := os.ReadDir(path.Join(q.dir, dir))
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, entry := range entries {
+		if id, ok := strings.CutSuffix(entry.Name(), fileQueueExtension); ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (q *FileQueue) Ack(ctx context.Context, msg *Message) error {
+	err := os.Remove(q.inflightPath(msg.ID))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (q *FileQueue) Nack(ctx context.Context, msg *Message) error {
+	return os.Rename(q.inflightPath(msg.ID), q.pendingPath(msg.ID))
+}
+
+// Delay moves the message back to the pending messages under an ID sorting
+// at notBefore.
+func (q *FileQueue) Delay(ctx context.Context, msg *Message, notBefore time.Time) error {
+	id, err := newFileQueueID(notBefore)
+	if err != nil {
+		return err
+	}
+	return os.Rename(q.inflightPath(msg.ID), q.pendingPath(id))
+}
+
+// Ping checks that the queue directories are still there.
+func (q *FileQueue) Ping(ctx context.Context) error {
+	for _, d := range []string{fileQueuePendingDir, fileQueueInflightDir} {
+		if _, err := os.Stat(path.Join(q.dir, d)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *FileQueue) Close() error {
+	return nil
+}
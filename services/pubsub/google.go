@@ -0,0 +1,119 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// GooglePubSubQueue publishes checks to a Google Pub/Sub topic. Messages are
+// delivered by a push subscription calling Handler.
+//
+// Pub/Sub considers a push delivered once Handler answers it, which it does
+// as soon as the message is handed to the subscribed handler, so Ack has
+// nothing left to do. Until then, pushes that are refused or fail are
+// delivered again after the backoff of the subscription. Once answered, the
+// message only lives on the instance handling it: Nack and Delay publish it
+// again as a new message, checks interrupted by a shutdown are published
+// again, and checks lost with a crashed instance are found by the reaper.
+type GooglePubSubQueue struct {
+	client *pubsub.Client
+	topic  *pubsub.Topic
+
+	mu      sync.Mutex
+	handler MessageHandler
+	ctx     context.Context
+}
+
+func NewGooglePubSubQueue(ctx context.Context, projectID, topicID string) (*GooglePubSubQueue, error) {
+	client, err := pubsub.NewClient(ctx, projectID)
+	if err != nil {
+		return nil, fmt.Errorf("pubsub: NewClient: %w", err)
+	}
+
+	return &GooglePubSubQueue{
+		client: client,
+		topic:  client.Topic(topicID),
+	}, nil
+}
+
+func (q *GooglePubSubQueue) Publish(ctx context.Context, data []byte) (string, error) {
+	result := q.topic.Publish(ctx, &pubsub.Message{
+		Data: data,
+	})
+	// Block until the result is returned and a server-generated
+	// ID is returned for the published message.
+	id, err := result.Get(ctx)
+	if err != nil {
+		return "", fmt.Errorf("pubsub: result.Get: %w", err)
+	}
+	return id, nil
+}
+
+// Subscribe registers the handler for messages pushed to Handler and blocks
+// until the context is done.
+func (q *GooglePubSubQueue) Subscribe(ctx context.Context, handler MessageHandler) error {
+	q.mu.Lock()
+	q.handler, q.ctx = handler, ctx
+	q.mu.Unlock()
+
+	<-ctx.Done()
+
+	q.mu.Lock()
+	q.handler, q.ctx = nil, nil
+	q.mu.Unlock()
+	return ctx.Err()
+}
+
+// push hands a message received from the push subscription to the subscribed
+// handler. It returns false if nothing is subscribed.
+func (q *GooglePubSubQueue) push(msg *Message) bool {
+	q.mu.Lock()
+	handler, ctx := q.handler, q.ctx
+	q.mu.Unlock()
+
+	if handler == nil {
+		return false
+	}
+	go handler(ctx, msg)
+	return true
+}
+
+// Ack is a no-op, pushes are acknowledged by the answer of Handler, see
+// GooglePubSubQueue.
+func (q *GooglePubSubQueue) Ack(ctx context.Context, msg *Message) error {
+	return nil
+}
+
+// Nack publishes the message again since the push delivery was already
+// acknowledged.
+func (q *GooglePubSubQueue) Nack(ctx context.Context, msg *Message) error {
+	_, err := q.Publish(ctx, msg.Data)
+	return err
+}
+
+// Delay publishes the message again, pushes of checks that aren't due yet
+// are refused by Handler so Pub/Sub delivers them again after a backoff.
+func (q *GooglePubSubQueue) Delay(ctx context.Context, msg *Message, notBefore time.Time) error {
+	return q.Nack(ctx, msg)
+}
+
+// Ping checks that the topic exists.
+func (q *GooglePubSubQueue) Ping(ctx context.Context) error {
+	exists, err := q.topic.Exists(ctx)
+	if err != nil {
+		return fmt.Errorf("pubsub: topic.Exists: %w", err)
+	}
+	if !exists {
+		return fmt.Errorf("pubsub: topic '%s' doesn't exist", q.topic.ID())
+	}
+	return nil
+}
+
+func (q *GooglePubSubQueue) Close() error {
+	q.topic.Stop()
+	return q.client.Close()
+}
@@ -2,34 +2,60 @@ package pubsub
 
 import (
 	"encoding/json"
-	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/rs/zerolog/log"
 
-	"github.com/jahagaley/phantom/checks"
+	"github.com/jahagaley/phantom/utils/metrics"
 )
 
+// Handler receives messages from the Google Pub/Sub push subscription.
 func Handler(w http.ResponseWriter, r *http.Request) {
+	recorder := metrics.NewStatusRecorder(w)
+	defer func() {
+		metrics.PubSubPushes.WithLabelValues(strconv.Itoa(recorder.Status)).Inc()
+	}()
+	w = recorder
+
+	q, ok := queue.(*GooglePubSubQueue)
+	if !ok {
+		log.Warn().Msg("Received a Pub/Sub push while Pub/Sub is not the queue backend.")
+		http.Error(w, "Pub/Sub is not the queue backend", http.StatusNotFound)
+		return
+	}
+
+	// Pushes are redelivered to other instances while this one shuts down.
+	if IsDraining() {
+		http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
 	// Parse the Pub/Sub message from the request body.
 	var msg PubSubMessage
 	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
 		log.Error().Err(err).Msg("Could not decode body")
 		w.WriteHeader(http.StatusBadRequest)
+		return
 	}
 
-	log.Info().Msg(fmt.Sprintf("Got message with ID: '%s'", msg.Message.ID))
-	checkParam, err := DecodeCheckParams(msg.Message.Data)
-	if err != nil {
-		log.Error().Err(err).Msg("Could not decode CheckParams")
-		w.WriteHeader(http.StatusBadRequest)
+	// Checks that aren't due yet are refused, so Pub/Sub delivers them again
+	// after the backoff of the subscription instead of holding them here.
+	if checkParams, err := DecodeCheckParams(msg.Message.Data); err == nil {
+		if notBefore, wait := waitUntil(checkParams); wait {
+			w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(notBefore).Seconds())+1))
+			http.Error(w, "Check is not due yet", http.StatusTooEarly)
+			return
+		}
 	}
 
-	go func(checkParam *checks.CheckParams) {
-		// TODO - try reprocessing this.
-		err := RunIntendedCheck(checkParam)
-		log.Error().Err(err).Msg("Failed to complete the processing of check param.")
-	}(checkParam)
+	// A failed delivery is retried by Pub/Sub.
+	if !q.push(&Message{ID: msg.Message.ID, Data: msg.Message.Data}) {
+		log.Warn().Msg("Received a Pub/Sub push before subscribing to the queue.")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
 
 	// Return a success response.
 	w.WriteHeader(http.StatusOK)
@@ -0,0 +1,99 @@
+package pubsub
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MemoryQueue is an in-process queue for local runs and tests. Messages are
+// lost when the process exits. At most workers messages are handled at once,
+// the others waiting in the queue.
+type MemoryQueue struct {
+	messages chan *Message
+	workers  int
+	lastID   atomic.Int64
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func NewMemoryQueue(size, workers int) *MemoryQueue {
+	return &MemoryQueue{
+		messages: make(chan *Message, size),
+		workers:  max(workers, 1),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (q *MemoryQueue) Publish(ctx context.Context, data []byte) (string, error) {
+	msg := &Message{
+		ID:   strconv.FormatInt(q.lastID.Add(1), 10),
+		Data: data,
+	}
+
+	select {
+	case q.messages <- msg:
+		return msg.ID, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// Subscribe hands the messages to a pool of workers until the context is
+// done. Workers finish the message they are handling before stopping.
+func (q *MemoryQueue) Subscribe(ctx context.Context, handler MessageHandler) error {
+	for i := 0; i < q.workers; i++ {
+		go q.work(ctx, handler)
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (q *MemoryQueue) work(ctx context.Context, handler MessageHandler) {
+	for {
+		select {
+		case msg := <-q.messages:
+			// Messages received as the subscription ends go back to the queue
+			if ctx.Err() != nil {
+				q.Nack(context.Background(), msg)
+				return
+			}
+			handler(ctx, msg)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (q *MemoryQueue) Ack(ctx context.Context, msg *Message) error {
+	return nil
+}
+
+func (q *MemoryQueue) Nack(ctx context.Context, msg *Message) error {
+	return q.Delay(ctx, msg, time.Time{})
+}
+
+// Delay returns right away, the message is added back to the queue once
+// notBefore has passed and there is room for it, or dropped if the queue is
+// closed first.
+func (q *MemoryQueue) Delay(ctx context.Context, msg *Message, notBefore time.Time) error {
+	time.AfterFunc(time.Until(notBefore), func() {
+		select {
+		case q.messages <- msg:
+		case <-q.closed:
+		}
+	})
+	return nil
+}
+
+func (q *MemoryQueue) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (q *MemoryQueue) Close() error {
+	q.closeOnce.Do(func() { close(q.closed) })
+	return nil
+}
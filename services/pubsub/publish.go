@@ -4,18 +4,20 @@ import (
 	"bytes"
 	"context"
 	"encoding/gob"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"time"
 
-	"cloud.google.com/go/pubsub"
 	"github.com/jahagaley/phantom/checks"
+	"github.com/jahagaley/phantom/utils/metrics"
+	"github.com/jahagaley/phantom/utils/settings"
+	"github.com/jahagaley/phantom/utils/tracing"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// TODO - Make these dynamic
-var PUBSUB_PROJECT_ID = "jahagaley"
-
-var PUBSUB_TOPIC_ID = "github-checks-production"
-
 type PubSubMessage struct {
 	Message struct {
 		Data []byte `json:"data"`
@@ -25,33 +27,91 @@ type PubSubMessage struct {
 }
 
 func PublishGithubCheck(checkParams *checks.CheckParams) error {
-	ctx := context.Background()
-	client, err := pubsub.NewClient(ctx, PUBSUB_PROJECT_ID)
-	if err != nil {
-		log.Error().Err(err).Send()
-		return err
+	if queue == nil {
+		return fmt.Errorf("No queue has been configured.")
+	}
+	if len(checkParams.TraceID) == 0 {
+		checkParams.TraceID = NewTraceID()
 	}
-	defer client.Close()
 
-	t := client.Topic(PUBSUB_TOPIC_ID)
 	data, err := EncodeCheckParams(checkParams)
 	if err != nil {
 		return err
 	}
-	result := t.Publish(ctx, &pubsub.Message{
-		Data: data,
-	})
-	// Block until the result is returned and a server-generated
-	// ID is returned for the published message.
-	id, err := result.Get(ctx)
+	start := time.Now()
+	id, err := queue.Publish(context.Background(), data)
+	metrics.Since(metrics.QueuePublishDuration.WithLabelValues(metrics.Result(err)), start)
 	if err != nil {
-		return fmt.Errorf("pubsub: result.Get: %w", err)
+		log.Error().Err(err).Send()
+		return err
 	}
 	log.Info().Msg(fmt.Sprintf("Published a message; msg ID: %v\n", id))
 	return nil
 }
 
+// PublishGithubCheckWithContext publishes the check as part of the trace of the
+// context, so the span running it continues the trace.
+func PublishGithubCheckWithContext(ctx context.Context, checkParams *checks.CheckParams) (err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "publish "+checkParams.Name,
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(checkAttributes(checkParams)...),
+	)
+	defer func() { tracing.EndSpan(span, err) }()
+
+	checkParams.TraceContext = tracing.Inject(ctx)
+	if traceID, ok := tracing.TraceID(ctx); ok {
+		checkParams.TraceID = traceID
+	}
+	return PublishGithubCheck(checkParams)
+}
+
+// checkAttributes describes the check on its spans.
+func checkAttributes(checkParams *checks.CheckParams) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("phantom.check.type", checkParams.Type),
+		attribute.String("phantom.check.name", checkParams.Name),
+		attribute.String("phantom.repository", checkParams.Owner+"/"+checkParams.Repo),
+		attribute.String("phantom.commit", checkParams.HeadSHA),
+		attribute.Int("phantom.check.attempt", checkParams.Attempt),
+	}
+}
+
+// EncodeCheckParams encodes the check in a versioned JSON envelope, or with
+// gob when the queue encoding is "gob" while older workers still run.
 func EncodeCheckParams(checkParams *checks.CheckParams) ([]byte, error) {
+	if settings.Get().Queue.Encoding == settings.QUEUE_ENCODING_GOB {
+		return encodeGobCheckParams(checkParams)
+	}
+	return encodeEnvelope(MESSAGE_TYPE_CHECK, checkParams.TraceID, checkParams.TraceContext, checkParams)
+}
+
+// DecodeCheckParams decodes a check encoded in a JSON envelope, or with gob by
+// older versions.
+func DecodeCheckParams(data []byte) (*checks.CheckParams, error) {
+	envelope, err := decodeEnvelope(data)
+	if errors.Is(err, errNotAnEnvelope) {
+		return decodeGobCheckParams(data)
+	} else if err != nil {
+		return nil, err
+	}
+
+	if envelope.Type != MESSAGE_TYPE_CHECK {
+		return nil, fmt.Errorf("Unexpected message type '%s'.", envelope.Type)
+	}
+	checkParams := checks.CheckParams{}
+	if err := json.Unmarshal(envelope.Payload, &checkParams); err != nil {
+		return nil, fmt.Errorf("Invalid check payload: %w", err)
+	}
+	if len(checkParams.TraceID) == 0 {
+		checkParams.TraceID = envelope.TraceID
+	}
+	if len(checkParams.TraceContext) == 0 {
+		checkParams.TraceContext = envelope.TraceContext
+	}
+	return &checkParams, nil
+}
+
+func encodeGobCheckParams(checkParams *checks.CheckParams) ([]byte, error) {
 	buf := bytes.Buffer{}
 	enc := gob.NewEncoder(&buf)
 	err := enc.Encode(checkParams)
@@ -61,7 +121,7 @@ func EncodeCheckParams(checkParams *checks.CheckParams) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func DecodeCheckParams(data []byte) (*checks.CheckParams, error) {
+func decodeGobCheckParams(data []byte) (*checks.CheckParams, error) {
 	checkParams := checks.CheckParams{}
 	dec := gob.NewDecoder(bytes.NewReader(data))
 	err := dec.Decode(&checkParams)
@@ -0,0 +1,186 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/jahagaley/phantom/checks"
+	"github.com/jahagaley/phantom/services"
+	"github.com/jahagaley/phantom/utils/settings"
+)
+
+const (
+	// Number of messages the in-memory backend buffers before publishing blocks.
+	MEMORY_QUEUE_SIZE = 1024
+
+	// Number of messages the in-memory backend handles at once.
+	MEMORY_QUEUE_WORKERS = 16
+
+	// Sub-directory of the queue directory holding dead-lettered checks.
+	DEAD_LETTER_DIR = "dead-letter"
+)
+
+// Message is a single encoded check delivered by a Queue.
+type Message struct {
+	ID   string
+	Data []byte
+}
+
+// MessageHandler processes a message delivered by a Queue. Handlers must
+// call Ack or Nack on the queue once they are done with the message.
+type MessageHandler func(ctx context.Context, msg *Message)
+
+// Queue carries checks between the webhook handlers and the workers
+// running them.
+type Queue interface {
+	// Publish adds a message to the queue and returns its ID.
+	Publish(ctx context.Context, data []byte) (string, error)
+	// Subscribe delivers messages to the handler until the context is done.
+	Subscribe(ctx context.Context, handler MessageHandler) error
+	// Ack marks a message as processed.
+	Ack(ctx context.Context, msg *Message) error
+	// Nack returns a message to the queue so it is delivered again.
+	Nack(ctx context.Context, msg *Message) error
+	// Delay returns a message to the queue so it is delivered again once
+	// notBefore has passed.
+	Delay(ctx context.Context, msg *Message, notBefore time.Time) error
+	// Ping checks that the queue backend is reachable.
+	Ping(ctx context.Context) error
+	// Close releases the resources held by the queue.
+	Close() error
+}
+
+// Queue used to publish and receive checks.
+var queue Queue
+
+// SetQueue sets the queue used to publish and receive checks.
+func SetQueue(q Queue) {
+	queue = q
+}
+
+// PingQueue checks that the configured queue is reachable.
+func PingQueue(ctx context.Context) error {
+	if queue == nil {
+		return fmt.Errorf("No queue has been configured.")
+	}
+	return queue.Ping(ctx)
+}
+
+// NewQueueFromSettings creates the queue backend selected in the settings.
+func NewQueueFromSettings(ctx context.Context, s settings.Queue) (Queue, error) {
+	return newQueue(ctx, s, s.Topic, "")
+}
+
+// NewDeadLetterQueueFromSettings creates the queue receiving checks that
+// failed after all of their attempts, using the same backend as the queue.
+func NewDeadLetterQueueFromSettings(ctx context.Context, s settings.Queue) (Queue, error) {
+	return newQueue(ctx, s, s.DeadLetterTopic, DEAD_LETTER_DIR)
+}
+
+func newQueue(ctx context.Context, s settings.Queue, topicID, subDir string) (Queue, error) {
+	switch s.Backend {
+	case settings.QUEUE_BACKEND_PUBSUB:
+		return NewGooglePubSubQueue(ctx, s.PubSubProject, topicID)
+	case settings.QUEUE_BACKEND_MEMORY:
+		return NewMemoryQueue(MEMORY_QUEUE_SIZE, MEMORY_QUEUE_WORKERS), nil
+	case settings.QUEUE_BACKEND_FILE:
+		return NewFileQueue(path.Join(s.Dir, subDir))
+	}
+
+	return nil, fmt.Errorf("Unknown queue backend '%s'.", s.Backend)
+}
+
+// Subscribe runs the checks delivered by the configured queue until the
+// context is done. Checks run with checksCtx, cancelled to interrupt them
+// when the server shuts down.
+func Subscribe(ctx, checksCtx context.Context) error {
+	if queue == nil {
+		return fmt.Errorf("No queue has been configured.")
+	}
+	return queue.Subscribe(ctx, func(_ context.Context, msg *Message) {
+		handleMessage(checksCtx, msg)
+	})
+}
+
+func handleMessage(ctx context.Context, msg *Message) {
+	// Messages received while shutting down go back to the queue, so another
+	// instance or the next start runs them.
+	if !startCheck() {
+		log.Info().Msg(fmt.Sprintf("Returning message with ID '%s' to the queue while shutting down", msg.ID))
+		nackMessage(ctx, msg)
+		return
+	}
+	defer endCheck()
+
+	log.Info().Msg(fmt.Sprintf("Got message with ID: '%s'", msg.ID))
+	checkParam, err := DecodeCheckParams(msg.Data)
+	if err != nil {
+		// Messages that can't be decoded will never succeed, drop them.
+		log.Error().Err(err).Msg("Could not decode CheckParams")
+		ackMessage(ctx, msg)
+		return
+	}
+	log.Debug().Str("trace_id", checkParam.TraceID).Msg(fmt.Sprintf("Message '%s' holds check '%s'", msg.ID, checkParam.Name))
+
+	// Checks that aren't due yet go back to the queue.
+	if notBefore, wait := waitUntil(checkParam); wait {
+		queueCtx, cancel := detachedQueueContext(ctx)
+		defer cancel()
+		if err := queue.Delay(queueCtx, msg, notBefore); err != nil {
+			log.Warn().Err(err).Msg(fmt.Sprintf("Unable to delay message with ID: '%s'", msg.ID))
+		}
+		return
+	}
+
+	recordActiveCommit(checkParam)
+	err = RunIntendedCheck(ctx, checkParam)
+	if err != nil && ctx.Err() != nil {
+		requeueInterruptedCheck(checkParam)
+	} else if err != nil {
+		log.Error().Err(err).Msg("Failed to complete the processing of check param.")
+		handleCheckFailure(ctx, checkParam, err)
+	}
+
+	ackMessage(ctx, msg)
+}
+
+// detachedQueueContext returns a context for the queue operations ending the
+// handling of a message, which still have to happen once ctx is cancelled by
+// a shutdown.
+func detachedQueueContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), REQUEUE_TIMEOUT)
+}
+
+func ackMessage(ctx context.Context, msg *Message) {
+	queueCtx, cancel := detachedQueueContext(ctx)
+	defer cancel()
+
+	if err := queue.Ack(queueCtx, msg); err != nil {
+		log.Warn().Err(err).Msg(fmt.Sprintf("Unable to ack message with ID: '%s'", msg.ID))
+	}
+}
+
+func nackMessage(ctx context.Context, msg *Message) {
+	queueCtx, cancel := detachedQueueContext(ctx)
+	defer cancel()
+
+	if err := queue.Nack(queueCtx, msg); err != nil {
+		log.Warn().Err(err).Msg(fmt.Sprintf("Unable to nack message with ID: '%s'", msg.ID))
+	}
+}
+
+// waitUntil returns when the check can run, if it can't run yet: retried
+// checks wait for their backoff to pass, and checks of installations running
+// out of Github requests wait for their rate limit to reset.
+func waitUntil(checkParams *checks.CheckParams) (time.Time, bool) {
+	notBefore := checkParams.NotBefore
+	if reset, throttled := services.ThrottleUntil(checkParams.Host, checkParams.InstallationID); throttled && reset.After(notBefore) {
+		log.Info().Msg(fmt.Sprintf("Delaying check '%s' until the Github rate limit resets at %s", checkParams.Name, reset.Format(time.RFC3339)))
+		notBefore = reset
+	}
+	return notBefore, time.Now().Before(notBefore)
+}
@@ -0,0 +1,400 @@
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/google/go-github/v50/github"
+
+	"github.com/jahagaley/phantom/checks"
+)
+
+// receive returns the next message delivered by the queue, or nil if there is
+// none within timeout.
+func receive(t *testing.T, q Queue, timeout time.Duration) *Message {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	received := make(chan *Message, 1)
+	go q.Subscribe(ctx, func(_ context.Context, msg *Message) {
+		select {
+		case received <- msg:
+		default:
+		}
+	})
+
+	select {
+	case msg := <-received:
+		cancel()
+		return msg
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+func testQueueDelay(t *testing.T, q Queue) {
+	ctx := context.Background()
+	if _, err := q.Publish(ctx, []byte("check")); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+
+	msg := receive(t, q, 3*time.Second)
+	if msg == nil || string(msg.Data) != "check" {
+		t.Fatalf("received %v, want the published message", msg)
+	}
+
+	if err := q.Delay(ctx, msg, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Delay() error = %v", err)
+	}
+	if msg := receive(t, q, 1500*time.Millisecond); msg != nil {
+		t.Fatalf("received delayed message %s before it is due", msg.ID)
+	}
+}
+
+// testQueueContract checks the delivery of messages through their life:
+// published, handled, then acked, nacked or delayed.
+func testQueueContract(t *testing.T, q Queue) {
+	ctx := context.Background()
+	if err := q.Ping(ctx); err != nil {
+		t.Fatalf("Ping() error = %v", err)
+	}
+
+	// Acked messages aren't delivered again
+	if _, err := q.Publish(ctx, []byte("acked")); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	msg := receive(t, q, 3*time.Second)
+	if msg == nil || string(msg.Data) != "acked" {
+		t.Fatalf("received %v, want the published message", msg)
+	}
+	if err := q.Ack(ctx, msg); err != nil {
+		t.Fatalf("Ack() error = %v", err)
+	}
+	if msg := receive(t, q, 1500*time.Millisecond); msg != nil {
+		t.Fatalf("received acked message %s again", msg.ID)
+	}
+
+	// Nacked messages are delivered again
+	if _, err := q.Publish(ctx, []byte("nacked")); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	msg = receive(t, q, 3*time.Second)
+	if msg == nil || string(msg.Data) != "nacked" {
+		t.Fatalf("received %v, want the published message", msg)
+	}
+	if err := q.Nack(ctx, msg); err != nil {
+		t.Fatalf("Nack() error = %v", err)
+	}
+	msg = receive(t, q, 3*time.Second)
+	if msg == nil || string(msg.Data) != "nacked" {
+		t.Fatalf("received %v, want the nacked message again", msg)
+	}
+
+	// Delayed messages are delivered again once due
+	if err := q.Delay(ctx, msg, time.Now().Add(500*time.Millisecond)); err != nil {
+		t.Fatalf("Delay() error = %v", err)
+	}
+	msg = receive(t, q, 3*time.Second)
+	if msg == nil || string(msg.Data) != "nacked" {
+		t.Fatalf("received %v, want the delayed message once due", msg)
+	}
+	if err := q.Ack(ctx, msg); err != nil {
+		t.Fatalf("Ack() error = %v", err)
+	}
+}
+
+func TestMemoryQueueContract(t *testing.T) {
+	q := NewMemoryQueue(10, 2)
+	defer q.Close()
+	testQueueContract(t, q)
+}
+
+func TestFileQueueContract(t *testing.T) {
+	q, err := NewFileQueue(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	testQueueContract(t, q)
+}
+
+func TestMemoryQueueWorkers(t *testing.T) {
+	q := NewMemoryQueue(10, 2)
+	defer q.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	release := make(chan struct{})
+	var mu sync.Mutex
+	handling, most := 0, 0
+	go q.Subscribe(ctx, func(_ context.Context, msg *Message) {
+		mu.Lock()
+		handling++
+		most = max(most, handling)
+		mu.Unlock()
+
+		<-release
+
+		mu.Lock()
+		handling--
+		mu.Unlock()
+	})
+
+	for i := 0; i < 5; i++ {
+		if _, err := q.Publish(ctx, []byte("check")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	time.Sleep(50 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if most != 2 {
+		t.Errorf("handled %d messages at once, want 2", most)
+	}
+}
+
+func TestGooglePubSubQueuePush(t *testing.T) {
+	q := &GooglePubSubQueue{}
+	previous := queue
+	queue = q
+	defer func() { queue = previous }()
+
+	push := func(checkParams *checks.CheckParams) int {
+		t.Helper()
+		data, err := EncodeCheckParams(checkParams)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body PubSubMessage
+		body.Message.ID, body.Message.Data = "1", data
+		payload, _ := json.Marshal(&body)
+
+		recorder := httptest.NewRecorder()
+		Handler(recorder, httptest.NewRequest(http.MethodPost, "/gcp/pubsub", bytes.NewReader(payload)))
+		return recorder.Code
+	}
+
+	// Pushes fail until the queue is subscribed to, so Pub/Sub delivers them again
+	if code := push(&checks.CheckParams{Name: checks.SETUP}); code != http.StatusServiceUnavailable {
+		t.Errorf("push before Subscribe() = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	received := make(chan *Message, 1)
+	go q.Subscribe(ctx, func(_ context.Context, msg *Message) { received <- msg })
+
+	// Pushes are answered once handed to the subscribed handler
+	code := push(&checks.CheckParams{Name: checks.SETUP})
+	for i := 0; i < 100 && code == http.StatusServiceUnavailable; i++ {
+		time.Sleep(time.Millisecond)
+		code = push(&checks.CheckParams{Name: checks.SETUP})
+	}
+	if code != http.StatusOK {
+		t.Errorf("push = %d, want %d", code, http.StatusOK)
+	}
+	select {
+	case msg := <-received:
+		if err := q.Ack(ctx, msg); err != nil {
+			t.Errorf("Ack() error = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pushed message wasn't handled")
+	}
+
+	// Checks that aren't due yet are refused
+	if code := push(&checks.CheckParams{Name: checks.SETUP, NotBefore: time.Now().Add(time.Hour)}); code != http.StatusTooEarly {
+		t.Errorf("push of a check not due = %d, want %d", code, http.StatusTooEarly)
+	}
+
+	// Pushes go to other instances while this one drains
+	StartDraining()
+	defer draining.Store(false)
+	if code := push(&checks.CheckParams{Name: checks.SETUP}); code != http.StatusServiceUnavailable {
+		t.Errorf("push while draining = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestMemoryQueueDelay(t *testing.T) {
+	q := NewMemoryQueue(1, 1)
+	defer q.Close()
+	testQueueDelay(t, q)
+
+	// Nack never blocks, even on a full queue
+	q.Publish(context.Background(), []byte("full"))
+	done := make(chan struct{})
+	go func() {
+		q.Nack(context.Background(), &Message{ID: "nacked"})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Nack() blocked on a full queue")
+	}
+}
+
+func TestFileQueueDelay(t *testing.T) {
+	q, err := NewFileQueue(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testQueueDelay(t, q)
+
+	// Messages are delivered once due
+	if _, err := q.Publish(context.Background(), []byte("due")); err != nil {
+		t.Fatal(err)
+	}
+	msg := receive(t, q, 3*time.Second)
+	if msg == nil || string(msg.Data) != "due" {
+		t.Fatalf("received %v, want the due message", msg)
+	}
+	if err := q.Delay(context.Background(), msg, time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("Delay() error = %v", err)
+	}
+	if msg := receive(t, q, 3*time.Second); msg == nil || string(msg.Data) != "due" {
+		t.Fatalf("received %v, want the message delayed to the past", msg)
+	}
+}
+
+// ctxRecordingQueue records the error of the contexts messages are acked,
+// delayed and nacked with, and the messages nacked.
+type ctxRecordingQueue struct {
+	*MemoryQueue
+	errs   []error
+	nacked []string
+}
+
+func (q *ctxRecordingQueue) Nack(ctx context.Context, msg *Message) error {
+	q.errs = append(q.errs, ctx.Err())
+	q.nacked = append(q.nacked, msg.ID)
+	return nil
+}
+
+func (q *ctxRecordingQueue) Ack(ctx context.Context, msg *Message) error {
+	q.errs = append(q.errs, ctx.Err())
+	return nil
+}
+
+func (q *ctxRecordingQueue) Delay(ctx context.Context, msg *Message, notBefore time.Time) error {
+	q.errs = append(q.errs, ctx.Err())
+	return nil
+}
+
+func TestHandleMessageAfterShutdown(t *testing.T) {
+	recording := &ctxRecordingQueue{MemoryQueue: NewMemoryQueue(1, 1)}
+	defer recording.Close()
+	previous := queue
+	queue = recording
+	defer func() { queue = previous }()
+
+	// The checks context is cancelled once the server shuts down
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	delayed, err := EncodeCheckParams(&checks.CheckParams{Name: "Setup", NotBefore: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handleMessage(ctx, &Message{ID: "undecodable", Data: []byte("not a check")})
+	handleMessage(ctx, &Message{ID: "delayed", Data: delayed})
+
+	if len(recording.errs) != 2 {
+		t.Fatalf("messages acked or delayed %d times, want 2", len(recording.errs))
+	}
+	for _, err := range recording.errs {
+		if err != nil {
+			t.Errorf("message acked or delayed with a done context: %v", err)
+		}
+	}
+}
+
+func TestHandleMessageWhileDraining(t *testing.T) {
+	recording := &ctxRecordingQueue{MemoryQueue: NewMemoryQueue(1, 1)}
+	defer recording.Close()
+	previous := queue
+	queue = recording
+	defer func() { queue = previous }()
+
+	if !startCheck() {
+		t.Fatal("startCheck() = false before draining, want the check admitted")
+	}
+	endCheck()
+
+	StartDraining()
+	defer draining.Store(false)
+
+	// Checks received once draining has started go back to the queue
+	// without counting as running.
+	data, err := EncodeCheckParams(&checks.CheckParams{Name: "Setup"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	handleMessage(ctx, &Message{ID: "draining", Data: data})
+
+	if len(recording.nacked) != 1 || recording.nacked[0] != "draining" {
+		t.Errorf("nacked %v, want the message received while draining", recording.nacked)
+	}
+	if len(recording.errs) != 1 || recording.errs[0] != nil {
+		t.Errorf("queue operations with context errors %v, want a single nack with a live context", recording.errs)
+	}
+	if startCheck() {
+		t.Error("startCheck() = true while draining, want the check refused")
+	}
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), time.Second)
+	defer waitCancel()
+	if !WaitRunningChecks(waitCtx) {
+		t.Error("WaitRunningChecks() = false, want no check running")
+	}
+}
+
+func TestIsTransientError(t *testing.T) {
+	serverError := &github.ErrorResponse{Response: &http.Response{StatusCode: http.StatusBadGateway}}
+	notFound := &github.ErrorResponse{Response: &http.Response{StatusCode: http.StatusNotFound}}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"rate limit", &github.RateLimitError{}, true},
+		{"secondary rate limit", &github.AbuseRateLimitError{}, true},
+		{"github server error", serverError, true},
+		{"github not found", notFound, false},
+		{"deadline", context.DeadlineExceeded, true},
+		{"api unavailable", connect.NewError(connect.CodeUnavailable, errors.New("down")), true},
+		{"api invalid argument", connect.NewError(connect.CodeInvalidArgument, errors.New("bad")), false},
+		{"other", errors.New("invalid phantom.yaml"), false},
+	}
+
+	for _, test := range tests {
+		if got := IsTransientError(test.err); got != test.want {
+			t.Errorf("IsTransientError(%s) = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for attempt := 1; attempt < 20; attempt++ {
+		delay := retryDelay(attempt)
+		want := min(RETRY_BASE_DELAY<<(attempt-1), RETRY_MAX_DELAY)
+		if delay < want/2 || delay >= want {
+			t.Errorf("retryDelay(%d) = %s, want between %s and %s", attempt, delay, want/2, want)
+		}
+	}
+}
@@ -0,0 +1,409 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/google/go-github/v50/github"
+	apipb "github.com/jahagaley/phantomapi/phantom/api/v1"
+	api "github.com/jahagaley/phantomapi/phantom/api/v1/v1connect"
+	"github.com/rs/zerolog/log"
+
+	"github.com/jahagaley/phantom/checks"
+	"github.com/jahagaley/phantom/services"
+	"github.com/jahagaley/phantom/utils"
+	"github.com/jahagaley/phantom/utils/settings"
+	"github.com/jahagaley/phantom/utils/tracing"
+)
+
+const (
+	// How often check runs left in progress are looked for.
+	REAP_INTERVAL = 10 * time.Minute
+
+	// Check runs in progress for longer than this without anything waiting
+	// on them are stuck.
+	STUCK_CHECK_AGE = 30 * time.Minute
+
+	// Check runs in progress for longer than this are concluded whatever
+	// the state of their execution. Commits are no longer reaped after it.
+	STUCK_CHECK_MAX_AGE = 24 * time.Hour
+
+	// Number of times a stuck check that never started an execution is
+	// queued again before being concluded.
+	MAX_STUCK_CHECK_REQUEUES = 1
+
+	// Summary of the check runs concluded by a reaper after queuing their
+	// check again, counted to limit the requeues across instances.
+	STUCK_CHECK_REQUEUED_SUMMARY = "Phantom lost track of this check before it started, it was queued again."
+
+	activeCommitsFile = "active-commits.json"
+)
+
+// activeCommit is a commit with checks run by Phantom, with the fields needed
+// to queue its checks again.
+type activeCommit struct {
+	Check    *checks.CheckParams
+	LastSeen time.Time
+}
+
+var (
+	activeCommitsMu sync.Mutex
+	activeCommits   = make(map[string]*activeCommit)
+)
+
+func activeCommitKey(checkParams *checks.CheckParams) string {
+	return strings.Join([]string{activeRepositoryKey(checkParams), checkParams.HeadSHA}, "/")
+}
+
+func activeRepositoryKey(checkParams *checks.CheckParams) string {
+	return strings.Join([]string{services.HostName(checkParams.Host), checkParams.Owner, checkParams.Repo}, "/")
+}
+
+// recordActiveCommit remembers the commit of the check, so its check runs are
+// reaped if they get stuck.
+func recordActiveCommit(checkParams *checks.CheckParams) {
+	activeCommitsMu.Lock()
+	defer activeCommitsMu.Unlock()
+
+	key := activeCommitKey(checkParams)
+	commit, ok := activeCommits[key]
+	if !ok {
+		commit = &activeCommit{}
+		activeCommits[key] = commit
+	}
+
+	// Only the fields shared by every check of the commit are kept
+	commit.Check = &checks.CheckParams{
+		Owner:             checkParams.Owner,
+		Repo:              checkParams.Repo,
+		HeadSHA:           checkParams.HeadSHA,
+		Branch:            checkParams.Branch,
+		DefaultBranch:     checkParams.DefaultBranch,
+		BaseSHA:           checkParams.BaseSHA,
+		Host:              checkParams.Host,
+		InstallationID:    checkParams.InstallationID,
+		RepoID:            checkParams.RepoID,
+		PullRequestNumber: checkParams.PullRequestNumber,
+		BaseBranch:        checkParams.BaseBranch,
+		IsFork:            checkParams.IsFork,
+		TraceID:           checkParams.TraceID,
+	}
+	commit.LastSeen = time.Now()
+}
+
+// RunReaper looks for check runs left in progress by lost checks until the
+// context is done. Executions still running are watched again, checks that
+// never started one are queued again, and the others are concluded as timed
+// out. Check runs are claimed through their lease first, so the reapers of
+// several instances don't act on the same check run.
+func RunReaper(ctx context.Context) {
+	loadActiveCommits()
+
+	ticker := time.NewTicker(REAP_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			reapStuckChecks(ctx)
+			saveActiveCommits()
+		case <-ctx.Done():
+			saveActiveCommits()
+			return
+		}
+	}
+}
+
+func reapStuckChecks(ctx context.Context) {
+	discoverActiveCommits(ctx)
+
+	activeCommitsMu.Lock()
+	var commits []*activeCommit
+	for key, commit := range activeCommits {
+		if time.Since(commit.LastSeen) > STUCK_CHECK_MAX_AGE {
+			delete(activeCommits, key)
+			continue
+		}
+		commits = append(commits, commit)
+	}
+	activeCommitsMu.Unlock()
+
+	gitClient := api.NewGitServiceClient(tracing.HTTPClient, utils.API_URL)
+	for _, commit := range commits {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := reapCommit(ctx, gitClient, commit); err != nil {
+			log.Warn().Err(err).Msg(fmt.Sprintf("Unable to reap the check runs of %s/%s@%s", commit.Check.Owner, commit.Check.Repo, commit.Check.HeadSHA))
+		}
+	}
+}
+
+// discoverActiveCommits adds the commits recently pushed to the repositories
+// of the active commits, as their checks may have been run by other
+// instances.
+func discoverActiveCommits(ctx context.Context) {
+	activeCommitsMu.Lock()
+	repositories := make(map[string]*checks.CheckParams)
+	for _, commit := range activeCommits {
+		repositories[activeRepositoryKey(commit.Check)] = commit.Check
+	}
+	activeCommitsMu.Unlock()
+
+	for _, template := range repositories {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := discoverRepositoryCommits(ctx, template); err != nil {
+			log.Warn().Err(err).Msg(fmt.Sprintf("Unable to list the recent pushes to %s/%s", template.Owner, template.Repo))
+		}
+	}
+}
+
+func discoverRepositoryCommits(ctx context.Context, template *checks.CheckParams) error {
+	githubClient, err := newGithubClient(template.Host, template.InstallationID)
+	if err != nil {
+		return err
+	}
+
+	// The events of a repository are listed most recent first
+	events, _, err := githubClient.Activity.ListRepositoryEvents(ctx, template.Owner, template.Repo, &github.ListOptions{PerPage: 100})
+	if err != nil {
+		return fmt.Errorf("Error listing repository events: %w", err)
+	}
+
+	activeCommitsMu.Lock()
+	defer activeCommitsMu.Unlock()
+	for _, event := range events {
+		if event.GetType() != "PushEvent" || time.Since(event.GetCreatedAt().Time) > STUCK_CHECK_MAX_AGE {
+			continue
+		}
+		payload, err := event.ParsePayload()
+		if err != nil {
+			continue
+		}
+		push, ok := payload.(*github.PushEvent)
+		if !ok || len(push.GetHead()) == 0 {
+			continue
+		}
+
+		check := &checks.CheckParams{
+			Owner:          template.Owner,
+			Repo:           template.Repo,
+			HeadSHA:        push.GetHead(),
+			Branch:         strings.TrimPrefix(push.GetRef(), "refs/heads/"),
+			DefaultBranch:  template.DefaultBranch,
+			Host:           template.Host,
+			InstallationID: template.InstallationID,
+			RepoID:         template.RepoID,
+		}
+		key := activeCommitKey(check)
+		if _, ok := activeCommits[key]; !ok {
+			activeCommits[key] = &activeCommit{Check: check, LastSeen: event.GetCreatedAt().Time}
+		}
+	}
+	return nil
+}
+
+func reapCommit(ctx context.Context, gitClient api.GitServiceClient, commit *activeCommit) error {
+	template := commit.Check
+	githubHost, err := services.GetGithubHost(template.Host)
+	if err != nil {
+		return err
+	}
+	githubClient, err := newGithubClient(template.Host, template.InstallationID)
+	if err != nil {
+		return err
+	}
+
+	// Every check run of this app, the completed ones telling how many times
+	// each check was already queued again
+	var checkRuns []*github.CheckRun
+	opts := &github.ListCheckRunsOptions{
+		Filter:      github.String("all"),
+		AppID:       github.Int64(githubHost.AppID),
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+	for {
+		result, res, err := githubClient.Checks.ListCheckRunsForRef(ctx, template.Owner, template.Repo, template.HeadSHA, opts)
+		if err != nil {
+			return fmt.Errorf("Error listing check runs: %w", err)
+		}
+		checkRuns = append(checkRuns, result.CheckRuns...)
+
+		if res.NextPage == 0 {
+			break
+		}
+		opts.Page = res.NextPage
+	}
+
+	requeued := make(map[string]int)
+	for _, checkRun := range checkRuns {
+		if checkRun.GetConclusion() == checks.CONCLUSION_TIMED_OUT && checkRun.GetOutput().GetSummary() == STUCK_CHECK_REQUEUED_SUMMARY {
+			requeued[checkRun.GetName()]++
+		}
+	}
+
+	for _, checkRun := range checkRuns {
+		if checkRun.GetStatus() == checks.STATUS_COMPLETED || checkRun.StartedAt == nil {
+			continue
+		}
+		age := time.Since(checkRun.GetStartedAt().Time)
+		if age < STUCK_CHECK_AGE {
+			continue
+		}
+
+		// Check runs held by an instance are being watched, or wait on a
+		// retry that isn't due yet
+		executionName, lease := checks.ParseExternalID(checkRun.GetExternalID())
+		if lease.Held() || checks.IsExecutionWatched(executionName) {
+			continue
+		}
+		reapCheckRun(ctx, gitClient, githubClient, commit, checkRun, age, requeued[checkRun.GetName()])
+	}
+	return nil
+}
+
+func reapCheckRun(ctx context.Context, gitClient api.GitServiceClient, githubClient *github.Client, commit *activeCommit, checkRun *github.CheckRun, age time.Duration, requeued int) {
+	checkType, options, err := checks.GetCheckTypeAndOptions(checkRun.GetName())
+	if err != nil {
+		log.Warn().Err(err).Msg(fmt.Sprintf("Unable to parse stuck check run '%s'", checkRun.GetName()))
+		return
+	}
+
+	check := *commit.Check
+	check.Type = checkType
+	check.Name = checkRun.GetName()
+	check.Options = options
+	check.CheckRunID = checkRun.GetID()
+	check.ExecutionName, _ = checks.ParseExternalID(checkRun.GetExternalID())
+
+	// Another instance may be reaping the check run at the same time
+	claimed, err := checks.ClaimCheckRun(githubClient, &check)
+	if err != nil {
+		log.Warn().Err(err).Msg(fmt.Sprintf("Unable to claim stuck check run '%s'", check.Name))
+		return
+	}
+	if !claimed {
+		return
+	}
+
+	conclude := func(summary string) {
+		err := checks.UpdateCheckRunCompletion(githubClient, &check, checks.CONCLUSION_TIMED_OUT, summary, nil)
+		if err != nil {
+			log.Warn().Err(err).Msg(fmt.Sprintf("Unable to conclude stuck check run '%s'", check.Name))
+			return
+		}
+		log.Info().Msg(fmt.Sprintf("Concluded stuck check '%s' on %s", check.Name, check.HeadSHA))
+	}
+
+	if age > STUCK_CHECK_MAX_AGE {
+		if len(check.ExecutionName) > 0 {
+			cancelExecutionRequest := &apipb.CancelExecutionRequest{
+				Name: check.ExecutionName,
+			}
+			if _, err := gitClient.CancelExecution(ctx, connect.NewRequest(cancelExecutionRequest)); err != nil {
+				log.Warn().Err(err).Msg(fmt.Sprintf("Unable to cancel execution '%s'", check.ExecutionName))
+			}
+		}
+		conclude(fmt.Sprintf("Phantom lost track of this check, it was stopped after being in progress for %s.", age.Round(time.Minute)))
+		return
+	}
+
+	// Checks that started an execution wait on it again, the execution may
+	// have finished since. The claim holds the check run until a worker
+	// resumes it.
+	if len(check.ExecutionName) > 0 {
+		getExecutionRequest := &apipb.GetExecutionRequest{
+			Name: check.ExecutionName,
+		}
+		_, err := gitClient.GetExecution(ctx, connect.NewRequest(getExecutionRequest))
+		if connect.CodeOf(err) == connect.CodeNotFound {
+			conclude("Phantom lost track of this check, and its execution no longer exists.")
+			return
+		} else if err != nil {
+			log.Warn().Err(err).Msg(fmt.Sprintf("Unable to get execution '%s'", check.ExecutionName))
+			return
+		}
+
+		check.ExecutionDeadline = checkRun.GetStartedAt().Add(STUCK_CHECK_MAX_AGE)
+		if err := PublishGithubCheck(&check); err != nil {
+			log.Warn().Err(err).Msg(fmt.Sprintf("Unable to resume stuck check '%s'", check.Name))
+			return
+		}
+		log.Info().Msg(fmt.Sprintf("Resumed watching the execution of stuck check '%s'", check.Name))
+		return
+	}
+
+	// Checks that never started an execution are run again with a new check
+	// run, a limited number of times.
+	if requeued >= MAX_STUCK_CHECK_REQUEUES {
+		conclude("Phantom lost track of this check before it started, and it already failed to run again.")
+		return
+	}
+
+	retriedCheck := check
+	retriedCheck.CheckRunID = 0
+	if err := PublishGithubCheck(&retriedCheck); err != nil {
+		log.Warn().Err(err).Msg(fmt.Sprintf("Unable to queue stuck check '%s' again", check.Name))
+		return
+	}
+	conclude(STUCK_CHECK_REQUEUED_SUMMARY)
+}
+
+// loadActiveCommits reads the commits saved before the last restart.
+func loadActiveCommits() {
+	data, err := os.ReadFile(path.Join(settings.Get().StateDir, activeCommitsFile))
+	if err != nil {
+		return
+	}
+
+	saved := make(map[string]*activeCommit)
+	if err := json.Unmarshal(data, &saved); err != nil {
+		log.Warn().Err(err).Msg("Unable to decode saved active commits")
+		return
+	}
+
+	activeCommitsMu.Lock()
+	defer activeCommitsMu.Unlock()
+	for key, commit := range saved {
+		if commit.Check == nil || time.Since(commit.LastSeen) > STUCK_CHECK_MAX_AGE {
+			continue
+		}
+		if _, ok := activeCommits[key]; !ok {
+			activeCommits[key] = commit
+		}
+	}
+}
+
+// saveActiveCommits saves the commits to reap after a restart.
+func saveActiveCommits() {
+	activeCommitsMu.Lock()
+	data, err := json.Marshal(activeCommits)
+	activeCommitsMu.Unlock()
+	if err != nil {
+		log.Warn().Err(err).Msg("Unable to encode active commits")
+		return
+	}
+
+	dir := settings.Get().StateDir
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		log.Warn().Err(err).Msg("Unable to save active commits")
+		return
+	}
+	tempFile := path.Join(dir, activeCommitsFile+".tmp")
+	if err := os.WriteFile(tempFile, data, 0o600); err != nil {
+		log.Warn().Err(err).Msg("Unable to save active commits")
+		return
+	}
+	if err := os.Rename(tempFile, path.Join(dir, activeCommitsFile)); err != nil {
+		os.Remove(tempFile)
+		log.Warn().Err(err).Msg("Unable to save active commits")
+	}
+}
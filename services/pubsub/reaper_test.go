@@ -0,0 +1,230 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/google/go-github/v50/github"
+	apipb "github.com/jahagaley/phantomapi/phantom/api/v1"
+	api "github.com/jahagaley/phantomapi/phantom/api/v1/v1connect"
+
+	"github.com/jahagaley/phantom/checks"
+)
+
+// fakeExecutions serves the running executions, and records the ones cancelled.
+type fakeExecutions struct {
+	api.GitServiceClient
+
+	mu        sync.Mutex
+	running   map[string]bool
+	cancelled []string
+}
+
+func (c *fakeExecutions) GetExecution(ctx context.Context, req *connect.Request[apipb.GetExecutionRequest]) (*connect.Response[apipb.Execution], error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.running[req.Msg.Name] {
+		return nil, connect.NewError(connect.CodeNotFound, errors.New("no execution"))
+	}
+	return connect.NewResponse(&apipb.Execution{Name: req.Msg.Name, State: apipb.Execution_STATE_RUNNING}), nil
+}
+
+func (c *fakeExecutions) CancelExecution(ctx context.Context, req *connect.Request[apipb.CancelExecutionRequest]) (*connect.Response[apipb.Execution], error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cancelled = append(c.cancelled, req.Msg.Name)
+	return connect.NewResponse(&apipb.Execution{Name: req.Msg.Name, State: apipb.Execution_STATE_CANCELLED}), nil
+}
+
+func testActiveCommit() *activeCommit {
+	return &activeCommit{
+		Check:    &checks.CheckParams{Owner: "owner", Repo: "repo", HeadSHA: "sha", Branch: "main"},
+		LastSeen: time.Now(),
+	}
+}
+
+func stuckCheckRun(id int64, name, externalID string, age time.Duration) *github.CheckRun {
+	return &github.CheckRun{
+		ID:         github.Int64(id),
+		Name:       github.String(name),
+		HeadSHA:    github.String("sha"),
+		Status:     github.String(checks.STATUS_IN_PROGRESS),
+		ExternalID: github.String(externalID),
+		StartedAt:  &github.Timestamp{Time: time.Now().Add(-age)},
+	}
+}
+
+func TestReapCommit(t *testing.T) {
+	heldByOther := checks.FormatExternalID("projects/p/executions/1", checks.CheckRunLease{Owner: "other", Until: time.Now().Add(time.Hour)})
+	expired := checks.FormatExternalID("projects/p/executions/1", checks.CheckRunLease{Owner: "other", Until: time.Now().Add(-time.Minute)})
+
+	tests := []struct {
+		name           string
+		runs           []*github.CheckRun
+		wantPublished  bool
+		wantExecution  string
+		wantConclusion string
+		wantSummary    string
+		wantCancelled  bool
+	}{
+		{
+			name:          "resume",
+			runs:          []*github.CheckRun{stuckCheckRun(1, "Build Image - api", expired, time.Hour)},
+			wantPublished: true,
+			wantExecution: "projects/p/executions/1",
+		},
+		{
+			name:           "requeue",
+			runs:           []*github.CheckRun{stuckCheckRun(1, "Build Image - api", "", time.Hour)},
+			wantPublished:  true,
+			wantConclusion: checks.CONCLUSION_TIMED_OUT,
+			wantSummary:    STUCK_CHECK_REQUEUED_SUMMARY,
+		},
+		{
+			name: "requeued once already",
+			runs: []*github.CheckRun{
+				{
+					ID:         github.Int64(2),
+					Name:       github.String("Build Image - api"),
+					HeadSHA:    github.String("sha"),
+					Status:     github.String(checks.STATUS_COMPLETED),
+					Conclusion: github.String(checks.CONCLUSION_TIMED_OUT),
+					Output:     &github.CheckRunOutput{Summary: github.String(STUCK_CHECK_REQUEUED_SUMMARY)},
+				},
+				stuckCheckRun(1, "Build Image - api", "", time.Hour),
+			},
+			wantConclusion: checks.CONCLUSION_TIMED_OUT,
+			wantSummary:    "Phantom lost track of this check before it started, and it already failed to run again.",
+		},
+		{
+			name:           "max age",
+			runs:           []*github.CheckRun{stuckCheckRun(1, "Build Image - api", "projects/p/executions/1", 25*time.Hour)},
+			wantConclusion: checks.CONCLUSION_TIMED_OUT,
+			wantSummary:    "Phantom lost track of this check, it was stopped after being in progress for 25h0m0s.",
+			wantCancelled:  true,
+		},
+		{
+			name:           "execution gone",
+			runs:           []*github.CheckRun{stuckCheckRun(1, "Build Image - api", "projects/p/executions/2", time.Hour)},
+			wantConclusion: checks.CONCLUSION_TIMED_OUT,
+			wantSummary:    "Phantom lost track of this check, and its execution no longer exists.",
+		},
+		{
+			name: "watched by another instance",
+			runs: []*github.CheckRun{stuckCheckRun(1, "Build Image - api", heldByOther, time.Hour)},
+		},
+		{
+			name: "retry pending",
+			runs: []*github.CheckRun{func() *github.CheckRun {
+				run := stuckCheckRun(1, "Build Image - api", checks.FormatExternalID("", checks.CheckRunLease{Owner: "other", Until: time.Now().Add(time.Hour)}), time.Hour)
+				run.Status = github.String(checks.STATUS_QUEUED)
+				return run
+			}()},
+		},
+		{
+			name: "recent",
+			runs: []*github.CheckRun{stuckCheckRun(1, "Build Image - api", "", time.Minute)},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := useFakeGithub(t, test.runs...)
+			q, _ := useQueues(t)
+			gitClient := &fakeExecutions{running: map[string]bool{"projects/p/executions/1": true}}
+
+			if err := reapCommit(context.Background(), gitClient, testActiveCommit()); err != nil {
+				t.Fatalf("reapCommit() error = %v", err)
+			}
+
+			msg := receive(t, q, 100*time.Millisecond)
+			if (msg != nil) != test.wantPublished {
+				t.Fatalf("published %v, want %v", msg != nil, test.wantPublished)
+			}
+			if msg != nil {
+				check, err := DecodeCheckParams(msg.Data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if check.ExecutionName != test.wantExecution || check.Type != checks.PHANTOM_BUILD_IMAGE {
+					t.Errorf("published %s with execution '%s', want execution '%s'", check.Type, check.ExecutionName, test.wantExecution)
+				}
+				if len(test.wantExecution) == 0 && check.CheckRunID != 0 {
+					t.Errorf("requeued check has check run %d, want a new one", check.CheckRunID)
+				}
+			}
+
+			run := fake.runs[1]
+			if run.GetConclusion() != test.wantConclusion || run.GetOutput().GetSummary() != test.wantSummary {
+				t.Errorf("check run = %s %q, want %s %q", run.GetConclusion(), run.GetOutput().GetSummary(), test.wantConclusion, test.wantSummary)
+			}
+			if (len(gitClient.cancelled) > 0) != test.wantCancelled {
+				t.Errorf("cancelled %v, want cancelled %v", gitClient.cancelled, test.wantCancelled)
+			}
+
+			// Check runs acted on are claimed first, the others left alone
+			_, lease := checks.ParseExternalID(run.GetExternalID())
+			acted := test.wantPublished || len(test.wantConclusion) > 0
+			if acted != (lease.Owner == checks.INSTANCE_ID) {
+				t.Errorf("check run lease = %+v, want claimed %v", lease, acted)
+			}
+		})
+	}
+}
+
+func TestReapCommitResumeOnce(t *testing.T) {
+	fake := useFakeGithub(t, stuckCheckRun(1, "Build Image - api", "projects/p/executions/1", time.Hour))
+	q, _ := useQueues(t)
+	gitClient := &fakeExecutions{running: map[string]bool{"projects/p/executions/1": true}}
+
+	// The claim of the first pass holds the check run until a worker resumes it
+	for i := 0; i < 2; i++ {
+		if err := reapCommit(context.Background(), gitClient, testActiveCommit()); err != nil {
+			t.Fatalf("reapCommit() error = %v", err)
+		}
+	}
+	if msg := receive(t, q, 100*time.Millisecond); msg == nil {
+		t.Fatal("stuck check wasn't resumed")
+	}
+	if msg := receive(t, q, 100*time.Millisecond); msg != nil {
+		t.Error("stuck check was resumed twice")
+	}
+	if executionName, _ := checks.ParseExternalID(fake.runs[1].GetExternalID()); executionName != "projects/p/executions/1" {
+		t.Errorf("execution name = '%s' after the claim, want it kept", executionName)
+	}
+}
+
+func TestDiscoverRepositoryCommits(t *testing.T) {
+	fake := useFakeGithub(t)
+	event := func(sha string, age time.Duration) *github.Event {
+		payload, _ := json.Marshal(&github.PushEvent{Head: github.String(sha), Ref: github.String("refs/heads/feature")})
+		raw := json.RawMessage(payload)
+		return &github.Event{
+			Type:       github.String("PushEvent"),
+			RawPayload: &raw,
+			CreatedAt:  &github.Timestamp{Time: time.Now().Add(-age)},
+		}
+	}
+	fake.events = []*github.Event{event("pushed", time.Hour), event("old", 48*time.Hour)}
+
+	previous := activeCommits
+	activeCommits = make(map[string]*activeCommit)
+	defer func() { activeCommits = previous }()
+
+	if err := discoverRepositoryCommits(context.Background(), testActiveCommit().Check); err != nil {
+		t.Fatalf("discoverRepositoryCommits() error = %v", err)
+	}
+	if len(activeCommits) != 1 {
+		t.Fatalf("active commits = %v, want the recent push", activeCommits)
+	}
+	for _, commit := range activeCommits {
+		if commit.Check.HeadSHA != "pushed" || commit.Check.Branch != "feature" {
+			t.Errorf("active commit = %s on %s, want pushed on feature", commit.Check.HeadSHA, commit.Check.Branch)
+		}
+	}
+}
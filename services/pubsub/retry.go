@@ -0,0 +1,198 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/google/go-github/v50/github"
+	"github.com/rs/zerolog/log"
+
+	"github.com/jahagaley/phantom/checks"
+)
+
+const (
+	// Number of times a check is run before it is dead-lettered.
+	MAX_CHECK_ATTEMPTS = 5
+
+	// Delays between retries grow exponentially from the base delay.
+	RETRY_BASE_DELAY = 30 * time.Second
+	RETRY_MAX_DELAY  = 15 * time.Minute
+)
+
+// Queue receiving checks that failed after all of their attempts.
+var deadLetterQueue Queue
+
+// SetDeadLetterQueue sets the queue receiving checks that failed after all
+// of their attempts.
+func SetDeadLetterQueue(q Queue) {
+	deadLetterQueue = q
+}
+
+// IsTransientError reports whether a failed check is worth retrying.
+func IsTransientError(err error) bool {
+	var rateLimitErr *github.RateLimitError
+	var abuseRateLimitErr *github.AbuseRateLimitError
+	var errorResponse *github.ErrorResponse
+	var netErr net.Error
+
+	switch {
+	case errors.As(err, &rateLimitErr), errors.As(err, &abuseRateLimitErr):
+		return true
+	case errors.As(err, &errorResponse):
+		return errorResponse.Response != nil && errorResponse.Response.StatusCode >= http.StatusInternalServerError
+	case errors.As(err, &netErr), errors.Is(err, context.DeadlineExceeded):
+		return true
+	}
+
+	switch connect.CodeOf(err) {
+	case connect.CodeUnavailable, connect.CodeDeadlineExceeded, connect.CodeResourceExhausted, connect.CodeAborted:
+		return true
+	}
+	return false
+}
+
+// retryDelay returns the exponential backoff, with jitter, before the given attempt.
+func retryDelay(attempt int) time.Duration {
+	delay := RETRY_BASE_DELAY << (attempt - 1)
+	if delay <= 0 || delay > RETRY_MAX_DELAY {
+		delay = RETRY_MAX_DELAY
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+}
+
+// handleCheckFailure decides what becomes of a failed check: checks that failed
+// with a transient error are re-published with their check run queued again,
+// the others are dead-lettered with their check run concluded as failed.
+func handleCheckFailure(ctx context.Context, checkParams *checks.CheckParams, err error) {
+	attempt := checkParams.Attempt + 1
+	logger := log.With().
+		Str("check", checkParams.Name).
+		Str("repo", fmt.Sprintf("%s/%s", checkParams.Owner, checkParams.Repo)).
+		Str("sha", checkParams.HeadSHA).
+		Int("attempt", attempt).
+		Logger()
+
+	retry := *checkParams
+	retry.Attempt = attempt
+	retry.LastError = err.Error()
+
+	if !IsTransientError(err) {
+		logger.Error().Err(err).Msg("Check failed with a permanent error, dead-lettering.")
+		deadLetterCheck(ctx, &retry, err)
+		return
+	}
+	if attempt >= MAX_CHECK_ATTEMPTS {
+		logger.Error().Err(err).Msg("Check failed on its last attempt, dead-lettering.")
+		deadLetterCheck(ctx, &retry, err)
+		return
+	}
+
+	delay := retryDelay(attempt)
+	retry.NotBefore = time.Now().Add(delay)
+	if err := PublishGithubCheck(&retry); err != nil {
+		logger.Error().Err(err).Msg("Unable to re-publish check, dead-lettering.")
+		deadLetterCheck(ctx, &retry, err)
+		return
+	}
+	logger.Warn().Err(err).Dur("delay", delay).Msg("Check failed with a transient error, retrying.")
+
+	// The retry reports on the same check run, queued until it runs again.
+	if retry.CheckRunID != 0 {
+		requeueCheckRun(
+			&retry,
+			fmt.Sprintf(
+				"Attempt %d of %d failed and will be retried at %s: %v",
+				attempt, MAX_CHECK_ATTEMPTS, retry.NotBefore.Format(time.RFC3339), err,
+			),
+		)
+	}
+}
+
+// deadLetterCheck publishes the check to the dead-letter queue and marks its
+// Github check run as failed with the final error.
+func deadLetterCheck(ctx context.Context, checkParams *checks.CheckParams, err error) {
+	if deadLetterQueue != nil {
+		data, encodeErr := EncodeCheckParams(checkParams)
+		if encodeErr == nil {
+			_, encodeErr = deadLetterQueue.Publish(ctx, data)
+		}
+		if encodeErr != nil {
+			log.Error().Err(encodeErr).Msg(fmt.Sprintf("Unable to dead-letter check '%s'", checkParams.Name))
+		}
+	} else {
+		log.Warn().Msg("No dead-letter queue has been configured.")
+	}
+
+	concludeCheckRun(checkParams, checks.CONCLUSION_FAILURE, failureSummary(checkParams, err))
+}
+
+// failureSummary reports the error a check failed with on its check run.
+func failureSummary(checkParams *checks.CheckParams, err error) string {
+	summary := err.Error()
+	var failure *checks.CheckFailure
+	if errors.As(err, &failure) {
+		summary = failure.Summary
+	}
+	if checkParams.Attempt > 1 {
+		summary = fmt.Sprintf("Check failed after %d attempts: %s", checkParams.Attempt, summary)
+	}
+	return summary
+}
+
+// concludeCheckRun completes the check run of the check, creating it first if
+// the check failed before it had one.
+func concludeCheckRun(checkParams *checks.CheckParams, conclusion, summary string) {
+	githubClient, err := newGithubClient(checkParams.Host, checkParams.InstallationID)
+	if err != nil {
+		log.Err(err).Msg("Failed to create Github client.")
+		return
+	}
+
+	// Cancellations of superseded checks have no check run to report on
+	if checkParams.Type == checks.CANCEL_SUPERSEDED {
+		return
+	}
+
+	if checkParams.CheckRunID == 0 {
+		if err := checks.CreateCheckRun(githubClient, checkParams); err != nil {
+			log.Err(err).Msg("Unable to create check run.")
+			return
+		}
+	}
+
+	err = checks.ConcludeCheckRun(githubClient, checkParams, conclusion, summary, "", nil)
+	if err != nil {
+		log.Err(err).Msg("Unable to complete check run.")
+	}
+}
+
+// requeueCheckRun marks the check run of the check as queued again, and holds
+// it until the check is due so reapers don't take it for a lost check.
+func requeueCheckRun(checkParams *checks.CheckParams, summary string) {
+	githubClient, err := newGithubClient(checkParams.Host, checkParams.InstallationID)
+	if err != nil {
+		log.Err(err).Msg("Failed to create Github client.")
+		return
+	}
+
+	// Check runs concluded since, ex: cancelled by a newer push, stay so, and
+	// the retry skips the check
+	if checks.IsCheckRunCompleted(githubClient, checkParams) {
+		return
+	}
+
+	due := checkParams.NotBefore
+	if due.Before(time.Now()) {
+		due = time.Now()
+	}
+	err = checks.UpdateCheckRunQueued(githubClient, checkParams, summary, due.Add(checks.CHECK_RUN_LEASE))
+	if err != nil {
+		log.Err(err).Msg("Unable to queue check run again.")
+	}
+}
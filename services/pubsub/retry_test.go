@@ -0,0 +1,219 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"connectrpc.com/connect"
+	"github.com/google/go-github/v50/github"
+
+	"github.com/jahagaley/phantom/checks"
+)
+
+// checkRunUpdate is an update of a check run received by the fake Github.
+type checkRunUpdate struct {
+	id         int64
+	status     string
+	conclusion string
+	summary    string
+}
+
+// fakeGithub records the check runs created and updated by the checks of
+// owner/repo, and serves them back.
+type fakeGithub struct {
+	mu      sync.Mutex
+	runs    map[int64]*github.CheckRun
+	updates []checkRunUpdate
+	events  []*github.Event
+	nextID  int64
+}
+
+// useFakeGithub points the Github clients of the package to a fake server
+// for the test.
+func useFakeGithub(t *testing.T, runs ...*github.CheckRun) *fakeGithub {
+	t.Helper()
+
+	fake := &fakeGithub{runs: make(map[int64]*github.CheckRun), nextID: 1000}
+	for _, run := range runs {
+		fake.runs[run.GetID()] = run
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/owner/repo/check-runs", func(w http.ResponseWriter, r *http.Request) {
+		var opts github.CreateCheckRunOptions
+		json.NewDecoder(r.Body).Decode(&opts)
+
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		fake.nextID++
+		run := &github.CheckRun{
+			ID:         github.Int64(fake.nextID),
+			Name:       github.String(opts.Name),
+			HeadSHA:    github.String(opts.HeadSHA),
+			Status:     github.String(checks.STATUS_QUEUED),
+			ExternalID: opts.ExternalID,
+		}
+		fake.runs[run.GetID()] = run
+		json.NewEncoder(w).Encode(run)
+	})
+	mux.HandleFunc("/repos/owner/repo/check-runs/", func(w http.ResponseWriter, r *http.Request) {
+		id, _ := strconv.ParseInt(path.Base(r.URL.Path), 10, 64)
+
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		run, ok := fake.runs[id]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == http.MethodPatch {
+			var opts github.UpdateCheckRunOptions
+			json.NewDecoder(r.Body).Decode(&opts)
+			fake.updates = append(fake.updates, checkRunUpdate{id, opts.GetStatus(), opts.GetConclusion(), opts.GetOutput().GetSummary()})
+			if opts.Status != nil {
+				run.Status = opts.Status
+			}
+			if opts.Conclusion != nil {
+				run.Status, run.Conclusion = github.String(checks.STATUS_COMPLETED), opts.Conclusion
+			}
+			if opts.ExternalID != nil {
+				run.ExternalID = opts.ExternalID
+			}
+			if opts.Output != nil {
+				run.Output = opts.Output
+			}
+		}
+		json.NewEncoder(w).Encode(run)
+	})
+	mux.HandleFunc("/repos/owner/repo/commits/", func(w http.ResponseWriter, r *http.Request) {
+		sha := strings.Split(strings.TrimPrefix(r.URL.Path, "/repos/owner/repo/commits/"), "/")[0]
+
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		result := &github.ListCheckRunsResults{}
+		for _, run := range fake.runs {
+			if run.GetHeadSHA() == sha {
+				result.CheckRuns = append(result.CheckRuns, run)
+			}
+		}
+		result.Total = github.Int(len(result.CheckRuns))
+		json.NewEncoder(w).Encode(result)
+	})
+	mux.HandleFunc("/repos/owner/repo/events", func(w http.ResponseWriter, r *http.Request) {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		json.NewEncoder(w).Encode(fake.events)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	client := github.NewClient(srv.Client())
+	client.BaseURL, _ = url.Parse(srv.URL + "/")
+
+	previous := newGithubClient
+	newGithubClient = func(host string, installationID int64) (*github.Client, error) {
+		return client, nil
+	}
+	t.Cleanup(func() { newGithubClient = previous })
+	return fake
+}
+
+func (f *fakeGithub) Updates() []checkRunUpdate {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]checkRunUpdate(nil), f.updates...)
+}
+
+// useQueues replaces the queue and the dead-letter queue for the test.
+func useQueues(t *testing.T) (*MemoryQueue, *MemoryQueue) {
+	t.Helper()
+
+	q, dead := NewMemoryQueue(10, 1), NewMemoryQueue(10, 1)
+	previous, previousDead := queue, deadLetterQueue
+	queue, deadLetterQueue = q, dead
+	t.Cleanup(func() {
+		queue, deadLetterQueue = previous, previousDead
+		q.Close()
+		dead.Close()
+	})
+	return q, dead
+}
+
+func TestHandleCheckFailure(t *testing.T) {
+	fake := useFakeGithub(t)
+	q, dead := useQueues(t)
+
+	check := &checks.CheckParams{
+		Type:       checks.PHANTOM_BUILD_IMAGE,
+		Name:       "Build Image - api",
+		Owner:      "owner",
+		Repo:       "repo",
+		HeadSHA:    "sha",
+		CheckRunID: 42,
+	}
+	fake.runs[42] = &github.CheckRun{ID: github.Int64(42), Status: github.String(checks.STATUS_IN_PROGRESS)}
+
+	// A transient error queues the check run again along with the retry
+	unavailable := connect.NewError(connect.CodeUnavailable, errors.New("down"))
+	handleCheckFailure(context.Background(), check, &checks.CheckFailure{Summary: "Unable to complete build execution.", Err: unavailable})
+
+	msg := receive(t, q, time.Second)
+	if msg == nil {
+		t.Fatal("transient failure wasn't retried")
+	}
+	retry, err := DecodeCheckParams(msg.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retry.Attempt != 1 || retry.CheckRunID != 42 || !retry.NotBefore.After(time.Now()) {
+		t.Errorf("retry = attempt %d, check run %d, not before %s", retry.Attempt, retry.CheckRunID, retry.NotBefore)
+	}
+
+	// The retry fails for good, the check run is concluded with its summary
+	handleCheckFailure(context.Background(), retry, &checks.CheckFailure{Summary: "Invalid 'phantom.yaml' file.", Err: errors.New("invalid")})
+	if msg := receive(t, dead, time.Second); msg == nil {
+		t.Error("permanent failure wasn't dead-lettered")
+	}
+	if msg := receive(t, q, 100*time.Millisecond); msg != nil {
+		t.Error("permanent failure was retried")
+	}
+
+	updates := fake.Updates()
+	if len(updates) != 2 {
+		t.Fatalf("check run updates = %+v, want queued then failure", updates)
+	}
+	if updates[0].status != checks.STATUS_QUEUED || len(updates[0].conclusion) > 0 {
+		t.Errorf("first update = %+v, want the check run queued", updates[0])
+	}
+	want := "Check failed after 2 attempts: Invalid 'phantom.yaml' file."
+	if updates[1].conclusion != checks.CONCLUSION_FAILURE || updates[1].summary != want {
+		t.Errorf("second update = %+v, want failure with summary %q", updates[1], want)
+	}
+}
+
+func TestHandleCheckFailurePermanent(t *testing.T) {
+	fake := useFakeGithub(t)
+	_, dead := useQueues(t)
+
+	// Checks failing before they had a check run get one to report it
+	check := &checks.CheckParams{Type: checks.SETUP, Name: checks.SETUP, Owner: "owner", Repo: "repo", HeadSHA: "sha"}
+	handleCheckFailure(context.Background(), check, &checks.CheckFailure{Summary: "Unable to load your 'phantom.yaml' file.", Err: errors.New("yaml")})
+
+	if msg := receive(t, dead, time.Second); msg == nil {
+		t.Error("permanent failure wasn't dead-lettered")
+	}
+	updates := fake.Updates()
+	if len(updates) != 1 || updates[0].conclusion != checks.CONCLUSION_FAILURE || updates[0].summary != "Unable to load your 'phantom.yaml' file." {
+		t.Errorf("check run updates = %+v, want a single failure", updates)
+	}
+}
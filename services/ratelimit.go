@@ -0,0 +1,180 @@
+package services
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// Number of times a request is sent before its response is returned as is.
+	MAX_REQUEST_ATTEMPTS = 3
+
+	// Longest time a request waits for a rate limit to reset before its
+	// response is returned, leaving longer waits to the check retries.
+	MAX_RATE_LIMIT_WAIT = time.Minute
+
+	// Checks of an installation with less requests left than this wait for
+	// its rate limit to reset, keeping the rest for the checks already running.
+	RATE_LIMIT_RESERVE = 100
+
+	// Delay before retrying server errors, grows with every attempt.
+	retryBaseDelay = time.Second
+)
+
+// RateLimitQuota is the Github rate limit of an installation, as reported by
+// its latest response.
+type RateLimitQuota struct {
+	Limit     int
+	Remaining int
+	Reset     time.Time
+}
+
+var (
+	quotasMu sync.Mutex
+	quotas   = make(map[installationKey]RateLimitQuota)
+)
+
+// GetInstallationQuota returns the last known rate limit of the installation
+// on the Github host. The app itself uses installation ID 0.
+func GetInstallationQuota(host string, installationID int64) (RateLimitQuota, bool) {
+	quotasMu.Lock()
+	defer quotasMu.Unlock()
+
+	quota, ok := quotas[installationKey{HostName(host), installationID}]
+	if ok && time.Now().After(quota.Reset) {
+		// The limit has reset since the last response
+		quota.Remaining = quota.Limit
+	}
+	return quota, ok
+}
+
+// ThrottleUntil returns when new checks of the installation can start, if it
+// is running out of requests until its rate limit resets.
+func ThrottleUntil(host string, installationID int64) (time.Time, bool) {
+	quota, ok := GetInstallationQuota(host, installationID)
+	if !ok || quota.Remaining >= RATE_LIMIT_RESERVE {
+		return time.Time{}, false
+	}
+
+	// Spread the checks waiting on the reset
+	return quota.Reset.Add(time.Duration(rand.Int63n(int64(time.Minute)))), true
+}
+
+func updateQuota(key installationKey, resp *http.Response) {
+	limit, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Limit"))
+	if err != nil {
+		return
+	}
+	remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+	reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return
+	}
+
+	quotasMu.Lock()
+	quotas[key] = RateLimitQuota{
+		Limit:     limit,
+		Remaining: remaining,
+		Reset:     time.Unix(reset, 0),
+	}
+	quotasMu.Unlock()
+}
+
+// RateLimitTransport keeps track of the rate limit of an installation, waits
+// for rate limits to reset and retries idempotent requests failing with a
+// server error.
+type RateLimitTransport struct {
+	Base           http.RoundTripper
+	Host           string
+	InstallationID int64
+}
+
+func (t *RateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := t.Base.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		updateQuota(installationKey{HostName(t.Host), t.InstallationID}, resp)
+
+		wait, retry := retryAfter(resp, attempt)
+		if !retry || attempt >= MAX_REQUEST_ATTEMPTS || !canRetry(req) {
+			return resp, nil
+		}
+
+		// The request is sent again with a fresh body
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return resp, nil
+			}
+			clone := req.Clone(req.Context())
+			clone.Body = body
+			req = clone
+		}
+		resp.Body.Close()
+
+		log.Warn().
+			Str("host", HostName(t.Host)).
+			Int64("installation_id", t.InstallationID).
+			Int("status", resp.StatusCode).
+			Dur("wait", wait).
+			Msg("Github request failed, retrying.")
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// retryAfter returns how long to wait before sending the request again, if
+// the response is worth retrying.
+func retryAfter(resp *http.Response, attempt int) (time.Duration, bool) {
+	jitter := time.Duration(rand.Int63n(int64(retryBaseDelay)))
+
+	switch {
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return retryBaseDelay<<(attempt-1) + jitter, true
+	case resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests:
+		return 0, false
+	}
+
+	// Secondary rate limits say how long to wait
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		wait := time.Duration(seconds) * time.Second
+		return wait + jitter, wait <= MAX_RATE_LIMIT_WAIT
+	}
+
+	// Primary rate limits reset at a given time
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+		if err != nil {
+			return 0, false
+		}
+		wait := max(time.Until(time.Unix(reset, 0)), 0)
+		return wait + jitter, wait <= MAX_RATE_LIMIT_WAIT
+	}
+
+	return 0, false
+}
+
+// canRetry reports whether the request can be sent again without side effects.
+func canRetry(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package services
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func rateLimitResponse(status, remaining int, reset time.Time) *http.Response {
+	header := http.Header{}
+	header.Set("X-RateLimit-Limit", "5000")
+	header.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	header.Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+	return &http.Response{StatusCode: status, Header: header}
+}
+
+func TestThrottleUntil(t *testing.T) {
+	reset := time.Now().Add(30 * time.Minute)
+	tests := []struct {
+		name      string
+		remaining int
+		reset     time.Time
+		throttled bool
+	}{
+		{"plenty left", 4000, reset, false},
+		{"at the reserve", RATE_LIMIT_RESERVE, reset, false},
+		{"below the reserve", RATE_LIMIT_RESERVE - 1, reset, true},
+		{"limit already reset", 0, time.Now().Add(-time.Minute), false},
+	}
+
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			installationID := int64(1000 + i)
+			if _, throttled := ThrottleUntil("", installationID); throttled {
+				t.Fatal("unknown installation is throttled")
+			}
+
+			updateQuota(installationKey{DEFAULT_GITHUB_HOST, installationID}, rateLimitResponse(http.StatusOK, test.remaining, test.reset))
+			notBefore, throttled := ThrottleUntil("", installationID)
+			if throttled != test.throttled {
+				t.Fatalf("ThrottleUntil() = %v, want %v", throttled, test.throttled)
+			}
+			if throttled && (notBefore.Before(test.reset.Truncate(time.Second)) || notBefore.After(test.reset.Add(time.Minute))) {
+				t.Errorf("ThrottleUntil() = %s, want within a minute after %s", notBefore, test.reset)
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	secondaryLimit := func(seconds string) *http.Response {
+		resp := &http.Response{StatusCode: http.StatusForbidden, Header: http.Header{}}
+		resp.Header.Set("Retry-After", seconds)
+		return resp
+	}
+
+	tests := []struct {
+		name    string
+		resp    *http.Response
+		retry   bool
+		minWait time.Duration
+	}{
+		{"success", rateLimitResponse(http.StatusOK, 10, time.Now()), false, 0},
+		{"not found", &http.Response{StatusCode: http.StatusNotFound}, false, 0},
+		{"server error", &http.Response{StatusCode: http.StatusBadGateway}, true, retryBaseDelay},
+		{"short secondary limit", secondaryLimit("5"), true, 5 * time.Second},
+		{"long secondary limit", secondaryLimit("600"), false, 0},
+		{"primary limit resetting soon", rateLimitResponse(http.StatusForbidden, 0, time.Now().Add(30*time.Second)), true, 20 * time.Second},
+		{"primary limit resetting later", rateLimitResponse(http.StatusForbidden, 0, time.Now().Add(time.Hour)), false, 0},
+		{"forbidden", rateLimitResponse(http.StatusForbidden, 10, time.Now()), false, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wait, retry := retryAfter(test.resp, 1)
+			if retry != test.retry {
+				t.Fatalf("retryAfter() = %s, %v, want %v", wait, retry, test.retry)
+			}
+			if retry && wait < test.minWait {
+				t.Errorf("retryAfter() = %s, want at least %s", wait, test.minWait)
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package services
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jahagaley/phantom/utils"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// How long private keys are cached before being read again.
+	privateKeyRefreshInterval = time.Hour
+
+	// Github accepts app JWTs valid for at most 10 minutes.
+	appTokenLifetime = 10 * time.Minute
+
+	// App JWTs are issued in the past to allow for clock drift with Github.
+	appTokenClockDrift = time.Minute
+
+	// Tokens are refreshed this long before they expire, so requests
+	// started with a token don't fail half way.
+	appTokenEarlyExpiry          = time.Minute
+	installationTokenEarlyExpiry = 5 * time.Minute
+)
+
+// accessSecretVersion reads the private keys, tests replace it with fake keys.
+var accessSecretVersion = utils.AccessSecretVersion
+
+// installationKey identifies an installation, IDs are only unique on a host.
+type installationKey struct {
+	host string
+	id   int64
+}
+
+type privateKeyCache struct {
+	name string
+
+	mu       sync.Mutex
+	key      *rsa.PrivateKey
+	loadedAt time.Time
+}
+
+// get returns the private key of the Github app, reading it again from
+// Secret Manager once the refresh interval has passed.
+func (c *privateKeyCache) get() (*rsa.PrivateKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if c.key != nil && now.Sub(c.loadedAt) <= privateKeyRefreshInterval {
+		return c.key, nil
+	}
+
+	// Getting secret from Secret Manager
+	pem, err := accessSecretVersion(c.name)
+	if err == nil {
+		var key *rsa.PrivateKey
+		key, err = jwt.ParseRSAPrivateKeyFromPEM(pem)
+		if err == nil {
+			c.key, c.loadedAt = key, now
+			return c.key, nil
+		}
+	}
+
+	// Keep using the key we already have if a refresh fails.
+	if c.key != nil {
+		log.Warn().Err(err).Msg("Unable to reload Github private key, using the cached key")
+		return c.key, nil
+	}
+	return nil, fmt.Errorf("Unable to load Github private key: %w", err)
+}
+
+// appTokenSource signs JWTs authenticating as the Github app of a host.
+type appTokenSource struct {
+	host       *GithubHost
+	privateKey *privateKeyCache
+}
+
+func (s *appTokenSource) Token() (*oauth2.Token, error) {
+	if s.host.AppID <= 0 {
+		return nil, fmt.Errorf("Invalid Github app ID for host '%s'.", s.host.Host)
+	}
+
+	key, err := s.privateKey.get()
+	if err != nil {
+		return nil, err
+	}
+
+	// Create a new JWT for the GitHub App
+	now := time.Now()
+	expiry := now.Add(appTokenLifetime)
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.RegisteredClaims{
+		IssuedAt:  jwt.NewNumericDate(now.Add(-appTokenClockDrift)),
+		ExpiresAt: jwt.NewNumericDate(expiry),
+		Issuer:    strconv.FormatInt(s.host.AppID, 10),
+	})
+	tokenString, err := token.SignedString(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &oauth2.Token{AccessToken: tokenString, Expiry: expiry}, nil
+}
+
+// installationTokenSource creates installation access tokens with the app client.
+type installationTokenSource struct {
+	host           *GithubHost
+	installationID int64
+}
+
+func (s *installationTokenSource) Token() (*oauth2.Token, error) {
+	client, err := s.host.NewClient(newRateLimitedClient(getAppTokenSource(s.host), s.host.Host, 0))
+	if err != nil {
+		return nil, err
+	}
+
+	// Create an installation token for the repository
+	token, _, err := client.Apps.CreateInstallationToken(context.Background(), s.installationID, nil)
+	if isInstallationGone(err) {
+		DeactivateInstallation(s.host.Host, s.installationID)
+		return nil, fmt.Errorf("%w: %v", ErrInstallationInactive, err)
+	} else if err != nil {
+		log.Warn().Err(err).Msg("Error creating installation token")
+		return nil, err
+	}
+
+	return &oauth2.Token{AccessToken: token.GetToken(), Expiry: token.GetExpiresAt().Time}, nil
+}
+
+// Token sources of the apps and installations, reusing tokens until they are
+// about to expire.
+var (
+	tokenSourcesMu     sync.Mutex
+	appTokens          = make(map[string]oauth2.TokenSource)
+	installationTokens = make(map[installationKey]oauth2.TokenSource)
+)
+
+// CheckPrivateKeys verifies that the private keys of the Github apps of every
+// host can be loaded and sign tokens.
+func CheckPrivateKeys() error {
+	if _, err := GetGithubHost(DEFAULT_GITHUB_HOST); err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, githubHost := range hosts {
+		if _, err := getAppTokenSource(githubHost).Token(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", githubHost.Host, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func getAppTokenSource(host *GithubHost) oauth2.TokenSource {
+	tokenSourcesMu.Lock()
+	defer tokenSourcesMu.Unlock()
+
+	ts, ok := appTokens[host.Host]
+	if !ok {
+		src := &appTokenSource{
+			host:       host,
+			privateKey: &privateKeyCache{name: host.PrivateKeyName},
+		}
+		ts = oauth2.ReuseTokenSourceWithExpiry(nil, src, appTokenEarlyExpiry)
+		appTokens[host.Host] = ts
+	}
+	return ts
+}
+
+func getInstallationTokenSource(host *GithubHost, installationID int64) oauth2.TokenSource {
+	tokenSourcesMu.Lock()
+	defer tokenSourcesMu.Unlock()
+
+	key := installationKey{host.Host, installationID}
+	ts, ok := installationTokens[key]
+	if !ok {
+		src := &installationTokenSource{host: host, installationID: installationID}
+		ts = oauth2.ReuseTokenSourceWithExpiry(nil, src, installationTokenEarlyExpiry)
+		installationTokens[key] = ts
+	}
+	return ts
+}
+
+func forgetInstallationTokenSource(host string, installationID int64) {
+	tokenSourcesMu.Lock()
+	defer tokenSourcesMu.Unlock()
+
+	delete(installationTokens, installationKey{HostName(host), installationID})
+}
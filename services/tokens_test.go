@@ -0,0 +1,180 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/go-github/v50/github"
+)
+
+func newPrivateKey(t *testing.T) (*rsa.PrivateKey, []byte) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
+
+// fakeSecrets replaces the private keys read from Secret Manager.
+func fakeSecrets(t *testing.T, secrets map[string][]byte) {
+	t.Helper()
+	original := accessSecretVersion
+	accessSecretVersion = func(name string) ([]byte, error) {
+		secret, ok := secrets[name]
+		if !ok {
+			return nil, errors.New("secret not found")
+		}
+		return secret, nil
+	}
+	t.Cleanup(func() { accessSecretVersion = original })
+}
+
+func TestPrivateKeyCache(t *testing.T) {
+	first, firstPEM := newPrivateKey(t)
+	second, secondPEM := newPrivateKey(t)
+	secrets := map[string][]byte{"key": firstPEM}
+	fakeSecrets(t, secrets)
+
+	cache := &privateKeyCache{name: "key"}
+	if key, err := cache.get(); err != nil || !key.Equal(first) {
+		t.Fatalf("get() = %v, want the first key", err)
+	}
+
+	// Rotated keys are only read once the cached key is old enough
+	secrets["key"] = secondPEM
+	if key, _ := cache.get(); !key.Equal(first) {
+		t.Error("get() returned the rotated key before the refresh interval")
+	}
+	cache.loadedAt = time.Now().Add(-privateKeyRefreshInterval - time.Second)
+	if key, _ := cache.get(); !key.Equal(second) {
+		t.Error("get() returned the cached key after the refresh interval, want the rotated key")
+	}
+
+	// The cached key is kept when it can't be read again
+	delete(secrets, "key")
+	cache.loadedAt = time.Now().Add(-privateKeyRefreshInterval - time.Second)
+	if key, err := cache.get(); err != nil || !key.Equal(second) {
+		t.Errorf("get() = %v when reloading fails, want the cached key", err)
+	}
+	secrets["key"] = []byte("invalid")
+	if key, err := cache.get(); err != nil || !key.Equal(second) {
+		t.Errorf("get() = %v when the key is invalid, want the cached key", err)
+	}
+
+	if _, err := (&privateKeyCache{name: "missing"}).get(); err == nil {
+		t.Error("get() without any key succeeded, want an error")
+	}
+}
+
+func TestAppToken(t *testing.T) {
+	key, keyPEM := newPrivateKey(t)
+	fakeSecrets(t, map[string][]byte{"key": keyPEM})
+
+	src := &appTokenSource{host: &GithubHost{Host: "github.test", AppID: 12}, privateKey: &privateKeyCache{name: "key"}}
+	token, err := src.Token()
+	if err != nil {
+		t.Fatalf("Token() error = %v", err)
+	}
+
+	claims := &jwt.RegisteredClaims{}
+	_, err = jwt.ParseWithClaims(token.AccessToken, claims, func(*jwt.Token) (interface{}, error) { return &key.PublicKey, nil })
+	if err != nil {
+		t.Fatalf("Token() signed an invalid JWT: %v", err)
+	}
+	if claims.Issuer != "12" {
+		t.Errorf("iss = %s, want the app ID", claims.Issuer)
+	}
+
+	// Tokens are issued in the past to allow for clock drift, and expire
+	// within the lifetime Github accepts.
+	now := time.Now()
+	if issuedAt := claims.IssuedAt.Time; issuedAt.After(now.Add(-appTokenClockDrift)) || issuedAt.Before(now.Add(-appTokenClockDrift-5*time.Second)) {
+		t.Errorf("iat = %s, want %s before now", issuedAt, appTokenClockDrift)
+	}
+	if lifetime := claims.ExpiresAt.Sub(claims.IssuedAt.Time); lifetime > appTokenLifetime+appTokenClockDrift {
+		t.Errorf("exp is %s after iat, want at most %s", lifetime, appTokenLifetime+appTokenClockDrift)
+	}
+	if claims.ExpiresAt.Time.After(now.Add(appTokenLifetime)) || !token.Expiry.Truncate(time.Second).Equal(claims.ExpiresAt.Time) {
+		t.Errorf("exp = %s, token expiry %s, want the expiry of the token at most %s from now", claims.ExpiresAt.Time, token.Expiry, appTokenLifetime)
+	}
+
+	if _, err := (&appTokenSource{host: &GithubHost{Host: "github.test"}, privateKey: src.privateKey}).Token(); err == nil {
+		t.Error("Token() without an app ID succeeded, want an error")
+	}
+}
+
+func TestInstallationTokenReuse(t *testing.T) {
+	_, keyPEM := newPrivateKey(t)
+	fakeSecrets(t, map[string][]byte{"key": keyPEM})
+
+	tests := []struct {
+		name         string
+		expiresIn    time.Duration
+		wantRequests int32
+	}{
+		{"valid", time.Hour, 1},
+		{"about to expire", installationTokenEarlyExpiry - time.Minute, 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var requests atomic.Int32
+			mux := http.NewServeMux()
+			mux.HandleFunc("/api/v3/app/installations/42/access_tokens", func(w http.ResponseWriter, r *http.Request) {
+				if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+					t.Errorf("installation token requested with Authorization %q, want an app JWT", r.Header.Get("Authorization"))
+				}
+				requests.Add(1)
+				w.WriteHeader(http.StatusCreated)
+				json.NewEncoder(w).Encode(&github.InstallationToken{
+					Token:     github.String("token"),
+					ExpiresAt: &github.Timestamp{Time: time.Now().Add(test.expiresIn)},
+				})
+			})
+			srv := httptest.NewServer(mux)
+			defer srv.Close()
+
+			host := &GithubHost{Host: "tokens-" + strings.ReplaceAll(test.name, " ", "-") + ".test", BaseURL: srv.URL + "/", AppID: 12, PrivateKeyName: "key"}
+			t.Cleanup(func() {
+				tokenSourcesMu.Lock()
+				defer tokenSourcesMu.Unlock()
+				delete(appTokens, host.Host)
+				delete(installationTokens, installationKey{host.Host, 42})
+			})
+
+			for i := 0; i < 2; i++ {
+				token, err := getInstallationTokenSource(host, 42).Token()
+				if err != nil {
+					t.Fatalf("Token() error = %v", err)
+				}
+				if token.AccessToken != "token" {
+					t.Errorf("Token() = %q, want the installation token", token.AccessToken)
+				}
+			}
+			if got := requests.Load(); got != test.wantRequests {
+				t.Errorf("created %d installation tokens, want %d", got, test.wantRequests)
+			}
+
+			// Forgotten installations create a new token
+			forgetInstallationTokenSource(host.Host, 42)
+			if _, err := getInstallationTokenSource(host, 42).Token(); err != nil {
+				t.Fatalf("Token() error = %v", err)
+			}
+			if got := requests.Load(); got != test.wantRequests+1 {
+				t.Errorf("created %d installation tokens after forgetting the installation, want %d", got, test.wantRequests+1)
+			}
+		})
+	}
+}
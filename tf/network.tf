@@ -21,7 +21,7 @@ resource "google_compute_health_check" "compute_health_check" {
   http_health_check {
     port               = 8080
     port_specification = "USE_FIXED_PORT"
-    request_path       = "/"
+    request_path       = "/readyz"
   }
   timeout_sec         = 5
   unhealthy_threshold = 2
@@ -1,6 +1,8 @@
 package utils
 
-const (
+// URLs of the Phantom API and site, set from the server settings. Tests point
+// API_URL to a local stand-in.
+var (
 	API_URL  = "https://phantom.hagaley.com"
 	SITE_URL = "https://hagaley.com"
 )
@@ -0,0 +1,214 @@
+package utils
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// Limits of the repository archives downloaded from Github.
+	MAX_ARCHIVE_SIZE    = 1 << 30
+	MAX_EXTRACTED_SIZE  = 4 << 30
+	MAX_EXTRACTED_FILES = 200000
+
+	// Most symlinks followed when resolving a single path.
+	maxSymlinkDepth = 255
+)
+
+var ErrArchiveTooLarge = fmt.Errorf("Repository archive is larger than %d bytes.", MAX_ARCHIVE_SIZE)
+
+// ExtractTarGz extracts the gzipped tar archive read from r into dst, dropping
+// the first strip components of every path. Entries escaping dst, either
+// through their path or through symlinks, are rejected, as are archives
+// extracting to more than MAX_EXTRACTED_SIZE bytes or MAX_EXTRACTED_FILES files.
+func ExtractTarGz(r io.Reader, dst string, strip int) error {
+	dst, err := filepath.Abs(dst)
+	if err != nil {
+		return err
+	}
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("Invalid repository archive: %w", err)
+	}
+	defer gz.Close()
+
+	// Symlinks are created once all files are extracted, so no file is ever
+	// written through one.
+	var symlinks []*tar.Header
+	var size int64
+	files := 0
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return fmt.Errorf("Invalid repository archive: %w", err)
+		}
+
+		name, ok, err := stripPath(hdr.Name, strip)
+		if err != nil {
+			return err
+		} else if !ok {
+			continue
+		}
+
+		files++
+		if files > MAX_EXTRACTED_FILES {
+			return fmt.Errorf("Repository archive has more than %d files.", MAX_EXTRACTED_FILES)
+		}
+
+		target := filepath.Join(dst, filepath.FromSlash(name))
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0o755)
+		case tar.TypeReg:
+			size += hdr.Size
+			if size > MAX_EXTRACTED_SIZE {
+				return fmt.Errorf("Repository archive extracts to more than %d bytes.", MAX_EXTRACTED_SIZE)
+			}
+			err = extractFile(tr, hdr, target)
+		case tar.TypeLink:
+			linkName, _, linkErr := stripPath(hdr.Linkname, strip)
+			if linkErr != nil {
+				return linkErr
+			}
+			if err = os.MkdirAll(filepath.Dir(target), 0o755); err == nil {
+				err = os.Link(filepath.Join(dst, filepath.FromSlash(linkName)), target)
+			}
+		case tar.TypeSymlink:
+			if path.IsAbs(hdr.Linkname) {
+				return fmt.Errorf("Symlink '%s' points to the absolute path '%s'.", name, hdr.Linkname)
+			}
+			hdr.Name = name
+			symlinks = append(symlinks, hdr)
+		default:
+			// Devices, fifos and Github's global pax header aren't extracted
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to extract '%s': %w", name, err)
+		}
+	}
+
+	for _, hdr := range symlinks {
+		// Nothing is created through a link, and no link points outside of
+		// dst given the links already created.
+		dir := path.Dir(hdr.Name)
+		if err := resolveInRoot(dst, dir); err != nil {
+			return fmt.Errorf("Symlink '%s' is created outside of the repository: %w", hdr.Name, err)
+		}
+		// The link name isn't cleaned, as '..' applies to where the
+		// components before it resolve to.
+		if err := resolveInRoot(dst, dir+"/"+hdr.Linkname); err != nil {
+			return fmt.Errorf("Symlink '%s' points outside of the repository: %w", hdr.Name, err)
+		}
+
+		target := filepath.Join(dst, filepath.FromSlash(hdr.Name))
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return fmt.Errorf("Unable to extract '%s': %w", hdr.Name, err)
+		}
+		if err := os.Symlink(filepath.FromSlash(hdr.Linkname), target); err != nil {
+			return fmt.Errorf("Unable to extract '%s': %w", hdr.Name, err)
+		}
+	}
+
+	// Links are checked again once all of them exist, as a link may escape
+	// through another one created after it.
+	for _, hdr := range symlinks {
+		if err := resolveInRoot(dst, hdr.Name); err != nil {
+			return fmt.Errorf("Symlink '%s' points outside of the repository: %w", hdr.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// stripPath drops the first strip components of an archive path and checks it
+// stays inside the extraction directory. It returns false for paths that are
+// entirely stripped.
+func stripPath(name string, strip int) (string, bool, error) {
+	parts := strings.Split(strings.Trim(name, "/"), "/")
+	if len(parts) <= strip {
+		return "", false, nil
+	}
+
+	stripped := path.Clean(strings.Join(parts[strip:], "/"))
+	if path.IsAbs(name) || stripped == ".." || strings.HasPrefix(stripped, "../") {
+		return "", false, fmt.Errorf("Archive entry '%s' escapes the repository directory.", name)
+	}
+	return stripped, stripped != ".", nil
+}
+
+func extractFile(r io.Reader, hdr *tar.Header, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, hdr.FileInfo().Mode().Perm()|0o600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := io.CopyN(file, r, hdr.Size); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// resolveInRoot follows the symlinks of the path relative to root, and
+// returns an error if any of them leads outside of root. Components that
+// don't exist are resolved lexically.
+func resolveInRoot(root, name string) error {
+	remaining := strings.Split(name, "/")
+	var resolved []string
+	followed := 0
+
+	for len(remaining) > 0 {
+		part := remaining[0]
+		remaining = remaining[1:]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) == 0 {
+				return fmt.Errorf("'%s' leads above the repository root", name)
+			}
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+
+		current := filepath.Join(root, filepath.Join(append(resolved, part)...))
+		info, err := os.Lstat(current)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			resolved = append(resolved, part)
+			continue
+		}
+
+		followed++
+		if followed > maxSymlinkDepth {
+			return fmt.Errorf("too many levels of symlinks in '%s'", name)
+		}
+		link, err := os.Readlink(current)
+		if err != nil {
+			return err
+		}
+		if filepath.IsAbs(link) {
+			return fmt.Errorf("'%s' points to the absolute path '%s'", path.Join(append(resolved, part)...), link)
+		}
+
+		// The link replaces its own component
+		remaining = append(strings.Split(filepath.ToSlash(link), "/"), remaining...)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type tarEntry struct {
+	name     string
+	typeflag byte
+	body     string
+	linkname string
+}
+
+func makeTarGz(t *testing.T, entries []tarEntry) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typeflag, Linkname: e.linkname, Mode: 0o644}
+		switch e.typeflag {
+		case tar.TypeReg:
+			hdr.Size = int64(len(e.body))
+		case tar.TypeDir:
+			hdr.Mode = 0o755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if e.typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte(e.body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestExtractTarGz(t *testing.T) {
+	root := t.TempDir()
+	dst := filepath.Join(root, "dst")
+
+	archive := makeTarGz(t, []tarEntry{
+		{name: "repo-sha/", typeflag: tar.TypeDir},
+		{name: "repo-sha/phantom.yaml", typeflag: tar.TypeReg, body: "name: test"},
+		{name: "repo-sha/src/main.go", typeflag: tar.TypeReg, body: "package main"},
+		{name: "repo-sha/src/link.go", typeflag: tar.TypeSymlink, linkname: "main.go"},
+		{name: "repo-sha/config", typeflag: tar.TypeSymlink, linkname: "phantom.yaml"},
+		{name: "repo-sha/copy.yaml", typeflag: tar.TypeLink, linkname: "repo-sha/phantom.yaml"},
+	})
+	if err := ExtractTarGz(archive, dst, 1); err != nil {
+		t.Fatalf("ExtractTarGz() error = %v", err)
+	}
+
+	for name, want := range map[string]string{
+		"phantom.yaml": "name: test",
+		"src/main.go":  "package main",
+		"src/link.go":  "package main",
+		"config":       "name: test",
+		"copy.yaml":    "name: test",
+	} {
+		data, err := os.ReadFile(filepath.Join(dst, name))
+		if err != nil {
+			t.Errorf("reading %s: %v", name, err)
+		} else if string(data) != want {
+			t.Errorf("%s = %q, want %q", name, data, want)
+		}
+	}
+}
+
+func TestExtractTarGzRejectsEscapes(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []tarEntry
+	}{
+		{
+			name: "parent path",
+			entries: []tarEntry{
+				{name: "repo/../../escaped", typeflag: tar.TypeReg, body: "x"},
+			},
+		},
+		{
+			name: "absolute symlink",
+			entries: []tarEntry{
+				{name: "repo/link", typeflag: tar.TypeSymlink, linkname: "/etc"},
+			},
+		},
+		{
+			name: "symlink above root",
+			entries: []tarEntry{
+				{name: "repo/a", typeflag: tar.TypeSymlink, linkname: "../../.."},
+			},
+		},
+		{
+			name: "symlink created through symlink",
+			entries: []tarEntry{
+				{name: "repo/a", typeflag: tar.TypeSymlink, linkname: "../../.."},
+				{name: "repo/a/x", typeflag: tar.TypeSymlink, linkname: "."},
+			},
+		},
+		{
+			name: "symlink created through later symlink",
+			entries: []tarEntry{
+				{name: "repo/a/x", typeflag: tar.TypeSymlink, linkname: "."},
+				{name: "repo/a", typeflag: tar.TypeSymlink, linkname: "../../.."},
+			},
+		},
+		{
+			name: "parent of symlink target",
+			entries: []tarEntry{
+				{name: "repo/d/s", typeflag: tar.TypeSymlink, linkname: ".."},
+				{name: "repo/d/l", typeflag: tar.TypeSymlink, linkname: "s/../escaped"},
+			},
+		},
+		{
+			name: "symlink escaping through later symlink",
+			entries: []tarEntry{
+				{name: "repo/d/a", typeflag: tar.TypeSymlink, linkname: "b/../.."},
+				{name: "repo/d/b", typeflag: tar.TypeSymlink, linkname: "."},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			dst := filepath.Join(root, "a", "b", "dst")
+
+			err := ExtractTarGz(makeTarGz(t, test.entries), dst, 1)
+			if err == nil {
+				t.Fatal("ExtractTarGz() succeeded, want an error")
+			}
+
+			// Nothing is written next to the extraction directory
+			filepath.WalkDir(root, func(p string, d os.DirEntry, err error) error {
+				if err == nil && !strings.HasPrefix(p, dst) && p != root &&
+					p != filepath.Join(root, "a") && p != filepath.Join(root, "a", "b") {
+					t.Errorf("%s created outside of the extraction directory", p)
+				}
+				return nil
+			})
+		})
+	}
+}
+
+func TestExtractTarGzLimits(t *testing.T) {
+	entries := []tarEntry{{name: "repo/file", typeflag: tar.TypeReg, body: "x"}}
+	if err := ExtractTarGz(makeTarGz(t, entries), t.TempDir(), 1); err != nil {
+		t.Fatalf("ExtractTarGz() error = %v", err)
+	}
+
+	r := &maxSizeReader{r: strings.NewReader("0123456789"), remaining: 5}
+	buf := make([]byte, 16)
+	if _, err := r.Read(buf); err != ErrArchiveTooLarge {
+		t.Errorf("maxSizeReader.Read() error = %v, want ErrArchiveTooLarge", err)
+	}
+}
@@ -2,40 +2,41 @@ package utils
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path"
+	"time"
 
 	"github.com/google/go-github/v50/github"
 	"github.com/rs/zerolog/log"
 
-	"github.com/jahagaley/phantomcli/utils"
+	"github.com/jahagaley/phantom/utils/metrics"
 )
 
-var (
-	tempCompressedTarball = "temp.tar.gz"
+const (
+	// Longest time a repository archive takes to download and extract.
+	REPO_DOWNLOAD_TIMEOUT = 10 * time.Minute
 )
 
-func HandleGithubRepoDownload(client *github.Client, owner, repo, headSha string) (string, error) {
-
-	// creating a temp directory for repo
-	tempDir, err := os.MkdirTemp("", "")
-	if err != nil {
-		return "", err
-	}
-
-	// Download entire git repository using tar
-	err = DownloadAndExtractRepoTarFile(client, tempDir, owner, repo, headSha)
+// HandleGithubRepoDownload returns a read-only checkout of the commit, shared
+// with the other checks of the commit. The release function must be called
+// once the checkout is no longer used.
+func HandleGithubRepoDownload(client *github.Client, owner, repo, headSha string) (string, func(), error) {
+	cache, err := getRepoCache()
 	if err != nil {
-		log.Warn().Err(err).Send()
-		return "", err
+		return "", nil, err
 	}
 
-	return tempDir, nil
+	return cache.Checkout(client, owner, repo, headSha)
 }
 
-func DownloadAndExtractRepoTarFile(client *github.Client, tempDir, owner, repo, sha string) error {
+func DownloadAndExtractRepoTarFile(client *github.Client, tempDir, owner, repo, sha string) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), REPO_DOWNLOAD_TIMEOUT)
+	defer cancel()
+
 	getOptions := &github.RepositoryContentGetOptions{}
 	if len(sha) > 0 {
 		getOptions = &github.RepositoryContentGetOptions{
@@ -43,7 +44,7 @@ func DownloadAndExtractRepoTarFile(client *github.Client, tempDir, owner, repo,
 		}
 	}
 	url, _, err := client.Repositories.GetArchiveLink(
-		context.Background(),
+		ctx,
 		owner,
 		repo,
 		github.Tarball,
@@ -57,29 +58,61 @@ func DownloadAndExtractRepoTarFile(client *github.Client, tempDir, owner, repo,
 	}
 
 	log.Debug().Msg("Downloading Github repository tarball file.")
-	resp, err := http.Get(url.String())
+	start := time.Now()
+	body := &maxSizeReader{remaining: MAX_ARCHIVE_SIZE}
+	defer func() {
+		metrics.TarballDownloadBytes.Observe(float64(MAX_ARCHIVE_SIZE - body.remaining))
+		metrics.Since(metrics.TarballDownloadDuration.WithLabelValues(metrics.Result(err)), start)
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url.String(), nil)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-
-	tempTarFile := path.Join(tempDir, tempCompressedTarball)
-	file, err := os.Create(tempTarFile)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		os.Remove(tempTarFile)
-		return err
+		return fmt.Errorf("Unable to download the repository archive: %w", err)
 	}
-	defer os.Remove(tempTarFile)
+	defer resp.Body.Close()
 
-	// Write the body to file
-	_, err = io.Copy(file, resp.Body)
-	if err != nil {
-		return err
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected status downloading the repository archive: %s", resp.Status)
+	}
+	if resp.ContentLength > MAX_ARCHIVE_SIZE {
+		return ErrArchiveTooLarge
 	}
-	file.Close()
 
+	// The archive is extracted while it downloads
 	log.Debug().Msg("Decompressing Github tarball file.")
-	return utils.ExtractTarGz(tempTarFile, tempDir, 1)
+	body.r = resp.Body
+	err = ExtractTarGz(body, tempDir, 1)
+	if errors.Is(err, ErrArchiveTooLarge) {
+		return ErrArchiveTooLarge
+	} else if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("Downloading the repository archive took longer than %s.", REPO_DOWNLOAD_TIMEOUT)
+	}
+	return err
+}
+
+// maxSizeReader fails with ErrArchiveTooLarge once more than remaining bytes are read.
+type maxSizeReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (m *maxSizeReader) Read(p []byte) (int, error) {
+	if m.remaining < 0 {
+		return 0, ErrArchiveTooLarge
+	}
+	if int64(len(p)) > m.remaining+1 {
+		p = p[:m.remaining+1]
+	}
+	n, err := m.r.Read(p)
+	m.remaining -= int64(n)
+	if m.remaining < 0 {
+		return n, ErrArchiveTooLarge
+	}
+	return n, err
 }
 
 func GetInputFiles(dir string) ([]string, error) {
@@ -0,0 +1,201 @@
+// Package metrics holds the Prometheus metrics of the check pipeline, served
+// on /metrics of the internal metrics address.
+package metrics
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "phantom"
+
+var (
+	WebhooksReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "webhooks_received_total",
+		Help:      "Github webhook events received, by event type and response status.",
+	}, []string{"event_type", "status"})
+
+	PubSubPushes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pubsub_pushes_total",
+		Help:      "Pub/Sub pushes received, by response status.",
+	}, []string{"status"})
+
+	ChecksStarted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "checks_started_total",
+		Help:      "Checks started, by type.",
+	}, []string{"type"})
+
+	ChecksCompleted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "checks_completed_total",
+		Help:      "Check runs concluded, by type and conclusion.",
+	}, []string{"type", "conclusion"})
+
+	CheckDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "check_duration_seconds",
+		Help:      "Time spent running checks, by type and result: ok, error or interrupted.",
+		Buckets:   []float64{1, 5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600, 7200},
+	}, []string{"type", "result"})
+
+	QueuePublishDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "queue_publish_duration_seconds",
+		Help:      "Latency of publishing checks to the queue, by result.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"result"})
+
+	ExecutionWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "execution_wait_seconds",
+		Help:      "Time checks waited on their Phantom execution, by check type and conclusion.",
+		Buckets:   []float64{10, 30, 60, 120, 300, 600, 1200, 1800, 3600, 7200, 14400},
+	}, []string{"type", "conclusion"})
+
+	GithubRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "github_requests_total",
+		Help:      "Requests sent to the Github API, by method, endpoint and response status.",
+	}, []string{"method", "endpoint", "status"})
+
+	GithubRequestErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "github_request_errors_total",
+		Help:      "Requests to the Github API failing to get a response or getting an error status, by method and endpoint.",
+	}, []string{"method", "endpoint"})
+
+	GithubRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "github_request_duration_seconds",
+		Help:      "Latency of requests to the Github API, by method and endpoint.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "endpoint"})
+
+	TarballDownloadBytes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "tarball_download_bytes",
+		Help:      "Size of the repository archives downloaded.",
+		Buckets:   prometheus.ExponentialBuckets(64*1024, 4, 10),
+	})
+
+	TarballDownloadDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "tarball_download_duration_seconds",
+		Help:      "Time spent downloading and extracting repository archives, by result.",
+		Buckets:   []float64{0.5, 1, 2, 5, 10, 30, 60, 120, 300, 600},
+	}, []string{"result"})
+)
+
+// Handler serves the metrics in the Prometheus format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Result is the label of an operation ending with the error.
+func Result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+// Since observes the seconds elapsed since start.
+func Since(observer prometheus.Observer, start time.Time) {
+	observer.Observe(time.Since(start).Seconds())
+}
+
+// StatusRecorder is a response writer remembering the status of the response.
+type StatusRecorder struct {
+	http.ResponseWriter
+	Status int
+}
+
+func NewStatusRecorder(w http.ResponseWriter) *StatusRecorder {
+	return &StatusRecorder{ResponseWriter: w, Status: http.StatusOK}
+}
+
+func (r *StatusRecorder) WriteHeader(status int) {
+	r.Status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Transport counts the requests sent to the Github API and their errors.
+type Transport struct {
+	Base http.RoundTripper
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := GithubEndpoint(req.URL.Path)
+	start := time.Now()
+	resp, err := t.Base.RoundTrip(req)
+	GithubRequestDuration.WithLabelValues(req.Method, endpoint).Observe(time.Since(start).Seconds())
+
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	GithubRequests.WithLabelValues(req.Method, endpoint, status).Inc()
+	if err != nil || resp.StatusCode >= http.StatusBadRequest {
+		GithubRequestErrors.WithLabelValues(req.Method, endpoint).Inc()
+	}
+	return resp, err
+}
+
+var (
+	idSegment  = regexp.MustCompile(`^[0-9]+$`)
+	shaSegment = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+	// Segments followed by a ref, a branch or a range of commits.
+	refSegments = map[string]bool{"commits": true, "tarball": true, "branches": true, "compare": true, "refs": true, "ref": true}
+
+	// Segments of the Git database followed by the SHA of an object.
+	objectSegments = map[string]bool{"trees": true, "blobs": true, "tags": true}
+)
+
+// GithubEndpoint returns the path of a Github API request with its owners,
+// repositories, IDs and commits replaced by placeholders, ex:
+// /repos/:owner/:repo/check-runs/:id.
+func GithubEndpoint(urlPath string) string {
+	// Github Enterprise Server serves the API under /api/v3
+	urlPath = strings.TrimPrefix(urlPath, "/api/v3")
+
+	segments := strings.Split(strings.Trim(urlPath, "/"), "/")
+	for i := 0; i < len(segments); i++ {
+		switch {
+		case segments[i] == "repos" && i+2 < len(segments):
+			segments[i+1], segments[i+2] = ":owner", ":repo"
+			i += 2
+		case (segments[i] == "users" || segments[i] == "orgs") && i+1 < len(segments):
+			segments[i+1] = ":owner"
+			i++
+		case refSegments[segments[i]] && i+1 < len(segments):
+			// Refs may hold slashes, the rest of the path is kept when it
+			// is a known endpoint of the ref.
+			rest := segments[len(segments)-1]
+			if rest == "check-runs" || rest == "check-suites" || rest == "status" || rest == "statuses" {
+				segments = append(segments[:i+1], ":ref", rest)
+			} else {
+				segments = append(segments[:i+1], ":ref")
+			}
+			i = len(segments)
+		case i > 0 && segments[i-1] == "git" && objectSegments[segments[i]] && i+1 < len(segments):
+			segments[i+1] = ":sha"
+			i++
+		case idSegment.MatchString(segments[i]):
+			segments[i] = ":id"
+		case shaSegment.MatchString(segments[i]):
+			segments[i] = ":sha"
+		}
+	}
+	return "/" + strings.Join(segments, "/")
+}
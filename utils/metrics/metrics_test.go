@@ -0,0 +1,36 @@
+package metrics
+
+import (
+	"testing"
+)
+
+func TestGithubEndpoint(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/repos/octo/hello/check-runs/123", "/repos/:owner/:repo/check-runs/:id"},
+		{"/repos/octo/hello/pulls/7", "/repos/:owner/:repo/pulls/:id"},
+		{"/repos/octo/hello/commits/feature/login/check-runs", "/repos/:owner/:repo/commits/:ref/check-runs"},
+		{"/repos/octo/hello/commits/0123456789abcdef0123456789abcdef01234567", "/repos/:owner/:repo/commits/:ref"},
+		{"/repos/octo/hello/tarball/main", "/repos/:owner/:repo/tarball/:ref"},
+		{"/repos/octo/hello/git/trees/0123456789abcdef0123456789abcdef01234567", "/repos/:owner/:repo/git/trees/:sha"},
+		{"/repos/octo/hello/git/trees/main", "/repos/:owner/:repo/git/trees/:sha"},
+		{"/repos/octo/hello/git/blobs/0123456789abcdef0123456789abcdef01234567", "/repos/:owner/:repo/git/blobs/:sha"},
+		{"/repos/octo/hello/git/commits/0123456789abcdef0123456789abcdef01234567", "/repos/:owner/:repo/git/commits/:ref"},
+		{"/repos/octo/hello/git/refs/heads/feature/login", "/repos/:owner/:repo/git/refs/:ref"},
+		{"/repos/octo/hello/git/ref/heads/main", "/repos/:owner/:repo/git/ref/:ref"},
+		{"/api/v3/repos/octo/hello/branches/feature/login", "/repos/:owner/:repo/branches/:ref"},
+		{"/app/installations/42/access_tokens", "/app/installations/:id/access_tokens"},
+		{"/orgs/acme/installation", "/orgs/:owner/installation"},
+		{"/users/octo/installation", "/users/:owner/installation"},
+		{"/repos/octo/hello/compare/0123456789abcdef0123456789abcdef01234567...main", "/repos/:owner/:repo/compare/:ref"},
+		{"/repos/octo/hello/branches", "/repos/:owner/:repo/branches"},
+	}
+
+	for _, test := range tests {
+		if got := GithubEndpoint(test.path); got != test.want {
+			t.Errorf("GithubEndpoint(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+}
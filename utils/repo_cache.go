@@ -0,0 +1,256 @@
+package utils
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/google/go-github/v50/github"
+	"github.com/rs/zerolog/log"
+
+	"github.com/jahagaley/phantom/utils/settings"
+)
+
+const (
+	// Prefix of the directories checkouts are extracted to before being
+	// added to the cache.
+	repoCacheStagingPrefix = ".staging-"
+)
+
+// RepoCache keeps the checkouts of repository commits on disk, so the checks
+// of a commit share a single download. Checkouts are read-only and are
+// evicted, least recently used first, once the cache grows past its size.
+type RepoCache struct {
+	dir     string
+	maxSize int64
+
+	mu      sync.Mutex
+	size    int64
+	entries map[string]*repoCacheEntry
+	// Released entries, the least recently used at the front.
+	unused *list.List
+}
+
+type repoCacheEntry struct {
+	key  string
+	dir  string
+	size int64
+	refs int
+	elem *list.Element
+
+	// Closed once the download finished, err is set if it failed.
+	ready chan struct{}
+	err   error
+}
+
+var (
+	repoCacheOnce sync.Once
+	repoCache     *RepoCache
+	repoCacheErr  error
+)
+
+// getRepoCache returns the cache configured by the settings.
+func getRepoCache() (*RepoCache, error) {
+	repoCacheOnce.Do(func() {
+		s := settings.Get().RepoCache
+		repoCache, repoCacheErr = NewRepoCache(s.Dir, s.SizeMB*1024*1024)
+	})
+	return repoCache, repoCacheErr
+}
+
+// NewRepoCache creates a cache in dir, keeping the checkouts already there.
+func NewRepoCache(dir string, maxSize int64) (*RepoCache, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	c := &RepoCache{
+		dir:     dir,
+		maxSize: maxSize,
+		entries: make(map[string]*repoCacheEntry),
+		unused:  list.New(),
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		entryDir := path.Join(dir, file.Name())
+
+		// Checkouts interrupted by a restart are incomplete
+		if strings.HasPrefix(file.Name(), repoCacheStagingPrefix) || !file.IsDir() {
+			removeCheckout(entryDir)
+			continue
+		}
+
+		size, err := dirSize(entryDir)
+		if err != nil {
+			removeCheckout(entryDir)
+			continue
+		}
+		entry := &repoCacheEntry{key: file.Name(), dir: entryDir, size: size, ready: make(chan struct{})}
+		close(entry.ready)
+		entry.elem = c.unused.PushBack(entry)
+		c.entries[entry.key] = entry
+		c.size += size
+	}
+
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	return c, nil
+}
+
+// Checkout returns a read-only checkout of the commit, downloading it unless
+// it is cached or already being downloaded. The release function must be
+// called once the checkout is no longer used.
+func (c *RepoCache) Checkout(client *github.Client, owner, repo, sha string) (string, func(), error) {
+	hash := sha256.Sum256([]byte(strings.Join([]string{client.BaseURL.String(), owner, repo, sha}, "/")))
+	key := hex.EncodeToString(hash[:])
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if !ok {
+		entry = &repoCacheEntry{key: key, dir: path.Join(c.dir, key), ready: make(chan struct{})}
+		c.entries[key] = entry
+		go c.download(entry, client, owner, repo, sha)
+	}
+	c.acquire(entry)
+	c.mu.Unlock()
+
+	<-entry.ready
+	if entry.err != nil {
+		c.release(entry)
+		return "", nil, entry.err
+	}
+
+	var once sync.Once
+	return entry.dir, func() { once.Do(func() { c.release(entry) }) }, nil
+}
+
+func (c *RepoCache) download(entry *repoCacheEntry, client *github.Client, owner, repo, sha string) {
+	defer close(entry.ready)
+
+	// Extract next to the cache so the checkout only appears once complete
+	stagingDir, err := os.MkdirTemp(c.dir, repoCacheStagingPrefix)
+	if err == nil {
+		err = DownloadAndExtractRepoTarFile(client, stagingDir, owner, repo, sha)
+	}
+	if err == nil {
+		err = makeReadOnly(stagingDir)
+	}
+	if err == nil {
+		err = os.Rename(stagingDir, entry.dir)
+	}
+	var size int64
+	if err == nil {
+		size, err = dirSize(entry.dir)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		log.Warn().Err(err).Msg(fmt.Sprintf("Unable to download %s/%s@%s", owner, repo, sha))
+		removeCheckout(stagingDir)
+		entry.err = err
+		delete(c.entries, entry.key)
+		return
+	}
+	entry.size = size
+	c.size += size
+	c.evict()
+}
+
+func (c *RepoCache) acquire(entry *repoCacheEntry) {
+	if entry.elem != nil {
+		c.unused.Remove(entry.elem)
+		entry.elem = nil
+	}
+	entry.refs++
+}
+
+func (c *RepoCache) release(entry *repoCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry.refs--
+	if entry.refs == 0 && entry.err == nil {
+		entry.elem = c.unused.PushBack(entry)
+		c.evict()
+	}
+}
+
+// evict removes the least recently used checkouts nobody is using until the
+// cache fits in its size. It must be called with the lock held.
+func (c *RepoCache) evict() {
+	for c.size > c.maxSize && c.unused.Len() > 0 {
+		entry := c.unused.Remove(c.unused.Front()).(*repoCacheEntry)
+		delete(c.entries, entry.key)
+		c.size -= entry.size
+
+		// Move the checkout out of the way so the commit can be downloaded
+		// again while it is being deleted.
+		trashDir := path.Join(c.dir, repoCacheStagingPrefix+"evicted-"+entry.key)
+		if err := os.Rename(entry.dir, trashDir); err != nil {
+			removeCheckout(entry.dir)
+			continue
+		}
+		go removeCheckout(trashDir)
+	}
+}
+
+// makeReadOnly removes the write permissions of every regular file in dir.
+// Directories stay writable so the checkout can be deleted.
+func makeReadOnly(dir string) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return os.Chmod(p, info.Mode().Perm()&^0o222)
+	})
+}
+
+// removeCheckout deletes a checkout, making its directories writable first
+// in case they were made read-only by an earlier version.
+func removeCheckout(dir string) {
+	filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			os.Chmod(p, 0o700)
+		}
+		return nil
+	})
+	os.RemoveAll(dir)
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,162 @@
+package utils
+
+import (
+	"archive/tar"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-github/v50/github"
+)
+
+// newArchiveServer serves the tarball of every commit of owner/repo, and
+// counts the archives downloaded.
+func newArchiveServer(t *testing.T, downloads *int32) *github.Client {
+	t.Helper()
+
+	var srv *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/owner/repo/tarball/", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, srv.URL+"/archive/"+filepath.Base(r.URL.Path), http.StatusFound)
+	})
+	mux.HandleFunc("/archive/", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(downloads, 1)
+		sha := filepath.Base(r.URL.Path)
+		archive := makeTarGz(t, []tarEntry{
+			{name: "repo-" + sha + "/", typeflag: tar.TypeDir},
+			{name: "repo-" + sha + "/src/", typeflag: tar.TypeDir},
+			{name: "repo-" + sha + "/src/main.go", typeflag: tar.TypeReg, body: sha},
+		})
+		w.Write(archive.Bytes())
+	})
+	srv = httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	client := github.NewClient(srv.Client())
+	client.BaseURL, _ = url.Parse(srv.URL + "/")
+	return client
+}
+
+func TestRepoCacheCheckout(t *testing.T) {
+	var downloads int32
+	client := newArchiveServer(t, &downloads)
+
+	cache, err := NewRepoCache(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, release, err := cache.Checkout(client, "owner", "repo", "sha1")
+	if err != nil {
+		t.Fatalf("Checkout() error = %v", err)
+	}
+	sharedDir, releaseShared, err := cache.Checkout(client, "owner", "repo", "sha1")
+	if err != nil {
+		t.Fatalf("Checkout() error = %v", err)
+	}
+	if dir != sharedDir || downloads != 1 {
+		t.Errorf("checkouts of the same commit aren't shared: %s, %s, %d downloads", dir, sharedDir, downloads)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "src", "main.go"))
+	if err != nil || string(data) != "sha1" {
+		t.Errorf("main.go = %q, %v, want %q", data, err, "sha1")
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "src", "main.go"))
+	if err != nil || info.Mode().Perm()&0o222 != 0 {
+		t.Errorf("main.go is writable: %v, %v", info.Mode(), err)
+	}
+	info, err = os.Stat(filepath.Join(dir, "src"))
+	if err != nil || info.Mode().Perm()&0o200 == 0 {
+		t.Errorf("src isn't writable: %v, %v", info.Mode(), err)
+	}
+
+	release()
+	releaseShared()
+}
+
+func TestRepoCacheEvicts(t *testing.T) {
+	var downloads int32
+	client := newArchiveServer(t, &downloads)
+
+	// Fits a single checkout
+	cache, err := NewRepoCache(t.TempDir(), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, release, err := cache.Checkout(client, "owner", "repo", "sha1")
+	if err != nil {
+		t.Fatalf("Checkout() error = %v", err)
+	}
+	second, releaseSecond, err := cache.Checkout(client, "owner", "repo", "sha2")
+	if err != nil {
+		t.Fatalf("Checkout() error = %v", err)
+	}
+
+	// Checkouts in use are never evicted
+	for _, dir := range []string{first, second} {
+		if _, err := os.Stat(dir); err != nil {
+			t.Errorf("checkout in use evicted: %v", err)
+		}
+	}
+
+	release()
+	if _, err := os.Stat(first); !os.IsNotExist(err) {
+		t.Errorf("released checkout not evicted: %v", err)
+	}
+
+	// An evicted commit is downloaded again
+	again, releaseAgain, err := cache.Checkout(client, "owner", "repo", "sha1")
+	if err != nil {
+		t.Fatalf("Checkout() error = %v", err)
+	}
+	if again != first || downloads != 3 {
+		t.Errorf("evicted checkout = %s, %d downloads, want %s, 3 downloads", again, downloads, first)
+	}
+	releaseAgain()
+	releaseSecond()
+}
+
+func TestNewRepoCacheKeepsCheckouts(t *testing.T) {
+	var downloads int32
+	client := newArchiveServer(t, &downloads)
+	cacheDir := t.TempDir()
+
+	cache, err := NewRepoCache(cacheDir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, release, err := cache.Checkout(client, "owner", "repo", "sha1")
+	if err != nil {
+		t.Fatalf("Checkout() error = %v", err)
+	}
+	release()
+
+	staging := filepath.Join(cacheDir, repoCacheStagingPrefix+"interrupted")
+	if err := os.MkdirAll(filepath.Join(staging, "src"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err = NewRepoCache(cacheDir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(staging); !os.IsNotExist(err) {
+		t.Errorf("interrupted checkout kept: %v", err)
+	}
+
+	again, release, err := cache.Checkout(client, "owner", "repo", "sha1")
+	if err != nil {
+		t.Fatalf("Checkout() error = %v", err)
+	}
+	if again != dir || downloads != 1 {
+		t.Errorf("checkout = %s, %d downloads, want %s, 1 download", again, downloads, dir)
+	}
+	release()
+}
@@ -0,0 +1,109 @@
+package settings
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// envVar binds an environment variable to a setting.
+type envVar struct {
+	name string
+	set  func(value string) error
+}
+
+func (s *Settings) envVars() []envVar {
+	return []envVar{
+		stringEnv("PHANTOM_ADDR", &s.Addr),
+		stringEnv("PHANTOM_LOG_LEVEL", &s.LogLevel),
+		stringEnv("PHANTOM_METRICS_ADDR", &s.MetricsAddr),
+		durationEnv("PHANTOM_SHUTDOWN_TIMEOUT", &s.ShutdownTimeout),
+		durationEnv("PHANTOM_DRAIN_DELAY", &s.DrainDelay),
+		stringEnv("PHANTOM_API_URL", &s.APIURL),
+		stringEnv("PHANTOM_API_HEALTH_URL", &s.APIHealthURL),
+		stringEnv("PHANTOM_SITE_URL", &s.SiteURL),
+		stringEnv("PHANTOM_PROJECT", &s.Project),
+		stringEnv("PHANTOM_ARTIFACT_REGISTRY", &s.ArtifactRegistry),
+		stringEnv("PHANTOM_STATE_DIR", &s.StateDir),
+
+		stringEnv("PHANTOM_QUEUE_BACKEND", &s.Queue.Backend),
+		stringEnv("PHANTOM_QUEUE_DIR", &s.Queue.Dir),
+		stringEnv("PHANTOM_QUEUE_ENCODING", &s.Queue.Encoding),
+		stringEnv("PHANTOM_PUBSUB_PROJECT_ID", &s.Queue.PubSubProject),
+		stringEnv("PHANTOM_PUBSUB_TOPIC_ID", &s.Queue.Topic),
+		stringEnv("PHANTOM_PUBSUB_DEAD_LETTER_TOPIC_ID", &s.Queue.DeadLetterTopic),
+
+		int64Env("PHANTOM_APP_ID", &s.Github.AppID),
+		stringEnv("PHANTOM_GITHUB_PRIVATE_KEY", &s.Github.PrivateKey),
+		stringEnv("GITHUB_WEBHOOK_SECRET_NAME", &s.Github.WebhookSecret),
+		stringEnv("GITHUB_WEBHOOK_PREVIOUS_SECRET_NAME", &s.Github.PreviousWebhookSecret),
+		timeEnv("GITHUB_WEBHOOK_SECRET_GRACE_UNTIL", &s.Github.WebhookSecretGraceUntil),
+		stringEnv("PHANTOM_GITHUB_HOSTS_FILE", &s.Github.HostsFile),
+		boolEnv("PHANTOM_CANCEL_DEFAULT_BRANCH", &s.Github.CancelDefaultBranch),
+
+		stringEnv("PHANTOM_REPO_CACHE_DIR", &s.RepoCache.Dir),
+		int64Env("PHANTOM_REPO_CACHE_SIZE_MB", &s.RepoCache.SizeMB),
+
+		stringEnv("PHANTOM_TRACING_ENDPOINT", &s.Tracing.Endpoint),
+		boolEnv("PHANTOM_TRACING_INSECURE", &s.Tracing.Insecure),
+		float64Env("PHANTOM_TRACING_SAMPLE_RATIO", &s.Tracing.SampleRatio),
+	}
+}
+
+// readEnv overrides the settings set in the environment.
+func (s *Settings) readEnv() error {
+	for _, v := range s.envVars() {
+		value, ok := os.LookupEnv(v.name)
+		if !ok || len(value) == 0 {
+			continue
+		}
+		if err := v.set(value); err != nil {
+			return fmt.Errorf("Invalid %s '%s': %w", v.name, value, err)
+		}
+	}
+	return nil
+}
+
+func stringEnv(name string, field *string) envVar {
+	return envVar{name, func(value string) error {
+		*field = value
+		return nil
+	}}
+}
+
+func int64Env(name string, field *int64) envVar {
+	return envVar{name, func(value string) (err error) {
+		*field, err = strconv.ParseInt(value, 10, 64)
+		return err
+	}}
+}
+
+func float64Env(name string, field *float64) envVar {
+	return envVar{name, func(value string) (err error) {
+		*field, err = strconv.ParseFloat(value, 64)
+		return err
+	}}
+}
+
+func boolEnv(name string, field *bool) envVar {
+	return envVar{name, func(value string) (err error) {
+		*field, err = strconv.ParseBool(value)
+		return err
+	}}
+}
+
+func durationEnv(name string, field *time.Duration) envVar {
+	return envVar{name, func(value string) (err error) {
+		*field, err = time.ParseDuration(value)
+		return err
+	}}
+}
+
+// timeEnv parses RFC 3339 times.
+func timeEnv(name string, field *time.Time) envVar {
+	return envVar{name, func(value string) (err error) {
+		*field, err = time.Parse(time.RFC3339, value)
+		return err
+	}}
+}
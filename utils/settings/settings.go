@@ -0,0 +1,307 @@
+// Package settings holds the configuration of the server, loaded from a YAML
+// file, the environment and the command line, in that order of precedence.
+package settings
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// Environment variable pointing to the configuration file, also set with
+	// the -config flag.
+	CONFIG_FILE_ENV = "PHANTOM_CONFIG_FILE"
+
+	// Supported queue backends and encodings.
+	QUEUE_BACKEND_PUBSUB = "pubsub"
+	QUEUE_BACKEND_MEMORY = "memory"
+	QUEUE_BACKEND_FILE   = "file"
+	QUEUE_ENCODING_JSON  = "json"
+	QUEUE_ENCODING_GOB   = "gob"
+)
+
+// Settings is the configuration of the server.
+type Settings struct {
+	// Address the HTTP server listens on.
+	Addr     string `yaml:"addr"`
+	LogLevel string `yaml:"log_level"`
+
+	// Internal address serving the Prometheus metrics, kept off the address
+	// exposed through the load balancer.
+	MetricsAddr string `yaml:"metrics_addr"`
+
+	// How long running checks are given to finish on shutdown before being
+	// re-queued. The server keeps answering requests for the first
+	// DrainDelay of it, until the load balancer sees it isn't ready.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	DrainDelay      time.Duration `yaml:"drain_delay"`
+
+	// URLs of the Phantom API and of the site linked from check runs.
+	APIURL  string `yaml:"api_url"`
+	SiteURL string `yaml:"site_url"`
+	// URL of the Phantom API checked by the readiness probe, which must not
+	// go through the load balancer of this server. Defaults to APIURL.
+	APIHealthURL string `yaml:"api_health_url"`
+
+	// Google Cloud project hosting Phantom, the default project of the
+	// queues, secrets and cloud resources.
+	Project          string `yaml:"project"`
+	ArtifactRegistry string `yaml:"artifact_registry"`
+
+	// Directory where outstanding executions are saved.
+	StateDir string `yaml:"state_dir"`
+
+	Queue     Queue     `yaml:"queue"`
+	Github    Github    `yaml:"github"`
+	RepoCache RepoCache `yaml:"repo_cache"`
+	Tracing   Tracing   `yaml:"tracing"`
+}
+
+// Queue configures the queue carrying checks to the workers.
+type Queue struct {
+	Backend string `yaml:"backend"`
+	// Directory of the file backend.
+	Dir string `yaml:"dir"`
+	// Encoding of published checks, "gob" while older workers still run.
+	Encoding string `yaml:"encoding"`
+
+	PubSubProject   string `yaml:"pubsub_project"`
+	Topic           string `yaml:"topic"`
+	DeadLetterTopic string `yaml:"dead_letter_topic"`
+}
+
+// Github configures the Github app on github.com, apps on Github Enterprise
+// Server are listed in HostsFile.
+type Github struct {
+	AppID int64 `yaml:"app_id"`
+
+	// Secret Manager versions of the private key of the app and of the
+	// webhook secret. During a rotation, the previous webhook secret is
+	// accepted until WebhookSecretGraceUntil.
+	PrivateKey              string    `yaml:"private_key"`
+	WebhookSecret           string    `yaml:"webhook_secret"`
+	PreviousWebhookSecret   string    `yaml:"previous_webhook_secret"`
+	WebhookSecretGraceUntil time.Time `yaml:"webhook_secret_grace_until"`
+
+	HostsFile string `yaml:"hosts_file"`
+
+	// Whether pushes to the default branch cancel the checks of the commit
+	// they replace.
+	CancelDefaultBranch bool `yaml:"cancel_default_branch"`
+}
+
+// RepoCache configures the cache of repository checkouts.
+type RepoCache struct {
+	Dir    string `yaml:"dir"`
+	SizeMB int64  `yaml:"size_mb"`
+}
+
+// Tracing configures the export of traces to an OpenTelemetry collector.
+type Tracing struct {
+	// OTLP/HTTP endpoint of the collector, ex: localhost:4318. Traces are
+	// not exported when it is empty.
+	Endpoint string `yaml:"endpoint"`
+	Insecure bool   `yaml:"insecure"`
+
+	// Fraction of the traces started by Github events that are exported.
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+// Default returns the settings of production.
+func Default() *Settings {
+	return &Settings{
+		Addr:            ":8080",
+		LogLevel:        zerolog.LevelInfoValue,
+		MetricsAddr:     ":9090",
+		ShutdownTimeout: 25 * time.Second,
+		DrainDelay:      10 * time.Second,
+		APIURL:          "https://phantom.hagaley.com",
+		SiteURL:         "https://hagaley.com",
+		Project:         "jahagaley",
+		Queue: Queue{
+			Backend:         QUEUE_BACKEND_PUBSUB,
+			Encoding:        QUEUE_ENCODING_JSON,
+			Topic:           "github-checks-production",
+			DeadLetterTopic: "github-checks-dead-letter-production",
+		},
+		RepoCache: RepoCache{
+			SizeMB: 2048,
+		},
+		Tracing: Tracing{
+			SampleRatio: 1,
+		},
+	}
+}
+
+var current atomic.Pointer[Settings]
+
+// Get returns the settings of the server, or the default settings until they
+// are loaded.
+func Get() *Settings {
+	if s := current.Load(); s != nil {
+		return s
+	}
+	s := Default()
+	s.fillDefaults()
+	current.CompareAndSwap(nil, s)
+	return current.Load()
+}
+
+// Set replaces the settings of the server.
+func Set(s *Settings) {
+	current.Store(s)
+}
+
+// Load reads the settings from the configuration file, the environment and
+// the command line arguments, and validates them.
+func Load(args []string) (*Settings, error) {
+	s := Default()
+
+	flags := flag.NewFlagSet("phantom", flag.ContinueOnError)
+	configFile := flags.String("config", os.Getenv(CONFIG_FILE_ENV), "YAML configuration file")
+	overrides := map[string]*string{
+		"addr":          flags.String("addr", "", "address the server listens on"),
+		"metrics-addr":  flags.String("metrics-addr", "", "internal address serving the metrics"),
+		"log-level":     flags.String("log-level", "", "log level"),
+		"api-url":       flags.String("api-url", "", "URL of the Phantom API"),
+		"site-url":      flags.String("site-url", "", "URL of the Phantom site"),
+		"project":       flags.String("project", "", "Google Cloud project hosting Phantom"),
+		"queue-backend": flags.String("queue-backend", "", "queue backend: pubsub, memory or file"),
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if len(*configFile) > 0 {
+		if err := s.readFile(*configFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.readEnv(); err != nil {
+		return nil, err
+	}
+
+	// Flags given on the command line override everything else
+	fields := map[string]*string{
+		"addr":          &s.Addr,
+		"metrics-addr":  &s.MetricsAddr,
+		"log-level":     &s.LogLevel,
+		"api-url":       &s.APIURL,
+		"site-url":      &s.SiteURL,
+		"project":       &s.Project,
+		"queue-backend": &s.Queue.Backend,
+	}
+	flags.Visit(func(f *flag.Flag) {
+		if value, ok := overrides[f.Name]; ok {
+			*fields[f.Name] = *value
+		}
+	})
+
+	s.fillDefaults()
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Settings) readFile(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("Unable to read configuration: %w", err)
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(s); err != nil {
+		return fmt.Errorf("Unable to parse configuration '%s': %w", file, err)
+	}
+	return nil
+}
+
+// fillDefaults sets the settings derived from other settings.
+func (s *Settings) fillDefaults() {
+	if len(s.APIHealthURL) == 0 {
+		s.APIHealthURL = s.APIURL
+	}
+	if len(s.ArtifactRegistry) == 0 {
+		s.ArtifactRegistry = fmt.Sprintf("us-docker.pkg.dev/%s/phantom", s.Project)
+	}
+	if len(s.StateDir) == 0 {
+		s.StateDir = path.Join(os.TempDir(), "phantom")
+	}
+	if len(s.Queue.PubSubProject) == 0 {
+		s.Queue.PubSubProject = s.Project
+	}
+	if len(s.Github.PrivateKey) == 0 {
+		s.Github.PrivateKey = fmt.Sprintf("projects/%s/secrets/github_pem/versions/latest", s.Project)
+	}
+	if len(s.Github.WebhookSecret) == 0 {
+		s.Github.WebhookSecret = fmt.Sprintf("projects/%s/secrets/github_webhook_secret/versions/latest", s.Project)
+	}
+	if len(s.RepoCache.Dir) == 0 {
+		s.RepoCache.Dir = path.Join(os.TempDir(), "phantom", "repos")
+	}
+}
+
+// Validate returns every problem found in the settings.
+func (s *Settings) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(len(s.Addr) > 0, "addr is empty")
+	check(len(s.MetricsAddr) > 0, "metrics_addr is empty")
+	check(s.MetricsAddr != s.Addr, "metrics_addr must differ from addr")
+	_, err := zerolog.ParseLevel(s.LogLevel)
+	check(err == nil, "invalid log_level '%s'", s.LogLevel)
+	check(s.ShutdownTimeout > 0, "shutdown_timeout must be positive")
+	check(s.DrainDelay >= 0 && s.DrainDelay < s.ShutdownTimeout, "drain_delay must be positive and shorter than shutdown_timeout")
+	check(isHTTPURL(s.APIURL), "invalid api_url '%s'", s.APIURL)
+	check(isHTTPURL(s.SiteURL), "invalid site_url '%s'", s.SiteURL)
+	check(isHTTPURL(s.APIHealthURL), "invalid api_health_url '%s'", s.APIHealthURL)
+	check(len(s.Project) > 0, "project is empty")
+
+	switch s.Queue.Backend {
+	case QUEUE_BACKEND_PUBSUB:
+		check(len(s.Queue.PubSubProject) > 0, "queue.pubsub_project is empty")
+		check(len(s.Queue.Topic) > 0, "queue.topic is empty")
+		check(len(s.Queue.DeadLetterTopic) > 0, "queue.dead_letter_topic is empty")
+	case QUEUE_BACKEND_FILE:
+		check(len(s.Queue.Dir) > 0, "queue.dir must be set for the '%s' queue backend", QUEUE_BACKEND_FILE)
+	case QUEUE_BACKEND_MEMORY:
+	default:
+		check(false, "unknown queue.backend '%s'", s.Queue.Backend)
+	}
+	check(s.Queue.Encoding == QUEUE_ENCODING_JSON || s.Queue.Encoding == QUEUE_ENCODING_GOB,
+		"unknown queue.encoding '%s'", s.Queue.Encoding)
+
+	check(s.Github.AppID > 0, "github.app_id must be set")
+	check(len(s.Github.PreviousWebhookSecret) == 0 || !s.Github.WebhookSecretGraceUntil.IsZero(),
+		"github.webhook_secret_grace_until must be set with github.previous_webhook_secret")
+	check(s.RepoCache.SizeMB > 0, "repo_cache.size_mb must be positive")
+	check(s.Tracing.SampleRatio >= 0 && s.Tracing.SampleRatio <= 1, "tracing.sample_ratio must be between 0 and 1")
+
+	if len(errs) > 0 {
+		return fmt.Errorf("Invalid configuration: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+func isHTTPURL(value string) bool {
+	u, err := url.Parse(value)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && len(u.Host) > 0
+}
@@ -0,0 +1,145 @@
+package settings
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testConfig = `
+addr: ":8000"
+log_level: debug
+api_url: https://file.example.com
+site_url: https://site.example.com
+project: file-project
+shutdown_timeout: 40s
+queue:
+  backend: memory
+github:
+  app_id: 12
+`
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	file := path.Join(t.TempDir(), "phantom.yaml")
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// clearEnv unsets the settings environment variables for the test.
+func clearEnv(t *testing.T) {
+	t.Helper()
+
+	t.Setenv(CONFIG_FILE_ENV, "")
+	for _, v := range Default().envVars() {
+		t.Setenv(v.name, "")
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         map[string]string
+		args        []string
+		wantAddr    string
+		wantProject string
+		wantAPIURL  string
+	}{
+		{
+			name:        "file",
+			wantAddr:    ":8000",
+			wantProject: "file-project",
+			wantAPIURL:  "https://file.example.com",
+		},
+		{
+			name:        "environment overrides file",
+			env:         map[string]string{"PHANTOM_ADDR": ":8100", "PHANTOM_PROJECT": "env-project"},
+			wantAddr:    ":8100",
+			wantProject: "env-project",
+			wantAPIURL:  "https://file.example.com",
+		},
+		{
+			name:        "flags override environment",
+			env:         map[string]string{"PHANTOM_ADDR": ":8100", "PHANTOM_PROJECT": "env-project"},
+			args:        []string{"-addr", ":8200", "-api-url", "https://flag.example.com"},
+			wantAddr:    ":8200",
+			wantProject: "env-project",
+			wantAPIURL:  "https://flag.example.com",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clearEnv(t)
+			t.Setenv(CONFIG_FILE_ENV, writeConfig(t, testConfig))
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+
+			s, err := Load(test.args)
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			if s.Addr != test.wantAddr || s.Project != test.wantProject || s.APIURL != test.wantAPIURL {
+				t.Errorf("Load() = addr %s, project %s, api_url %s, want %s, %s, %s",
+					s.Addr, s.Project, s.APIURL, test.wantAddr, test.wantProject, test.wantAPIURL)
+			}
+
+			// Settings missing from every source keep their defaults or are
+			// derived from the others
+			if s.ShutdownTimeout != 40*time.Second || s.MetricsAddr != Default().MetricsAddr {
+				t.Errorf("Load() = shutdown_timeout %s, metrics_addr %s", s.ShutdownTimeout, s.MetricsAddr)
+			}
+			if s.APIHealthURL != s.APIURL || s.Queue.PubSubProject != s.Project {
+				t.Errorf("Load() = api_health_url %s, queue.pubsub_project %s, want them derived", s.APIHealthURL, s.Queue.PubSubProject)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFlag(t *testing.T) {
+	clearEnv(t)
+	t.Setenv(CONFIG_FILE_ENV, writeConfig(t, "addr: \":8000\"\n"))
+
+	s, err := Load([]string{"-config", writeConfig(t, testConfig), "-addr", ":8300"})
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if s.Project != "file-project" || s.Addr != ":8300" {
+		t.Errorf("Load() = project %s, addr %s, want the -config file and the -addr flag", s.Project, s.Addr)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		env     map[string]string
+		args    []string
+		wantErr string
+	}{
+		{"unknown field", testConfig + "unknown: true\n", nil, nil, "Unable to parse configuration"},
+		{"invalid environment", testConfig, map[string]string{"PHANTOM_SHUTDOWN_TIMEOUT": "soon"}, nil, "Invalid PHANTOM_SHUTDOWN_TIMEOUT"},
+		{"invalid setting", testConfig, nil, []string{"-api-url", "phantom"}, "invalid api_url"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clearEnv(t)
+			t.Setenv(CONFIG_FILE_ENV, writeConfig(t, test.config))
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+
+			_, err := Load(test.args)
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("Load() error = %v, want %s", err, test.wantErr)
+			}
+		})
+	}
+}
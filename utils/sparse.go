@@ -0,0 +1,112 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/google/go-github/v50/github"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// Largest number of files fetched one by one, more than that and the
+	// tarball is faster.
+	MAX_SPARSE_FILES = 50
+)
+
+var (
+	ErrTreeTruncated = errors.New("Repository tree is too large to be listed.")
+	ErrTooManyFiles  = errors.New("Too many files match to be fetched one by one.")
+)
+
+// HandleGithubFilesOrRepoDownload fetches the files of the commit whose path
+// matches, and falls back to downloading the whole repository when they can't
+// be fetched one by one. sparse reports whether only the files were fetched.
+func HandleGithubFilesOrRepoDownload(
+	client *github.Client,
+	owner,
+	repo,
+	sha string,
+	match func(filePath string) bool,
+) (dir string, release func(), sparse bool, err error) {
+	dir, release, err = HandleGithubFilesDownload(client, owner, repo, sha, match)
+	if err == nil {
+		return dir, release, true, nil
+	}
+
+	log.Info().Err(err).Msg("Unable to fetch the files one by one, downloading the repository.")
+	dir, release, err = HandleGithubRepoDownload(client, owner, repo, sha)
+	return dir, release, false, err
+}
+
+// HandleGithubFilesDownload fetches the files of the commit whose path matches
+// into a new temporary directory, without downloading the whole repository.
+// The release function deletes the directory.
+func HandleGithubFilesDownload(
+	client *github.Client,
+	owner,
+	repo,
+	sha string,
+	match func(filePath string) bool,
+) (string, func(), error) {
+	ctx := context.Background()
+
+	// List every file of the commit in a single call
+	tree, _, err := client.Git.GetTree(ctx, owner, repo, sha, true)
+	if err != nil {
+		return "", nil, err
+	}
+	if tree.GetTruncated() {
+		return "", nil, ErrTreeTruncated
+	}
+
+	var entries []*github.TreeEntry
+	for _, entry := range tree.Entries {
+		if entry.GetType() == "blob" && match(entry.GetPath()) {
+			entries = append(entries, entry)
+		}
+	}
+	if len(entries) > MAX_SPARSE_FILES {
+		return "", nil, fmt.Errorf("%w %d files match, at most %d are fetched.", ErrTooManyFiles, len(entries), MAX_SPARSE_FILES)
+	}
+
+	// creating a temp directory for the files
+	tempDir, err := os.MkdirTemp("", "")
+	if err != nil {
+		return "", nil, err
+	}
+	release := func() { os.RemoveAll(tempDir) }
+
+	log.Debug().Msg(fmt.Sprintf("Downloading %d files from Github repository.", len(entries)))
+	for _, entry := range entries {
+		if err := downloadBlob(ctx, client, owner, repo, entry, tempDir); err != nil {
+			release()
+			return "", nil, err
+		}
+	}
+
+	return tempDir, release, nil
+}
+
+func downloadBlob(ctx context.Context, client *github.Client, owner, repo string, entry *github.TreeEntry, dir string) error {
+	// Paths come from Github, but never write outside of the directory
+	filePath := path.Clean(entry.GetPath())
+	if path.IsAbs(filePath) || filePath == ".." || strings.HasPrefix(filePath, "../") {
+		return fmt.Errorf("Invalid path in repository tree: '%s'", entry.GetPath())
+	}
+
+	data, _, err := client.Git.GetBlobRaw(ctx, owner, repo, entry.GetSHA())
+	if err != nil {
+		return err
+	}
+
+	file := path.Join(dir, filePath)
+	if err := os.MkdirAll(path.Dir(file), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(file, data, 0o600)
+}
@@ -0,0 +1,224 @@
+package utils
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-github/v50/github"
+)
+
+// fakeSparseRepo serves the tree and blobs of a commit of owner/repo, and its
+// tarball holding a single 'main.go' file.
+type fakeSparseRepo struct {
+	tree      *github.Tree
+	blobs     int32
+	downloads int32
+}
+
+func newSparseServer(t *testing.T, fake *fakeSparseRepo) *github.Client {
+	t.Helper()
+
+	var srv *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/owner/repo/git/trees/sha", func(w http.ResponseWriter, r *http.Request) {
+		if fake.tree == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Query().Get("recursive") != "1" {
+			t.Errorf("tree listed with query %q, want it recursive", r.URL.RawQuery)
+		}
+		json.NewEncoder(w).Encode(fake.tree)
+	})
+	mux.HandleFunc("/repos/owner/repo/git/blobs/", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fake.blobs, 1)
+		w.Write([]byte(path.Base(r.URL.Path)))
+	})
+	mux.HandleFunc("/repos/owner/repo/tarball/", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, srv.URL+"/archive/"+filepath.Base(r.URL.Path), http.StatusFound)
+	})
+	mux.HandleFunc("/archive/", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fake.downloads, 1)
+		archive := makeTarGz(t, []tarEntry{
+			{name: "repo-sha/", typeflag: tar.TypeDir},
+			{name: "repo-sha/main.go", typeflag: tar.TypeReg, body: "package main"},
+		})
+		w.Write(archive.Bytes())
+	})
+	srv = httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	client := github.NewClient(srv.Client())
+	client.BaseURL, _ = url.Parse(srv.URL + "/")
+	return client
+}
+
+// useRepoCache replaces the repository cache of the settings.
+func useRepoCache(t *testing.T) {
+	t.Helper()
+
+	cache, err := NewRepoCache(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repoCacheOnce.Do(func() {})
+	repoCache, repoCacheErr = cache, nil
+	t.Cleanup(func() { repoCache = nil })
+}
+
+func treeOf(entries ...*github.TreeEntry) *github.Tree {
+	return &github.Tree{SHA: github.String("sha"), Entries: entries}
+}
+
+func blob(filePath string) *github.TreeEntry {
+	return &github.TreeEntry{Path: github.String(filePath), Type: github.String("blob"), SHA: github.String(strings.ReplaceAll(filePath, "/", "-"))}
+}
+
+func configBlobs(n int) []*github.TreeEntry {
+	var entries []*github.TreeEntry
+	for _, filePath := range configFiles(n) {
+		entries = append(entries, blob(filePath))
+	}
+	return entries
+}
+
+func configFiles(n int) []string {
+	var files []string
+	for i := 0; i < n; i++ {
+		files = append(files, fmt.Sprintf("services/%d/phantom.yaml", i))
+	}
+	sort.Strings(files)
+	return files
+}
+
+func listFiles(t *testing.T, dir string) []string {
+	t.Helper()
+
+	var files []string
+	err := filepath.Walk(dir, func(filePath string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			rel, _ := filepath.Rel(dir, filePath)
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func TestHandleGithubFilesOrRepoDownload(t *testing.T) {
+	isConfig := func(filePath string) bool { return path.Base(filePath) == "phantom.yaml" }
+
+	tests := []struct {
+		name          string
+		tree          *github.Tree
+		wantErr       error
+		wantSparse    bool
+		wantFiles     []string
+		wantBlobs     int32
+		wantDownloads int32
+	}{
+		{
+			name: "matching files",
+			tree: treeOf(
+				blob("phantom.yaml"),
+				blob("api/phantom.yaml"),
+				blob("api/main.go"),
+				&github.TreeEntry{Path: github.String("web/phantom.yaml"), Type: github.String("tree"), SHA: github.String("dir")},
+			),
+			wantSparse: true,
+			wantFiles:  []string{"api/phantom.yaml", "phantom.yaml"},
+			wantBlobs:  2,
+		},
+		{
+			name:       "no matching files",
+			tree:       treeOf(blob("main.go")),
+			wantSparse: true,
+		},
+		{
+			name:       "as many files as fetched one by one",
+			tree:       treeOf(configBlobs(MAX_SPARSE_FILES)...),
+			wantSparse: true,
+			wantFiles:  configFiles(MAX_SPARSE_FILES),
+			wantBlobs:  MAX_SPARSE_FILES,
+		},
+		{
+			name:          "too many files",
+			tree:          treeOf(configBlobs(MAX_SPARSE_FILES + 1)...),
+			wantErr:       ErrTooManyFiles,
+			wantFiles:     []string{"main.go"},
+			wantDownloads: 1,
+		},
+		{
+			name:          "truncated tree",
+			tree:          &github.Tree{SHA: github.String("sha"), Entries: []*github.TreeEntry{blob("phantom.yaml")}, Truncated: github.Bool(true)},
+			wantErr:       ErrTreeTruncated,
+			wantFiles:     []string{"main.go"},
+			wantDownloads: 1,
+		},
+		{
+			name:          "path outside of the directory",
+			tree:          treeOf(blob("phantom.yaml"), blob("../phantom.yaml")),
+			wantFiles:     []string{"main.go"},
+			wantBlobs:     1,
+			wantDownloads: 1,
+		},
+		{
+			name:          "tree not found",
+			wantFiles:     []string{"main.go"},
+			wantDownloads: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useRepoCache(t)
+			fake := &fakeSparseRepo{tree: test.tree}
+			client := newSparseServer(t, fake)
+
+			// Files that can't be fetched one by one fail the sparse download...
+			_, release, err := HandleGithubFilesDownload(client, "owner", "repo", "sha", isConfig)
+			if test.wantSparse && err != nil {
+				t.Fatalf("HandleGithubFilesDownload() error = %v", err)
+			} else if test.wantSparse {
+				release()
+			} else if err == nil || (test.wantErr != nil && !errors.Is(err, test.wantErr)) {
+				t.Fatalf("HandleGithubFilesDownload() error = %v, want %v", err, test.wantErr)
+			}
+			atomic.StoreInt32(&fake.blobs, 0)
+
+			// ...and the whole repository is downloaded instead
+			dir, release, sparse, err := HandleGithubFilesOrRepoDownload(client, "owner", "repo", "sha", isConfig)
+			if err != nil {
+				t.Fatalf("HandleGithubFilesOrRepoDownload() error = %v", err)
+			}
+			defer release()
+
+			if sparse != test.wantSparse {
+				t.Errorf("HandleGithubFilesOrRepoDownload() sparse = %v, want %v", sparse, test.wantSparse)
+			}
+			if files := listFiles(t, dir); !reflect.DeepEqual(files, test.wantFiles) {
+				t.Errorf("downloaded %q, want %q", files, test.wantFiles)
+			}
+			if fake.blobs != test.wantBlobs || fake.downloads != test.wantDownloads {
+				t.Errorf("fetched %d blobs and %d tarballs, want %d and %d", fake.blobs, fake.downloads, test.wantBlobs, test.wantDownloads)
+			}
+		})
+	}
+}
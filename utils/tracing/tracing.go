@@ -0,0 +1,125 @@
+// Package tracing exports OpenTelemetry traces of the check pipeline to an
+// OTLP collector, and carries their context across the queue.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/jahagaley/phantom/utils/settings"
+)
+
+const (
+	// Name of the tracer and default name of the service.
+	tracerName  = "github.com/jahagaley/phantom"
+	serviceName = "phantom"
+)
+
+// HTTPClient traces the requests sent to the Phantom API.
+var HTTPClient = &http.Client{
+	Transport: NewTransport(http.DefaultTransport, func(r *http.Request) string {
+		return "phantom " + r.URL.Path
+	}),
+}
+
+// Start exports the spans to the OTLP/HTTP collector of the settings, spans
+// are dropped when no endpoint is set. The returned function flushes the
+// spans left on shutdown.
+func Start(ctx context.Context, config settings.Tracing) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if len(config.Endpoint) == 0 {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(config.Endpoint)}
+	if config.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create the trace exporter: %w", err)
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the defaults
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", serviceName)),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to describe the trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Tracer returns the tracer of Phantom spans.
+func Tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// Inject returns the trace context of ctx, to be carried by a message.
+func Inject(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// Extract returns ctx continuing the trace context carried by a message.
+func Extract(ctx context.Context, traceContext map[string]string) context.Context {
+	if len(traceContext) == 0 {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(traceContext))
+}
+
+// TraceID returns the ID of the trace of ctx, if there is one.
+func TraceID(ctx context.Context) (string, bool) {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.HasTraceID() {
+		return "", false
+	}
+	return spanContext.TraceID().String(), true
+}
+
+// EndSpan records the error on the span before ending it.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Handler traces the requests received by the handler.
+func Handler(handler http.Handler, operation string) http.Handler {
+	return otelhttp.NewHandler(handler, operation)
+}
+
+// NewTransport traces the requests sent with the base transport, with spans
+// named by name.
+func NewTransport(base http.RoundTripper, name func(*http.Request) string) http.RoundTripper {
+	return otelhttp.NewTransport(base, otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+		return name(r)
+	}))
+}